@@ -3,6 +3,7 @@ package crypto
 import (
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -27,10 +28,32 @@ func GenerateCipher() (cipher.AEAD, error) {
 	return aead, nil
 }
 
+// Error returned for degenerate keys, a correctly generated key should never be one.
+var ErrWeakKey = errors.New("symmetrical key is degenerate")
+
+// Check key strength.
+// Keys consisting of one repeated byte (including all-zero keys) are rejected, they can only be produced by a broken client.
+// Accept key bytes.
+// Return nil if key is not degenerate, otherwise ErrWeakKey.
+func CheckKeyStrength(key []byte) error {
+	for _, value := range key {
+		if value != key[0] {
+			return nil
+		}
+	}
+	return ErrWeakKey
+}
+
 // Parse cipher AEAD from bytes.
+// Degenerate keys are rejected.
 // Accept 32 byte key.
 // Return AEAD and nil if parsed successfully, otherwise nil and error.
 func ParseCipher(key []byte) (cipher.AEAD, error) {
+	// Check key strength
+	if err := CheckKeyStrength(key); err != nil {
+		return nil, err
+	}
+
 	// Parse cipher AEAD
 	aead, err := chacha20poly1305.NewX(key)
 	if err != nil {
@@ -63,6 +86,14 @@ func Encrypt(plaintext []byte, aead cipher.AEAD) ([]byte, error) {
 // Accept: ciphertext (as bytes) and cipher AEAD.
 // Return plaintext and nil if decrypting was successful, otherwise nil and error.
 func Decrypt(ciphertext []byte, aead cipher.AEAD) ([]byte, error) {
+	return DecryptTo(nil, ciphertext, aead)
+}
+
+// Decrypt bytes with given AEAD into destination buffer.
+// Plaintext is written from the beginning of the buffer, new buffer is allocated only if its capacity is not enough.
+// Accept: destination buffer (or nil), ciphertext (as bytes) and cipher AEAD.
+// Return plaintext and nil if decrypting was successful, otherwise nil and error.
+func DecryptTo(dst, ciphertext []byte, aead cipher.AEAD) ([]byte, error) {
 	// Check ciphertext length is at least greater than nonce and overhead size
 	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
 		return nil, fmt.Errorf("ciphertext length %d too short (less than nonce length %d + overhead %d)", len(ciphertext), aead.NonceSize(), aead.Overhead())
@@ -70,7 +101,7 @@ func Decrypt(ciphertext []byte, aead cipher.AEAD) ([]byte, error) {
 
 	// Split ciphertext into ciphertext and nonce, decrypt ciphertext
 	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
-	result, err := aead.Open(nil, nonce, ciphertext, nil)
+	result, err := aead.Open(dst[:0], nonce, ciphertext, nil)
 	if err != nil {
 		return nil, fmt.Errorf("symmetrical decrypting error: %v", err)
 	}
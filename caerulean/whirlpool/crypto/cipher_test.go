@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"testing"
 )
 
@@ -65,3 +66,45 @@ func TestParseCipher(test *testing.T) {
 
 	testEncryptCycle(test, aead)
 }
+
+func TestDecryptToBuffer(test *testing.T) {
+	aead, err := GenerateCipher()
+	if err != nil {
+		test.Fatalf("error generating cipher: %v", err)
+	}
+
+	message := bytes.Repeat([]byte{0xCD}, ENCRYPTION_CYCLE_MESSAGE_LENGTH)
+	ciphertext, err := Encrypt(message, aead)
+	if err != nil {
+		test.Fatalf("error encrypting message: %v", err)
+	}
+
+	buffer := make([]byte, 0, ENCRYPTION_CYCLE_MESSAGE_LENGTH)
+	plaintext, err := DecryptTo(buffer, ciphertext, aead)
+	if err != nil || !bytes.Equal(plaintext, message) {
+		test.Fatalf("decrypted bytes (%v) don't match encrypted bytes (%v): %v", plaintext, message, err)
+	}
+	if &plaintext[0] != &buffer[:1][0] {
+		test.Fatalf("plaintext not decrypted into destination buffer")
+	}
+}
+
+func TestParseCipherWeakKey(test *testing.T) {
+	zeroKey := make([]byte, GENERATE_CIPHER_KEY_LENGTH)
+	if _, err := ParseCipher(zeroKey); !errors.Is(err, ErrWeakKey) {
+		test.Fatalf("all-zero key not rejected: %v", err)
+	}
+
+	sameKey := bytes.Repeat([]byte{0xAB}, GENERATE_CIPHER_KEY_LENGTH)
+	if _, err := ParseCipher(sameKey); !errors.Is(err, ErrWeakKey) {
+		test.Fatalf("all-same-byte key not rejected: %v", err)
+	}
+
+	randomKey := make([]byte, GENERATE_CIPHER_KEY_LENGTH)
+	if _, err := rand.Read(randomKey); err != nil {
+		test.Fatalf("error generating random key: %v", err)
+	}
+	if _, err := ParseCipher(randomKey); err != nil {
+		test.Fatalf("random key rejected: %v", err)
+	}
+}
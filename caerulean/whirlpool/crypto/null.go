@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"fmt"
+)
+
+// Default session cipher suite: XChaCha20-Poly1305.
+const CIPHER_XCHACHA20_POLY1305 = "xchacha20-poly1305"
+
+// Null session cipher suite: packets are neither encrypted nor authenticated.
+// NB! should only be used for performance testing and on trusted links.
+const CIPHER_NULL = "null"
+
+// Null cipher AEAD structure.
+// Implements cipher.AEAD interface without any encryption or authentication: sealed data is equal to plaintext.
+type nullCipher struct{}
+
+// Get null cipher nonce size.
+// Should be applied for nullCipher object.
+// Return zero: null cipher uses no nonce.
+func (nullCipher) NonceSize() int {
+	return 0
+}
+
+// Get null cipher overhead.
+// Should be applied for nullCipher object.
+// Return zero: null cipher adds no tag.
+func (nullCipher) Overhead() int {
+	return 0
+}
+
+// "Encrypt" plaintext with null cipher.
+// Should be applied for nullCipher object.
+// Accept destination, nonce (ignored), plaintext and additional data (ignored).
+// Return plaintext appended to destination.
+func (nullCipher) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	return append(dst, plaintext...)
+}
+
+// "Decrypt" ciphertext with null cipher.
+// Should be applied for nullCipher object.
+// Accept destination, nonce (ignored), ciphertext and additional data (ignored).
+// Return ciphertext appended to destination and nil.
+func (nullCipher) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	return append(dst, ciphertext...), nil
+}
+
+// Check if cipher suite is supported.
+// Accept cipher suite name (empty string means default cipher suite).
+// Return nil if cipher suite is supported, error otherwise.
+func CheckCipherSuite(suite string) error {
+	switch suite {
+	case "", CIPHER_XCHACHA20_POLY1305, CIPHER_NULL:
+		return nil
+	default:
+		return fmt.Errorf("unsupported cipher suite: %s", suite)
+	}
+}
+
+// Parse cipher AEAD of cipher suite from bytes.
+// Key is ignored for null cipher suite.
+// Accept cipher suite name (empty string means default cipher suite) and 32 byte key.
+// Return AEAD and nil if parsed successfully, otherwise nil and error.
+func ParseSuiteCipher(suite string, key []byte) (cipher.AEAD, error) {
+	if err := CheckCipherSuite(suite); err != nil {
+		return nil, err
+	} else if suite == CIPHER_NULL {
+		return nullCipher{}, nil
+	}
+	return ParseCipher(key)
+}
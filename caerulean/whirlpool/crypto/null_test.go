@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNullCipherCycle(test *testing.T) {
+	aead, err := ParseSuiteCipher(CIPHER_NULL, nil)
+	if err != nil {
+		test.Fatalf("error parsing null cipher: %v", err)
+	}
+	testEncryptCycle(test, aead)
+
+	message := []byte("plaintext message")
+	ciphertext, err := Encrypt(message, aead)
+	if err != nil || !bytes.Equal(ciphertext, message) {
+		test.Fatalf("null cipher ciphertext doesn't match plaintext: %v != %v (%v)", ciphertext, message, err)
+	}
+}
+
+func TestParseSuiteCipher(test *testing.T) {
+	key := make([]byte, GENERATE_CIPHER_KEY_LENGTH)
+	key[0] = 1
+
+	for _, suite := range []string{"", CIPHER_XCHACHA20_POLY1305} {
+		aead, err := ParseSuiteCipher(suite, key)
+		if err != nil || aead.NonceSize() == 0 || aead.Overhead() == 0 {
+			test.Fatalf("cipher suite %q not parsed as authenticated cipher: %v", suite, err)
+		}
+	}
+
+	if _, err := ParseSuiteCipher("aes-128-ecb", key); err == nil {
+		test.Fatal("unsupported cipher suite parsed successfully")
+	}
+}
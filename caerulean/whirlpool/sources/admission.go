@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Authentication limiter structure.
+// Bounds the number of authentication requests (token encryption and decryption, identity lookups) processed concurrently,
+// so that a burst of handshakes can not starve packet forwarding of CPU.
+// Excess requests wait in a bounded queue for a bounded time, requests that don't fit into the queue or wait too long are rejected.
+type authLimiter struct {
+	// Number of requests waiting for a slot (accessed atomically, kept first for alignment).
+	waiting int64
+
+	// Processing slots, a slot is taken by sending to the channel and released by receiving from it.
+	slots chan struct{}
+
+	// Maximum number of requests waiting for a slot.
+	queue int64
+
+	// Maximum time a request waits for a slot.
+	timeout time.Duration
+}
+
+// Create authentication limiter.
+// Accept maximum number of concurrent requests, maximum number of waiting requests and maximum waiting time.
+// Return limiter pointer.
+func newAuthLimiter(concurrency, queue int, timeout time.Duration) *authLimiter {
+	return &authLimiter{
+		slots:   make(chan struct{}, concurrency),
+		queue:   int64(queue),
+		timeout: timeout,
+	}
+}
+
+// Take processing slot, waiting for it if necessary.
+// Should be applied for authLimiter object.
+// Accept request context.
+// Return slot release function and nil if slot was taken, otherwise nil and gRPC status error.
+func (limiter *authLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-limiter.slots }
+
+	// Take free slot without waiting, if there is one
+	select {
+	case limiter.slots <- struct{}{}:
+		return release, nil
+	default: // wait in queue
+	}
+
+	// Reject request if waiting queue is full
+	if atomic.AddInt64(&limiter.waiting, 1) > limiter.queue {
+		atomic.AddInt64(&limiter.waiting, -1)
+		return nil, status.Error(codes.ResourceExhausted, "too many concurrent authentication requests")
+	}
+	defer atomic.AddInt64(&limiter.waiting, -1)
+
+	// Wait for a slot until timeout or request cancellation
+	timer := time.NewTimer(limiter.timeout)
+	defer timer.Stop()
+	select {
+	case limiter.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, status.Error(codes.ResourceExhausted, "authentication request waited too long")
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"main/generated"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ADMISSION_CONCURRENCY = 2
+	ADMISSION_QUEUE       = 4
+	ADMISSION_REQUESTS    = 32
+	ADMISSION_HOLD        = 20 * time.Millisecond
+	ADMISSION_TIMEOUT     = 5 * time.Second
+)
+
+func TestAuthLimiterConcurrency(test *testing.T) {
+	limiter := newAuthLimiter(ADMISSION_CONCURRENCY, ADMISSION_QUEUE, ADMISSION_TIMEOUT)
+
+	var active, peak, admitted, rejected int64
+	var requests sync.WaitGroup
+	for i := 0; i < ADMISSION_REQUESTS; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			release, err := limiter.acquire(context.Background())
+			if status.Code(err) == codes.ResourceExhausted {
+				atomic.AddInt64(&rejected, 1)
+				return
+			} else if err != nil {
+				test.Errorf("unexpected limiter error: %v", err)
+				return
+			}
+			defer release()
+
+			atomic.AddInt64(&admitted, 1)
+			current := atomic.AddInt64(&active, 1)
+			for previous := atomic.LoadInt64(&peak); current > previous && !atomic.CompareAndSwapInt64(&peak, previous, current); previous = atomic.LoadInt64(&peak) {
+			}
+			time.Sleep(ADMISSION_HOLD)
+			atomic.AddInt64(&active, -1)
+		}()
+	}
+	requests.Wait()
+
+	if peak > ADMISSION_CONCURRENCY {
+		test.Fatalf("limiter concurrency exceeded: %d > %d", peak, ADMISSION_CONCURRENCY)
+	}
+	if admitted < ADMISSION_CONCURRENCY || admitted > ADMISSION_CONCURRENCY+ADMISSION_QUEUE {
+		test.Fatalf("unexpected number of admitted requests: %d", admitted)
+	}
+	if admitted+rejected != ADMISSION_REQUESTS {
+		test.Fatalf("requests lost by limiter: %d admitted, %d rejected", admitted, rejected)
+	}
+}
+
+func TestAuthLimiterTimeout(test *testing.T) {
+	limiter := newAuthLimiter(1, ADMISSION_QUEUE, ADMISSION_HOLD)
+	release, err := limiter.acquire(context.Background())
+	if err != nil {
+		test.Fatalf("error acquiring free slot: %v", err)
+	}
+
+	if _, err := limiter.acquire(context.Background()); status.Code(err) != codes.ResourceExhausted {
+		test.Fatalf("request waiting too long not rejected: %v", err)
+	}
+
+	release()
+	if release, err = limiter.acquire(context.Background()); err != nil {
+		test.Fatalf("error acquiring released slot: %v", err)
+	}
+	release()
+}
+
+func TestAuthenticateConcurrencyLimit(test *testing.T) {
+	server := createTestServer(test)
+	server.nodeViridianPayload = SERVER_VIRIDIAN_PAYLOAD
+	server.authLimiter = newAuthLimiter(1, 0, ADMISSION_TIMEOUT)
+
+	release, err := server.admitAuthentication(context.Background())
+	if err != nil {
+		test.Fatalf("error acquiring authentication slot: %v", err)
+	}
+
+	request := &generated.WhirlpoolAuthenticationRequest{Uid: SERVER_STATS_VIRIDIAN_UID, Session: createTestSession(test), Payload: SERVER_VIRIDIAN_PAYLOAD}
+	if _, err := server.Authenticate(context.Background(), request); status.Code(err) != codes.ResourceExhausted {
+		test.Fatalf("authentication above concurrency limit not rejected: %v", err)
+	}
+
+	release()
+	if _, err := server.Authenticate(context.Background(), request); err != nil {
+		test.Fatalf("error authenticating after slot release: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Number of buffers in token decryption arena (maximum number of tokens decrypted concurrently without allocation).
+const TOKEN_ARENA_BUFFERS = 64
+
+// Size of a single token decryption arena buffer (bytes), enough for a token with maximum number of split tunnel routes.
+const TOKEN_ARENA_BUFFER_SIZE = 4096
+
+// Token decryption arena structure.
+// A bounded set of small buffers, that handshake token plaintexts are decrypted into, so that handshake storms do not produce garbage.
+// It is separate from packet buffers, as tokens are much smaller than packets.
+// If all the buffers are borrowed, new (unpooled) buffers are allocated, so the arena never holds more than its capacity.
+type tokenArena struct {
+	// Number of currently borrowed buffers, should only be accessed atomically.
+	borrowed int64
+
+	// Free buffers channel.
+	buffers chan []byte
+
+	// Size of every arena buffer.
+	size int
+}
+
+// Create token decryption arena, fill it with buffers.
+// Accept number of buffers and buffer size.
+// Return token arena pointer.
+func newTokenArena(count, size int) *tokenArena {
+	buffers := make(chan []byte, count)
+	for i := 0; i < count; i++ {
+		buffers <- make([]byte, size)
+	}
+	return &tokenArena{buffers: buffers, size: size}
+}
+
+// Borrow a buffer from the arena, allocate a new one if all the buffers are borrowed.
+// Buffer should be released once it is no longer used.
+// Should be applied for tokenArena object, nil arena always allocates.
+// Return empty buffer.
+func (arena *tokenArena) borrow() []byte {
+	if arena == nil {
+		return nil
+	}
+
+	atomic.AddInt64(&arena.borrowed, 1)
+	select {
+	case buffer := <-arena.buffers:
+		return buffer[:0]
+	default:
+		return make([]byte, 0, arena.size)
+	}
+}
+
+// Release a buffer borrowed from the arena.
+// Buffer is only returned to the arena if there is space for it, otherwise it is left for garbage collection.
+// Should be applied for tokenArena object, nil arena does nothing.
+// Accept borrowed buffer.
+func (arena *tokenArena) release(buffer []byte) {
+	if arena == nil {
+		return
+	}
+
+	atomic.AddInt64(&arena.borrowed, -1)
+	select {
+	case arena.buffers <- buffer[:arena.size]:
+	default:
+	}
+}
+
+// Get number of currently borrowed buffers.
+// Should be applied for tokenArena object.
+// Return number of buffers that were borrowed, but not yet released.
+func (arena *tokenArena) outstanding() int64 {
+	return atomic.LoadInt64(&arena.borrowed)
+}
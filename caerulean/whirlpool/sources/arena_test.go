@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"main/crypto"
+	"main/generated"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ARENA_TEST_BUFFERS     = 4
+	ARENA_TEST_HANDSHAKES  = 1000
+	ARENA_TEST_CONCURRENCY = 16
+)
+
+func TestTokenArenaOverflow(test *testing.T) {
+	arena := newTokenArena(ARENA_TEST_BUFFERS, TOKEN_ARENA_BUFFER_SIZE)
+
+	borrowed := make([][]byte, 0, ARENA_TEST_BUFFERS*2)
+	for i := 0; i < ARENA_TEST_BUFFERS*2; i++ {
+		buffer := arena.borrow()
+		if len(buffer) != 0 || cap(buffer) != TOKEN_ARENA_BUFFER_SIZE {
+			test.Fatalf("borrowed buffer size doesn't match arena: %d (%d)", len(buffer), cap(buffer))
+		}
+		borrowed = append(borrowed, buffer)
+	}
+	if arena.outstanding() != ARENA_TEST_BUFFERS*2 {
+		test.Fatalf("borrowed buffers not counted: %d", arena.outstanding())
+	}
+
+	for _, buffer := range borrowed {
+		arena.release(buffer)
+	}
+	if arena.outstanding() != 0 || len(arena.buffers) != ARENA_TEST_BUFFERS {
+		test.Fatalf("arena not bounded after overflow: %d outstanding, %d free", arena.outstanding(), len(arena.buffers))
+	}
+}
+
+func TestTokenArenaNoLeak(test *testing.T) {
+	server := createTestServer(test)
+	server.tokenArena = newTokenArena(ARENA_TEST_BUFFERS, TOKEN_ARENA_BUFFER_SIZE)
+	token := createTestToken(test, server, SERVER_STATS_VIRIDIAN_UID, false)
+	invalid := bytes.Repeat([]byte{0xEF}, len(token))
+
+	done := make(chan error, ARENA_TEST_CONCURRENCY)
+	for i := 0; i < ARENA_TEST_CONCURRENCY; i++ {
+		go func() {
+			for j := 0; j < ARENA_TEST_HANDSHAKES/ARENA_TEST_CONCURRENCY; j++ {
+				if _, err := server.decryptToken(invalid); err == nil {
+					done <- err
+					return
+				}
+				if _, err := server.decryptToken(token); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+	}
+	for i := 0; i < ARENA_TEST_CONCURRENCY; i++ {
+		if err := <-done; err != nil {
+			test.Fatalf("error decrypting token: %v", err)
+		}
+	}
+
+	if arena := server.tokenArena; arena.outstanding() != 0 || len(arena.buffers) != ARENA_TEST_BUFFERS {
+		test.Fatalf("token buffers leaked: %d outstanding, %d free", arena.outstanding(), len(arena.buffers))
+	}
+}
+
+func TestTokenArenaReuse(test *testing.T) {
+	server := createTestServer(test)
+	server.tokenArena = newTokenArena(1, TOKEN_ARENA_BUFFER_SIZE)
+
+	first, err := server.decryptToken(createTestToken(test, server, SERVER_STATS_VIRIDIAN_UID, false))
+	if err != nil {
+		test.Fatalf("error decrypting first token: %v", err)
+	}
+	session := append([]byte{}, first.Session...)
+
+	// The only arena buffer is reused for the second token, first token should not be affected
+	if _, err := server.decryptToken(createTestToken(test, server, SERVER_STATS_ADMIN_UID, true)); err != nil {
+		test.Fatalf("error decrypting second token: %v", err)
+	}
+	if first.Uid != SERVER_STATS_VIRIDIAN_UID || !bytes.Equal(first.Session, session) {
+		test.Fatalf("token references reused arena buffer: %v", first)
+	}
+}
+
+func benchmarkDecryptToken(benchmark *testing.B, arena *tokenArena) {
+	privateKey, err := crypto.GenerateCipher()
+	if err != nil {
+		benchmark.Fatalf("error creating server private key: %v", err)
+	}
+	server := &WhirlpoolServer{privateKey: privateKey, tokenArena: arena}
+
+	marshToken, err := proto.Marshal(&generated.UserToken{Uid: SERVER_STATS_VIRIDIAN_UID, Session: make([]byte, chacha20poly1305.KeySize)})
+	if err != nil {
+		benchmark.Fatalf("error marshalling token: %v", err)
+	}
+	token, err := crypto.Encrypt(marshToken, privateKey)
+	if err != nil {
+		benchmark.Fatalf("error encrypting token: %v", err)
+	}
+
+	benchmark.ReportAllocs()
+	benchmark.ResetTimer()
+	for i := 0; i < benchmark.N; i++ {
+		if _, err := server.decryptToken(token); err != nil {
+			benchmark.Fatalf("error decrypting token: %v", err)
+		}
+	}
+}
+
+func BenchmarkDecryptTokenAllocated(benchmark *testing.B) {
+	benchmarkDecryptToken(benchmark, nil)
+}
+
+func BenchmarkDecryptTokenPooled(benchmark *testing.B) {
+	benchmarkDecryptToken(benchmark, newTokenArena(TOKEN_ARENA_BUFFERS, TOKEN_ARENA_BUFFER_SIZE))
+}
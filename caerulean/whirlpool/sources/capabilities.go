@@ -0,0 +1,43 @@
+package main
+
+import (
+	"main/crypto"
+	"main/generated"
+	"main/utils"
+)
+
+// Assemble node capabilities from the effective node configuration.
+// Every optional feature viridians should know about is reported here, so that they can configure themselves.
+// Should be applied for WhirlpoolServer object.
+// Return node capabilities.
+func (server *WhirlpoolServer) capabilities() *generated.NodeCapabilities {
+	capabilities := &generated.NodeCapabilities{
+		Protocols:   SUPPORTED_PROTOCOLS,
+		Ciphers:     []string{crypto.CIPHER_XCHACHA20_POLY1305},
+		Tails:       !utils.TAIL_DISABLED,
+		SplitTunnel: true,
+	}
+
+	// Node that serves API only does not accept viridian connections, so no data transfer features are advertised
+	if server.apiOnly {
+		capabilities.Protocols = nil
+		capabilities.SplitTunnel = false
+		capabilities.ApiOnly = true
+	}
+
+	// Null cipher is only advertised if it is explicitly allowed
+	if server.allowNullCipher {
+		capabilities.Ciphers = append(capabilities.Ciphers, crypto.CIPHER_NULL)
+	}
+
+	// Report proof of work difficulty and authentication concurrency limit, if any
+	if server.puzzle != nil {
+		capabilities.PowDifficulty = int32(server.puzzle.difficulty)
+	}
+	if server.authLimiter != nil {
+		capabilities.MaxConcurrentAuth = int32(cap(server.authLimiter.slots))
+	}
+
+	// Return capabilities
+	return capabilities
+}
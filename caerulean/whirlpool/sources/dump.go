@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Initial size of goroutine stack dump buffer (in bytes), it is doubled until all the stacks fit.
+const STACK_DUMP_BUFFER_SIZE = 64 * 1024
+
+// Capture stacks of all the running goroutines.
+// Return stack dump in the same format as runtime crash output.
+func dumpStacks() []byte {
+	buffer := make([]byte, STACK_DUMP_BUFFER_SIZE)
+	for {
+		length := runtime.Stack(buffer, true)
+		if length < len(buffer) {
+			return buffer[:length]
+		}
+		buffer = make([]byte, len(buffer)*2)
+	}
+}
+
+// Dump all goroutine stacks on every signal received, until signal channel is closed.
+// Stacks are appended to the dump file if it is provided, otherwise they are logged.
+// Accept signal channel and dump file path (empty for logging).
+// NB! this method is blocking, so it should be run as goroutine.
+func handleStackDumps(signals <-chan os.Signal, path string) {
+	for received := range signals {
+		stacks := dumpStacks()
+		if path == "" {
+			logrus.Warnf("Goroutine stacks dumped on %v:\n%s", received, stacks)
+			continue
+		}
+
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			logrus.Errorf("Error opening stack dump file: %v", err)
+			continue
+		}
+		_, err = fmt.Fprintf(file, "Goroutine stacks dumped on %v at %s:\n%s\n", received, time.Now().Format(time.RFC3339), stacks)
+		file.Close()
+		if err != nil {
+			logrus.Errorf("Error writing stack dump file: %v", err)
+		} else {
+			logrus.Warnf("Goroutine stacks dumped on %v to file: %s", received, path)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDumpStacks(test *testing.T) {
+	stacks := dumpStacks()
+	if !bytes.Contains(stacks, []byte("goroutine ")) || !bytes.Contains(stacks, []byte("TestDumpStacks")) {
+		test.Fatalf("stack dump doesn't contain current goroutine:\n%s", stacks)
+	}
+}
+
+func TestHandleStackDumps(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "stacks")
+	signals := make(chan os.Signal, 2)
+	signals <- syscall.SIGUSR1
+	signals <- syscall.SIGQUIT
+	close(signals)
+
+	handleStackDumps(signals, path)
+
+	dump, err := os.ReadFile(path)
+	if err != nil {
+		test.Fatalf("error reading stack dump file: %v", err)
+	}
+	if count := bytes.Count(dump, []byte("Goroutine stacks dumped")); count != 2 {
+		test.Fatalf("unexpected stack dump number: %d != 2", count)
+	}
+	if !bytes.Contains(dump, []byte("TestHandleStackDumps")) {
+		test.Fatalf("stack dump doesn't contain current goroutine:\n%s", dump)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum number of source addresses tracked by authentication failure tracker.
+const AUTH_FAILURE_CAPACITY = 4096
+
+// Authentication failures of a single source address.
+type authFailure struct {
+	// Number of failures in the current window.
+	count int
+
+	// Time of the first failure in the current window.
+	since time.Time
+
+	// Time until which the source address is blocked (zero if it is not blocked).
+	blockedUntil time.Time
+}
+
+// Authentication failure tracker structure.
+// Counts failed token decryptions per source address, instead of logging every failure,
+// a single structured warning is logged once the failure number within window reaches threshold.
+// After that, source address can be blocked for a while.
+type authFailureTracker struct {
+	// Number of failures within window that triggers warning (and block).
+	threshold int
+
+	// Failure counting window.
+	window time.Duration
+
+	// Source address block duration (source addresses are not blocked if not positive).
+	block time.Duration
+
+	// Failures by source address.
+	entries map[string]*authFailure
+
+	// Mutex for tracker operations.
+	mutex sync.Mutex
+}
+
+// Create authentication failure tracker.
+// Accept failure threshold, failure counting window and block duration.
+// Return tracker pointer.
+func newAuthFailureTracker(threshold int, window, block time.Duration) *authFailureTracker {
+	return &authFailureTracker{
+		threshold: threshold,
+		window:    window,
+		block:     block,
+		entries:   make(map[string]*authFailure),
+	}
+}
+
+// Check if source address is blocked.
+// Should be applied for authFailureTracker object.
+// Accept source address and current time.
+// Return true if source address is blocked, false otherwise.
+func (tracker *authFailureTracker) blocked(address net.IP, now time.Time) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	entry, ok := tracker.entries[address.String()]
+	return ok && now.Before(entry.blockedUntil)
+}
+
+// Remove entries with expired windows and blocks.
+// Should be applied for authFailureTracker object, tracker mutex should be held by caller.
+// Accept current time.
+func (tracker *authFailureTracker) prune(now time.Time) {
+	for address, entry := range tracker.entries {
+		if now.Sub(entry.since) >= tracker.window && !now.Before(entry.blockedUntil) {
+			delete(tracker.entries, address)
+		}
+	}
+}
+
+// Account authentication failure from source address.
+// Logs structured warning (and blocks source address) once the failure number within window reaches threshold.
+// Should be applied for authFailureTracker object.
+// Accept source address and current time.
+// Return true if the failure triggered warning, false otherwise.
+func (tracker *authFailureTracker) fail(address net.IP, now time.Time) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	// Find source address entry, drop expired entries if there is no space for a new one
+	key := address.String()
+	entry, ok := tracker.entries[key]
+	if !ok {
+		if len(tracker.entries) >= AUTH_FAILURE_CAPACITY {
+			tracker.prune(now)
+			if len(tracker.entries) >= AUTH_FAILURE_CAPACITY {
+				logrus.Debugf("Authentication failure tracker full, failure from %v not tracked", address)
+				return false
+			}
+		}
+		entry = &authFailure{since: now}
+		tracker.entries[key] = entry
+	}
+
+	// Restart counting if the previous window is over
+	if now.Sub(entry.since) >= tracker.window {
+		entry.count = 0
+		entry.since = now
+	}
+
+	// Count failure, warn only once per window
+	entry.count++
+	logrus.Debugf("Authentication failure from %v (%d in current window)", address, entry.count)
+	if entry.count != tracker.threshold {
+		return false
+	}
+
+	// Block source address if blocking is enabled
+	if tracker.block > 0 {
+		entry.blockedUntil = now.Add(tracker.block)
+	}
+	logrus.WithFields(logrus.Fields{
+		"event":    "auth_failures",
+		"source":   address.String(),
+		"failures": entry.count,
+		"window":   tracker.window,
+		"block":    tracker.block,
+	}).Warn("Repeated authentication failures")
+	return true
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"main/users"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Identity store interface.
+// Identity stores contain viridian identifiers with their own payloads and limits, so that every viridian can be authenticated separately.
+// Stores are loaded entirely and consulted on authentication, they can be updated without node restart.
+type identityStore interface {
+	// Get time the store was last modified at.
+	// Return modification time and nil if successful, otherwise zero time and error.
+	modified() (time.Time, error)
+
+	// Load all viridian identities.
+	// Return identity payloads and limits by viridian identifiers and nil if loaded successfully, otherwise nil and error.
+	load() (map[string]*payloadTier, error)
+}
+
+// Open identity store by location.
+// Store backend is selected by location URL scheme, only "file" scheme is currently supported.
+// Accept identity store location.
+// Return identity store and nil if opened successfully, otherwise nil and error.
+func openIdentityStore(location string) (identityStore, error) {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity store location: %v", err)
+	}
+
+	switch parsed.Scheme {
+	case "file":
+		return &fileIdentityStore{path: parsed.Path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported identity store scheme: %s", parsed.Scheme)
+	}
+}
+
+// File identity store structure.
+// Identities are stored in a text file, one identity per line, in "uid:payload:session:bandwidth[:routes]" format,
+// where session is session length in seconds (positive), bandwidth is bandwidth limit in kbytes per second (not limited if not positive)
+// and optional routes are comma-separated IPv4 prefixes the viridian is allowed to route (within the routes allowed by node).
+// Empty lines and lines starting with "#" are ignored, invalid lines are skipped with a warning.
+type fileIdentityStore struct {
+	// Path to the identity file.
+	path string
+}
+
+// Parse identity file line.
+// Accept identity line.
+// Return viridian identifier, identity payload and limits and nil if parsed successfully, otherwise empty string, nil and error.
+func parseIdentity(line string) (string, *payloadTier, error) {
+	// Split identity into fields
+	fields := strings.Split(line, ":")
+	if len(fields) < 4 || len(fields) > 5 || fields[0] == "" || fields[1] == "" {
+		return "", nil, fmt.Errorf("invalid identity format: %s", line)
+	}
+
+	// Parse session length
+	session, err := strconv.Atoi(fields[2])
+	if err != nil || session <= 0 {
+		return "", nil, fmt.Errorf("invalid identity session length: %s", fields[2])
+	}
+
+	// Parse bandwidth limit
+	bandwidth, err := strconv.ParseInt(fields[3], 10, 32)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid identity bandwidth: %s", fields[3])
+	}
+
+	// Parse allowed routes, if any
+	var routes []string
+	if len(fields) == 5 {
+		if routes, err = users.ParseAllowedRoutes(fields[4]); err != nil {
+			return "", nil, fmt.Errorf("invalid identity routes: %v", err)
+		}
+	}
+
+	return fields[0], &payloadTier{
+		payload:   fields[1],
+		session:   time.Duration(session) * time.Second,
+		bandwidth: int32(bandwidth),
+		routes:    routes,
+	}, nil
+}
+
+// Get identity file modification time.
+// Should be applied for fileIdentityStore object.
+// Return modification time and nil if successful, otherwise zero time and error.
+func (store *fileIdentityStore) modified() (time.Time, error) {
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error accessing identity file: %v", err)
+	}
+	return info.ModTime(), nil
+}
+
+// Load all viridian identities from identity file.
+// Should be applied for fileIdentityStore object.
+// Return identity payloads and limits by viridian identifiers and nil if loaded successfully, otherwise nil and error.
+func (store *fileIdentityStore) load() (map[string]*payloadTier, error) {
+	file, err := os.Open(store.path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening identity file: %v", err)
+	}
+	defer file.Close()
+
+	// Scan identity lines, skipping empty lines, comments and invalid lines
+	identities := make(map[string]*payloadTier)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		identifier, identity, err := parseIdentity(line)
+		if err != nil {
+			logrus.Warnf("Identity file line %d skipped: %v", number, err)
+			continue
+		}
+		identities[identifier] = identity
+	}
+
+	// Return identities or reading error
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading identity file: %v", err)
+	}
+	return identities, nil
+}
+
+// Cached identity store structure.
+// Wraps identity store, keeps all its identities in memory.
+// Identities are reloaded if the store is modified or once cache TTL passes, lookups are served from the previous identities meanwhile.
+// Loading errors are not cached.
+type cachedIdentityStore struct {
+	// Wrapped identity store.
+	store identityStore
+
+	// Time identities are reloaded after, even if the store was not modified.
+	ttl time.Duration
+
+	// Loaded identity payloads and limits by viridian identifier (nil if not loaded yet).
+	identities map[string]*payloadTier
+
+	// Modification time of the store identities were loaded from.
+	version time.Time
+
+	// Time identities were loaded at.
+	loaded time.Time
+
+	// Mutex for loaded identities access.
+	mutex sync.RWMutex
+
+	// Mutex for identities reloading, so that only one lookup reloads identities at a time.
+	reloading sync.Mutex
+}
+
+// Create cached identity store.
+// Accept wrapped identity store and cache TTL.
+// Return cached identity store pointer.
+func newCachedIdentityStore(store identityStore, ttl time.Duration) *cachedIdentityStore {
+	return &cachedIdentityStore{
+		store: store,
+		ttl:   ttl,
+	}
+}
+
+// Check if loaded identities are up to date.
+// Should be applied for cachedIdentityStore object.
+// Accept current time and store modification time.
+// Return true if identities are loaded and don't need to be reloaded, false otherwise.
+func (cache *cachedIdentityStore) fresh(now, version time.Time) bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.identities != nil && cache.version.Equal(version) && now.Before(cache.loaded.Add(cache.ttl))
+}
+
+// Check if any identities are loaded.
+// Should be applied for cachedIdentityStore object.
+// Return true if identities were loaded at least once, false otherwise.
+func (cache *cachedIdentityStore) available() bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.identities != nil
+}
+
+// Reload identities from the wrapped store if they are outdated.
+// Identities are loaded without locking identities mutex, if another lookup is already reloading them, the previous identities are used.
+// If the store can not be accessed (e.g. identity file is being replaced), the previous identities are used as well.
+// Should be applied for cachedIdentityStore object.
+// Accept current time.
+// Return nil if identities are available, error otherwise.
+func (cache *cachedIdentityStore) refresh(now time.Time) error {
+	// Check store modification time
+	version, err := cache.store.modified()
+	if err != nil {
+		if cache.available() {
+			logrus.Warnf("Identity store unavailable, using cached identities: %v", err)
+			return nil
+		}
+		return err
+	} else if cache.fresh(now, version) {
+		return nil
+	}
+
+	// Use the previous identities if another lookup is reloading them, wait for it only if there are none
+	if !cache.reloading.TryLock() {
+		if cache.available() {
+			return nil
+		}
+		cache.reloading.Lock()
+	}
+	defer cache.reloading.Unlock()
+
+	// Check again, identities could have been reloaded meanwhile
+	if cache.fresh(now, version) {
+		return nil
+	}
+
+	// Load identities and replace the previous ones
+	identities, err := cache.store.load()
+	if err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	cache.identities, cache.version, cache.loaded = identities, version, now
+	cache.mutex.Unlock()
+	return nil
+}
+
+// Find viridian identity in loaded identities, reload them if they are outdated.
+// Should be applied for cachedIdentityStore object.
+// Accept viridian identifier.
+// Return identity payload and limits, true and nil if found, nil, false and nil if not found, otherwise nil, false and error.
+func (cache *cachedIdentityStore) lookup(uid string) (*payloadTier, bool, error) {
+	if err := cache.refresh(time.Now()); err != nil {
+		return nil, false, err
+	}
+
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	identity, ok := cache.identities[uid]
+	return identity, ok, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"main/generated"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	IDENTITY_ALICE_UID     = "test_alice_uid"
+	IDENTITY_ALICE_PAYLOAD = "test_alice_payload"
+	IDENTITY_BOB_UID       = "test_bob_uid"
+	IDENTITY_BOB_PAYLOAD   = "test_bob_payload"
+	IDENTITY_CAROL_UID     = "test_carol_uid"
+	IDENTITY_CAROL_PAYLOAD = "test_carol_payload"
+	IDENTITY_FILE          = "# test identities\n\n" + IDENTITY_ALICE_UID + ":" + IDENTITY_ALICE_PAYLOAD + ":3600:1000\n" + IDENTITY_BOB_UID + ":" + IDENTITY_BOB_PAYLOAD + ":3600:-1\n" + IDENTITY_CAROL_UID + ":" + IDENTITY_CAROL_PAYLOAD + ":3600:0:" + SERVER_SPLIT_ROUTE + "\n"
+	IDENTITY_INVALID_LINE  = "test_invalid_uid:payload\n"
+	IDENTITY_CACHE_TTL     = time.Hour
+	IDENTITY_LOOKUP_WAIT   = time.Second
+)
+
+type countingIdentityStore struct {
+	identityStore
+	loads   int
+	loading chan struct{}
+}
+
+func (store *countingIdentityStore) load() (map[string]*payloadTier, error) {
+	store.loads++
+	if store.loading != nil {
+		<-store.loading
+	}
+	return store.identityStore.load()
+}
+
+func createTestIdentityFile(test *testing.T, content string) string {
+	path := filepath.Join(test.TempDir(), "identities")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		test.Fatalf("error writing identity file: %v", err)
+	}
+	return path
+}
+
+func TestOpenIdentityStore(test *testing.T) {
+	if _, err := openIdentityStore("file:///var/lib/seaside/identities"); err != nil {
+		test.Fatalf("error opening file identity store: %v", err)
+	}
+	if _, err := openIdentityStore("sqlite:///var/lib/seaside/identities.db"); err == nil {
+		test.Fatal("unsupported identity store opened successfully")
+	}
+}
+
+func TestAuthenticateIdentities(test *testing.T) {
+	server := createTestServer(test)
+	server.nodeOwnerPayload = SERVER_OWNER_PAYLOAD
+	server.identities = newCachedIdentityStore(&fileIdentityStore{path: createTestIdentityFile(test, IDENTITY_FILE)}, IDENTITY_CACHE_TTL)
+
+	authenticate := func(uid, payload string, routes ...string) (*generated.UserToken, error) {
+		request := &generated.WhirlpoolAuthenticationRequest{Uid: uid, Session: createTestSession(test), Payload: payload, Routes: routes}
+		response, err := server.Authenticate(context.Background(), request)
+		if err != nil {
+			return nil, err
+		}
+		return server.decryptToken(response.Token)
+	}
+
+	alice, err := authenticate(IDENTITY_ALICE_UID, IDENTITY_ALICE_PAYLOAD)
+	if err != nil || alice.Privileged || alice.Subscription == nil || alice.Bandwidth == nil || *alice.Bandwidth != 1000 {
+		test.Fatalf("identity token doesn't match expected: %v (%v)", alice, err)
+	}
+
+	bob, err := authenticate(IDENTITY_BOB_UID, IDENTITY_BOB_PAYLOAD)
+	if err != nil || bob.Privileged || bob.Subscription == nil || bob.Bandwidth != nil {
+		test.Fatalf("unlimited identity token doesn't match expected: %v (%v)", bob, err)
+	}
+
+	carol, err := authenticate(IDENTITY_CAROL_UID, IDENTITY_CAROL_PAYLOAD)
+	if err != nil || len(carol.Routes) != 1 || carol.Routes[0] != SERVER_SPLIT_ROUTE {
+		test.Fatalf("identity routes not applied to token: %v (%v)", carol, err)
+	}
+	if _, err := authenticate(IDENTITY_CAROL_UID, IDENTITY_CAROL_PAYLOAD, SERVER_DISALLOWED_ROUTE); status.Code(err) != codes.PermissionDenied {
+		test.Fatalf("route outside of identity routes not rejected: %v", err)
+	}
+	if alice, err := authenticate(IDENTITY_ALICE_UID, IDENTITY_ALICE_PAYLOAD, SERVER_DISALLOWED_ROUTE); err != nil || len(alice.Routes) != 1 {
+		test.Fatalf("route of identity without routes rejected: %v (%v)", alice, err)
+	}
+
+	if _, err := authenticate(IDENTITY_ALICE_UID, IDENTITY_BOB_PAYLOAD); status.Code(err) != codes.PermissionDenied {
+		test.Fatalf("authentication with other identity payload not rejected: %v", err)
+	}
+	if _, err := authenticate(SERVER_STATS_VIRIDIAN_UID, IDENTITY_ALICE_PAYLOAD); status.Code(err) != codes.PermissionDenied {
+		test.Fatalf("authentication with unknown identity not rejected: %v", err)
+	}
+
+	owner, err := authenticate(IDENTITY_ALICE_UID, SERVER_OWNER_PAYLOAD)
+	if err != nil || !owner.Privileged {
+		test.Fatalf("owner token doesn't match expected: %v (%v)", owner, err)
+	}
+
+	server.identities = newCachedIdentityStore(&fileIdentityStore{path: filepath.Join(test.TempDir(), "missing")}, IDENTITY_CACHE_TTL)
+	if _, err := authenticate(IDENTITY_ALICE_UID, IDENTITY_ALICE_PAYLOAD); status.Code(err) != codes.Unavailable {
+		test.Fatalf("authentication with unavailable identity store not failed: %v", err)
+	}
+}
+
+func TestCachedIdentityStore(test *testing.T) {
+	path := createTestIdentityFile(test, IDENTITY_INVALID_LINE+IDENTITY_FILE)
+	store := &countingIdentityStore{identityStore: &fileIdentityStore{path: path}}
+	cache := newCachedIdentityStore(store, IDENTITY_CACHE_TTL)
+
+	for i := 0; i < 3; i++ {
+		if identity, ok, err := cache.lookup(IDENTITY_ALICE_UID); err != nil || !ok || identity.payload != IDENTITY_ALICE_PAYLOAD {
+			test.Fatalf("cached identity doesn't match expected: %v (%v)", identity, err)
+		}
+		if _, ok, err := cache.lookup(SERVER_STATS_VIRIDIAN_UID); err != nil || ok {
+			test.Fatalf("unknown identity found: %v", err)
+		}
+	}
+	if store.loads != 1 {
+		test.Fatalf("identities not cached: %d != 1", store.loads)
+	}
+
+	// Identities are reloaded once the file is modified
+	if err := os.WriteFile(path, []byte(IDENTITY_BOB_UID+":"+IDENTITY_BOB_PAYLOAD+":3600:0\n"), 0o600); err != nil {
+		test.Fatalf("error rewriting identity file: %v", err)
+	}
+	if err := os.Chtimes(path, time.Now(), cache.version.Add(time.Second)); err != nil {
+		test.Fatalf("error updating identity file modification time: %v", err)
+	}
+	if _, ok, _ := cache.lookup(IDENTITY_ALICE_UID); ok {
+		test.Fatal("removed identity found after modification")
+	}
+	if _, ok, _ := cache.lookup(IDENTITY_BOB_UID); !ok {
+		test.Fatal("added identity not found after modification")
+	}
+
+	// Identities are reloaded once TTL passes, even if the file is not modified
+	cache.loaded = time.Now().Add(-IDENTITY_CACHE_TTL)
+	if _, ok, _ := cache.lookup(IDENTITY_BOB_UID); !ok || store.loads != 3 {
+		test.Fatalf("identities not reloaded after TTL: %d != 3", store.loads)
+	}
+
+	// Cached identities are used if the file is missing (e.g. being replaced)
+	if err := os.Remove(path); err != nil {
+		test.Fatalf("error removing identity file: %v", err)
+	}
+	if _, ok, err := cache.lookup(IDENTITY_BOB_UID); err != nil || !ok || store.loads != 3 {
+		test.Fatalf("cached identities not used while identity file is missing: %v", err)
+	}
+}
+
+func TestCachedIdentityStoreReloading(test *testing.T) {
+	store := &countingIdentityStore{identityStore: &fileIdentityStore{path: createTestIdentityFile(test, IDENTITY_FILE)}}
+	cache := newCachedIdentityStore(store, IDENTITY_CACHE_TTL)
+	if _, ok, err := cache.lookup(IDENTITY_ALICE_UID); err != nil || !ok {
+		test.Fatalf("identity not found: %v", err)
+	}
+
+	// Lookups should use the previous identities while they are being reloaded
+	store.loading = make(chan struct{})
+	defer close(store.loading)
+	cache.loaded = time.Now().Add(-IDENTITY_CACHE_TTL)
+	go cache.lookup(IDENTITY_ALICE_UID)
+	for deadline := time.Now().Add(IDENTITY_LOOKUP_WAIT); cache.reloading.TryLock(); {
+		cache.reloading.Unlock()
+		if time.Now().After(deadline) {
+			test.Fatal("identities reloading not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	found := make(chan bool)
+	go func() {
+		_, ok, _ := cache.lookup(IDENTITY_BOB_UID)
+		found <- ok
+	}()
+	select {
+	case ok := <-found:
+		if !ok {
+			test.Fatal("identity not found while identities are reloaded")
+		}
+	case <-time.After(IDENTITY_LOOKUP_WAIT):
+		test.Fatal("lookup blocked while identities are reloaded")
+	}
+}
+
+func TestParseIdentity(test *testing.T) {
+	for _, invalid := range []string{"uid:payload:3600", ":payload:3600:0", "uid::3600:0", "uid:payload:0:0", "uid:payload:session:0", "uid:payload:3600:bandwidth", "uid:payload:3600:0:10.0.0.0/33", "uid:payload:3600:0:route:extra"} {
+		if _, _, err := parseIdentity(invalid); err == nil {
+			test.Fatalf("invalid identity parsed successfully: %s", invalid)
+		}
+	}
+
+	uid, identity, err := parseIdentity("uid:payload:3600:0:" + SERVER_SPLIT_ROUTE)
+	if err != nil || uid != "uid" || len(identity.routes) != 1 || identity.routes[0] != SERVER_SPLIT_ROUTE {
+		test.Fatalf("identity with routes doesn't match expected: %s, %v (%v)", uid, identity, err)
+	}
+}
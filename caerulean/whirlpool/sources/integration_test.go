@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"main/crypto"
+	"main/generated"
+	"main/tunnel"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	INTEGRATION_UID         = "test_integration_uid"
+	INTEGRATION_SOURCE_PORT = 5555
+	INTEGRATION_TIMEOUT     = 5 * time.Second
+
+	INTEGRATION_JUMBO_MTU     = 9000
+	INTEGRATION_JUMBO_PAYLOAD = INTEGRATION_JUMBO_MTU - 20 - 8
+)
+
+var (
+	INTEGRATION_VIRIDIAN_ADDRESS = net.IPv4(10, 0, 0, 2).To4()
+	INTEGRATION_REQUEST          = []byte("integration request")
+	INTEGRATION_REPLY            = []byte("integration reply")
+)
+
+func createIntegrationPacket(test *testing.T, source, destination *net.UDPAddr, payload []byte) []byte {
+	netLayer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    source.IP.To4(),
+		DstIP:    destination.IP.To4(),
+	}
+	udpLayer := &layers.UDP{SrcPort: layers.UDPPort(source.Port), DstPort: layers.UDPPort(destination.Port)}
+	udpLayer.SetNetworkLayerForChecksum(netLayer)
+
+	serialBuffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(serialBuffer, options, netLayer, udpLayer, gopacket.Payload(payload)); err != nil {
+		test.Fatalf("error serializing integration packet: %v", err)
+	}
+	return serialBuffer.Bytes()
+}
+
+func createIntegrationDataConnection(test *testing.T, protocol string) net.PacketConn {
+	switch protocol {
+	case "udp":
+		connection, err := net.ListenPacket("udp4", net.JoinHostPort(META_LOCAL_ADDRESS, "0"))
+		if err != nil {
+			test.Fatalf("error creating viridian connection: %v", err)
+		}
+		return connection
+	default:
+		test.Fatalf("unknown data protocol: %s", protocol)
+		return nil
+	}
+}
+
+func createIntegrationJumboPayload(test *testing.T) []byte {
+	payload := make([]byte, INTEGRATION_JUMBO_PAYLOAD)
+	if _, err := rand.Read(payload); err != nil {
+		test.Fatalf("error generating jumbo payload: %v", err)
+	}
+	return payload
+}
+
+func sumIntegrationChecksum(data []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return uint16(sum)
+}
+
+func checkIntegrationChecksums(test *testing.T, raw []byte) {
+	headerLength := int(raw[0]&0x0F) * 4
+	if sumIntegrationChecksum(raw[:headerLength]) != 0xFFFF {
+		test.Fatalf("packet IP header checksum is invalid")
+	}
+
+	totalLength := int(binary.BigEndian.Uint16(raw[2:]))
+	if totalLength != len(raw) || int(binary.BigEndian.Uint16(raw[headerLength+4:])) != totalLength-headerLength {
+		test.Fatalf("packet lengths don't match packet size: %d", len(raw))
+	}
+
+	pseudoHeader := make([]byte, 12)
+	copy(pseudoHeader[0:8], raw[12:20])
+	pseudoHeader[9] = uint8(layers.IPProtocolUDP)
+	binary.BigEndian.PutUint16(pseudoHeader[10:], uint16(totalLength-headerLength))
+	if sumIntegrationChecksum(append(pseudoHeader, raw[headerLength:]...)) != 0xFFFF {
+		test.Fatalf("packet UDP checksum is invalid")
+	}
+}
+
+func TestIntegrationFlow(test *testing.T) {
+	for _, protocol := range SUPPORTED_PROTOCOLS {
+		test.Run(protocol, func(test *testing.T) {
+			testIntegrationFlow(test, protocol, INTEGRATION_REQUEST, INTEGRATION_REPLY)
+		})
+	}
+}
+
+func TestIntegrationJumboFlow(test *testing.T) {
+	test.Setenv("SEASIDE_TUNNEL_MTU", strconv.Itoa(INTEGRATION_JUMBO_MTU))
+	for _, protocol := range SUPPORTED_PROTOCOLS {
+		test.Run(protocol, func(test *testing.T) {
+			testIntegrationFlow(test, protocol, createIntegrationJumboPayload(test), createIntegrationJumboPayload(test))
+		})
+	}
+}
+
+func testIntegrationFlow(test *testing.T, protocol string, request, reply []byte) {
+	// Open tunnel and start node with control listener on loopback
+	tunnelConfig := tunnel.Preserve()
+	if err := tunnelConfig.Open(); err != nil {
+		test.Fatalf("error establishing network connections: %v", err)
+	}
+	defer tunnelConfig.Close()
+
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	whirlpoolServer := createWhirlpoolServer(tunnel.NewContext(base, tunnelConfig))
+	defer whirlpoolServer.destroyWhirlpoolServer()
+
+	listeners, err := listenControlPorts(META_LOCAL_ADDRESS, []int{0})
+	if err != nil {
+		test.Fatalf("error creating listener: %v", err)
+	}
+	grpcServer := grpc.NewServer(serverOptions(insecure.NewCredentials(), DEFAULT_MAX_CONTROL_MESSAGE)...)
+	generated.RegisterWhirlpoolViridianServer(grpcServer, whirlpoolServer)
+	go grpcServer.Serve(listeners[0])
+	defer grpcServer.Stop()
+
+	client, connection := createTestMetaClient(test, listeners[0])
+	defer connection.Close()
+
+	// Create viridian data connection and "internet" server, reachable through tunnel
+	viridianConnection := createIntegrationDataConnection(test, protocol)
+	defer viridianConnection.Close()
+	viridianConnection.SetReadDeadline(time.Now().Add(INTEGRATION_TIMEOUT))
+
+	internetConnection, err := net.ListenUDP("udp4", &net.UDPAddr{IP: tunnelConfig.IP})
+	if err != nil {
+		test.Fatalf("error creating internet server connection: %v", err)
+	}
+	defer internetConnection.Close()
+	internetConnection.SetReadDeadline(time.Now().Add(INTEGRATION_TIMEOUT))
+
+	// Authenticate and connect viridian
+	session := createTestSession(test)
+	aead, err := crypto.ParseCipher(session)
+	if err != nil {
+		test.Fatalf("error parsing session cipher: %v", err)
+	}
+
+	authentication, err := client.Authenticate(context.Background(), &generated.WhirlpoolAuthenticationRequest{Uid: INTEGRATION_UID, Session: session, Payload: whirlpoolServer.nodeOwnerPayload})
+	if err != nil {
+		test.Fatalf("error authenticating viridian: %v", err)
+	}
+
+	viridianPort := viridianConnection.LocalAddr().(*net.UDPAddr).Port
+	connectionRequest := &generated.ControlConnectionRequest{Token: authentication.Token, Version: VERSION, Address: INTEGRATION_VIRIDIAN_ADDRESS, Port: int32(viridianPort)}
+	connectionResponse, err := client.Connect(context.Background(), connectionRequest)
+	if err != nil {
+		test.Fatalf("error connecting viridian: %v", err)
+	}
+	userID := uint16(connectionResponse.UserID)
+
+	// Send request from viridian to internet server through node
+	viridianSource := &net.UDPAddr{IP: INTEGRATION_VIRIDIAN_ADDRESS, Port: INTEGRATION_SOURCE_PORT}
+	internetAddress := internetConnection.LocalAddr().(*net.UDPAddr)
+	encrypted, err := crypto.Encrypt(createIntegrationPacket(test, viridianSource, internetAddress, request), aead)
+	if err != nil {
+		test.Fatalf("error encrypting request: %v", err)
+	}
+	nodeAddress := &net.UDPAddr{IP: net.ParseIP(META_LOCAL_ADDRESS), Port: int(userID)}
+	if _, err := viridianConnection.WriteTo(encrypted, nodeAddress); err != nil {
+		test.Fatalf("error sending request to node: %v", err)
+	}
+
+	// Receive request on internet server, it should come from viridian tunnel address
+	buffer := make([]byte, 1<<16)
+	r, requestSource, err := internetConnection.ReadFromUDP(buffer)
+	if err != nil {
+		test.Fatalf("error receiving request from tunnel: %v", err)
+	}
+	if !bytes.Equal(buffer[:r], request) {
+		test.Fatalf("request payload doesn't match sent: %d bytes received, %d bytes sent", r, len(request))
+	}
+	if tunnelSource := requestSource.IP.To4(); binary.BigEndian.Uint16(tunnelSource[2:]) != userID || requestSource.Port != INTEGRATION_SOURCE_PORT {
+		test.Fatalf("request source doesn't match viridian tunnel address: %v", requestSource)
+	}
+
+	// Reply from internet server and receive reply on viridian
+	if _, err := internetConnection.WriteToUDP(reply, requestSource); err != nil {
+		test.Fatalf("error sending reply to tunnel: %v", err)
+	}
+	r, _, err = viridianConnection.ReadFrom(buffer)
+	if err != nil {
+		test.Fatalf("error receiving reply from node: %v", err)
+	}
+	decrypted, err := crypto.Decrypt(buffer[:r], aead)
+	if err != nil {
+		test.Fatalf("error decrypting reply: %v", err)
+	}
+
+	packet := gopacket.NewPacket(decrypted, layers.LayerTypeIPv4, gopacket.Default)
+	netLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || !netLayer.DstIP.Equal(INTEGRATION_VIRIDIAN_ADDRESS) {
+		test.Fatalf("reply destination doesn't match viridian address: %v", packet)
+	}
+	if application := packet.ApplicationLayer(); application == nil || !bytes.Equal(application.Payload(), reply) {
+		test.Fatalf("reply payload doesn't match sent: %d bytes received, %d bytes sent", len(decrypted), len(reply))
+	}
+	checkIntegrationChecksums(test, decrypted)
+}
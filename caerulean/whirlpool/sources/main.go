@@ -8,6 +8,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"main/tunnel"
 	"main/utils"
 	"os"
@@ -20,6 +22,12 @@ import (
 // Current Whirlpool distribution version.
 const VERSION = "0.0.1"
 
+// Source commit Whirlpool was built from (should be set with "-ldflags -X").
+var BUILD_COMMIT = "unknown"
+
+// Whirlpool build time (should be set with "-ldflags -X").
+var BUILD_TIME = "unknown"
+
 // Initialize package variables from environment variables and setup logging level.
 func init() {
 	unparsedLevel := utils.GetEnv("SEASIDE_LOG_LEVEL")
@@ -30,29 +38,109 @@ func init() {
 	logrus.SetLevel(level)
 }
 
+// Check if node serves control API only, without opening tunnel, applying firewall and forwarding viridian traffic.
+// Only exact "1" value enables the mode, so that it can not be enabled accidentally.
+// Return true if node serves API only.
+func apiOnlyMode() bool {
+	return utils.GetOptionalEnv("SEASIDE_API_ONLY", "0") == "1"
+}
+
+// Print the firewall rules currently installed, read back from the kernel, in readable form.
+func dumpFirewall() {
+	fmt.Println(tunnel.ReadableFirewallRules())
+}
+
+// Apply or clear firewall rules standalone, without starting the node, then print the resulting rules.
+// Accept flag, whether rules should be applied (otherwise they are cleared) and tunnel interface name for forwarding rules.
+func runFirewall(apply bool, tunIface string) {
+	if apply {
+		if err := tunnel.Preserve().ApplyFirewall(tunIface); err != nil {
+			logrus.Fatalf("Error applying firewall rules: %v", err)
+		}
+	} else {
+		tunnel.ClearFirewall()
+	}
+	fmt.Print(tunnel.FirewallRules())
+}
+
 func main() {
-	logrus.Infof("Running Caerulean Whirlpool version %s...", VERSION)
+	// Parse command line flags
+	firewallApply := flag.Bool("firewall-apply", false, "apply firewall rules for the current configuration, print them and exit")
+	firewallClear := flag.Bool("firewall-clear", false, "clear firewall rules, print the remaining rules and exit")
+	firewallInterface := flag.String("firewall-interface", "tun0", "tunnel interface name for the forwarding rules applied with -firewall-apply")
+	firewallDump := flag.Bool("firewall-dump", false, "print the installed firewall rules in readable form (for audit) and exit")
+	flag.Parse()
 
-	// Initialize tunnel interface and firewall rules
-	tunnelConfig := tunnel.Preserve()
-	err := tunnelConfig.Open()
+	// Run firewall setup, teardown or dump standalone if requested
+	if (*firewallApply && *firewallClear) || (*firewallDump && (*firewallApply || *firewallClear)) {
+		logrus.Fatal("Only one of -firewall-apply, -firewall-clear and -firewall-dump can be specified")
+	} else if *firewallDump {
+		dumpFirewall()
+		return
+	} else if *firewallApply || *firewallClear {
+		runFirewall(*firewallApply, *firewallInterface)
+		return
+	}
+
+	logrus.Infof("Running Caerulean Whirlpool version %s (commit: %s, built: %s)...", VERSION, BUILD_COMMIT, BUILD_TIME)
+
+	// Dump goroutine stacks on SIGQUIT and SIGUSR1 instead of crashing
+	dumpSignal := make(chan os.Signal, 1)
+	signal.Notify(dumpSignal, syscall.SIGQUIT, syscall.SIGUSR1)
+	go handleStackDumps(dumpSignal, utils.GetOptionalEnv("SEASIDE_STACK_DUMP_FILE", ""))
+
+	// Start serving liveness and readiness probes
+	apiOnly := apiOnlyMode()
+	probe, err := startProbeServer(utils.GetOptionalIntEnv("SEASIDE_PROBE_PORT", 0), apiOnly)
 	if err != nil {
-		logrus.Fatalf("Error establishing network connections: %v", err)
+		logrus.Fatalf("Error starting probe server: %v", err)
 	}
 
-	// Initialize context and start metaserver
+	// Initialize context, tunnel interface and firewall rules (unless node serves API only), start tunnel monitoring
 	ctx, cancel := context.WithCancel(context.Background())
-	server := start(tunnel.NewContext(ctx, tunnelConfig))
+	base := ctx
+	var tunnelConfig *tunnel.TunnelConfig
+	if apiOnly {
+		logrus.Info("Serving API only: tunnel is not opened, firewall is not applied, viridian connections are not accepted")
+	} else {
+		tunnelConfig = tunnel.Preserve()
+		err = tunnelConfig.Open()
+		if err != nil {
+			logrus.Fatalf("Error establishing network connections: %v", err)
+		}
+		probe.setTunnel(tunnelConfig)
+		go tunnelConfig.Monitor(ctx)
+		base = tunnel.NewContext(ctx, tunnelConfig)
+	}
+
+	// Start metaserver
+	server := start(base)
+	probe.setMetaServer(server)
 
-	// Prepare termination signal
+	// Prepare termination signal, wait for it or for probe server failure
 	exitSignal := make(chan os.Signal, 1)
 	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-	<-exitSignal
+	var probeErr error
+	select {
+	case <-exitSignal:
+	case probeErr = <-probe.failure:
+		logrus.Errorf("Error serving probes: %v", probeErr)
+	}
 
-	// Send termination signal to metaserver
+	// Mark node as not ready and send termination signal to metaserver
+	probe.setMetaServer(nil)
 	cancel()
 	server.stop()
 
-	// Disable tunnel and restore firewall configs
-	tunnelConfig.Close()
+	// Disable tunnel and restore firewall configs (if they were set up)
+	if tunnelConfig != nil {
+		probe.setTunnel(nil)
+		tunnelConfig.Close()
+	}
+	probe.stop()
+
+	// Report failure if node was stopped because of an error
+	if probeErr != nil {
+		os.Exit(1)
+	}
 }
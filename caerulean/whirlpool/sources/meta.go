@@ -13,8 +13,11 @@ import (
 	"google.golang.org/grpc/credentials"
 )
 
+// Default maximum size of control message received from viridian (bytes).
+const DEFAULT_MAX_CONTROL_MESSAGE = 64 * 1024
+
 // Metaserver structure.
-// Contains gRPC server and whirlpool server, also includes connection listener.
+// Contains gRPC server and whirlpool server, also includes connection listeners (one per control port).
 type MetaServer struct {
 	// End handler of Whirlpool server API.
 	whirlpoolServer *WhirlpoolServer
@@ -22,8 +25,8 @@ type MetaServer struct {
 	// General purpose gRPC server.
 	grpcServer *grpc.Server
 
-	// gRPC connection listener.
-	listener net.Listener
+	// gRPC connection listeners, the main control port listener goes first.
+	listeners []net.Listener
 }
 
 // Load TLS credentials from files.
@@ -46,6 +49,37 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	return credentials.NewTLS(config), nil
 }
 
+// Create gRPC server options.
+// Incoming messages are limited in size, so that clients can not exhaust node memory with huge messages
+// (oversized messages are rejected with "resource exhausted" status before being unmarshalled).
+// Accept transport credentials and maximum incoming message size (bytes).
+// Return gRPC server options list.
+func serverOptions(credentials credentials.TransportCredentials, maxMessageSize int) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.Creds(credentials),
+		grpc.MaxRecvMsgSize(maxMessageSize),
+	}
+}
+
+// Create TCP listeners for all the control ports.
+// If any of the ports can not be listened on, all the created listeners are closed.
+// Accept internal IP address and control port numbers.
+// Return listeners list and nil if all the listeners were created, otherwise nil and error.
+func listenControlPorts(intIP string, ctrlPorts []int) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(ctrlPorts))
+	for _, ctrlPort := range ctrlPorts {
+		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", intIP, ctrlPort))
+		if err != nil {
+			for _, created := range listeners {
+				created.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
 // Start the metaserver.
 // Accept context that will be used as base context.
 // Return pointer to metaserver object.
@@ -53,12 +87,18 @@ func start(base context.Context) *MetaServer {
 	// Create whirlpool server
 	whirlpoolServer := createWhirlpoolServer(base)
 
-	// Parse internal IP and control port from environment
+	// Parse internal IP and control ports from environment
 	intIP := utils.GetEnv("SEASIDE_ADDRESS")
-	ctrlPort := utils.GetIntEnv("SEASIDE_CTRLPORT")
+	ctrlPorts := utils.GetControlPorts()
+
+	// Parse maximum control message size from environment
+	maxMessageSize := utils.GetOptionalIntEnv("SEASIDE_MAX_CONTROL_MESSAGE", DEFAULT_MAX_CONTROL_MESSAGE)
+	if maxMessageSize <= 0 {
+		logrus.Fatalf("Maximum control message size should be positive: %d", maxMessageSize)
+	}
 
-	// Create TCP listener for gRPC connections
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", intIP, ctrlPort))
+	// Create TCP listeners for gRPC connections
+	listeners, err := listenControlPorts(intIP, ctrlPorts)
 	if err != nil {
 		logrus.Fatalf("failed to listen: %v", err)
 	}
@@ -70,15 +110,17 @@ func start(base context.Context) *MetaServer {
 	}
 
 	// Create and start gRPC server
-	grpcServer := grpc.NewServer(grpc.Creds(credentials))
+	grpcServer := grpc.NewServer(serverOptions(credentials, maxMessageSize)...)
 	generated.RegisterWhirlpoolViridianServer(grpcServer, whirlpoolServer)
 
-	// Launch server in goroutine and return the metaserver object
-	go runServer(grpcServer, listener)
+	// Launch server for every listener in goroutine and return the metaserver object
+	for _, listener := range listeners {
+		go runServer(grpcServer, listener)
+	}
 	return &MetaServer{
 		whirlpoolServer: whirlpoolServer,
 		grpcServer:      grpcServer,
-		listener:        listener,
+		listeners:       listeners,
 	}
 }
 
@@ -94,9 +136,11 @@ func runServer(server *grpc.Server, listener net.Listener) {
 // Stop metaserver.
 // Should be applied for MetaServer object.
 // Accept metaserver object pointer.
-// Destroy gRPC and Whirlpool server, also close TCP listener.
+// Destroy gRPC and Whirlpool server, also close TCP listeners.
 func (server *MetaServer) stop() {
 	server.grpcServer.GracefulStop()
 	server.whirlpoolServer.destroyWhirlpoolServer()
-	server.listener.Close()
+	for _, listener := range server.listeners {
+		listener.Close()
+	}
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"main/generated"
+	"main/utils"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	META_MAX_MESSAGE_SIZE = 1024
+	META_LOCAL_ADDRESS    = "127.0.0.1"
+	META_CONTROL_PORTS    = 3
+)
+
+func createTestMetaServer(test *testing.T, listeners []net.Listener) *grpc.Server {
+	grpcServer := grpc.NewServer(serverOptions(insecure.NewCredentials(), META_MAX_MESSAGE_SIZE)...)
+	generated.RegisterWhirlpoolViridianServer(grpcServer, createTestServer(test))
+	for _, listener := range listeners {
+		go grpcServer.Serve(listener)
+	}
+	return grpcServer
+}
+
+func createTestMetaClient(test *testing.T, listener net.Listener) (generated.WhirlpoolViridianClient, *grpc.ClientConn) {
+	connection, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		test.Fatalf("error connecting to server: %v", err)
+	}
+	return generated.NewWhirlpoolViridianClient(connection), connection
+}
+
+func TestMaxControlMessageSize(test *testing.T) {
+	listeners, err := listenControlPorts(META_LOCAL_ADDRESS, []int{0})
+	if err != nil {
+		test.Fatalf("error creating listener: %v", err)
+	}
+	grpcServer := createTestMetaServer(test, listeners)
+	defer grpcServer.Stop()
+
+	client, connection := createTestMetaClient(test, listeners[0])
+	defer connection.Close()
+
+	oversized := &generated.ControlConnectionRequest{Version: VERSION, Token: make([]byte, META_MAX_MESSAGE_SIZE)}
+	if _, err := client.Connect(context.Background(), oversized); status.Code(err) != codes.ResourceExhausted {
+		test.Fatalf("oversized control message not rejected: %v", err)
+	}
+
+	regular := &generated.ControlConnectionRequest{Version: VERSION, Token: make([]byte, META_MAX_MESSAGE_SIZE/2)}
+	if _, err := client.Connect(context.Background(), regular); status.Code(err) != codes.InvalidArgument {
+		test.Fatalf("regular control message not processed: %v", err)
+	}
+}
+
+func TestAlternateControlPorts(test *testing.T) {
+	listeners, err := listenControlPorts(META_LOCAL_ADDRESS, make([]int, META_CONTROL_PORTS))
+	if err != nil {
+		test.Fatalf("error creating listeners: %v", err)
+	}
+	if len(listeners) != META_CONTROL_PORTS {
+		test.Fatalf("unexpected listener number: %d != %d", len(listeners), META_CONTROL_PORTS)
+	}
+	grpcServer := createTestMetaServer(test, listeners)
+	defer grpcServer.Stop()
+
+	client, connection := createTestMetaClient(test, listeners[META_CONTROL_PORTS-1])
+	defer connection.Close()
+
+	request := &generated.ControlConnectionRequest{Version: VERSION, Token: []byte("invalid_token")}
+	if _, err := client.Connect(context.Background(), request); status.Code(err) != codes.InvalidArgument {
+		test.Fatalf("control request on alternate port not processed: %v", err)
+	}
+}
+
+func TestListenControlPortsFailure(test *testing.T) {
+	occupied, err := net.Listen("tcp", META_LOCAL_ADDRESS+":0")
+	if err != nil {
+		test.Fatalf("error creating listener: %v", err)
+	}
+	defer occupied.Close()
+	occupiedPort := occupied.Addr().(*net.TCPAddr).Port
+
+	if _, err := listenControlPorts(META_LOCAL_ADDRESS, []int{0, occupiedPort}); err == nil {
+		test.Fatalf("listening on occupied port succeeded: %d", occupiedPort)
+	}
+}
+
+func TestTailTrailer(test *testing.T) {
+	listeners, err := listenControlPorts(META_LOCAL_ADDRESS, []int{0})
+	if err != nil {
+		test.Fatalf("error creating listener: %v", err)
+	}
+	grpcServer := createTestMetaServer(test, listeners)
+	defer grpcServer.Stop()
+
+	client, connection := createTestMetaClient(test, listeners[0])
+	defer connection.Close()
+	defer func() { utils.TAIL_DISABLED = false }()
+
+	for _, disabled := range []bool{false, true} {
+		utils.TAIL_DISABLED = disabled
+
+		var trailer metadata.MD
+		if _, err := client.Compatibility(context.Background(), &generated.CompatibilityRequest{Version: VERSION}, grpc.Trailer(&trailer)); err != nil {
+			test.Fatalf("error requesting compatibility: %v", err)
+		}
+
+		tails := trailer.Get(TAIL_TRAILER_KEY)
+		if disabled {
+			if len(tails) != 0 {
+				test.Fatalf("tail trailer sent while disabled: %v", tails)
+			}
+			continue
+		}
+
+		if len(tails) != 1 {
+			test.Fatalf("unexpected tail trailer number: %d != 1", len(tails))
+		}
+		tail, err := hex.DecodeString(tails[0])
+		if err != nil {
+			test.Fatalf("tail trailer is not valid hex: %v", err)
+		}
+		if len(tail) == 0 || int64(len(tail)) > utils.MAX_TAIL_LENGTH.Int64() {
+			test.Fatalf("tail trailer length out of bounds: %d", len(tail))
+		}
+	}
+}
+
+func TestAPIOnlyMode(test *testing.T) {
+	test.Setenv("SEASIDE_API_ONLY", "1")
+
+	// Base context contains no tunnel config, node would fail to start if it tried to use tunnel
+	whirlpoolServer := createWhirlpoolServer(context.Background())
+	defer whirlpoolServer.destroyWhirlpoolServer()
+	if !whirlpoolServer.apiOnly || whirlpoolServer.viridians != nil {
+		test.Fatalf("node not started in API only mode")
+	}
+
+	listeners, err := listenControlPorts(META_LOCAL_ADDRESS, []int{0})
+	if err != nil {
+		test.Fatalf("error creating listener: %v", err)
+	}
+	grpcServer := grpc.NewServer(serverOptions(insecure.NewCredentials(), DEFAULT_MAX_CONTROL_MESSAGE)...)
+	generated.RegisterWhirlpoolViridianServer(grpcServer, whirlpoolServer)
+	go grpcServer.Serve(listeners[0])
+	defer grpcServer.Stop()
+
+	client, connection := createTestMetaClient(test, listeners[0])
+	defer connection.Close()
+
+	request := &generated.WhirlpoolAuthenticationRequest{Uid: SERVER_STATS_VIRIDIAN_UID, Session: createTestSession(test), Payload: whirlpoolServer.nodeViridianPayload}
+	authentication, err := client.Authenticate(context.Background(), request)
+	if err != nil {
+		test.Fatalf("error authenticating viridian in API only mode: %v", err)
+	}
+	if !authentication.Capabilities.ApiOnly || len(authentication.Capabilities.Protocols) != 0 {
+		test.Fatalf("capabilities don't match API only mode: %v", authentication.Capabilities)
+	}
+
+	connectionRequest := &generated.ControlConnectionRequest{Token: authentication.Token, Version: VERSION}
+	if _, err := client.Connect(context.Background(), connectionRequest); status.Code(err) != codes.Unavailable {
+		test.Fatalf("viridian connection not rejected in API only mode: %v", err)
+	}
+	if _, err := client.Healthcheck(context.Background(), &generated.ControlHealthcheck{}); status.Code(err) != codes.Unavailable {
+		test.Fatalf("healthcheck not rejected in API only mode: %v", err)
+	}
+
+	probe, err := startProbeServer(0, true)
+	if err != nil {
+		test.Fatalf("error creating disabled probe server: %v", err)
+	}
+	probe.setMetaServer(&MetaServer{whirlpoolServer: whirlpoolServer})
+	if err := probe.ready(); err != nil {
+		test.Fatalf("node not ready without tunnel in API only mode: %v", err)
+	}
+}
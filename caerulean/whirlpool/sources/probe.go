@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"main/tunnel"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum time to wait for probe requests to complete on shutdown.
+const PROBE_SHUTDOWN_TIMEOUT = 3 * time.Second
+
+// Probe server structure.
+// Serves HTTP liveness ("/livez") and readiness ("/readyz") probes, following orchestration (kubernetes) conventions.
+// Readiness is calculated from the node component state, that is registered once components are started.
+type ProbeServer struct {
+	// Mutex for component state operations.
+	mutex sync.Mutex
+
+	// Tunnel config, set once tunnel interface is open and firewall is applied.
+	tunnelConfig *tunnel.TunnelConfig
+
+	// Metaserver, set once control listener is accepting connections.
+	metaServer *MetaServer
+
+	// HTTP server serving probes (nil if probes are disabled).
+	httpServer *http.Server
+
+	// Channel probe serving error is reported to (nil if probes are disabled, so that it is never ready).
+	failure chan error
+
+	// Flag, whether node serves API only, so that tunnel is not required for readiness.
+	apiOnly bool
+}
+
+// Create probe server and start serving probes.
+// Probes are served on all the interfaces, so that they are available before the node addresses are assigned.
+// Accept probe port (probes are not served if it is not positive) and flag, whether node serves API only.
+// Return probe server pointer and nil if probes are served, otherwise nil and error if probe port can not be listened.
+func startProbeServer(port int, apiOnly bool) (*ProbeServer, error) {
+	probe := &ProbeServer{apiOnly: apiOnly}
+	if port <= 0 {
+		return probe, nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("error listening probe port %d: %v", port, err)
+	}
+
+	probe.serve(listener, probe.handler())
+	return probe, nil
+}
+
+// Start serving HTTP requests on listener.
+// Should be applied for ProbeServer object.
+// Accept listener and HTTP request handler.
+func (probe *ProbeServer) serve(listener net.Listener, handler http.Handler) {
+	probe.httpServer = &http.Server{Handler: handler}
+	probe.failure = make(chan error, 1)
+	go probe.run(listener)
+}
+
+// Create HTTP handler for probe requests.
+// Should be applied for ProbeServer object.
+// Return HTTP handler.
+func (probe *ProbeServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", probe.livez)
+	mux.HandleFunc("/readyz", probe.readyz)
+	return mux
+}
+
+// Serve probe requests, report serving error to failure channel.
+// Should be applied for ProbeServer object.
+// Accept listener.
+// NB! this method is blocking, so it should be run as goroutine.
+func (probe *ProbeServer) run(listener net.Listener) {
+	logrus.Infof("Starting probe server on address: %v", listener.Addr())
+	if err := probe.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		probe.failure <- err
+	}
+}
+
+// Register tunnel as open (or closed if nil).
+// Should be applied for ProbeServer object.
+// Accept tunnel config pointer.
+func (probe *ProbeServer) setTunnel(tunnelConfig *tunnel.TunnelConfig) {
+	probe.mutex.Lock()
+	defer probe.mutex.Unlock()
+	probe.tunnelConfig = tunnelConfig
+}
+
+// Register metaserver as accepting connections (or stopped if nil).
+// Should be applied for ProbeServer object.
+// Accept metaserver pointer.
+func (probe *ProbeServer) setMetaServer(metaServer *MetaServer) {
+	probe.mutex.Lock()
+	defer probe.mutex.Unlock()
+	probe.metaServer = metaServer
+}
+
+// Check whether the node is ready to serve viridians.
+// Should be applied for ProbeServer object.
+// Return nil if all the node components are ready, otherwise error describing the first component that is not.
+func (probe *ProbeServer) ready() error {
+	probe.mutex.Lock()
+	defer probe.mutex.Unlock()
+
+	// Check tunnel interface and firewall (unless node serves API only)
+	if !probe.apiOnly {
+		if probe.tunnelConfig == nil {
+			return errors.New("tunnel is not open")
+		} else if err := probe.tunnelConfig.Healthy(); err != nil {
+			return fmt.Errorf("tunnel is not healthy: %v", err)
+		}
+	}
+
+	// Check control listener
+	if probe.metaServer == nil {
+		return errors.New("control listener is not accepting connections")
+	}
+
+	// Return no error
+	return nil
+}
+
+// Handle liveness probe: the node is alive as long as the process is running.
+// Should be applied for ProbeServer object.
+// Accept HTTP response writer and request.
+func (probe *ProbeServer) livez(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(http.StatusOK)
+	fmt.Fprintln(writer, "ok")
+}
+
+// Handle readiness probe: the node is ready once all of its components are started.
+// Should be applied for ProbeServer object.
+// Accept HTTP response writer and request.
+func (probe *ProbeServer) readyz(writer http.ResponseWriter, request *http.Request) {
+	if err := probe.ready(); err != nil {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(writer, err.Error())
+	} else {
+		writer.WriteHeader(http.StatusOK)
+		fmt.Fprintln(writer, "ok")
+	}
+}
+
+// Stop probe server.
+// New probe connections are refused, in-flight probe requests are completed (for PROBE_SHUTDOWN_TIMEOUT at most).
+// Should be applied for ProbeServer object.
+func (probe *ProbeServer) stop() {
+	if probe.httpServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PROBE_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := probe.httpServer.Shutdown(ctx); err != nil {
+		logrus.Warnf("Error stopping probe server: %v", err)
+	}
+}
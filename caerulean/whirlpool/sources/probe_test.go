@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"main/tunnel"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	PROBE_LOCAL_ADDRESS = "127.0.0.1:0"
+	PROBE_WAIT_TIMEOUT  = 5 * time.Second
+)
+
+func requestProbe(test *testing.T, probe *ProbeServer, path string) int {
+	recorder := httptest.NewRecorder()
+	probe.handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	test.Logf("probe %s response: %d %s", path, recorder.Code, recorder.Body.String())
+	return recorder.Code
+}
+
+func TestProbesStartup(test *testing.T) {
+	probe, err := startProbeServer(0, false)
+	if err != nil {
+		test.Fatalf("error creating disabled probe server: %v", err)
+	}
+
+	if code := requestProbe(test, probe, "/livez"); code != http.StatusOK {
+		test.Fatalf("node not alive before startup: %d", code)
+	}
+	if code := requestProbe(test, probe, "/readyz"); code != http.StatusServiceUnavailable {
+		test.Fatalf("node ready before startup: %d", code)
+	}
+
+	probe.setTunnel(&tunnel.TunnelConfig{})
+	if code := requestProbe(test, probe, "/readyz"); code != http.StatusServiceUnavailable {
+		test.Fatalf("node ready before control listener started: %d", code)
+	}
+
+	probe.setMetaServer(&MetaServer{})
+	if code := requestProbe(test, probe, "/livez"); code != http.StatusOK {
+		test.Fatalf("node not alive after startup: %d", code)
+	}
+	if code := requestProbe(test, probe, "/readyz"); code != http.StatusOK {
+		test.Fatalf("node not ready after startup: %d", code)
+	}
+
+	probe.setMetaServer(nil)
+	if code := requestProbe(test, probe, "/readyz"); code != http.StatusServiceUnavailable {
+		test.Fatalf("node ready during shutdown: %d", code)
+	}
+}
+
+func TestProbesShutdown(test *testing.T) {
+	listener, err := net.Listen("tcp", PROBE_LOCAL_ADDRESS)
+	if err != nil {
+		test.Fatalf("error creating probe listener: %v", err)
+	}
+	address := listener.Addr().String()
+
+	// Serve handler that blocks until released
+	started, release := make(chan struct{}), make(chan struct{})
+	probe := &ProbeServer{}
+	probe.serve(listener, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	// Start in-flight request and shutdown while it is being handled
+	inFlight := make(chan error, 1)
+	go func() {
+		response, err := http.Get("http://" + address + "/livez")
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				err = errors.New(response.Status)
+			}
+		}
+		inFlight <- err
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		probe.stop()
+		close(stopped)
+	}()
+
+	// Wait until new connections are refused
+	deadline := time.Now().Add(PROBE_WAIT_TIMEOUT)
+	for {
+		connection, err := net.Dial("tcp", address)
+		if err != nil {
+			break
+		}
+		connection.Close()
+		if time.Now().After(deadline) {
+			test.Fatalf("new connection accepted during shutdown")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Release in-flight request, it should complete
+	close(release)
+	if err := <-inFlight; err != nil {
+		test.Fatalf("in-flight request not completed during shutdown: %v", err)
+	}
+	<-stopped
+
+	select {
+	case err := <-probe.failure:
+		test.Fatalf("probe server failed during shutdown: %v", err)
+	default: // do nothing
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+// Period after which connection challenge of every address changes.
+const PUZZLE_ROTATION_PERIOD = time.Minute
+
+// Maximum proof of work difficulty (leading zero bits).
+const PUZZLE_MAX_DIFFICULTY = 32
+
+// Length of puzzle secret (bytes).
+const PUZZLE_SECRET_LENGTH = 32
+
+// Maximum number of remembered puzzle solutions, new solutions are rejected if there are more unexpired ones.
+const PUZZLE_MAX_SOLUTIONS = 65536
+
+// Connection proof of work puzzle structure.
+// Before expensive token decryption, viridians should find a nonce, such that SHA-256 hash of the challenge and the nonce has enough leading zero bits.
+// Challenges are derived from viridian address, rotation period number and node secret, so no state is kept before puzzle is solved.
+// Challenges of the previous rotation period are still accepted, so that viridians have time to solve them.
+// Every solution is accepted only once: accepted solutions are remembered until their challenge expires, so that they can not be replayed.
+type puzzle struct {
+	// Required number of leading zero bits of solution hash.
+	difficulty int
+
+	// Node secret, challenges can not be forged without it.
+	secret []byte
+
+	// Accepted solutions (address, rotation period and nonce) mapped to their rotation period number.
+	solutions map[string]int64
+
+	// Rotation period number expired solutions were last forgotten in.
+	pruned int64
+
+	// Mutex for accepted solutions operations.
+	mutex sync.Mutex
+}
+
+// Create connection proof of work puzzle with random secret.
+// Accept difficulty (number of leading zero bits, between 1 and PUZZLE_MAX_DIFFICULTY).
+// Return puzzle pointer and nil if created successfully, otherwise nil and error.
+func newPuzzle(difficulty int) (*puzzle, error) {
+	if difficulty <= 0 || difficulty > PUZZLE_MAX_DIFFICULTY {
+		return nil, fmt.Errorf("proof of work difficulty should be between 1 and %d: %d", PUZZLE_MAX_DIFFICULTY, difficulty)
+	}
+
+	secret := make([]byte, PUZZLE_SECRET_LENGTH)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("error generating puzzle secret: %v", err)
+	}
+	return &puzzle{difficulty: difficulty, secret: secret, solutions: make(map[string]int64)}, nil
+}
+
+// Calculate challenge for address and rotation period.
+// Should be applied for puzzle object.
+// Accept viridian IP address and rotation period number.
+// Return challenge bytes.
+func (puzzle *puzzle) challenge(address net.IP, period int64) []byte {
+	mac := hmac.New(sha256.New, puzzle.secret)
+	mac.Write(address.To16())
+	binary.Write(mac, binary.BigEndian, period)
+	return mac.Sum(nil)
+}
+
+// Issue current challenge for address.
+// Should be applied for puzzle object.
+// Accept viridian IP address and current time.
+// Return challenge bytes.
+func (puzzle *puzzle) issue(address net.IP, now time.Time) []byte {
+	return puzzle.challenge(address, now.UnixNano()/int64(PUZZLE_ROTATION_PERIOD))
+}
+
+// Check if nonce solves challenge with given difficulty.
+// Accept challenge bytes, nonce and difficulty.
+// Return true if SHA-256 hash of challenge and nonce (big endian) has at least difficulty leading zero bits, false otherwise.
+func solves(challenge []byte, nonce uint64, difficulty int) bool {
+	buffer := make([]byte, len(challenge)+8)
+	binary.BigEndian.PutUint64(buffer[copy(buffer, challenge):], nonce)
+	hash := sha256.Sum256(buffer)
+
+	zeros := 0
+	for _, value := range hash {
+		zeros += bits.LeadingZeros8(value)
+		if value != 0 || zeros >= difficulty {
+			break
+		}
+	}
+	return zeros >= difficulty
+}
+
+// Find rotation period, challenge of which is solved by nonce.
+// Should be applied for puzzle object.
+// Accept viridian IP address, nonce and current time.
+// Return rotation period number and true if nonce solves current or previous challenge of the address, otherwise zero and false.
+func (puzzle *puzzle) solved(address net.IP, nonce uint64, now time.Time) (int64, bool) {
+	period := now.UnixNano() / int64(PUZZLE_ROTATION_PERIOD)
+	if solves(puzzle.challenge(address, period), nonce, puzzle.difficulty) {
+		return period, true
+	} else if solves(puzzle.challenge(address, period-1), nonce, puzzle.difficulty) {
+		return period - 1, true
+	}
+	return 0, false
+}
+
+// Verify proof of work of address and remember it, so that it can not be used again.
+// Solutions of expired challenges are forgotten, if too many unexpired solutions are remembered, the new solution is rejected.
+// Should be applied for puzzle object.
+// Accept viridian IP address, nonce and current time.
+// Return true if nonce solves current or previous challenge of the address and was not used before, false otherwise.
+func (puzzle *puzzle) verify(address net.IP, nonce uint64, now time.Time) bool {
+	period, ok := puzzle.solved(address, nonce, now)
+	if !ok {
+		return false
+	}
+
+	// Create solution key: address, rotation period and nonce
+	key := make([]byte, net.IPv6len+16)
+	copy(key, address.To16())
+	binary.BigEndian.PutUint64(key[net.IPv6len:], uint64(period))
+	binary.BigEndian.PutUint64(key[net.IPv6len+8:], nonce)
+
+	puzzle.mutex.Lock()
+	defer puzzle.mutex.Unlock()
+
+	// Check if the solution was already used
+	if _, ok := puzzle.solutions[string(key)]; ok {
+		return false
+	}
+
+	// Forget solutions of expired challenges once per rotation period
+	if current := now.UnixNano() / int64(PUZZLE_ROTATION_PERIOD); current != puzzle.pruned {
+		for solution, solutionPeriod := range puzzle.solutions {
+			if solutionPeriod < current-1 {
+				delete(puzzle.solutions, solution)
+			}
+		}
+		puzzle.pruned = current
+	}
+
+	// Reject the solution if too many unexpired solutions are remembered
+	if len(puzzle.solutions) >= PUZZLE_MAX_SOLUTIONS {
+		return false
+	}
+
+	// Remember the solution
+	puzzle.solutions[string(key)] = period
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"main/generated"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	PUZZLE_TEST_DIFFICULTY = 8
+	PUZZLE_TEST_ATTEMPTS   = 1 << 24
+)
+
+func findTestNonce(test *testing.T, predicate func(uint64) bool) uint64 {
+	for nonce := uint64(0); nonce < PUZZLE_TEST_ATTEMPTS; nonce++ {
+		if predicate(nonce) {
+			return nonce
+		}
+	}
+	test.Fatalf("no nonce found in %d attempts", PUZZLE_TEST_ATTEMPTS)
+	return 0
+}
+
+func TestPuzzleVerify(test *testing.T) {
+	puzzle, err := newPuzzle(PUZZLE_TEST_DIFFICULTY)
+	if err != nil {
+		test.Fatalf("error creating puzzle: %v", err)
+	}
+	address, other := net.IPv4(203, 0, 113, 1), net.IPv4(203, 0, 113, 2)
+	now := time.Now()
+	period := now.UnixNano() / int64(PUZZLE_ROTATION_PERIOD)
+
+	valid := findTestNonce(test, func(nonce uint64) bool {
+		return solves(puzzle.challenge(address, period), nonce, PUZZLE_TEST_DIFFICULTY) &&
+			!solves(puzzle.challenge(address, period+1), nonce, PUZZLE_TEST_DIFFICULTY) &&
+			!solves(puzzle.challenge(address, period+2), nonce, PUZZLE_TEST_DIFFICULTY) &&
+			!solves(puzzle.challenge(other, period), nonce, PUZZLE_TEST_DIFFICULTY) &&
+			!solves(puzzle.challenge(other, period-1), nonce, PUZZLE_TEST_DIFFICULTY)
+	})
+	if solvedPeriod, ok := puzzle.solved(address, valid, now); !ok || solvedPeriod != period {
+		test.Fatal("valid proof of work rejected")
+	}
+	if solvedPeriod, ok := puzzle.solved(address, valid, now.Add(PUZZLE_ROTATION_PERIOD)); !ok || solvedPeriod != period {
+		test.Fatal("proof of work for previous challenge rejected")
+	}
+	if _, ok := puzzle.solved(address, valid, now.Add(PUZZLE_ROTATION_PERIOD*2)); ok {
+		test.Fatal("proof of work for expired challenge accepted")
+	}
+	if _, ok := puzzle.solved(other, valid, now); ok {
+		test.Fatal("proof of work accepted for another address")
+	}
+
+	invalid := findTestNonce(test, func(nonce uint64) bool {
+		return !solves(puzzle.challenge(address, period), nonce, PUZZLE_TEST_DIFFICULTY) &&
+			!solves(puzzle.challenge(address, period-1), nonce, PUZZLE_TEST_DIFFICULTY)
+	})
+	if puzzle.verify(address, invalid, now) {
+		test.Fatal("invalid proof of work accepted")
+	}
+}
+
+func TestPuzzleReplay(test *testing.T) {
+	puzzle, err := newPuzzle(PUZZLE_TEST_DIFFICULTY)
+	if err != nil {
+		test.Fatalf("error creating puzzle: %v", err)
+	}
+	address := net.IPv4(203, 0, 113, 1)
+	now := time.Now()
+	period := now.UnixNano() / int64(PUZZLE_ROTATION_PERIOD)
+
+	valid := findTestNonce(test, func(nonce uint64) bool {
+		return solves(puzzle.challenge(address, period), nonce, PUZZLE_TEST_DIFFICULTY)
+	})
+	if !puzzle.verify(address, valid, now) {
+		test.Fatal("valid proof of work rejected")
+	}
+	if puzzle.verify(address, valid, now) || puzzle.verify(address, valid, now.Add(PUZZLE_ROTATION_PERIOD)) {
+		test.Fatal("replayed proof of work accepted")
+	}
+
+	// Solutions of expired challenges are forgotten once a new solution is accepted
+	fresh := findTestNonce(test, func(nonce uint64) bool {
+		return solves(puzzle.challenge(address, period+2), nonce, PUZZLE_TEST_DIFFICULTY)
+	})
+	if !puzzle.verify(address, fresh, now.Add(PUZZLE_ROTATION_PERIOD*2)) || len(puzzle.solutions) != 1 {
+		test.Fatalf("expired proof of work solutions remembered: %d", len(puzzle.solutions))
+	}
+}
+
+func TestPuzzleSolutionsBounded(test *testing.T) {
+	puzzle, err := newPuzzle(PUZZLE_TEST_DIFFICULTY)
+	if err != nil {
+		test.Fatalf("error creating puzzle: %v", err)
+	}
+	address := net.IPv4(203, 0, 113, 1)
+	now := time.Now()
+	period := now.UnixNano() / int64(PUZZLE_ROTATION_PERIOD)
+
+	puzzle.pruned = period
+	for i := 0; i < PUZZLE_MAX_SOLUTIONS; i++ {
+		puzzle.solutions[fmt.Sprint(i)] = period
+	}
+
+	valid := findTestNonce(test, func(nonce uint64) bool {
+		return solves(puzzle.challenge(address, period), nonce, PUZZLE_TEST_DIFFICULTY)
+	})
+	if puzzle.verify(address, valid, now) || len(puzzle.solutions) != PUZZLE_MAX_SOLUTIONS {
+		test.Fatalf("proof of work accepted with too many solutions remembered: %d", len(puzzle.solutions))
+	}
+}
+
+func TestNewPuzzleDifficulty(test *testing.T) {
+	for _, difficulty := range []int{0, PUZZLE_MAX_DIFFICULTY + 1} {
+		if _, err := newPuzzle(difficulty); err == nil {
+			test.Fatalf("puzzle with invalid difficulty created: %d", difficulty)
+		}
+	}
+}
+
+func TestConnectProofOfWork(test *testing.T) {
+	server := createTestServer(test)
+	puzzle, err := newPuzzle(PUZZLE_TEST_DIFFICULTY)
+	if err != nil {
+		test.Fatalf("error creating puzzle: %v", err)
+	}
+	server.puzzle = puzzle
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}})
+
+	response, err := server.GetChallenge(ctx, &generated.ChallengeRequest{Version: VERSION})
+	if err != nil {
+		test.Fatalf("error getting challenge: %v", err)
+	}
+	if response.Difficulty != PUZZLE_TEST_DIFFICULTY {
+		test.Fatalf("unexpected challenge difficulty: %d != %d", response.Difficulty, PUZZLE_TEST_DIFFICULTY)
+	}
+
+	request := &generated.ControlConnectionRequest{Version: VERSION, Token: []byte("invalid_token")}
+	if _, err := server.Connect(ctx, request); status.Code(err) != codes.FailedPrecondition {
+		test.Fatalf("connection without proof of work not rejected: %v", err)
+	}
+
+	nonce := findTestNonce(test, func(nonce uint64) bool {
+		return solves(response.Challenge, nonce, int(response.Difficulty))
+	})
+	request.Nonce = &nonce
+	if _, err := server.Connect(ctx, request); status.Code(err) != codes.InvalidArgument {
+		test.Fatalf("connection with valid proof of work did not reach token decryption: %v", err)
+	}
+	if _, err := server.Connect(ctx, request); status.Code(err) != codes.FailedPrecondition {
+		test.Fatalf("connection with replayed proof of work not rejected: %v", err)
+	}
+}
@@ -3,12 +3,18 @@ package main
 import (
 	"context"
 	"crypto/cipher"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"main/crypto"
 	"main/generated"
 	"main/users"
 	"main/utils"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
@@ -17,9 +23,80 @@ import (
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// VPN data transfer protocols supported by the node.
+var SUPPORTED_PROTOCOLS = []string{"udp"}
+
+// Control response trailer key, random tail is sent in.
+const TAIL_TRAILER_KEY = "tail"
+
+// Payload tier structure.
+// Defines limits applied to viridians authenticated with the tier payload.
+type payloadTier struct {
+	// Authentication string for the tier.
+	payload string
+
+	// Session length, viridian subscription ends after it.
+	session time.Duration
+
+	// Viridian bandwidth limit (kbytes per second), not limited if not positive.
+	bandwidth int32
+
+	// Routes viridian is allowed to request, within the routes allowed by node (nil if only node routes are applied).
+	routes []string
+}
+
+// Parse payload tiers.
+// Tiers are separated by commas, every tier has format "payload:session:bandwidth",
+// where session is session length in seconds (positive) and bandwidth is bandwidth limit in kbytes per second (not limited if not positive).
+// Accept tiers string.
+// Return payload tiers list and nil if parsed successfully, otherwise nil and error.
+func parsePayloadTiers(value string) ([]payloadTier, error) {
+	tiers := make([]payloadTier, 0)
+	if value == "" {
+		return tiers, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		// Split tier into fields
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid payload tier format: %s", entry)
+		}
+
+		// Parse session length
+		session, err := strconv.Atoi(fields[1])
+		if err != nil || session <= 0 {
+			return nil, fmt.Errorf("invalid payload tier session length: %s", fields[1])
+		}
+
+		// Parse bandwidth limit
+		bandwidth, err := strconv.ParseInt(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload tier bandwidth: %s", fields[2])
+		}
+
+		tiers = append(tiers, payloadTier{
+			payload:   fields[0],
+			session:   time.Duration(session) * time.Second,
+			bandwidth: int32(bandwidth),
+		})
+	}
+
+	return tiers, nil
+}
+
+// Compare payloads in constant time.
+// Accept received payload and expected payload.
+// Return true if payloads match, false otherwise.
+func payloadMatches(received, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(received), []byte(expected)) == 1
+}
+
 // Whirlpool server structure.
 // Extends from generated gRPC Whirlpool server API.
 // Contains all the data required for server execution.
@@ -32,8 +109,11 @@ type WhirlpoolServer struct {
 	// Authentication string for node user (viridian).
 	nodeViridianPayload string
 
+	// Authentication tiers for node users (viridians) with limits.
+	nodeTiers []payloadTier
+
 	// Viridians dictionary, contains all the currently connected viridians.
-	viridians users.ViridianDict
+	viridians *users.ViridianDict
 
 	// Private node AEAD: used for authentication token encryption.
 	// TODO: change it once in a while.
@@ -41,6 +121,30 @@ type WhirlpoolServer struct {
 
 	// Server context, used as a base context for viridian port listeners.
 	base context.Context
+
+	// Token decryption failure tracker (nil if failures are not tracked).
+	authFailures *authFailureTracker
+
+	// Connection proof of work puzzle (nil if proof of work is not required).
+	puzzle *puzzle
+
+	// Viridian identity store (nil if viridians are authenticated with node payloads only).
+	identities *cachedIdentityStore
+
+	// Flag, whether viridians are allowed to request null (plaintext) session cipher.
+	allowNullCipher bool
+
+	// Split tunnel routes viridians are allowed to request (nil if any routes are allowed).
+	allowedRoutes []string
+
+	// Concurrent authentication limiter (nil if authentication concurrency is not limited).
+	authLimiter *authLimiter
+
+	// Token decryption buffer arena (nil if token buffers are allocated on every decryption).
+	tokenArena *tokenArena
+
+	// Flag, whether node serves API only (viridians dictionary is nil then, viridian connections are not accepted).
+	apiOnly bool
 }
 
 // Create Whirlpool server.
@@ -49,8 +153,14 @@ type WhirlpoolServer struct {
 // Return Whirlpool server pointer.
 func createWhirlpoolServer(ctx context.Context) *WhirlpoolServer {
 	// Read server payloads from environment
-	nodeOwnerPayload := utils.GetEnv("SEASIDE_PAYLOAD_OWNER")
-	nodeViridianPayload := utils.GetEnv("SEASIDE_PAYLOAD_VIRIDIAN")
+	nodeOwnerPayload := utils.GetSecretEnv("SEASIDE_PAYLOAD_OWNER")
+	nodeViridianPayload := utils.GetSecretEnv("SEASIDE_PAYLOAD_VIRIDIAN")
+
+	// Read server payload tiers from environment
+	nodeTiers, err := parsePayloadTiers(utils.GetOptionalSecretEnv("SEASIDE_PAYLOAD_TIERS", ""))
+	if err != nil {
+		logrus.Fatalf("error parsing payload tiers: %v", err)
+	}
 
 	// Generate private node cipher
 	privateKey, err := crypto.GenerateCipher()
@@ -58,13 +168,78 @@ func createWhirlpoolServer(ctx context.Context) *WhirlpoolServer {
 		logrus.Fatalf("error creating server private key: %v", err)
 	}
 
+	// Create authentication failure tracker if failure threshold is positive
+	var authFailures *authFailureTracker
+	authFailureThreshold := utils.GetOptionalIntEnv("SEASIDE_AUTH_FAILURE_THRESHOLD", 10)
+	if authFailureThreshold > 0 {
+		authFailureWindow := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_AUTH_FAILURE_WINDOW", 60))
+		authFailureBlock := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_AUTH_FAILURE_BLOCK", 0))
+		authFailures = newAuthFailureTracker(authFailureThreshold, authFailureWindow, authFailureBlock)
+	}
+
+	// Create connection proof of work puzzle if difficulty is positive
+	var connectionPuzzle *puzzle
+	if difficulty := utils.GetOptionalIntEnv("SEASIDE_POW_DIFFICULTY", 0); difficulty > 0 {
+		connectionPuzzle, err = newPuzzle(difficulty)
+		if err != nil {
+			logrus.Fatalf("error creating connection puzzle: %v", err)
+		}
+	}
+
+	// Open viridian identity store if its location is provided
+	var identities *cachedIdentityStore
+	if identityLocation := utils.GetOptionalEnv("SEASIDE_IDENTITY_DB", ""); identityLocation != "" {
+		store, err := openIdentityStore(identityLocation)
+		if err != nil {
+			logrus.Fatalf("error opening identity store: %v", err)
+		}
+		identityCacheTTL := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_IDENTITY_CACHE_TTL", 60))
+		identities = newCachedIdentityStore(store, identityCacheTTL)
+	}
+
+	// Check if null session cipher is allowed, only exact "1" value allows it, so that it can not be enabled accidentally
+	allowNullCipher := utils.GetOptionalEnv("SEASIDE_ALLOW_NULL_CIPHER", "0") == "1"
+	if allowNullCipher {
+		logrus.Warn("NULL CIPHER IS ALLOWED: viridians can request sessions WITHOUT ENCRYPTION, use for testing on trusted links only!")
+	}
+
+	// Read split tunnel routes viridians are allowed to request
+	allowedRoutes, err := users.ParseAllowedRoutes(utils.GetOptionalEnv("SEASIDE_ALLOWED_ROUTES", ""))
+	if err != nil {
+		logrus.Fatalf("error parsing allowed routes: %v", err)
+	}
+
+	// Create authentication limiter if concurrency limit is positive
+	var limiter *authLimiter
+	if maxConcurrentAuth := utils.GetOptionalIntEnv("SEASIDE_MAX_CONCURRENT_AUTH", 0); maxConcurrentAuth > 0 {
+		authQueueLength := utils.GetOptionalIntEnv("SEASIDE_AUTH_QUEUE_LENGTH", 64)
+		authQueueTimeout := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_AUTH_QUEUE_TIMEOUT", 1))
+		limiter = newAuthLimiter(maxConcurrentAuth, authQueueLength, authQueueTimeout)
+	}
+
+	// Create viridians dictionary unless node serves API only (there is no tunnel to forward viridian traffic to then)
+	apiOnly := apiOnlyMode()
+	var viridians *users.ViridianDict
+	if !apiOnly {
+		viridians = users.NewViridianDict(ctx)
+	}
+
 	// Return Whirlpool server pointer
 	return &WhirlpoolServer{
 		nodeOwnerPayload:    nodeOwnerPayload,
 		nodeViridianPayload: nodeViridianPayload,
-		viridians:           *users.NewViridianDict(ctx),
+		nodeTiers:           nodeTiers,
+		viridians:           viridians,
 		privateKey:          privateKey,
 		base:                ctx,
+		authFailures:        authFailures,
+		puzzle:              connectionPuzzle,
+		identities:          identities,
+		allowNullCipher:     allowNullCipher,
+		allowedRoutes:       allowedRoutes,
+		authLimiter:         limiter,
+		tokenArena:          newTokenArena(TOKEN_ARENA_BUFFERS, TOKEN_ARENA_BUFFER_SIZE),
+		apiOnly:             apiOnly,
 	}
 }
 
@@ -72,43 +247,314 @@ func createWhirlpoolServer(ctx context.Context) *WhirlpoolServer {
 // Gracefully srops all the viridian listeners.
 // Should be applied for WhirlpoolServer object.
 func (server *WhirlpoolServer) destroyWhirlpoolServer() {
-	server.viridians.Clear()
+	if server.viridians != nil {
+		server.viridians.Clear()
+	}
+}
+
+// Set random tail trailer of control response.
+// Tail is hex-encoded random bytes of bounded length, trailer is skipped entirely if tails are disabled.
+// Accept gRPC call context.
+func setTailTrailer(ctx context.Context) {
+	if !utils.TAIL_DISABLED {
+		grpc.SetTrailer(ctx, metadata.Pairs(TAIL_TRAILER_KEY, hex.EncodeToString(utils.GenerateReliableTail())))
+	}
+}
+
+// Create error for a request of viridian that is not connected.
+// If the viridian was disconnected, termination exception with disconnect reason is attached to the error,
+// so that the viridian knows why its session ended.
+// Should be applied for WhirlpoolServer object.
+// Accept viridian ID.
+// Return gRPC status error.
+func (server *WhirlpoolServer) notConnectedError(userID uint16) error {
+	reason, ok := server.viridians.Departure(userID)
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "user not connected: %d", userID)
+	}
+
+	message := string(reason)
+	termination := &generated.ControlException{Status: generated.ControlExceptionStatus_TERMINATION, UserID: int32(userID), Message: &message}
+	disconnected, err := status.Newf(codes.Unauthenticated, "user disconnected: %d, reason: %s", userID, reason).WithDetails(termination)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "user disconnected: %d, reason: %s", userID, reason)
+	}
+	return disconnected.Err()
+}
+
+// Wait for authentication processing slot, if authentication concurrency is limited.
+// Should be applied for WhirlpoolServer object.
+// Accept request context.
+// Return slot release function (should be called once the request is processed) and nil if slot was taken, otherwise nil and gRPC status error.
+func (server *WhirlpoolServer) admitAuthentication(ctx context.Context) (func(), error) {
+	if server.authLimiter == nil {
+		return func() {}, nil
+	}
+	return server.authLimiter.acquire(ctx)
+}
+
+// Decrypt and parse user token.
+// Should be applied for WhirlpoolServer object.
+// Accept encrypted token bytes.
+// Return user token and nil if token is valid, otherwise nil and gRPC status error.
+func (server *WhirlpoolServer) decryptToken(data []byte) (*generated.UserToken, error) {
+	// Check if token is not null
+	if data == nil {
+		return nil, status.Error(codes.InvalidArgument, "user token is null")
+	}
+
+	// Decrypt token into a buffer borrowed from the arena, unmarshalled token does not reference the buffer, so it is released on return
+	buffer := server.tokenArena.borrow()
+	defer server.tokenArena.release(buffer)
+	tokenBytes, err := crypto.DecryptTo(buffer, data, server.privateKey)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "error decrypting token")
+	}
+
+	// Unmarshall token datastructure
+	token := &generated.UserToken{}
+	err = proto.Unmarshal(tokenBytes, token)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "error unmarshalling token")
+	}
+
+	// Return token and no error
+	return token, nil
+}
+
+// Check if node forwards viridian traffic.
+// Should be applied for WhirlpoolServer object.
+// Return nil if viridian connections are accepted, otherwise "unavailable" gRPC status error if node serves API only.
+func (server *WhirlpoolServer) checkDataPlane() error {
+	if server.apiOnly {
+		return status.Error(codes.Unavailable, "node serves API only, viridian connections are not accepted")
+	}
+	return nil
+}
+
+// Check if handshake should be aborted.
+// Handshakes are aborted if either the node is shutting down or the request is cancelled, so that no expensive steps are performed in vain.
+// Should be applied for WhirlpoolServer object.
+// Accept request context.
+// Return nil if handshake can proceed, otherwise gRPC status error.
+func (server *WhirlpoolServer) checkHandshake(ctx context.Context) error {
+	if server.base.Err() != nil {
+		return status.Error(codes.Unavailable, "node is shutting down")
+	} else if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	return nil
+}
+
+// Check if client version is compatible with the node.
+// Versions are compatible if their major versions match.
+// Accept client version string.
+// Return true if versions are compatible, false otherwise.
+func isVersionCompatible(version string) bool {
+	return strings.Split(VERSION, ".")[0] == strings.Split(version, ".")[0]
+}
+
+// Report node compatibility information.
+// Allows clients to check compatibility before authentication, does not require token.
+// Only major version is reported, so that the node can not be fingerprinted by exact version.
+// Should be applied for WhirlpoolServer object.
+// Accept context and compatibility request.
+// Return compatibility response and nil if version is parsed successfully, otherwise nil and error.
+func (server *WhirlpoolServer) Compatibility(ctx context.Context, request *generated.CompatibilityRequest) (*generated.CompatibilityResponse, error) {
+	// Parse node major version
+	major, err := strconv.Atoi(strings.Split(VERSION, ".")[0])
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error parsing node version: %v", err)
+	}
+
+	// Create and return compatibility response
+	setTailTrailer(ctx)
+	return &generated.CompatibilityResponse{
+		Compatible: isVersionCompatible(request.Version),
+		Major:      int32(major),
+		Protocols:  SUPPORTED_PROTOCOLS,
+	}, nil
+}
+
+// Find payload tier matching payload.
+// All the tiers are compared in constant time, so that the matching tier can not be guessed by timing.
+// Should be applied for WhirlpoolServer object.
+// Accept received payload.
+// Return matching tier pointer or nil if no tier matches.
+func (server *WhirlpoolServer) findTier(payload string) *payloadTier {
+	var matching *payloadTier
+	for i := range server.nodeTiers {
+		if payloadMatches(payload, server.nodeTiers[i].payload) && matching == nil {
+			matching = &server.nodeTiers[i]
+		}
+	}
+	return matching
+}
+
+// Find viridian identity matching payload.
+// Should be applied for WhirlpoolServer object.
+// Accept viridian identifier and received payload.
+// Return identity limits and nil if identity is found and payload matches, nil and nil if not, otherwise nil and lookup error.
+func (server *WhirlpoolServer) findIdentity(uid, payload string) (*payloadTier, error) {
+	identity, ok, err := server.identities.lookup(uid)
+	if err != nil || !ok || !payloadMatches(payload, identity.payload) {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Restrict viridian routes to the routes allowed by payload tier (or identity) and by node.
+// Should be applied for WhirlpoolServer object.
+// Accept requested route strings and payload tier (nil if tier routes should not be applied).
+// Return routes viridian is allowed to use and nil if the routes are valid and allowed, otherwise nil and error (wrapping users.ErrRouteNotAllowed if a route is not allowed).
+func (server *WhirlpoolServer) restrictRoutes(routes []string, tier *payloadTier) ([]string, error) {
+	if tier != nil {
+		var err error
+		if routes, err = users.RestrictRoutes(routes, tier.routes); err != nil {
+			return nil, err
+		}
+	}
+	return users.RestrictRoutes(routes, server.allowedRoutes)
 }
 
 // Authenticate viridian.
 // Check payload values, create user token and encrypt it with private key.
-// Send the token to user.
+// If payload matches one of the payload tiers, tier limits are written to the token.
+// If no node payload matches, viridian identity is looked up in identity store (if any), its limits are written to the token.
+// Send the token and node capabilities to user.
 // Should be applied for WhirlpoolServer object.
 // Accept context and authentication request.
 // Return authentication response and nil if authentication successful, otherwise nil and error.
 func (server *WhirlpoolServer) Authenticate(ctx context.Context, request *generated.WhirlpoolAuthenticationRequest) (*generated.WhirlpoolAuthenticationResponse, error) {
-	// Check node owner or viridian payload
-	if request.Payload != server.nodeOwnerPayload && request.Payload != server.nodeViridianPayload {
+	// Check if node is shutting down
+	if err := server.checkHandshake(ctx); err != nil {
+		return nil, err
+	}
+
+	// Wait for authentication slot, so that authentication bursts can not starve packet forwarding
+	release, err := server.admitAuthentication(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Check node owner, viridian or tier payload
+	owner := payloadMatches(request.Payload, server.nodeOwnerPayload)
+	viridian := payloadMatches(request.Payload, server.nodeViridianPayload)
+	tier := server.findTier(request.Payload)
+
+	// Check viridian identity payload, if no node payload matches
+	if !owner && !viridian && tier == nil && server.identities != nil {
+		identity, err := server.findIdentity(request.Uid, request.Payload)
+		if err != nil {
+			logrus.Errorf("Error looking up viridian %s identity: %v", request.Uid, err)
+			return nil, status.Error(codes.Unavailable, "error looking up identity")
+		}
+		tier = identity
+	}
+
+	if !owner && !viridian && tier == nil {
 		return nil, status.Error(codes.PermissionDenied, "wrong payload value")
 	}
 
-	// Create and marshall user token
+	// Check session key strength
+	if err := crypto.CheckKeyStrength(request.Session); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "session key is degenerate")
+	}
+
+	// Check session cipher suite, null cipher is only allowed explicitly
+	if err := crypto.CheckCipherSuite(request.GetCipher()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	} else if request.GetCipher() == crypto.CIPHER_NULL {
+		if !server.allowNullCipher {
+			return nil, status.Error(codes.PermissionDenied, "null cipher is not allowed")
+		}
+		logrus.Warnf("User %s requested NULL CIPHER, its traffic will NOT BE ENCRYPTED!", request.Uid)
+	}
+
+	// Check split tunnel routes against the tier (identity) and node allowed routes, viridian will only be allowed to send packets to them
+	limits := tier
+	if owner {
+		limits = nil
+	}
+	routes, err := server.restrictRoutes(request.Routes, limits)
+	if errors.Is(err, users.ErrRouteNotAllowed) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Create user token
 	token := &generated.UserToken{
 		Uid:        request.Uid,
 		Session:    request.Session,
-		Privileged: request.Payload == server.nodeOwnerPayload,
+		Privileged: owner,
+		Cipher:     request.Cipher,
+		Routes:     routes,
 	}
+
+	// Apply tier limits to non-privileged token
+	if !owner && tier != nil {
+		token.Subscription = timestamppb.New(time.Now().Add(tier.session))
+		if tier.bandwidth > 0 {
+			token.Bandwidth = &tier.bandwidth
+		}
+	}
+
+	// Marshall user token
 	logrus.Infof("User %s (privileged: %t) autnenticated", token.Uid, token.Privileged)
 	marshToken, err := proto.Marshal(token)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "error marshalling token: %v", err)
 	}
 
-	// Encrypt token
+	// Check if node is shutting down, encrypt token
+	if err := server.checkHandshake(ctx); err != nil {
+		return nil, err
+	}
 	tokenData, err := crypto.Encrypt(marshToken, server.privateKey)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "error encrypting token: %v", err)
 	}
 
 	// Create and marshall response
-	grpc.SetTrailer(ctx, metadata.Pairs("tail", hex.EncodeToString(utils.GenerateReliableTail())))
+	setTailTrailer(ctx)
 	return &generated.WhirlpoolAuthenticationResponse{
-		Token: tokenData,
+		Token:        tokenData,
+		Capabilities: server.capabilities(),
+	}, nil
+}
+
+// Get connection proof of work challenge.
+// Challenge is valid for the requesting address only, it changes every PUZZLE_ROTATION_PERIOD.
+// Should be applied for WhirlpoolServer object.
+// Accept context and challenge request.
+// Return challenge response (empty challenge and zero difficulty if proof of work is disabled) and nil if successful, otherwise nil and error.
+func (server *WhirlpoolServer) GetChallenge(ctx context.Context, request *generated.ChallengeRequest) (*generated.ChallengeResponse, error) {
+	// Check viridian version (major)
+	if !isVersionCompatible(request.Version) {
+		return nil, status.Error(codes.FailedPrecondition, "major versions do not match")
+	}
+
+	// Return empty challenge if proof of work is disabled
+	if server.puzzle == nil {
+		return &generated.ChallengeResponse{}, nil
+	}
+
+	// Get viridian address the challenge is issued for
+	address, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.DataLoss, "error identifying source IP address")
+	}
+	remoteAddress, _, err := utils.GetIPAndPortFromAddress(address.Addr)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error parsing gateway IP address: %v", err)
+	}
+
+	// Return challenge response
+	return &generated.ChallengeResponse{
+		Challenge:  server.puzzle.issue(remoteAddress, time.Now()),
+		Difficulty: int32(server.puzzle.difficulty),
 	}, nil
 }
 
@@ -119,6 +565,11 @@ func (server *WhirlpoolServer) Authenticate(ctx context.Context, request *genera
 // Accept context and connection request.
 // Return connection response and nil if connection successful, otherwise nil and error.
 func (server *WhirlpoolServer) Connect(ctx context.Context, request *generated.ControlConnectionRequest) (*generated.ControlConnectionResponse, error) {
+	// Check if node accepts viridian connections
+	if err := server.checkDataPlane(); err != nil {
+		return nil, err
+	}
+
 	// Get viridian "gateway": the IP address the packages can be forwarded through
 	address, ok := peer.FromContext(ctx)
 	if !ok {
@@ -132,34 +583,48 @@ func (server *WhirlpoolServer) Connect(ctx context.Context, request *generated.C
 	}
 
 	// Check viridian version (major)
-	if strings.Split(VERSION, ".")[0] != strings.Split(request.Version, ".")[0] {
+	if !isVersionCompatible(request.Version) {
 		return nil, status.Error(codes.FailedPrecondition, "major versions do not match")
 	}
 
-	// Check if token is not null
-	if request.Token == nil {
-		return nil, status.Error(codes.InvalidArgument, "user token is null")
+	// Check if source address is blocked for repeated authentication failures
+	if server.authFailures != nil && server.authFailures.blocked(remoteAddress, time.Now()) {
+		return nil, status.Error(codes.ResourceExhausted, "too many authentication failures")
+	}
+
+	// Check proof of work before performing expensive token decryption
+	if server.puzzle != nil && (request.Nonce == nil || !server.puzzle.verify(remoteAddress, *request.Nonce, time.Now())) {
+		return nil, status.Error(codes.FailedPrecondition, "proof of work challenge not solved")
 	}
 
-	// Decrypt token
-	tokenBytes, err := crypto.Decrypt(request.Token, server.privateKey)
+	// Check if node is shutting down, wait for authentication slot
+	if err := server.checkHandshake(ctx); err != nil {
+		return nil, err
+	}
+	release, err := server.admitAuthentication(ctx)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, "error decrypting token")
+		return nil, err
 	}
+	defer release()
 
-	// Unmarshall token datastructure
-	token := &generated.UserToken{}
-	err = proto.Unmarshal(tokenBytes, token)
+	// Decrypt and parse token, account failure if token is invalid
+	token, err := server.decryptToken(request.Token)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, "error unmarshalling token")
+		if server.authFailures != nil {
+			server.authFailures.fail(remoteAddress, time.Now())
+		}
+		return nil, err
 	}
 
 	// Make viridian privileged if it passed owner payload
 	if request.Payload != nil {
-		token.Privileged = token.Privileged || (*request.Payload == server.nodeOwnerPayload)
+		token.Privileged = token.Privileged || payloadMatches(*request.Payload, server.nodeOwnerPayload)
 	}
 
-	// Add viridian to the dictionary
+	// Check if node is shutting down, add viridian to the dictionary
+	if err := server.checkHandshake(ctx); err != nil {
+		return nil, err
+	}
 	userID, err := server.viridians.Add(server.base, token, request.Address, remoteAddress, uint16(request.Port))
 	if err != nil {
 		return nil, err
@@ -167,7 +632,7 @@ func (server *WhirlpoolServer) Connect(ctx context.Context, request *generated.C
 
 	// Log and return connection response
 	logrus.Infof("User %d (uid: %s, privileged: %t) connected", *userID, token.Uid, token.Privileged)
-	grpc.SetTrailer(ctx, metadata.Pairs("tail", hex.EncodeToString(utils.GenerateReliableTail())))
+	setTailTrailer(ctx)
 	return &generated.ControlConnectionResponse{
 		UserID: int32(*userID),
 	}, nil
@@ -180,11 +645,16 @@ func (server *WhirlpoolServer) Connect(ctx context.Context, request *generated.C
 // Accept context and healthcheck request.
 // Return empty response and nil if healthcheck successful, otherwise nil and error.
 func (server *WhirlpoolServer) Healthcheck(ctx context.Context, request *generated.ControlHealthcheck) (*emptypb.Empty, error) {
+	// Check if node accepts viridian connections
+	if err := server.checkDataPlane(); err != nil {
+		return nil, err
+	}
+
 	// Get connected viridian by ID
 	userID := uint16(request.UserID)
 	viridian, ok := server.viridians.Get(userID)
 	if !ok {
-		return nil, status.Errorf(codes.Unauthenticated, "user not connected: %d", userID)
+		return nil, server.notConnectedError(userID)
 	}
 
 	// Get next healthcheck timeout
@@ -198,7 +668,7 @@ func (server *WhirlpoolServer) Healthcheck(ctx context.Context, request *generat
 	}
 
 	// Return empty response
-	grpc.SetTrailer(ctx, metadata.Pairs("tail", hex.EncodeToString(utils.GenerateReliableTail())))
+	setTailTrailer(ctx)
 	return &emptypb.Empty{}, nil
 }
 
@@ -209,16 +679,23 @@ func (server *WhirlpoolServer) Healthcheck(ctx context.Context, request *generat
 // Accept context and exception request.
 // Return empty response and nil if exception hendling successful, otherwise nil and error.
 func (server *WhirlpoolServer) Exception(ctx context.Context, request *generated.ControlException) (*emptypb.Empty, error) {
+	// Check if node accepts viridian connections
+	if err := server.checkDataPlane(); err != nil {
+		return nil, err
+	}
+
 	// Get connected viridian by ID
 	userID := uint16(request.UserID)
 	viridian, ok := server.viridians.Get(userID)
 	if !ok {
-		return nil, status.Errorf(codes.Unauthenticated, "user not connected: %d", userID)
+		return nil, server.notConnectedError(userID)
 	}
 
 	// Check exception status and react according to it
+	reason := users.DISCONNECT_ERROR
 	if request.Status == generated.ControlExceptionStatus_TERMINATION {
 		logrus.Infof("Disconnecting user %s: %d", viridian.UID, userID)
+		reason = users.DISCONNECT_REQUESTED
 	} else if request.Message != nil {
 		logrus.Infof("Aborting user connection, user %s: %d, message: %s", viridian.UID, userID, *request.Message)
 	} else {
@@ -226,7 +703,105 @@ func (server *WhirlpoolServer) Exception(ctx context.Context, request *generated
 	}
 
 	// Remove viridian and return empty response
-	server.viridians.Delete(userID, false)
-	grpc.SetTrailer(ctx, metadata.Pairs("tail", hex.EncodeToString(utils.GenerateReliableTail())))
+	server.viridians.Delete(userID, reason)
+	setTailTrailer(ctx)
 	return &emptypb.Empty{}, nil
 }
+
+// Get connected viridian statistics.
+// Only privileged viridians (admins) are allowed to request statistics.
+// Viridian is identified by user ID or, if it is not provided, by unique identifier.
+// Should be applied for WhirlpoolServer object.
+// Accept context and statistics request.
+// Return statistics response and nil if viridian is found, otherwise nil and error.
+func (server *WhirlpoolServer) GetViridianStats(ctx context.Context, request *generated.ViridianStatsRequest) (*generated.ViridianStatsResponse, error) {
+	// Decrypt and parse token
+	token, err := server.decryptToken(request.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check token privileges
+	if !token.Privileged {
+		return nil, status.Error(codes.PermissionDenied, "statistics are only available for privileged users")
+	}
+
+	// Check if node accepts viridian connections
+	if err := server.checkDataPlane(); err != nil {
+		return nil, err
+	}
+
+	// Find viridian by user ID or unique identifier
+	var userID uint16
+	var viridian *users.Viridian
+	var ok bool
+	if request.UserID != nil {
+		userID = uint16(*request.UserID)
+		viridian, ok = server.viridians.Get(userID)
+	} else if request.Uid != nil {
+		userID, viridian, ok = server.viridians.Find(*request.Uid)
+	} else {
+		return nil, status.Error(codes.InvalidArgument, "neither user ID nor unique identifier provided")
+	}
+	if !ok {
+		return nil, status.Error(codes.NotFound, "requested user not connected")
+	}
+
+	// Create statistics response
+	stats := viridian.Statistics()
+	response := &generated.ViridianStatsResponse{
+		UserID:       int32(userID),
+		Uid:          viridian.UID,
+		Privileged:   stats.Privileged,
+		PacketsIn:    stats.PacketsIn,
+		BytesIn:      stats.BytesIn,
+		PacketsOut:   stats.PacketsOut,
+		BytesOut:     stats.BytesOut,
+		Uptime:       durationpb.New(stats.Uptime),
+		PayloadBytes: stats.PayloadBytes,
+		WireBytes:    stats.WireBytes,
+		Goodput:      stats.Goodput(),
+		Dropped:      stats.Dropped,
+	}
+	if stats.Subscription != nil {
+		response.Subscription = timestamppb.New(*stats.Subscription)
+	}
+
+	// Count viridian flows, leave them unset if connection tracking table is not available
+	if flows, err := server.viridians.Flows(userID); err != nil {
+		logrus.Debugf("Error counting user %d flows: %v", userID, err)
+	} else {
+		response.Flows = &flows
+	}
+
+	// Return statistics response
+	setTailTrailer(ctx)
+	return response, nil
+}
+
+// Get node build information.
+// Only privileged viridians (admins) are allowed to request build information, so that the node can not be fingerprinted.
+// Should be applied for WhirlpoolServer object.
+// Accept context and build information request.
+// Return build information response and nil if token is privileged, otherwise nil and error.
+func (server *WhirlpoolServer) GetBuildInfo(ctx context.Context, request *generated.BuildInfoRequest) (*generated.BuildInfoResponse, error) {
+	// Decrypt and parse token
+	token, err := server.decryptToken(request.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check token privileges
+	if !token.Privileged {
+		return nil, status.Error(codes.PermissionDenied, "build information is only available for privileged users")
+	}
+
+	// Return build information response
+	setTailTrailer(ctx)
+	return &generated.BuildInfoResponse{
+		Version:   VERSION,
+		GoVersion: runtime.Version(),
+		Commit:    BUILD_COMMIT,
+		BuildTime: BUILD_TIME,
+	}, nil
+}
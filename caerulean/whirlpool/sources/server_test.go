@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"main/crypto"
+	"main/generated"
+	"main/tunnel"
+	"main/users"
+	"main/utils"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/crypto/chacha20poly1305"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	SERVER_OWNER_PAYLOAD    = "test_owner_payload"
+	SERVER_VIRIDIAN_PAYLOAD = "test_viridian_payload"
+	SERVER_GOLD_PAYLOAD     = "test_gold_payload"
+	SERVER_SILVER_PAYLOAD   = "test_silver_payload"
+	SERVER_UNKNOWN_PAYLOAD  = "test_unknown_payload"
+	SERVER_UNKNOWN_CIPHER   = "test_unknown_cipher"
+	SERVER_TIERS            = SERVER_GOLD_PAYLOAD + ":3600:1000," + SERVER_SILVER_PAYLOAD + ":600:-1"
+
+	SERVER_COMPATIBLE_VERSION   = "0.1.0"
+	SERVER_INCOMPATIBLE_VERSION = "1.0.1"
+
+	SERVER_STATS_VIRIDIAN_UID = "test_user_uid"
+	SERVER_STATS_ADMIN_UID    = "test_admin_uid"
+
+	SERVER_EXCEPTION_MESSAGE = "test_exception_message"
+
+	SERVER_SPLIT_ROUTE      = "10.10.0.0/16"
+	SERVER_INVALID_ROUTE    = "10.10.0.0/33"
+	SERVER_DISALLOWED_ROUTE = "0.0.0.0/0"
+
+	SERVER_AUTH_FAILURE_THRESHOLD = 5
+
+	SERVER_POW_DIFFICULTY   = 8
+	SERVER_AUTH_CONCURRENCY = 4
+)
+
+func createTestServer(test *testing.T) *WhirlpoolServer {
+	privateKey, err := crypto.GenerateCipher()
+	if err != nil {
+		test.Fatalf("error creating server private key: %v", err)
+	}
+
+	return &WhirlpoolServer{
+		privateKey: privateKey,
+		viridians:  &users.ViridianDict{},
+		base:       context.Background(),
+	}
+}
+
+func createTestSession(test *testing.T) []byte {
+	session := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(session); err != nil {
+		test.Fatalf("symmetrical key reading error: %v", err)
+	}
+	return session
+}
+
+func createTestToken(test *testing.T, server *WhirlpoolServer, uid string, privileged bool) []byte {
+	session := createTestSession(test)
+
+	marshToken, err := proto.Marshal(&generated.UserToken{
+		Uid:        uid,
+		Session:    session,
+		Privileged: privileged,
+	})
+	if err != nil {
+		test.Fatalf("error marshalling token: %v", err)
+	}
+
+	tokenData, err := crypto.Encrypt(marshToken, server.privateKey)
+	if err != nil {
+		test.Fatalf("error encrypting token: %v", err)
+	}
+	return tokenData
+}
+
+func TestGetViridianStatsNotPrivileged(test *testing.T) {
+	server := createTestServer(test)
+	uid := SERVER_STATS_VIRIDIAN_UID
+
+	request := &generated.ViridianStatsRequest{
+		Token: createTestToken(test, server, SERVER_STATS_VIRIDIAN_UID, false),
+		Uid:   &uid,
+	}
+
+	_, err := server.GetViridianStats(context.Background(), request)
+	if status.Code(err) != codes.PermissionDenied {
+		test.Fatalf("statistics request with non-privileged token not rejected: %v", err)
+	}
+}
+
+func TestGetViridianStatsNotFound(test *testing.T) {
+	server := createTestServer(test)
+	uid := SERVER_STATS_VIRIDIAN_UID
+
+	request := &generated.ViridianStatsRequest{
+		Token: createTestToken(test, server, SERVER_STATS_ADMIN_UID, true),
+		Uid:   &uid,
+	}
+
+	_, err := server.GetViridianStats(context.Background(), request)
+	if status.Code(err) != codes.NotFound {
+		test.Fatalf("statistics request for not connected viridian didn't fail: %v", err)
+	}
+}
+
+func TestGetViridianStatsFound(test *testing.T) {
+	tunnelConfig := tunnel.Preserve()
+	err := tunnelConfig.Open()
+	if err != nil {
+		test.Fatalf("Error establishing network connections: %v", err)
+	}
+	defer tunnelConfig.Close()
+
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := createTestServer(test)
+	server.base = tunnel.NewContext(base, tunnelConfig)
+	server.viridians = users.NewViridianDict(server.base)
+	defer server.viridians.Clear()
+
+	viridianToken, err := server.decryptToken(createTestToken(test, server, SERVER_STATS_VIRIDIAN_UID, true))
+	if err != nil {
+		test.Fatalf("error decrypting viridian token: %v", err)
+	}
+
+	userID, err := server.viridians.Add(server.base, viridianToken, net.IP{127, 0, 0, 1}, net.IP{127, 0, 0, 1}, 12345)
+	if err != nil {
+		test.Fatalf("error adding viridian: %v", err)
+	}
+
+	uid := SERVER_STATS_VIRIDIAN_UID
+	requestedID := int32(*userID)
+	adminToken := createTestToken(test, server, SERVER_STATS_ADMIN_UID, true)
+	requests := []*generated.ViridianStatsRequest{
+		{Token: adminToken, Uid: &uid},
+		{Token: adminToken, UserID: &requestedID},
+	}
+
+	for _, request := range requests {
+		response, err := server.GetViridianStats(context.Background(), request)
+		if err != nil {
+			test.Fatalf("error requesting viridian statistics: %v", err)
+		}
+		test.Logf("viridian statistics received: %v", response)
+
+		if response.Uid != SERVER_STATS_VIRIDIAN_UID || response.UserID != requestedID {
+			test.Fatalf("statistics don't match requested viridian: %s (%d) != %s (%d)", response.Uid, response.UserID, SERVER_STATS_VIRIDIAN_UID, requestedID)
+		}
+
+		if !response.Privileged {
+			test.Fatalf("privileged viridian statistics report it as not privileged")
+		}
+	}
+}
+
+func TestExceptionDisconnectReason(test *testing.T) {
+	tunnelConfig := tunnel.Preserve()
+	err := tunnelConfig.Open()
+	if err != nil {
+		test.Fatalf("Error establishing network connections: %v", err)
+	}
+	defer tunnelConfig.Close()
+
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := createTestServer(test)
+	server.base = tunnel.NewContext(base, tunnelConfig)
+	server.viridians = users.NewViridianDict(server.base)
+	defer server.viridians.Clear()
+
+	viridianToken, err := server.decryptToken(createTestToken(test, server, SERVER_STATS_VIRIDIAN_UID, false))
+	if err != nil {
+		test.Fatalf("error decrypting viridian token: %v", err)
+	}
+
+	userID, err := server.viridians.Add(server.base, viridianToken, net.IP{127, 0, 0, 1}, net.IP{127, 0, 0, 1}, 12345)
+	if err != nil {
+		test.Fatalf("error adding viridian: %v", err)
+	}
+
+	message := SERVER_EXCEPTION_MESSAGE
+	exception := &generated.ControlException{Status: generated.ControlExceptionStatus_EXCEPTION, UserID: int32(*userID), Message: &message}
+	if _, err := server.Exception(context.Background(), exception); err != nil {
+		test.Fatalf("error reporting viridian exception: %v", err)
+	}
+
+	_, err = server.Healthcheck(context.Background(), &generated.ControlHealthcheck{UserID: int32(*userID), NextIn: 1})
+	if status.Code(err) != codes.Unauthenticated {
+		test.Fatalf("disconnected viridian healthcheck not rejected: %v", err)
+	}
+
+	details := status.Convert(err).Details()
+	if len(details) != 1 {
+		test.Fatalf("termination not attached to disconnected viridian error: %v", details)
+	}
+	termination, ok := details[0].(*generated.ControlException)
+	if !ok || termination.Status != generated.ControlExceptionStatus_TERMINATION || termination.GetMessage() != string(users.DISCONNECT_ERROR) {
+		test.Fatalf("termination doesn't match expected: %v", details[0])
+	}
+}
+
+func TestCompatibility(test *testing.T) {
+	server := createTestServer(test)
+
+	response, err := server.Compatibility(context.Background(), &generated.CompatibilityRequest{Version: SERVER_COMPATIBLE_VERSION})
+	if err != nil {
+		test.Fatalf("error requesting compatibility: %v", err)
+	}
+	if !response.Compatible {
+		test.Fatalf("compatible version %s reported incompatible with %s", SERVER_COMPATIBLE_VERSION, VERSION)
+	}
+	if response.Major != 0 || len(response.Protocols) == 0 {
+		test.Fatalf("unexpected compatibility response: major %d, protocols %v", response.Major, response.Protocols)
+	}
+
+	response, err = server.Compatibility(context.Background(), &generated.CompatibilityRequest{Version: SERVER_INCOMPATIBLE_VERSION})
+	if err != nil {
+		test.Fatalf("error requesting compatibility: %v", err)
+	}
+	if response.Compatible {
+		test.Fatalf("incompatible version %s reported compatible with %s", SERVER_INCOMPATIBLE_VERSION, VERSION)
+	}
+}
+
+func TestParsePayloadTiers(test *testing.T) {
+	tiers, err := parsePayloadTiers(SERVER_TIERS)
+	if err != nil {
+		test.Fatalf("error parsing payload tiers: %v", err)
+	}
+	if len(tiers) != 2 || tiers[0].session != time.Hour || tiers[0].bandwidth != 1000 || tiers[1].session != 10*time.Minute {
+		test.Fatalf("parsed payload tiers don't match expected: %v", tiers)
+	}
+
+	for _, invalid := range []string{"payload", "payload:0:100", "payload:abc:100", ":60:100", "payload:60:abc"} {
+		if _, err := parsePayloadTiers(invalid); err == nil {
+			test.Fatalf("invalid payload tier parsed successfully: %s", invalid)
+		}
+	}
+}
+
+func TestAuthenticateTiers(test *testing.T) {
+	server := createTestServer(test)
+	server.nodeOwnerPayload = SERVER_OWNER_PAYLOAD
+	server.nodeViridianPayload = SERVER_VIRIDIAN_PAYLOAD
+
+	tiers, err := parsePayloadTiers(SERVER_TIERS)
+	if err != nil {
+		test.Fatalf("error parsing payload tiers: %v", err)
+	}
+	server.nodeTiers = tiers
+
+	authenticate := func(payload string) (*generated.UserToken, error) {
+		request := &generated.WhirlpoolAuthenticationRequest{Uid: SERVER_STATS_VIRIDIAN_UID, Session: createTestSession(test), Payload: payload}
+		response, err := server.Authenticate(context.Background(), request)
+		if err != nil {
+			return nil, err
+		}
+		return server.decryptToken(response.Token)
+	}
+
+	owner, err := authenticate(SERVER_OWNER_PAYLOAD)
+	if err != nil || !owner.Privileged || owner.Subscription != nil || owner.Bandwidth != nil {
+		test.Fatalf("owner token doesn't match expected: %v (%v)", owner, err)
+	}
+
+	viridian, err := authenticate(SERVER_VIRIDIAN_PAYLOAD)
+	if err != nil || viridian.Privileged || viridian.Subscription != nil || viridian.Bandwidth != nil {
+		test.Fatalf("viridian token doesn't match expected: %v (%v)", viridian, err)
+	}
+
+	gold, err := authenticate(SERVER_GOLD_PAYLOAD)
+	if err != nil || gold.Privileged || gold.Subscription == nil || gold.Bandwidth == nil || *gold.Bandwidth != 1000 {
+		test.Fatalf("gold tier token doesn't match expected: %v (%v)", gold, err)
+	}
+	if remaining := time.Until(gold.Subscription.AsTime()); remaining <= 59*time.Minute || remaining > time.Hour {
+		test.Fatalf("gold tier subscription doesn't match session length: %v", remaining)
+	}
+
+	silver, err := authenticate(SERVER_SILVER_PAYLOAD)
+	if err != nil || silver.Privileged || silver.Subscription == nil || silver.Bandwidth != nil {
+		test.Fatalf("silver tier token doesn't match expected: %v (%v)", silver, err)
+	}
+	if remaining := time.Until(silver.Subscription.AsTime()); remaining <= 9*time.Minute || remaining > 10*time.Minute {
+		test.Fatalf("silver tier subscription doesn't match session length: %v", remaining)
+	}
+
+	if _, err := authenticate(SERVER_UNKNOWN_PAYLOAD); status.Code(err) != codes.PermissionDenied {
+		test.Fatalf("authentication with unknown payload not rejected: %v", err)
+	}
+}
+
+func TestAuthenticateNullCipher(test *testing.T) {
+	server := createTestServer(test)
+	server.nodeViridianPayload = SERVER_VIRIDIAN_PAYLOAD
+
+	authenticate := func(suite string) (*generated.UserToken, error) {
+		request := &generated.WhirlpoolAuthenticationRequest{Uid: SERVER_STATS_VIRIDIAN_UID, Session: createTestSession(test), Payload: SERVER_VIRIDIAN_PAYLOAD, Cipher: &suite}
+		response, err := server.Authenticate(context.Background(), request)
+		if err != nil {
+			return nil, err
+		}
+		return server.decryptToken(response.Token)
+	}
+
+	if _, err := authenticate(crypto.CIPHER_NULL); status.Code(err) != codes.PermissionDenied {
+		test.Fatalf("null cipher not refused while not allowed: %v", err)
+	}
+	if _, err := authenticate(SERVER_UNKNOWN_CIPHER); status.Code(err) != codes.InvalidArgument {
+		test.Fatalf("unknown cipher not refused: %v", err)
+	}
+
+	server.allowNullCipher = true
+	token, err := authenticate(crypto.CIPHER_NULL)
+	if err != nil || token.GetCipher() != crypto.CIPHER_NULL {
+		test.Fatalf("null cipher token doesn't match expected: %v (%v)", token, err)
+	}
+
+	aead, err := crypto.ParseSuiteCipher(token.GetCipher(), token.Session)
+	if err != nil || aead.Overhead() != 0 {
+		test.Fatalf("null cipher not parsed from token: %v", err)
+	}
+}
+
+func TestAuthenticateRoutes(test *testing.T) {
+	server := createTestServer(test)
+	server.nodeViridianPayload = SERVER_VIRIDIAN_PAYLOAD
+
+	routes := []string{SERVER_SPLIT_ROUTE}
+	request := &generated.WhirlpoolAuthenticationRequest{Uid: SERVER_STATS_VIRIDIAN_UID, Session: createTestSession(test), Payload: SERVER_VIRIDIAN_PAYLOAD, Routes: routes}
+	response, err := server.Authenticate(context.Background(), request)
+	if err != nil {
+		test.Fatalf("error authenticating split tunnel viridian: %v", err)
+	}
+
+	token, err := server.decryptToken(response.Token)
+	if err != nil || len(token.Routes) != 1 || token.Routes[0] != SERVER_SPLIT_ROUTE {
+		test.Fatalf("token routes don't match requested: %v (%v)", token, err)
+	}
+
+	request.Routes = []string{SERVER_INVALID_ROUTE}
+	if _, err := server.Authenticate(context.Background(), request); status.Code(err) != codes.InvalidArgument {
+		test.Fatalf("invalid route not rejected: %v", err)
+	}
+
+	// Routes outside the allowed routes are rejected, full tunnel is restricted to the allowed routes
+	server.allowedRoutes = []string{SERVER_SPLIT_ROUTE}
+	request.Routes = []string{SERVER_DISALLOWED_ROUTE}
+	if _, err := server.Authenticate(context.Background(), request); status.Code(err) != codes.PermissionDenied {
+		test.Fatalf("route outside allowed routes not rejected: %v", err)
+	}
+
+	request.Routes = nil
+	response, err = server.Authenticate(context.Background(), request)
+	if err != nil {
+		test.Fatalf("error authenticating full tunnel viridian: %v", err)
+	}
+	token, err = server.decryptToken(response.Token)
+	if err != nil || len(token.Routes) != 1 || token.Routes[0] != SERVER_SPLIT_ROUTE {
+		test.Fatalf("full tunnel token routes not restricted to allowed routes: %v (%v)", token, err)
+	}
+}
+
+func TestAuthenticateCapabilities(test *testing.T) {
+	server := createTestServer(test)
+	server.nodeViridianPayload = SERVER_VIRIDIAN_PAYLOAD
+	defer func() { utils.TAIL_DISABLED = false }()
+
+	authenticate := func() *generated.NodeCapabilities {
+		request := &generated.WhirlpoolAuthenticationRequest{Uid: SERVER_STATS_VIRIDIAN_UID, Session: createTestSession(test), Payload: SERVER_VIRIDIAN_PAYLOAD}
+		response, err := server.Authenticate(context.Background(), request)
+		if err != nil {
+			test.Fatalf("error authenticating viridian: %v", err)
+		}
+		return response.Capabilities
+	}
+
+	capabilities := authenticate()
+	if len(capabilities.Ciphers) != 1 || capabilities.Ciphers[0] != crypto.CIPHER_XCHACHA20_POLY1305 || !capabilities.Tails || !capabilities.SplitTunnel {
+		test.Fatalf("default capabilities don't match configuration: %v", capabilities)
+	}
+	if len(capabilities.Protocols) != len(SUPPORTED_PROTOCOLS) || capabilities.PowDifficulty != 0 || capabilities.MaxConcurrentAuth != 0 {
+		test.Fatalf("default capabilities advertise disabled features: %v", capabilities)
+	}
+
+	connectionPuzzle, err := newPuzzle(SERVER_POW_DIFFICULTY)
+	if err != nil {
+		test.Fatalf("error creating connection puzzle: %v", err)
+	}
+	server.puzzle = connectionPuzzle
+	server.authLimiter = newAuthLimiter(SERVER_AUTH_CONCURRENCY, 0, time.Second)
+	server.allowNullCipher = true
+	utils.TAIL_DISABLED = true
+
+	capabilities = authenticate()
+	if len(capabilities.Ciphers) != 2 || capabilities.Ciphers[1] != crypto.CIPHER_NULL || capabilities.Tails {
+		test.Fatalf("capabilities don't match changed cipher and tail configuration: %v", capabilities)
+	}
+	if capabilities.PowDifficulty != SERVER_POW_DIFFICULTY || capabilities.MaxConcurrentAuth != SERVER_AUTH_CONCURRENCY {
+		test.Fatalf("capabilities don't match changed admission configuration: %v", capabilities)
+	}
+}
+
+func TestAuthenticateWeakSession(test *testing.T) {
+	server := createTestServer(test)
+	server.nodeViridianPayload = SERVER_VIRIDIAN_PAYLOAD
+
+	request := &generated.WhirlpoolAuthenticationRequest{Uid: SERVER_STATS_VIRIDIAN_UID, Session: make([]byte, chacha20poly1305.KeySize), Payload: SERVER_VIRIDIAN_PAYLOAD}
+	if _, err := server.Authenticate(context.Background(), request); status.Code(err) != codes.InvalidArgument {
+		test.Fatalf("authentication with all-zero session key not rejected: %v", err)
+	}
+}
+
+func TestGetBuildInfo(test *testing.T) {
+	server := createTestServer(test)
+
+	request := &generated.BuildInfoRequest{Token: createTestToken(test, server, SERVER_STATS_VIRIDIAN_UID, false)}
+	if _, err := server.GetBuildInfo(context.Background(), request); status.Code(err) != codes.PermissionDenied {
+		test.Fatalf("build information request with non-privileged token not rejected: %v", err)
+	}
+
+	request = &generated.BuildInfoRequest{Token: createTestToken(test, server, SERVER_STATS_ADMIN_UID, true)}
+	response, err := server.GetBuildInfo(context.Background(), request)
+	if err != nil {
+		test.Fatalf("error requesting build information: %v", err)
+	}
+	test.Logf("build information received: %v", response)
+
+	if response.Version != VERSION || response.GoVersion != runtime.Version() {
+		test.Fatalf("build information doesn't match compiled: %s (%s) != %s (%s)", response.Version, response.GoVersion, VERSION, runtime.Version())
+	}
+	if response.Commit != BUILD_COMMIT || response.BuildTime != BUILD_TIME {
+		test.Fatalf("build metadata doesn't match compiled: %s (%s) != %s (%s)", response.Commit, response.BuildTime, BUILD_COMMIT, BUILD_TIME)
+	}
+}
+
+func TestHandshakeCancelled(test *testing.T) {
+	server := createTestServer(test)
+	address := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}}
+	request := &generated.ControlConnectionRequest{Version: VERSION, Token: []byte("invalid_token")}
+
+	requestCtx, requestCancel := context.WithCancel(peer.NewContext(context.Background(), address))
+	requestCancel()
+	if _, err := server.Connect(requestCtx, request); status.Code(err) != codes.Canceled {
+		test.Fatalf("cancelled connection request not aborted: %v", err)
+	}
+
+	base, baseCancel := context.WithCancel(context.Background())
+	server.base = base
+	baseCancel()
+
+	if _, err := server.Connect(peer.NewContext(context.Background(), address), request); status.Code(err) != codes.Unavailable {
+		test.Fatalf("connection request not aborted during shutdown: %v", err)
+	}
+
+	authentication := &generated.WhirlpoolAuthenticationRequest{Uid: SERVER_STATS_VIRIDIAN_UID, Payload: SERVER_VIRIDIAN_PAYLOAD}
+	if _, err := server.Authenticate(context.Background(), authentication); status.Code(err) != codes.Unavailable {
+		test.Fatalf("authentication request not aborted during shutdown: %v", err)
+	}
+}
+
+func TestAuthFailureWarning(test *testing.T) {
+	server := createTestServer(test)
+	server.authFailures = newAuthFailureTracker(SERVER_AUTH_FAILURE_THRESHOLD, time.Minute, time.Minute)
+	attacker := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 12345}}
+	bystander := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 2), Port: 12345}}
+	request := &generated.ControlConnectionRequest{Version: VERSION, Token: []byte("invalid_token")}
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	for i := 0; i < SERVER_AUTH_FAILURE_THRESHOLD; i++ {
+		if _, err := server.Connect(peer.NewContext(context.Background(), attacker), request); status.Code(err) != codes.InvalidArgument {
+			test.Fatalf("invalid token not rejected: %v", err)
+		}
+	}
+
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel && entry.Data["event"] == "auth_failures" {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		test.Fatalf("unexpected authentication failure warning number: %d", warnings)
+	}
+
+	if _, err := server.Connect(peer.NewContext(context.Background(), attacker), request); status.Code(err) != codes.ResourceExhausted {
+		test.Fatalf("connection request from blocked source not rejected: %v", err)
+	}
+	if _, err := server.Connect(peer.NewContext(context.Background(), bystander), request); status.Code(err) != codes.InvalidArgument {
+		test.Fatalf("connection request from other source rejected: %v", err)
+	}
+}
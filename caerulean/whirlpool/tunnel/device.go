@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/songgao/water"
+)
+
+// Tunnel device type that transfers IP packets.
+const DEVICE_TUN = "tun"
+
+// Tunnel device type that transfers Ethernet frames.
+const DEVICE_TAP = "tap"
+
+// Ethernet frame header length: destination and source MAC addresses and EtherType.
+const ETHERNET_HEADER_LENGTH = 14
+
+// EtherType of IPv4 packets.
+const ETHERTYPE_IPV4 = 0x0800
+
+// Locally administered MAC address, used as a source of the frames written to TAP device.
+var DEVICE_MAC = net.HardwareAddr{0x02, 0x53, 0x45, 0x41, 0x00, 0x01}
+
+// Tunnel device structure.
+// Reads and writes IP packets regardless of the underlying device type:
+// for TUN devices packets are passed as is, for TAP devices Ethernet headers are stripped and added.
+type Device struct {
+	// Underlying TUN or TAP device.
+	iface *water.Interface
+
+	// MAC address of TAP interface, destination of the frames written to it (nil for TUN devices).
+	mac net.HardwareAddr
+
+	// Buffer for frames read from TAP device.
+	readBuffer []byte
+
+	// Buffer for frames written to TAP device.
+	writeBuffer []byte
+
+	// Mutex for TAP frame reading.
+	readMutex sync.Mutex
+
+	// Mutex for TAP frame writing.
+	writeMutex sync.Mutex
+}
+
+// Create tunnel device wrapper.
+// Accept underlying device and MAC address of TAP interface (should be nil for TUN devices).
+// Return tunnel device pointer.
+func newDevice(iface *water.Interface, mac net.HardwareAddr) *Device {
+	device := &Device{iface: iface, mac: mac}
+	if mac != nil {
+		device.readBuffer = make([]byte, ETHERNET_HEADER_LENGTH+math.MaxUint16)
+		device.writeBuffer = make([]byte, ETHERNET_HEADER_LENGTH+math.MaxUint16)
+	}
+	return device
+}
+
+// Parse tunnel device type.
+// Accept device type name ("tun" or "tap").
+// Return water device type and nil if parsed successfully, otherwise 0 and error.
+func parseDeviceType(name string) (water.DeviceType, error) {
+	switch name {
+	case DEVICE_TUN:
+		return water.TUN, nil
+	case DEVICE_TAP:
+		return water.TAP, nil
+	default:
+		return 0, fmt.Errorf("unknown tunnel device type: %s", name)
+	}
+}
+
+// Strip Ethernet header from frame.
+// Accept Ethernet frame bytes.
+// Return frame payload, true if it is an IPv4 packet and nil if frame is valid, otherwise nil, false and error.
+func stripEthernet(frame []byte) ([]byte, bool, error) {
+	if len(frame) < ETHERNET_HEADER_LENGTH {
+		return nil, false, fmt.Errorf("frame length %d too short (less than Ethernet header length %d)", len(frame), ETHERNET_HEADER_LENGTH)
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:ETHERNET_HEADER_LENGTH])
+	return frame[ETHERNET_HEADER_LENGTH:], etherType == ETHERTYPE_IPV4, nil
+}
+
+// Add Ethernet header to IPv4 packet.
+// Accept buffer for the frame (should be at least Ethernet header length longer than packet), destination MAC address and IPv4 packet bytes.
+// Return Ethernet frame bytes (slice of the buffer).
+func addEthernet(buffer []byte, destination net.HardwareAddr, packet []byte) []byte {
+	copy(buffer[0:6], destination)
+	copy(buffer[6:12], DEVICE_MAC)
+	binary.BigEndian.PutUint16(buffer[12:ETHERNET_HEADER_LENGTH], ETHERTYPE_IPV4)
+	return buffer[:ETHERNET_HEADER_LENGTH+copy(buffer[ETHERNET_HEADER_LENGTH:], packet)]
+}
+
+// Read IP packet from tunnel device.
+// For TAP devices, Ethernet header is stripped, payloads of non-IPv4 frames are returned as is (so that they can be classified and dropped).
+// Should be applied for Device object.
+// Accept buffer for the packet.
+// Return number of bytes read and nil if successful, otherwise number of bytes read and error.
+func (device *Device) Read(packet []byte) (int, error) {
+	if device.mac == nil {
+		return device.iface.Read(packet)
+	}
+
+	device.readMutex.Lock()
+	defer device.readMutex.Unlock()
+
+	r, err := device.iface.Read(device.readBuffer)
+	if err != nil {
+		return 0, err
+	}
+	payload, _, err := stripEthernet(device.readBuffer[:r])
+	if err != nil {
+		return 0, err
+	}
+	return copy(packet, payload), nil
+}
+
+// Write IPv4 packet to tunnel device.
+// For TAP devices, Ethernet header addressed to the TAP interface is added.
+// Should be applied for Device object.
+// Accept packet bytes.
+// Return number of packet bytes written and nil if successful, otherwise number of bytes written and error.
+func (device *Device) Write(packet []byte) (int, error) {
+	if device.mac == nil {
+		return device.iface.Write(packet)
+	}
+
+	device.writeMutex.Lock()
+	defer device.writeMutex.Unlock()
+
+	s, err := device.iface.Write(addEthernet(device.writeBuffer, device.mac, packet))
+	if s >= ETHERNET_HEADER_LENGTH {
+		s -= ETHERNET_HEADER_LENGTH
+	}
+	return s, err
+}
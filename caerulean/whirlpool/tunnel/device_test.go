@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/songgao/water"
+)
+
+// Ethernet frame (broadcast destination) with IPv4 header of a UDP packet (10.0.0.1 -> 10.0.0.2, no payload).
+const DEVICE_SAMPLE_FRAME = "ffffffffffff0253454100010800" + "4500001c000040004011267c0a0000010a000002" + "0035003500080000"
+
+func TestStripEthernet(test *testing.T) {
+	frame, err := hex.DecodeString(DEVICE_SAMPLE_FRAME)
+	if err != nil {
+		test.Fatalf("error decoding sample frame: %v", err)
+	}
+
+	packet, ipv4, err := stripEthernet(frame)
+	if err != nil || !ipv4 {
+		test.Fatalf("error stripping IPv4 frame (IPv4: %t): %v", ipv4, err)
+	}
+	if !bytes.Equal(packet, frame[ETHERNET_HEADER_LENGTH:]) || packet[0]>>4 != 4 {
+		test.Fatalf("stripped frame payload doesn't match IPv4 packet: %x", packet)
+	}
+
+	arp := append([]byte(nil), frame...)
+	arp[12], arp[13] = 0x08, 0x06
+	if _, ipv4, err := stripEthernet(arp); err != nil || ipv4 {
+		test.Fatalf("ARP frame stripped as IPv4 (IPv4: %t): %v", ipv4, err)
+	}
+
+	if _, _, err := stripEthernet(frame[:ETHERNET_HEADER_LENGTH-1]); err == nil {
+		test.Fatal("truncated frame stripped successfully")
+	}
+}
+
+func TestAddEthernet(test *testing.T) {
+	frame, err := hex.DecodeString(DEVICE_SAMPLE_FRAME)
+	if err != nil {
+		test.Fatalf("error decoding sample frame: %v", err)
+	}
+	packet := frame[ETHERNET_HEADER_LENGTH:]
+
+	buffer := make([]byte, len(frame))
+	rebuilt := addEthernet(buffer, frame[0:6], packet)
+	if !bytes.Equal(rebuilt, frame) {
+		test.Fatalf("rebuilt frame doesn't match sample frame: %x != %x", rebuilt, frame)
+	}
+}
+
+func TestParseDeviceType(test *testing.T) {
+	if deviceType, err := parseDeviceType(DEVICE_TUN); err != nil || deviceType != water.TUN {
+		test.Fatalf("TUN device type parsed incorrectly: %v (%v)", deviceType, err)
+	}
+	if deviceType, err := parseDeviceType(DEVICE_TAP); err != nil || deviceType != water.TAP {
+		test.Fatalf("TAP device type parsed incorrectly: %v (%v)", deviceType, err)
+	}
+	if _, err := parseDeviceType("tut"); err == nil {
+		test.Fatal("unknown device type parsed successfully")
+	}
+}
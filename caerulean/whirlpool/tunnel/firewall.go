@@ -1,8 +1,12 @@
 package tunnel
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"main/utils"
+	"net"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -28,6 +32,94 @@ func readLimit(envVar, template string, userNumber, burstMultiplier int) []strin
 	}
 }
 
+// Create per-viridian flow limit iptable rule (as a string array).
+// New connections forwarded from tunnel interface are counted per source address (every viridian has its own tunnel source address).
+// Connections above the limit are dropped, other viridians are not affected.
+// Accept tunnel and external interface names and maximum number of concurrent flows per viridian.
+// Return rule string array or nil if limit is not positive (no limit should be applied).
+func flowLimitRule(tunIface, extName string, limit int) []string {
+	if limit <= 0 {
+		return nil
+	}
+	return []string{"-A", "FORWARD", "-i", tunIface, "-o", extName, "-m", "conntrack", "--ctstate", "NEW", "-m", "connlimit", "--connlimit-above", strconv.Itoa(limit), "--connlimit-mask", "32", "--connlimit-saddr", "-j", "DROP"}
+}
+
+// Create asymmetric routing iptable rules (as string arrays).
+// Replies of the forwarded flows are expected to arrive on external interface, if a packet of an established flow
+// arrives on another interface (e.g. because of multi-uplink misconfiguration), it is logged (rate limited) and then accepted or dropped.
+// Only established flows are matched, new connections from other interfaces are still dropped by forwarding policy.
+// Accept tunnel and external interface names and asymmetric routing policy.
+// Return rule string arrays or nil if policy is empty (asymmetric packets are silently dropped by forwarding policy).
+func asymmetricRoutingRules(tunIface, extName, policy string) [][]string {
+	if policy == "" {
+		return nil
+	}
+
+	target := "DROP"
+	if policy == ASYMMETRIC_ROUTING_ACCEPT {
+		target = "ACCEPT"
+	}
+
+	match := []string{"-A", "FORWARD", "!", "-i", extName, "-o", tunIface, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED"}
+	return [][]string{
+		utils.ConcatSlices(match, []string{"-m", "limit", "--limit", ASYMMETRIC_ROUTING_LOG_LIMIT, "-j", "LOG", "--log-prefix", ASYMMETRIC_ROUTING_LOG_PREFIX}),
+		utils.ConcatSlices(match, []string{"-j", target}),
+	}
+}
+
+// Kernel connection tracking table, contains all the tracked flows, one per line.
+const CONNTRACK_TABLE = "/proc/net/nf_conntrack"
+
+// Count connection tracking table flows originating from the given source address.
+// Only the original direction source ("src=" field that comes first) of every flow is compared.
+// Accept connection tracking table reader and flow source address.
+// Return number of flows and nil if table was read, otherwise 0 and error.
+func countConntrackFlows(table io.Reader, source net.IP) (uint64, error) {
+	original := "src=" + source.String()
+
+	flows := uint64(0)
+	scanner := bufio.NewScanner(table)
+	for scanner.Scan() {
+		for _, field := range strings.Fields(scanner.Text()) {
+			if strings.HasPrefix(field, "src=") {
+				if field == original {
+					flows++
+				}
+				break
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading connection tracking table: %v", err)
+	}
+	return flows, nil
+}
+
+// Count currently tracked flows of a viridian, the same flows are limited by flow limit rule.
+// Accept viridian tunnel source address.
+// Return number of flows and nil if connection tracking table was read, otherwise 0 and error.
+func CountFlows(source net.IP) (uint64, error) {
+	table, err := os.Open(CONNTRACK_TABLE)
+	if err != nil {
+		return 0, fmt.Errorf("error opening connection tracking table: %v", err)
+	}
+	defer table.Close()
+	return countConntrackFlows(table, source)
+}
+
+// Create masquerade iptable rule (as a string array).
+// In deterministic mode source ports are preserved whenever possible, in random mode they are randomized.
+// Accept external interface name and flag whether source port randomization should be enabled.
+// Return rule string array.
+func masqueradeRule(extName string, random bool) []string {
+	rule := []string{"-t", "nat", "-A", "POSTROUTING", "-o", extName, "-j", "MASQUERADE"}
+	if random {
+		rule = append(rule, "--random")
+	}
+	return rule
+}
+
 // Store iptables configuration.
 // Use iptables-store command to store iptables configurations as bytes.
 // Should be applied for TunnelConf object, store the configurations in .buffer field.
@@ -43,14 +135,11 @@ func (conf *TunnelConfig) storeForwarding() {
 // Setup iptables configuration for VPN usage.
 // First, flush all iptables rules, setup allowed incoming packet patters and drop all the other packets.
 // Then, setup forwarding from external to tunnel interface and back, also enabling masquerade for external interface outputs.
+// Tunnel interface is not required to exist, so that the firewall can be configured independently.
 // Should be applied for TunnelConf object.
-// Accept internal and external IP addresses as strings, seaside, network and control ports as integers.
+// Accept tunnel interface name, internal and external IP addresses as strings, control ports as integers.
 // Return error if configuration was not successful, nil otherwise.
-func (conf *TunnelConfig) openForwarding(intIP, extIP string, ctrlPort int) error {
-	// Prepare interface names and port numbers as strings
-	tunIface := conf.Tunnel.Name()
-	ctrlStr := strconv.Itoa(ctrlPort)
-
+func (conf *TunnelConfig) openForwarding(tunIface, intIP, extIP string, ctrlPorts []int) error {
 	// Find internal network interface name
 	intIface, err := findInterfaceByIP(intIP)
 	if err != nil {
@@ -81,18 +170,33 @@ func (conf *TunnelConfig) openForwarding(intIP, extIP string, ctrlPort int) erro
 	runCommand("iptables", "-A", "OUTPUT", "-p", "tcp", "--sport", "22", "-m", "conntrack", "--ctstate", "ESTABLISHED", "-j", "ACCEPT")
 	// Accept packets to port network, control and whirlpool ports, also accept PING packets
 	runCommand("iptables", utils.ConcatSlices([]string{"-A", "INPUT", "-p", "udp", "-d", intIP, "-i", intName}, conf.vpnDataKbyteLimitRule)...)
-	runCommand("iptables", utils.ConcatSlices([]string{"-A", "INPUT", "-p", "tcp", "-d", intIP, "--dport", ctrlStr, "-i", intName}, conf.controlPacketLimitRule)...)
+	for _, ctrlPort := range ctrlPorts {
+		runCommand("iptables", utils.ConcatSlices([]string{"-A", "INPUT", "-p", "tcp", "-d", intIP, "--dport", strconv.Itoa(ctrlPort), "-i", intName}, conf.controlPacketLimitRule)...)
+	}
 	runCommand("iptables", utils.ConcatSlices([]string{"-A", "INPUT", "-p", "icmp", "-d", intIP, "-i", intName}, conf.icmpPacketPACKETLimitRules)...)
 	// Else drop all input packets
 	runCommand("iptables", "-P", "INPUT", "DROP")
+	// Limit number of concurrent flows per viridian
+	if rule := flowLimitRule(tunIface, extName, conf.flowLimit); rule != nil {
+		runCommand("iptables", rule...)
+	}
 	// Enable forwarding from tunnel interface to external interface (forward)
 	runCommand("iptables", "-A", "FORWARD", "-i", tunIface, "-o", extName, "-j", "ACCEPT")
 	// Enable forwarding from external interface to tunnel interface (backward)
 	runCommand("iptables", "-A", "FORWARD", "-i", extName, "-o", tunIface, "-j", "ACCEPT")
+	// Log and handle replies arriving on other interfaces than external one (asymmetric routing)
+	for _, rule := range asymmetricRoutingRules(tunIface, extName, conf.asymmetricRouting) {
+		runCommand("iptables", rule...)
+	}
 	// Drop all other forwarding packets (e.g. from external interface to external interface)
 	runCommand("iptables", "-P", "FORWARD", "DROP")
 	// Enable masquerade on all non-claimed output and input from and to external interface
-	runCommand("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", extName, "-j", "MASQUERADE")
+	runCommand("iptables", masqueradeRule(extName, conf.masqueradeRandom)...)
+
+	// Read back and log installed rules, if requested
+	if conf.logFirewall {
+		logrus.Infof("Installed firewall rules:\n%s", readableRules(FirewallRules()))
+	}
 
 	// Return no error
 	logrus.Infof("Forwarding configured: %s <-> %s <-> %s", intName, tunIface, extName)
@@ -111,3 +215,75 @@ func (conf *TunnelConfig) closeForwarding() {
 		logrus.Errorf("Error running command %s: %v", command, err)
 	}
 }
+
+// Remove VPN iptables configuration.
+// Flush all iptables rules and reset default policies changed by forwarding setup.
+func clearForwarding() {
+	runCommand("iptables", "-F")
+	runCommand("iptables", "-t", "raw", "-F")
+	runCommand("iptables", "-t", "nat", "-F")
+	runCommand("iptables", "-t", "mangle", "-F")
+	runCommand("iptables", "-P", "INPUT", "ACCEPT")
+	runCommand("iptables", "-P", "FORWARD", "ACCEPT")
+}
+
+// Setup iptables configuration for VPN usage without tunnel interface allocation.
+// IPs and control port numbers are read from environment variables, same as in Open.
+// The previous configuration is not stored, so it won't be restored.
+// Should be applied for TunnelConf object.
+// Accept tunnel interface name.
+// Return error if configuration was not successful, nil otherwise.
+func (conf *TunnelConfig) ApplyFirewall(tunIface string) error {
+	conf.mutex.Lock()
+	defer conf.mutex.Unlock()
+
+	intIP := utils.GetEnv("SEASIDE_ADDRESS")
+	extIP := utils.GetEnv("SEASIDE_EXTERNAL")
+	ctrlPorts := utils.GetControlPorts()
+	return conf.openForwarding(tunIface, intIP, extIP, ctrlPorts)
+}
+
+// Remove iptables configuration for VPN usage, leaving all the packets accepted.
+func ClearFirewall() {
+	clearForwarding()
+}
+
+// Get current iptables configuration.
+// Return configuration in iptables-save format.
+func FirewallRules() string {
+	return runCommand("iptables-save")
+}
+
+// Get current iptables configuration in readable form, for audit.
+// Rules are read back from the kernel, so the configuration actually installed is returned.
+// Return readable configuration, one table, chain or rule per line.
+func ReadableFirewallRules() string {
+	return readableRules(FirewallRules())
+}
+
+// Format iptables configuration for logging.
+// Comments, commit lines and packet counters are removed, tables, chain policies and rules are preserved.
+// Accept configuration in iptables-save format.
+// Return readable configuration, one table, chain or rule per line.
+func readableRules(save string) string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(save, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "COMMIT" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Remove packet counters of chains (suffix) and rules (prefix, if counters were requested)
+		if strings.HasPrefix(line, ":") {
+			if counters := strings.LastIndex(line, " ["); counters != -1 {
+				line = line[:counters]
+			}
+		} else if strings.HasPrefix(line, "[") {
+			if counters := strings.Index(line, "] "); counters != -1 {
+				line = line[counters+2:]
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,6 +1,27 @@
 package tunnel
 
-import "testing"
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const FIREWALL_TUNNEL_INTERFACE = "tun_test"
+
+const FIREWALL_SAVED_RULES = `# Generated by iptables-save v1.8.7 on Thu Jan  1 00:00:00 1970
+*filter
+:INPUT DROP [12:3456]
+:FORWARD DROP [0:0]
+:OUTPUT ACCEPT [78:9012]
+[5:420] -A INPUT -i lo -j ACCEPT
+-A FORWARD -i tun_test -o eth0 -j ACCEPT
+COMMIT
+# Completed on Thu Jan  1 00:00:00 1970
+*nat
+:POSTROUTING ACCEPT [0:0]
+-A POSTROUTING -o eth0 -j MASQUERADE
+COMMIT
+`
 
 func TestStoreForwardingCycle(test *testing.T) {
 	var conf TunnelConfig
@@ -26,3 +47,139 @@ func TestStoreForwardingCycle(test *testing.T) {
 		test.Fatalf("IP tables were not restored: %s != %s", aftersave, beforesave)
 	}
 }
+
+func TestMasqueradeRule(test *testing.T) {
+	deterministic := masqueradeRule("eth0", false)
+	test.Logf("deterministic masquerade rule: %v", deterministic)
+	for _, arg := range deterministic {
+		if arg == "--random" {
+			test.Fatalf("deterministic masquerade rule randomizes ports: %v", deterministic)
+		}
+	}
+
+	random := masqueradeRule("eth0", true)
+	test.Logf("random masquerade rule: %v", random)
+	if random[len(random)-1] != "--random" {
+		test.Fatalf("random masquerade rule doesn't randomize ports: %v", random)
+	}
+}
+
+func TestFlowLimitRule(test *testing.T) {
+	if rule := flowLimitRule("tun0", "eth0", -1); rule != nil {
+		test.Fatalf("flow limit rule created while limit is disabled: %v", rule)
+	}
+
+	rule := flowLimitRule("tun0", "eth0", 100)
+	test.Logf("flow limit rule: %v", rule)
+
+	expected := "-A FORWARD -i tun0 -o eth0 -m conntrack --ctstate NEW -m connlimit --connlimit-above 100 --connlimit-mask 32 --connlimit-saddr -j DROP"
+	if strings.Join(rule, " ") != expected {
+		test.Fatalf("flow limit rule doesn't match expected: %v != %s", rule, expected)
+	}
+}
+
+func TestAsymmetricRoutingRules(test *testing.T) {
+	if rules := asymmetricRoutingRules("tun0", "eth0", ""); rules != nil {
+		test.Fatalf("asymmetric routing rules created while policy is disabled: %v", rules)
+	}
+
+	match := "-A FORWARD ! -i eth0 -o tun0 -m conntrack --ctstate ESTABLISHED,RELATED"
+	for policy, target := range map[string]string{ASYMMETRIC_ROUTING_DROP: "DROP", ASYMMETRIC_ROUTING_ACCEPT: "ACCEPT"} {
+		rules := asymmetricRoutingRules("tun0", "eth0", policy)
+		test.Logf("asymmetric routing rules (policy %s): %v", policy, rules)
+		if len(rules) != 2 {
+			test.Fatalf("unexpected number of asymmetric routing rules: %d", len(rules))
+		}
+
+		logRule := strings.Join(rules[0], " ")
+		if !strings.HasPrefix(logRule, match) || !strings.Contains(logRule, "-j LOG --log-prefix "+ASYMMETRIC_ROUTING_LOG_PREFIX) || !strings.Contains(logRule, "--limit "+ASYMMETRIC_ROUTING_LOG_LIMIT) {
+			test.Fatalf("asymmetric routing log rule doesn't match expected: %s", logRule)
+		}
+
+		expected := match + " -j " + target
+		if policyRule := strings.Join(rules[1], " "); policyRule != expected {
+			test.Fatalf("asymmetric routing policy rule doesn't match expected: %s != %s", policyRule, expected)
+		}
+	}
+}
+
+func TestApplyClearFirewall(test *testing.T) {
+	conf := TunnelConfig{}
+	conf.storeForwarding()
+	defer conf.closeForwarding()
+
+	if err := conf.ApplyFirewall(FIREWALL_TUNNEL_INTERFACE); err != nil {
+		test.Fatalf("error applying firewall rules: %v", err)
+	}
+
+	applied := FirewallRules()
+	test.Logf("IP tables configuration after applying: %s", applied)
+	if !strings.Contains(applied, "-A FORWARD -i "+FIREWALL_TUNNEL_INTERFACE) || !strings.Contains(applied, ":INPUT DROP") {
+		test.Fatalf("forwarding rules were not applied: %s", applied)
+	}
+
+	ClearFirewall()
+
+	cleared := FirewallRules()
+	test.Logf("IP tables configuration after clearing: %s", cleared)
+	if strings.Contains(cleared, FIREWALL_TUNNEL_INTERFACE) || strings.Contains(cleared, ":INPUT DROP") {
+		test.Fatalf("forwarding rules were not cleared: %s", cleared)
+	}
+}
+
+func TestReadableFirewallRules(test *testing.T) {
+	conf := TunnelConfig{}
+	conf.storeForwarding()
+	defer conf.closeForwarding()
+
+	if err := conf.ApplyFirewall(FIREWALL_TUNNEL_INTERFACE); err != nil {
+		test.Fatalf("error applying firewall rules: %v", err)
+	}
+
+	dump := ReadableFirewallRules()
+	test.Logf("readable IP tables configuration after applying: %s", dump)
+	for _, expected := range []string{"*filter", ":INPUT DROP", ":FORWARD DROP", "-A FORWARD -i " + FIREWALL_TUNNEL_INTERFACE, "*nat", "-j MASQUERADE"} {
+		if !strings.Contains(dump, expected) {
+			test.Fatalf("readable rules don't contain expected entry %q: %s", expected, dump)
+		}
+	}
+	if strings.Contains(dump, "COMMIT") || strings.Contains(dump, "# ") {
+		test.Fatalf("readable rules contain iptables-save service lines: %s", dump)
+	}
+}
+
+func TestReadableRules(test *testing.T) {
+	readable := readableRules(FIREWALL_SAVED_RULES)
+	expected := strings.Join([]string{
+		"*filter",
+		":INPUT DROP",
+		":FORWARD DROP",
+		":OUTPUT ACCEPT",
+		"-A INPUT -i lo -j ACCEPT",
+		"-A FORWARD -i tun_test -o eth0 -j ACCEPT",
+		"*nat",
+		":POSTROUTING ACCEPT",
+		"-A POSTROUTING -o eth0 -j MASQUERADE",
+	}, "\n")
+	if readable != expected {
+		test.Fatalf("readable rules don't match expected:\n%s\n!=\n%s", readable, expected)
+	}
+}
+
+func TestCountConntrackFlows(test *testing.T) {
+	table := strings.Join([]string{
+		"ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.2 dst=1.1.1.1 sport=40000 dport=443 src=1.1.1.1 dst=192.168.0.1 sport=443 dport=40000 [ASSURED] mark=0 zone=0 use=2",
+		"ipv4     2 udp      17 29 src=10.0.0.2 dst=8.8.8.8 sport=40001 dport=53 [UNREPLIED] src=8.8.8.8 dst=192.168.0.1 sport=53 dport=40001 mark=0 zone=0 use=2",
+		"ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.3 dst=1.1.1.1 sport=40002 dport=443 src=1.1.1.1 dst=192.168.0.1 sport=443 dport=40002 [ASSURED] mark=0 zone=0 use=2",
+		"ipv4     2 tcp      6 431999 ESTABLISHED src=1.1.1.1 dst=10.0.0.2 sport=443 dport=40003 src=10.0.0.2 dst=1.1.1.1 sport=40003 dport=443 [ASSURED] mark=0 zone=0 use=2",
+		"ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.20 dst=1.1.1.1 sport=40004 dport=443 src=1.1.1.1 dst=192.168.0.1 sport=443 dport=40004 [ASSURED] mark=0 zone=0 use=2",
+	}, "\n")
+
+	flows, err := countConntrackFlows(strings.NewReader(table), net.IPv4(10, 0, 0, 2))
+	if err != nil {
+		test.Fatalf("error counting flows: %v", err)
+	}
+	if flows != 2 {
+		test.Fatalf("unexpected flow number: %d != 2", flows)
+	}
+}
@@ -1,15 +1,20 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/songgao/water"
 )
 
 // Create and open tunnel interface.
 // Use "ip" commands ("link" and "addr") to setup tunnel configuration.
-// Use MTU value received from environment variable if it is >= 0, use MTU of external network interface otherwise.
+// Use MTU value received from environment variable if it is > 0, use MTU of external network interface otherwise.
+// External network interface MTU is stored in the config anyway, it is used for path MTU discovery.
 // Should be applied for TunnelConf object, receives tunnel configurations from it.
 // Accept external IP address as a string.
 // Return nil if interface opened successfully, error otherwise.
@@ -19,18 +24,33 @@ func (conf *TunnelConfig) openInterface(extIP string) error {
 	tunnelString := conf.IP.String()
 	tunnelCIDR, _ := conf.Network.Mask.Size()
 
-	// Receive MTU from environment or use MTU of external network interface and cast it to string
+	// Receive MTU of external network interface
+	externalInterface, err := findInterfaceByIP(extIP)
+	if err != nil {
+		return fmt.Errorf("error resolving network addresses: %v", err)
+	}
+	conf.ExternalMTU = externalInterface.MTU
+
+	// Receive MTU from environment or use MTU of external network interface (limited by maximal tunnel MTU, e.g. for loopback)
 	if conf.mtu <= 0 {
-		tunnelInterface, err := findInterfaceByIP(extIP)
-		if err != nil {
-			return fmt.Errorf("error resolving network addresses: %v", err)
+		conf.mtu = conf.ExternalMTU
+		if conf.mtu > MAX_TUNNEL_MTU {
+			conf.mtu = MAX_TUNNEL_MTU
 		}
-		conf.mtu = tunnelInterface.MTU
+	}
+
+	// Check MTU (jumbo frames are supported if configured) and cast it to string
+	if err := checkTunnelMTU(conf.mtu); err != nil {
+		return err
 	}
 	tunnelMTU := strconv.Itoa(conf.mtu)
 
 	// Setup tunnel interface MTU
 	runCommand("ip", "link", "set", "dev", tunnelName, "mtu", tunnelMTU)
+	// Disable ARP for TAP interface, there is nobody to resolve viridian addresses
+	if conf.deviceType == water.TAP {
+		runCommand("ip", "link", "set", "dev", tunnelName, "arp", "off")
+	}
 	// Setup IP address for tunnel interface
 	runCommand("ip", "addr", "add", fmt.Sprintf("%s/%d", tunnelString, tunnelCIDR), "dev", tunnelName)
 	// Enable tunnel interfaces
@@ -55,3 +75,89 @@ func (conf *TunnelConfig) closeInterface() {
 	// Log interface closed
 	logrus.Infof("Interface %s closed", tunnelName)
 }
+
+// Check that tunnel interface exists, is up and has tunnel IP address, repair the interface if possible.
+// Interface is brought up and tunnel IP address is added if necessary.
+// Deleted interface can not be recreated, because the TUN device is in use.
+// Should be applied for TunnelConf object, config mutex should be locked.
+// Return nil if interface is healthy or was repaired, error otherwise.
+func (conf *TunnelConfig) checkInterface() error {
+	// Find tunnel interface
+	tunnelName := conf.Tunnel.Name()
+	tunnelInterface, err := net.InterfaceByName(tunnelName)
+	if err != nil {
+		return fmt.Errorf("tunnel interface %s not found (can not be recreated while in use): %v", tunnelName, err)
+	}
+
+	// Bring tunnel interface up if it is down
+	if tunnelInterface.Flags&net.FlagUp == 0 {
+		logrus.Warnf("Interface %s is down, bringing it up", tunnelName)
+		if err := tryCommand("ip", "link", "set", "dev", tunnelName, "up"); err != nil {
+			return fmt.Errorf("error bringing tunnel interface %s up: %v", tunnelName, err)
+		}
+	}
+
+	// Receive tunnel interface addresses
+	addrs, err := tunnelInterface.Addrs()
+	if err != nil {
+		return fmt.Errorf("error resolving tunnel interface %s addresses: %v", tunnelName, err)
+	}
+
+	// Check tunnel IP address is assigned to tunnel interface
+	for _, addr := range addrs {
+		if ip, ok := addr.(*net.IPNet); ok && ip.IP.Equal(conf.IP) {
+			return nil
+		}
+	}
+
+	// Add tunnel IP address to tunnel interface
+	tunnelCIDR, _ := conf.Network.Mask.Size()
+	logrus.Warnf("Interface %s has no address %s, adding it", tunnelName, conf.IP.String())
+	if err := tryCommand("ip", "addr", "add", fmt.Sprintf("%s/%d", conf.IP.String(), tunnelCIDR), "dev", tunnelName); err != nil {
+		return fmt.Errorf("error adding address to tunnel interface %s: %v", tunnelName, err)
+	}
+
+	// Return no error
+	return nil
+}
+
+// Get tunnel interface health status.
+// Should be applied for TunnelConf object.
+// Return nil if tunnel interface was healthy during the last check, error otherwise.
+func (conf *TunnelConfig) Healthy() error {
+	conf.mutex.Lock()
+	defer conf.mutex.Unlock()
+	return conf.health
+}
+
+// Check tunnel interface periodically, repair it if possible and store health status.
+// Check interval is read from SEASIDE_TUNNEL_CHECK_INTERVAL environment variable, checks are disabled if it is not positive.
+// Should be applied for TunnelConf object.
+// Accept context for graceful termination.
+// NB! this method is blocking, so it should be run as goroutine.
+func (conf *TunnelConfig) Monitor(ctx context.Context) {
+	if conf.checkInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(conf.checkInterval)
+	defer ticker.Stop()
+
+	logrus.Debug("Tunnel interface monitoring started")
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Debug("Tunnel interface monitoring stopped")
+			return
+		case <-ticker.C:
+			conf.mutex.Lock()
+			if ctx.Err() == nil {
+				conf.health = conf.checkInterface()
+				if conf.health != nil {
+					logrus.Errorf("Tunnel interface unhealthy: %v", conf.health)
+				}
+			}
+			conf.mutex.Unlock()
+		}
+	}
+}
@@ -56,3 +56,53 @@ func TestOpenInterfaceCycle(test *testing.T) {
 		test.Fatalf("tunnel interface found after deletion: %v", tunnelClosedIface.Index)
 	}
 }
+
+func TestCheckInterfaceRepair(test *testing.T) {
+	tunIP, tunNetwork, err := net.ParseCIDR("10.0.0.26/24")
+	if err != nil {
+		test.Fatalf("error parsing tunnel network address (%s): %v", tunIP, err)
+	}
+
+	tun, err := water.New(water.Config{DeviceType: water.TUN})
+	if err != nil {
+		test.Fatalf("error allocating TUN interface: %v", err)
+	}
+	defer tun.Close()
+
+	conf := TunnelConfig{
+		Tunnel:  tun,
+		IP:      tunIP,
+		Network: tunNetwork,
+		mtu:     OPEN_INTERFACE_CYCLE_MTU,
+	}
+	conf.openInterface("127.0.0.1")
+	defer conf.closeInterface()
+
+	runCommand("ip", "link", "set", "dev", conf.Tunnel.Name(), "down")
+	runCommand("ip", "addr", "flush", "dev", conf.Tunnel.Name())
+
+	brokenIface, err := net.InterfaceByName(conf.Tunnel.Name())
+	if err != nil {
+		test.Fatalf("tunnel interface not found: %v", err)
+	}
+	if (brokenIface.Flags & net.FlagUp) != 0 {
+		test.Fatal("tunnel interface is still up")
+	}
+
+	if err := conf.checkInterface(); err != nil {
+		test.Fatalf("error repairing tunnel interface: %v", err)
+	}
+
+	repairedIface, err := net.InterfaceByName(conf.Tunnel.Name())
+	if err != nil {
+		test.Fatalf("tunnel interface not found: %v", err)
+	}
+	if (repairedIface.Flags & net.FlagUp) == 0 {
+		test.Fatal("tunnel interface was not brought up")
+	}
+
+	addrs, err := repairedIface.Addrs()
+	if err != nil || len(addrs) == 0 || !addrs[0].(*net.IPNet).IP.Equal(tunIP) {
+		test.Fatalf("tunnel interface address was not restored: %v (%v)", addrs, err)
+	}
+}
@@ -6,11 +6,31 @@ import (
 	"main/utils"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/songgao/water"
 )
 
-// Tunnel IP address, also serves as gateway address for tunnel network interface.
+// Masquerade mode that preserves packet source ports whenever possible.
+const MASQUERADE_DETERMINISTIC = "deterministic"
+
+// Masquerade mode that randomizes packet source ports.
+const MASQUERADE_RANDOM = "random"
+
+// Asymmetric routing policy that logs and drops replies arriving on unexpected interfaces.
+const ASYMMETRIC_ROUTING_DROP = "drop"
+
+// Asymmetric routing policy that logs and accepts replies arriving on unexpected interfaces.
+const ASYMMETRIC_ROUTING_ACCEPT = "accept"
+
+// Log prefix of replies arriving on unexpected interfaces (visible in kernel log).
+const ASYMMETRIC_ROUTING_LOG_PREFIX = "seaside asymmetric: "
+
+// Rate limit of logging replies arriving on unexpected interfaces.
+const ASYMMETRIC_ROUTING_LOG_LIMIT = "10/min"
+
+// Default tunnel IP address (can be overridden by SEASIDE_TUNNEL_NETWORK or SEASIDE_TUNNEL_GATEWAY), also serves as gateway address for tunnel network interface.
 // Last bits of the packet source network address are used to store state user information in "iptables" firewall.
 // Last 2 bytes of will be used for attributing packages belonging to different viridians.
 const TUNNEL_IP = "172.16.0.1/12"
@@ -21,9 +41,15 @@ type TunnelConfig struct {
 	// Mutex that will be enabled during all interface manipulations.
 	mutex sync.Mutex
 
-	// Tunnel interface for VPN packet forwarding, unix TUN device.
+	// Tunnel interface for VPN packet forwarding, unix TUN or TAP device.
 	Tunnel *water.Interface
 
+	// Tunnel device type (TUN or TAP).
+	deviceType water.DeviceType
+
+	// Tunnel device, reads and writes IP packets regardless of tunnel device type.
+	Device *Device
+
 	// Tunnel interface IP address.
 	IP net.IP
 
@@ -44,6 +70,30 @@ type TunnelConfig struct {
 
 	// Tunnel MTU.
 	mtu int
+
+	// External interface MTU.
+	ExternalMTU int
+
+	// Flag, whether masquerade should randomize source ports.
+	masqueradeRandom bool
+
+	// Asymmetric routing policy, "drop", "accept" or empty (replies arriving on unexpected interfaces are not logged).
+	asymmetricRouting string
+
+	// Flag, whether installed firewall rules should be read back and logged after setup.
+	logFirewall bool
+
+	// Maximum number of concurrent flows per viridian (no limit if not positive).
+	flowLimit int
+
+	// Maximum total number of viridians (including admins).
+	maxUsers int
+
+	// Tunnel interface health check interval (checks are disabled if not positive).
+	checkInterval time.Duration
+
+	// Tunnel interface health status: nil if it was healthy during the last check, error otherwise.
+	health error
 }
 
 // Preserve current iptables configuration in a TunnelConfig object.
@@ -56,12 +106,37 @@ func Preserve() *TunnelConfig {
 	controlPacketLimitRule := readLimit("SEASIDE_CONTROL_PACKET_LIMIT", "%d/sec", maxViridians, burstMultiplier)
 	icmpPacketPACKETLimitRules := readLimit("SEASIDE_ICMP_PACKET_LIMIT", "%d/sec", maxViridians, burstMultiplier)
 	mtu := utils.GetIntEnv("SEASIDE_TUNNEL_MTU")
+	flowLimit := utils.GetOptionalIntEnv("SEASIDE_VIRIDIAN_FLOW_LIMIT", -1)
+	logFirewall := utils.GetOptionalIntEnv("SEASIDE_LOG_FIREWALL", 0) != 0
+	checkInterval := time.Duration(utils.GetOptionalIntEnv("SEASIDE_TUNNEL_CHECK_INTERVAL", 10)) * time.Second
+
+	deviceType, err := parseDeviceType(utils.GetOptionalEnv("SEASIDE_TUNNEL_DEVICE", DEVICE_TUN))
+	if err != nil {
+		logrus.Fatalf("Error parsing tunnel device type: %v", err)
+	}
+
+	masqueradeMode := utils.GetOptionalEnv("SEASIDE_MASQUERADE_MODE", MASQUERADE_DETERMINISTIC)
+	if masqueradeMode != MASQUERADE_DETERMINISTIC && masqueradeMode != MASQUERADE_RANDOM {
+		logrus.Fatalf("Unknown masquerade mode: %s", masqueradeMode)
+	}
+
+	asymmetricRouting := utils.GetOptionalEnv("SEASIDE_ASYMMETRIC_ROUTING", "")
+	if asymmetricRouting != "" && asymmetricRouting != ASYMMETRIC_ROUTING_DROP && asymmetricRouting != ASYMMETRIC_ROUTING_ACCEPT {
+		logrus.Fatalf("Unknown asymmetric routing policy: %s", asymmetricRouting)
+	}
 
 	conf := TunnelConfig{
 		vpnDataKbyteLimitRule:      vpnDataKbyteLimitRule,
 		controlPacketLimitRule:     controlPacketLimitRule,
 		icmpPacketPACKETLimitRules: icmpPacketPACKETLimitRules,
 		mtu:                        mtu,
+		deviceType:                 deviceType,
+		masqueradeRandom:           masqueradeMode == MASQUERADE_RANDOM,
+		asymmetricRouting:          asymmetricRouting,
+		logFirewall:                logFirewall,
+		flowLimit:                  flowLimit,
+		maxUsers:                   maxViridians,
+		checkInterval:              checkInterval,
 	}
 
 	conf.mutex.Lock()
@@ -79,21 +154,52 @@ func (conf *TunnelConfig) Open() (err error) {
 	conf.mutex.Lock()
 	defer conf.mutex.Unlock()
 
-	// Parse IPs and control port number from environment variables
+	// Parse IPs and control port numbers from environment variables
 	intIP := utils.GetEnv("SEASIDE_ADDRESS")
 	extIP := utils.GetEnv("SEASIDE_EXTERNAL")
-	ctrlPort := utils.GetIntEnv("SEASIDE_CTRLPORT")
+	ctrlPorts := utils.GetControlPorts()
+	addressTimeout := time.Duration(utils.GetOptionalIntEnv("SEASIDE_ADDRESS_TIMEOUT", 0)) * time.Second
+
+	// Wait for internal and external addresses to be assigned to network interfaces
+	for _, address := range []string{intIP, extIP} {
+		_, err = waitForInterfaceByIP(address, addressTimeout)
+		if err != nil {
+			return fmt.Errorf("error waiting for network address: %v", err)
+		}
+	}
 
 	// Parse and initialize tunnel IP and network fields
-	conf.IP, conf.Network, err = net.ParseCIDR(TUNNEL_IP)
+	tunnelNetwork := utils.GetOptionalEnv("SEASIDE_TUNNEL_NETWORK", TUNNEL_IP)
+	conf.IP, conf.Network, err = net.ParseCIDR(tunnelNetwork)
 	if err != nil {
-		return fmt.Errorf("error parsing tunnel network address (%s): %v", TUNNEL_IP, err)
+		return fmt.Errorf("error parsing tunnel network address (%s): %v", tunnelNetwork, err)
+	}
+
+	// Override tunnel gateway address if it is configured separately
+	tunnelGateway := utils.GetOptionalEnv("SEASIDE_TUNNEL_GATEWAY", "")
+	if tunnelGateway != "" {
+		conf.IP = net.ParseIP(tunnelGateway)
+		if conf.IP == nil {
+			return fmt.Errorf("error parsing tunnel gateway address: %s", tunnelGateway)
+		}
 	}
 
-	// Create and open TUN device
-	conf.Tunnel, err = water.New(water.Config{DeviceType: water.TUN})
+	// Check tunnel gateway does not collide with viridian addresses
+	err = checkGatewayAddress(conf.IP, conf.Network)
 	if err != nil {
-		return fmt.Errorf("error allocating TUN interface: %v", err)
+		return fmt.Errorf("error checking tunnel gateway: %v", err)
+	}
+
+	// Check tunnel network is large enough for all the viridians
+	err = checkNetworkCapacity(conf.Network, conf.maxUsers)
+	if err != nil {
+		return fmt.Errorf("error checking tunnel network: %v", err)
+	}
+
+	// Create and open TUN or TAP device
+	conf.Tunnel, err = water.New(water.Config{DeviceType: conf.deviceType})
+	if err != nil {
+		return fmt.Errorf("error allocating tunnel interface: %v", err)
 	}
 
 	// Open tunnel interface
@@ -102,8 +208,19 @@ func (conf *TunnelConfig) Open() (err error) {
 		return fmt.Errorf("error creating tunnel interface: %v", err)
 	}
 
+	// Create tunnel device, TAP frames should be addressed to the TAP interface
+	var mac net.HardwareAddr
+	if conf.deviceType == water.TAP {
+		tunnelInterface, err := net.InterfaceByName(conf.Tunnel.Name())
+		if err != nil {
+			return fmt.Errorf("error resolving tunnel interface: %v", err)
+		}
+		mac = tunnelInterface.HardwareAddr
+	}
+	conf.Device = newDevice(conf.Tunnel, mac)
+
 	// Setup iptables forwarding rules
-	err = conf.openForwarding(intIP, extIP, ctrlPort)
+	err = conf.openForwarding(conf.Tunnel.Name(), intIP, extIP, ctrlPorts)
 	if err != nil {
 		return fmt.Errorf("error creating firewall rules: %v", err)
 	}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"main/utils"
+	"math"
 	"net"
+	"os"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // Execute console command.
@@ -25,6 +31,17 @@ func runCommand(cmd string, args ...string) string {
 	return string(output)
 }
 
+// Execute console command, that is allowed to fail.
+// Accept executable name and vararg command arguments.
+// Return nil if command was executed successfully, error containing command output otherwise.
+func tryCommand(cmd string, args ...string) error {
+	output, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command %s %v failed: %v (output: %s)", cmd, args, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
 // Find network interface by IP address.
 // Accept IP address as a string.
 // Return network interface pointer and nil if interface was found, otherwise nil and error.
@@ -56,6 +73,159 @@ func findInterfaceByIP(address string) (*net.Interface, error) {
 	return nil, errors.New("error finding suitable interface")
 }
 
+// Maximum interval between network interface address checks while waiting for an address.
+const ADDRESS_POLL_INTERVAL = time.Second
+
+// Netlink multicast group of IPv4 address notifications (not defined in "syscall" package).
+const RTMGRP_IPV4_IFADDR = 0x10
+
+// Subscribe to IPv4 address change notifications (netlink "RTMGRP_IPV4_IFADDR" group).
+// Return notification socket file and nil if subscribed successfully, otherwise nil and error.
+func subscribeAddressChanges() (*os.File, error) {
+	// Open non-blocking netlink socket, so that it can be closed while reading
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("error opening netlink socket: %v", err)
+	}
+
+	// Subscribe to IPv4 address notifications
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: RTMGRP_IPV4_IFADDR})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("error binding netlink socket: %v", err)
+	}
+
+	// Return socket file
+	return os.NewFile(uintptr(fd), "netlink"), nil
+}
+
+// Wait for network interface with given IP address to appear.
+// Interface addresses are checked on every netlink address notification and at least once per ADDRESS_POLL_INTERVAL.
+// Accept IP address as a string and maximum waiting time (address is checked once if it is not positive).
+// Return network interface pointer and nil if interface was found in time, otherwise nil and error.
+func waitForInterfaceByIP(address string, timeout time.Duration) (*net.Interface, error) {
+	deadline := time.Now().Add(timeout)
+
+	// Subscribe to address notifications, fall back to polling if not possible
+	notifications := make(chan struct{}, 1)
+	socket, err := subscribeAddressChanges()
+	if err != nil {
+		logrus.Warnf("Error subscribing to address changes, polling will be used: %v", err)
+	} else {
+		defer socket.Close()
+		go func() {
+			buffer := make([]byte, os.Getpagesize())
+			for {
+				if _, err := socket.Read(buffer); err != nil {
+					return
+				}
+				select {
+				case notifications <- struct{}{}:
+				default: // do nothing
+				}
+			}
+		}()
+	}
+
+	for {
+		// Check if interface with the address exists
+		iface, err := findInterfaceByIP(address)
+		if err == nil {
+			return iface, nil
+		}
+
+		// Check if waiting time is over
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("interface with address %s not found in %v: %v", address, timeout, err)
+		} else if remaining > ADDRESS_POLL_INTERVAL {
+			remaining = ADDRESS_POLL_INTERVAL
+		}
+
+		// Wait for address notification or poll interval
+		logrus.Infof("Waiting for interface with address %s...", address)
+		select {
+		case <-notifications:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// Check that tunnel network can accommodate all the viridians.
+// Viridian IDs are stored in the last 2 bytes of tunnel IP address, so the network should have at least 16 host bits.
+// Special IP addresses (network, gateway and broadcast) can not be assigned to viridians.
+// Accept tunnel network and maximum total number of viridians.
+// Return nil if network is large enough, error otherwise.
+func checkNetworkCapacity(network *net.IPNet, users int) error {
+	// Check network is IPv4 and has enough host bits for viridian IDs
+	ones, bits := network.Mask.Size()
+	if bits != net.IPv4len*8 {
+		return fmt.Errorf("tunnel network %v is not an IPv4 network", network)
+	} else if bits-ones < 16 {
+		return fmt.Errorf("tunnel network %v is too small: at least 16 host bits required, %d found", network, bits-ones)
+	}
+
+	// Check all the viridians fit into the network
+	capacity := math.MaxUint16 + 1 - len(utils.SPECIAL_IP_ADDRESSES)
+	if users > capacity {
+		return fmt.Errorf("tunnel network %v can not accommodate %d users (maximum: %d)", network, users, capacity)
+	}
+
+	// Return no error
+	return nil
+}
+
+// Minimal tunnel MTU, minimal MTU every IPv4 link should support.
+const MIN_TUNNEL_MTU = 68
+
+// Maximal tunnel MTU, every tunnel packet should fit into a single UDP datagram to viridian after encryption:
+// outer IPv4 (20 bytes) and UDP (8 bytes) headers, XChaCha20-Poly1305 nonce and authentication tag are added to it.
+const MAX_TUNNEL_MTU = math.MaxUint16 - 20 - 8 - chacha20poly1305.NonceSizeX - chacha20poly1305.Overhead
+
+// Check tunnel MTU is within supported bounds.
+// Accept tunnel MTU.
+// Return nil if MTU is supported, error otherwise.
+func checkTunnelMTU(mtu int) error {
+	if mtu < MIN_TUNNEL_MTU || mtu > MAX_TUNNEL_MTU {
+		return fmt.Errorf("tunnel MTU %d is out of supported bounds (%d - %d)", mtu, MIN_TUNNEL_MTU, MAX_TUNNEL_MTU)
+	}
+	return nil
+}
+
+// Check tunnel gateway address does not collide with viridian tunnel addresses.
+// Viridian tunnel addresses share the first 2 bytes of the tunnel network address, their last 2 bytes are viridian IDs.
+// Gateway address is only allowed to have these first 2 bytes if its last 2 bytes are a special IP address (e.g. "*.*.0.1").
+// Accept tunnel gateway address and tunnel network.
+// Return nil if gateway address is valid, error otherwise.
+func checkGatewayAddress(gateway net.IP, network *net.IPNet) error {
+	// Check gateway is an IPv4 host address inside of the tunnel network
+	gateway4 := gateway.To4()
+	if gateway4 == nil {
+		return fmt.Errorf("tunnel gateway %v is not an IPv4 address", gateway)
+	} else if !network.Contains(gateway4) {
+		return fmt.Errorf("tunnel gateway %v is not in tunnel network %v", gateway4, network)
+	}
+
+	// Check gateway is neither network nor broadcast address
+	network4 := network.IP.To4()
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = network4[i] | ^network.Mask[i]
+	}
+	if gateway4.Equal(network4) || gateway4.Equal(broadcast) {
+		return fmt.Errorf("tunnel gateway %v is not a host address of tunnel network %v", gateway4, network)
+	}
+
+	// Check gateway does not overlap viridian ID region
+	hostID := uint16(gateway4[2])<<8 | uint16(gateway4[3])
+	if gateway4[0] == network4[0] && gateway4[1] == network4[1] && !utils.IsSpecialIPAddress(hostID) {
+		return fmt.Errorf("tunnel gateway %v overlaps viridian addresses %d.%d.*.* (viridian ID %d)", gateway4, network4[0], network4[1], hostID)
+	}
+
+	// Return no error
+	return nil
+}
+
 // An empty type that would be stored for keeping TunnelConfig object in context.
 type tunnelConfigKey struct{}
 
@@ -1,8 +1,10 @@
 package tunnel
 
 import (
+	"math"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestRunCommand(test *testing.T) {
@@ -31,3 +33,95 @@ func TestFindInterfaceByIP(test *testing.T) {
 		test.Fatalf("found loopback doesn't match expected: %s != %s", loopbackFound.Name, loopbackExpected.Name)
 	}
 }
+
+func TestWaitForInterfaceByIP(test *testing.T) {
+	delayedAddress := "127.0.0.53"
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		runCommand("ip", "addr", "add", delayedAddress+"/32", "dev", "lo")
+	}()
+	defer runCommand("ip", "addr", "del", delayedAddress+"/32", "dev", "lo")
+
+	start := time.Now()
+	loopbackFound, err := waitForInterfaceByIP(delayedAddress, 5*time.Second)
+	if err != nil {
+		test.Fatalf("interface for ip %s not found: %v", delayedAddress, err)
+	}
+	test.Logf("found interface with name %s in %v", loopbackFound.Name, time.Since(start))
+
+	if loopbackFound.Name != "lo" {
+		test.Fatalf("found interface doesn't match expected: %s != lo", loopbackFound.Name)
+	}
+
+	if _, err := waitForInterfaceByIP("127.0.0.54", 100*time.Millisecond); err == nil {
+		test.Fatalf("interface for unassigned ip 127.0.0.54 found")
+	}
+}
+
+func TestCheckNetworkCapacity(test *testing.T) {
+	_, defaultNetwork, err := net.ParseCIDR(TUNNEL_IP)
+	if err != nil {
+		test.Fatalf("error parsing tunnel network address (%s): %v", TUNNEL_IP, err)
+	}
+
+	if err := checkNetworkCapacity(defaultNetwork, 15); err != nil {
+		test.Fatalf("default tunnel network capacity check failed: %v", err)
+	}
+
+	_, smallNetwork, err := net.ParseCIDR("10.0.0.1/24")
+	if err != nil {
+		test.Fatalf("error parsing tunnel network address: %v", err)
+	}
+
+	if err := checkNetworkCapacity(smallNetwork, 15); err == nil {
+		test.Fatalf("too small tunnel network accepted: %v", smallNetwork)
+	}
+
+	if err := checkNetworkCapacity(defaultNetwork, math.MaxUint16); err == nil {
+		test.Fatalf("too many users accepted for tunnel network: %d", math.MaxUint16)
+	}
+}
+
+func TestCheckGatewayAddress(test *testing.T) {
+	defaultGateway, defaultNetwork, err := net.ParseCIDR(TUNNEL_IP)
+	if err != nil {
+		test.Fatalf("error parsing tunnel network address (%s): %v", TUNNEL_IP, err)
+	}
+
+	if err := checkGatewayAddress(defaultGateway, defaultNetwork); err != nil {
+		test.Fatalf("default tunnel gateway check failed: %v", err)
+	}
+
+	if err := checkGatewayAddress(net.ParseIP("172.20.5.5"), defaultNetwork); err != nil {
+		test.Fatalf("tunnel gateway outside of viridian addresses rejected: %v", err)
+	}
+
+	for _, gateway := range []string{"172.16.128.3", "172.16.0.2", "172.16.0.0", "172.31.255.255", "10.0.0.1", "fd00::1"} {
+		if err := checkGatewayAddress(net.ParseIP(gateway), defaultNetwork); err == nil {
+			test.Fatalf("conflicting tunnel gateway accepted: %s", gateway)
+		}
+	}
+
+	conflictingGateway, conflictingNetwork, err := net.ParseCIDR("10.0.2.3/8")
+	if err != nil {
+		test.Fatalf("error parsing tunnel network address: %v", err)
+	}
+
+	if err := checkGatewayAddress(conflictingGateway, conflictingNetwork); err == nil {
+		test.Fatalf("tunnel gateway overlapping viridian addresses accepted: %v", conflictingGateway)
+	}
+}
+
+func TestCheckTunnelMTU(test *testing.T) {
+	for _, mtu := range []int{MIN_TUNNEL_MTU, 1500, 9000, MAX_TUNNEL_MTU} {
+		if err := checkTunnelMTU(mtu); err != nil {
+			test.Fatalf("supported tunnel MTU rejected: %v", err)
+		}
+	}
+
+	for _, mtu := range []int{MIN_TUNNEL_MTU - 1, MAX_TUNNEL_MTU + 1, math.MaxUint16 + 1} {
+		if err := checkTunnelMTU(mtu); err == nil {
+			test.Fatalf("unsupported tunnel MTU accepted: %d", mtu)
+		}
+	}
+}
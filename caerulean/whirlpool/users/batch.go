@@ -0,0 +1,118 @@
+package users
+
+import (
+	"fmt"
+	"math"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+// Maximum number of UDP datagrams read from viridian connection at once.
+// Every batch slot reserves a 64KB buffer per viridian, so batch size is kept small (it should never exceed kernel `UIO_MAXIOV` limit of 1024 anyway).
+const MAX_READ_BATCH_SIZE = 64
+
+// Check viridian packet read batch size.
+// Batch size should not be negative and should not exceed MAX_READ_BATCH_SIZE (0 and 1 disable batching).
+// Accept batch size.
+// Return nil if batch size is valid, otherwise error.
+func checkReadBatchSize(batchSize int) error {
+	if batchSize < 0 {
+		return fmt.Errorf("read batch size should not be negative: %d", batchSize)
+	} else if batchSize > MAX_READ_BATCH_SIZE {
+		return fmt.Errorf("read batch size is too large: %d (maximum: %d)", batchSize, MAX_READ_BATCH_SIZE)
+	}
+	return nil
+}
+
+// Viridian packet reader structure.
+// Reads UDP datagrams from viridian connection either one by one or in batches (using `recvmmsg` where supported).
+type packetReader struct {
+	// Viridian connection, packets are read from it.
+	connection *net.UDPConn
+
+	// Batch connection wrapper, nil if packets are read one by one.
+	batch *ipv4.PacketConn
+
+	// Message buffers, reused for every read.
+	messages []ipv4.Message
+
+	// Number of zero-length datagrams dropped, they are never valid packets.
+	empty uint64
+}
+
+// Create viridian packet reader.
+// If batch size is greater than 1, datagrams will be read in batches of that size (at most MAX_READ_BATCH_SIZE), otherwise one by one.
+// Accept viridian connection and batch size.
+// Return packet reader pointer.
+func newPacketReader(connection *net.UDPConn, batchSize int) *packetReader {
+	// Single read fallback requires one message only
+	if batchSize < 1 {
+		batchSize = 1
+	} else if batchSize > MAX_READ_BATCH_SIZE {
+		batchSize = MAX_READ_BATCH_SIZE
+	}
+
+	// Allocate buffers for all the messages in batch
+	messages := make([]ipv4.Message, batchSize)
+	for i := range messages {
+		messages[i].Buffers = [][]byte{make([]byte, math.MaxUint16)}
+	}
+
+	// Create batch connection wrapper only if batching requested
+	reader := &packetReader{
+		connection: connection,
+		messages:   messages,
+	}
+	if batchSize > 1 {
+		reader.batch = ipv4.NewPacketConn(connection)
+	}
+
+	// Return reader pointer
+	return reader
+}
+
+// Read next packets from viridian connection.
+// Block until at least one datagram is available, then call handler for every non-empty datagram read.
+// Packet slice passed to handler is only valid until the handler returns.
+// Should be applied for packetReader object.
+// Accept datagram handler function.
+// Return number of datagrams read and nil if successful, otherwise 0 and error.
+func (reader *packetReader) read(handler func(packet []byte, address *net.UDPAddr)) (int, error) {
+	// Read single datagram if batching is disabled
+	if reader.batch == nil {
+		buffer := reader.messages[0].Buffers[0]
+		r, address, err := reader.connection.ReadFromUDP(buffer)
+		if err != nil {
+			return 0, err
+		}
+		reader.handle(handler, buffer[:r], address)
+		return 1, nil
+	}
+
+	// Read batch of datagrams
+	number, err := reader.batch.ReadBatch(reader.messages, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// Handle every datagram in batch
+	for _, message := range reader.messages[:number] {
+		address, _ := message.Addr.(*net.UDPAddr)
+		reader.handle(handler, message.Buffers[0][:message.N], address)
+	}
+	return number, nil
+}
+
+// Pass datagram to handler, dropping it if it is empty.
+// Should be applied for packetReader object.
+// Accept datagram handler function, datagram bytes and sender address.
+func (reader *packetReader) handle(handler func(packet []byte, address *net.UDPAddr), packet []byte, address *net.UDPAddr) {
+	if len(packet) == 0 {
+		reader.empty++
+		logrus.Debugf("Empty datagram from %v dropped (%d dropped in total)", address, reader.empty)
+		return
+	}
+	handler(packet, address)
+}
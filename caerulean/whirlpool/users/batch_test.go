@@ -0,0 +1,142 @@
+package users
+
+import (
+	"net"
+	"testing"
+)
+
+const (
+	PACKET_READER_FLOOD_PACKET_SIZE = 1024
+	PACKET_READER_BATCH_SIZE        = 32
+)
+
+func floodLoopbackUDP(benchmark *testing.B) (*net.UDPConn, func()) {
+	address, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	if err != nil {
+		benchmark.Fatalf("error resolving local address: %v", err)
+	}
+
+	listener, err := net.ListenUDP("udp4", address)
+	if err != nil {
+		benchmark.Fatalf("error resolving connection (%s): %v", address.String(), err)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		benchmark.Fatalf("error dialing connection (%s): %v", listener.LocalAddr().String(), err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		packet := make([]byte, PACKET_READER_FLOOD_PACKET_SIZE)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				sender.Write(packet)
+			}
+		}
+	}()
+
+	return listener, func() {
+		close(done)
+		sender.Close()
+		listener.Close()
+	}
+}
+
+func benchmarkPacketReader(benchmark *testing.B, batchSize int) {
+	listener, stop := floodLoopbackUDP(benchmark)
+	defer stop()
+
+	received := 0
+	reader := newPacketReader(listener, batchSize)
+	handler := func(packet []byte, address *net.UDPAddr) {
+		if len(packet) != PACKET_READER_FLOOD_PACKET_SIZE {
+			benchmark.Fatalf("unexpected packet size received: %d != %d", len(packet), PACKET_READER_FLOOD_PACKET_SIZE)
+		}
+		received++
+	}
+
+	benchmark.ResetTimer()
+	for received < benchmark.N {
+		if _, err := reader.read(handler); err != nil {
+			benchmark.Fatalf("error reading packets: %v", err)
+		}
+	}
+}
+
+func BenchmarkPacketReaderSingle(benchmark *testing.B) {
+	benchmarkPacketReader(benchmark, 1)
+}
+
+func BenchmarkPacketReaderBatched(benchmark *testing.B) {
+	benchmarkPacketReader(benchmark, PACKET_READER_BATCH_SIZE)
+}
+
+func TestPacketReaderEmptyDatagram(test *testing.T) {
+	for _, batchSize := range []int{1, PACKET_READER_BATCH_SIZE} {
+		listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			test.Fatalf("error listening to local address: %v", err)
+		}
+		defer listener.Close()
+
+		sender, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			test.Fatalf("error dialing connection (%s): %v", listener.LocalAddr().String(), err)
+		}
+		defer sender.Close()
+
+		if _, err := sender.Write(nil); err != nil {
+			test.Fatalf("error sending empty datagram: %v", err)
+		}
+		if _, err := sender.Write(make([]byte, PACKET_READER_FLOOD_PACKET_SIZE)); err != nil {
+			test.Fatalf("error sending datagram: %v", err)
+		}
+
+		packets := 0
+		reader := newPacketReader(listener, batchSize)
+		handler := func(packet []byte, address *net.UDPAddr) {
+			if len(packet) != PACKET_READER_FLOOD_PACKET_SIZE {
+				test.Fatalf("unexpected packet size received (batch size %d): %d != %d", batchSize, len(packet), PACKET_READER_FLOOD_PACKET_SIZE)
+			}
+			packets++
+		}
+		for packets == 0 {
+			if _, err := reader.read(handler); err != nil {
+				test.Fatalf("error reading packets (batch size %d): %v", batchSize, err)
+			}
+		}
+
+		if reader.empty != 1 {
+			test.Fatalf("empty datagram not dropped (batch size %d): %d dropped", batchSize, reader.empty)
+		}
+	}
+}
+
+func TestCheckReadBatchSize(test *testing.T) {
+	for _, batchSize := range []int{0, 1, PACKET_READER_BATCH_SIZE, MAX_READ_BATCH_SIZE} {
+		if err := checkReadBatchSize(batchSize); err != nil {
+			test.Fatalf("valid read batch size rejected (%d): %v", batchSize, err)
+		}
+	}
+
+	for _, batchSize := range []int{-1, MAX_READ_BATCH_SIZE + 1, 1024} {
+		if err := checkReadBatchSize(batchSize); err == nil {
+			test.Fatalf("invalid read batch size accepted: %d", batchSize)
+		}
+	}
+
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		test.Fatalf("error listening to local address: %v", err)
+	}
+	defer listener.Close()
+
+	reader := newPacketReader(listener, MAX_READ_BATCH_SIZE+1)
+	if len(reader.messages) != MAX_READ_BATCH_SIZE {
+		test.Fatalf("read batch size not capped: %d != %d", len(reader.messages), MAX_READ_BATCH_SIZE)
+	}
+}
@@ -0,0 +1,59 @@
+package users
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Socket buffer sizes of viridian connection.
+type socketBuffers struct {
+	// Socket receive buffer size (bytes).
+	read int
+
+	// Socket send buffer size (bytes).
+	write int
+}
+
+// Get socket buffer sizes of viridian connection.
+// NB! Linux reports doubled buffer sizes (including bookkeeping overhead).
+// Accept viridian connection.
+// Return socket buffer sizes and nil if successful, otherwise empty buffer sizes and error.
+func getSocketBuffers(connection *net.UDPConn) (socketBuffers, error) {
+	raw, err := connection.SyscallConn()
+	if err != nil {
+		return socketBuffers{}, fmt.Errorf("error accessing raw connection: %v", err)
+	}
+
+	// Read buffer sizes from socket options
+	var buffers socketBuffers
+	var optionErr error
+	err = raw.Control(func(fd uintptr) {
+		buffers.read, optionErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if optionErr == nil {
+			buffers.write, optionErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		}
+	})
+	if err != nil {
+		return socketBuffers{}, fmt.Errorf("error controlling raw connection: %v", err)
+	} else if optionErr != nil {
+		return socketBuffers{}, fmt.Errorf("error reading socket buffer sizes: %v", optionErr)
+	}
+
+	// Return buffer sizes
+	return buffers, nil
+}
+
+// Set socket buffer sizes of viridian connection.
+// Sizes are halved before setting, so that Linux doubling is compensated and the sizes match values returned by getSocketBuffers.
+// Accept viridian connection and socket buffer sizes.
+// Return nil if successful, error otherwise.
+func setSocketBuffers(connection *net.UDPConn, buffers socketBuffers) error {
+	if err := connection.SetReadBuffer(buffers.read / 2); err != nil {
+		return fmt.Errorf("error setting socket receive buffer size: %v", err)
+	}
+	if err := connection.SetWriteBuffer(buffers.write / 2); err != nil {
+		return fmt.Errorf("error setting socket send buffer size: %v", err)
+	}
+	return nil
+}
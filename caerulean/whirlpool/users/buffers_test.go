@@ -0,0 +1,51 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	BUFFERS_IDLE_TIMEOUT = time.Minute
+	BUFFERS_IDLE_SIZE    = 4096
+)
+
+func TestIdleBufferShrink(test *testing.T) {
+	viridian := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	defer viridian.stop(DISCONNECT_REQUESTED)
+
+	original, err := getSocketBuffers(viridian.SeaConn)
+	if err != nil {
+		test.Fatalf("error reading connection buffer sizes: %v", err)
+	}
+	test.Logf("original connection buffer sizes: %v", original)
+	viridian.buffers = original
+
+	viridian.touch()
+	if viridian.shrinkIfIdle(BUFFERS_IDLE_TIMEOUT, BUFFERS_IDLE_SIZE) {
+		test.Fatalf("active viridian buffers were shrunk")
+	}
+
+	viridian.lastActive = time.Now().Add(-2 * BUFFERS_IDLE_TIMEOUT).UnixNano()
+	if !viridian.shrinkIfIdle(BUFFERS_IDLE_TIMEOUT, BUFFERS_IDLE_SIZE) {
+		test.Fatalf("idle viridian buffers were not shrunk")
+	}
+
+	shrunk, err := getSocketBuffers(viridian.SeaConn)
+	if err != nil {
+		test.Fatalf("error reading connection buffer sizes: %v", err)
+	}
+	test.Logf("shrunk connection buffer sizes: %v", shrunk)
+	if shrunk.read >= original.read || shrunk.write >= original.write {
+		test.Fatalf("connection buffers were not shrunk: %v >= %v", shrunk, original)
+	}
+
+	viridian.touch()
+	restored, err := getSocketBuffers(viridian.SeaConn)
+	if err != nil {
+		test.Fatalf("error reading connection buffer sizes: %v", err)
+	}
+	if restored != original {
+		test.Fatalf("connection buffers were not restored: %v != %v", restored, original)
+	}
+}
@@ -2,6 +2,8 @@ package users
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"main/crypto"
 	"main/generated"
@@ -10,6 +12,7 @@ import (
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -17,9 +20,18 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// Interval of viridian dictionary consistency audit.
+const DICTIONARY_AUDIT_INTERVAL = time.Minute
+
 // Viridian dictionary wrapper structure.
 // Consists of the dictionary itself and limits that should be applied to users.
 type ViridianDict struct {
+	// Numbers of tunnel packets dropped as unsupported (non-IPv4), malformed and looping, should only be accessed atomically (placed first for 64-bit alignment).
+	unsupportedPackets, malformedPackets, loopingPackets uint64
+
+	// Number of viridian packets dropped because of IP total length mismatch, should only be accessed atomically.
+	mismatchedPackets uint64
+
 	// A multiplier for maximum healthcheck waiting time for viridian (before deletion).
 	viridianWaitingOvertime uint
 
@@ -32,25 +44,119 @@ type ViridianDict struct {
 	// Maximum number of privileged viridian (admin).
 	maxOverhead uint
 
+	// Flag, whether valid packets received from viridian count as healthchecks.
+	dataHealthcheck bool
+
+	// Maximum viridian connection lifetime, viridians are deleted after it regardless of subscription (not limited if zero).
+	maxLifetime time.Duration
+
+	// Flag, whether privileged viridians are exempt from maximum connection lifetime.
+	lifetimeExemptAdmins bool
+
+	// Tolerated difference between node clock and subscription issuer clock, subscriptions expire later by this value.
+	clockSkew time.Duration
+
+	// Maximum number of bytes tolerated after IP total length of viridian packets (negative disables length check).
+	maxPacketPadding int
+
+	// Number of times viridian connection creation is retried before the viridian is rejected.
+	listenRetries int
+
+	// Number of UDP datagrams read from viridian connection at once (1 disables batching).
+	readBatchSize int
+
+	// Flag, whether traffic counters should count wire bytes instead of payload bytes.
+	wireAccounting bool
+
+	// Tunnel interface IP address, used as a source of the generated ICMP packets.
+	tunnelIP net.IP
+
+	// External interface MTU, packets exceeding it with "don't fragment" flag set are not forwarded.
+	externalMTU int
+
+	// Fair tunnel write scheduler, shares tunnel egress between viridians.
+	scheduler *fairScheduler
+
+	// Minimal DSCP class of the packets prioritized by tunnel write scheduler (prioritization is disabled if 0).
+	priorityDSCP uint8
+
+	// Traffic mirror, receives copies of encrypted viridian packets (nil if mirroring is disabled).
+	mirror *Mirror
+
+	// Inactivity time after which viridian connection buffers are shrunk (disabled if not positive).
+	idleTimeout time.Duration
+
+	// Size of shrunk viridian connection buffers (bytes).
+	idleBufferSize int
+
+	// Flow exporter, receives all the forwarded packets (nil if flow export is disabled).
+	flows *FlowExporter
+
+	// Flow sampler, logs headers of a fraction of the forwarded packets (nil if sampling is disabled).
+	sampler *flowSampler
+
+	// Packet loop detector, checks packets read from tunnel (nil if loop detection is disabled).
+	loops *loopDetector
+
+	// Tracker of source addresses sending invalid packets, checked before decryption (nil if bad source blocking is disabled).
+	badSources *badSources
+
+	// ICMP type filter, checked for packets forwarded in both directions (nil if all ICMP types are forwarded).
+	icmpTypes *icmpFilter
+
+	// Reserved viridian IDs by viridian unique identifiers.
+	reservations map[string]uint16
+
+	// Viridian unique identifiers by reserved IDs.
+	reserved map[uint16]string
+
 	// The viridian dictionary itself.
 	entries map[uint16]*Viridian
 
-	// Mutex for viridian operations.
-	mutex sync.Mutex
+	// Viridian IDs by unique user identifiers, only one connection per identifier is allowed.
+	uniques map[string]uint16
+
+	// Viridian connections opened by the dictionary, connections without live viridians are closed by audit.
+	sockets map[uint16]*net.UDPConn
+
+	// Disconnect reasons of removed viridians by their IDs, reported to viridians that are still trying to use them.
+	departures map[uint16]DisconnectReason
+
+	// Mutex for viridian operations, lookups only take read lock, so that they don't block each other.
+	mutex sync.RWMutex
+}
+
+// Check viridian limits.
+// Both limits should not be negative and their sum should fit into the user ID space (excluding special IP addresses).
+// The sum is calculated using integers, so that it can not overflow.
+// Accept maximum viridian number and maximum admin number.
+// Return both limits and nil if limits are consistent, otherwise 0, 0 and error.
+func checkViridianLimits(maxViridians, maxAdmins int) (uint, uint, error) {
+	// Check individual limits
+	if maxViridians < 0 {
+		return 0, 0, fmt.Errorf("maximum viridian number should not be negative: %d", maxViridians)
+	} else if maxAdmins < 0 {
+		return 0, 0, fmt.Errorf("maximum admin number should not be negative: %d", maxAdmins)
+	}
+
+	// Check total limit
+	maxTotal := maxViridians + maxAdmins
+	if maxTotal > math.MaxUint16-len(utils.SPECIAL_IP_ADDRESSES) {
+		return 0, 0, fmt.Errorf("too many users requested: %d (maximum: %d)", maxTotal, math.MaxUint16-len(utils.SPECIAL_IP_ADDRESSES))
+	}
+
+	// Return limits and no error
+	return uint(maxViridians), uint(maxAdmins), nil
 }
 
 // Create viridian dictionary.
 // Will use limits from environment variables and TunnelConfig from context.
 // Accept context, return viridian dictionary pointer.
 func NewViridianDict(ctx context.Context) *ViridianDict {
-	// Retrieve limits from environment variables
-	maxViridians := uint16(utils.GetIntEnv("SEASIDE_MAX_VIRIDIANS"))
-	maxAdmins := uint16(utils.GetIntEnv("SEASIDE_MAX_ADMINS"))
-	maxTotal := maxViridians + maxAdmins
-
-	// Exit if limit configuration is inconsistant
-	if maxTotal > math.MaxUint16-3 {
-		logrus.Fatalf("Error initializing viridian array: too many users requested: %d", maxTotal)
+	// Retrieve limits from environment variables, exit if limit configuration is inconsistant
+	maxViridians, maxAdmins, err := checkViridianLimits(utils.GetIntEnv("SEASIDE_MAX_VIRIDIANS"), utils.GetIntEnv("SEASIDE_MAX_ADMINS"))
+	if err != nil {
+		logrus.Fatalf("Error initializing viridian array: %v", err)
 	}
 
 	// Retrieve time limits from environment variables
@@ -58,46 +164,230 @@ func NewViridianDict(ctx context.Context) *ViridianDict {
 	firstHealthcheckDelayMultiplier := uint(utils.GetIntEnv("SEASIDE_VIRIDIAN_FIRST_HEALTHCHECK_DELAY"))
 	firstHealthcheckDelay := time.Second * time.Duration(viridianWaitingOvertime*firstHealthcheckDelayMultiplier)
 
+	// Retrieve data plane healthcheck flag from environment variables
+	dataHealthcheck := utils.GetOptionalIntEnv("SEASIDE_DATA_HEALTHCHECK", 0) != 0
+
+	// Retrieve maximum connection lifetime from environment variables
+	maxLifetime := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_MAX_SESSION_LIFETIME", 0))
+	lifetimeExemptAdmins := utils.GetOptionalIntEnv("SEASIDE_SESSION_LIFETIME_EXEMPT_ADMINS", 0) != 0
+
+	// Retrieve clock skew tolerance from environment variables, check node clock if NTP server is provided
+	clockSkew := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_CLOCK_SKEW", 0))
+	if ntpServer := utils.GetOptionalEnv("SEASIDE_NTP_SERVER", ""); ntpServer != "" {
+		go utils.CheckClockOffset(ntpServer, clockSkew)
+	}
+
+	// Retrieve viridian connection retry number from environment variables
+	listenRetries := utils.GetOptionalIntEnv("SEASIDE_LISTEN_RETRIES", 2)
+
+	// Retrieve viridian packet length check padding from environment variables
+	maxPacketPadding := utils.GetOptionalIntEnv("SEASIDE_STRICT_PACKET_LENGTH", -1)
+
+	// Retrieve viridian packet read batch size from environment variables
+	readBatchSize := utils.GetOptionalIntEnv("SEASIDE_READ_BATCH_SIZE", 1)
+	if err := checkReadBatchSize(readBatchSize); err != nil {
+		logrus.Fatalf("Error configuring viridian packet reads: %v", err)
+	}
+
+	// Retrieve traffic accounting mode from environment variables
+	accountingMode := utils.GetOptionalEnv("SEASIDE_ACCOUNTING", ACCOUNTING_PAYLOAD)
+	if accountingMode != ACCOUNTING_PAYLOAD && accountingMode != ACCOUNTING_WIRE {
+		logrus.Fatalf("Unknown traffic accounting mode: %s", accountingMode)
+	}
+
+	// Retrieve idle connection buffer parameters from environment variables
+	idleTimeout := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_IDLE_BUFFER_TIMEOUT", 0))
+	idleBufferSize := utils.GetOptionalIntEnv("SEASIDE_IDLE_BUFFER_SIZE", 4096)
+
+	// Retrieve tunnel write queue parameters from environment variables
+	tunnelQueueDepth := utils.GetOptionalIntEnv("SEASIDE_TUNNEL_QUEUE_DEPTH", 64)
+	adminQueueWeight := utils.GetOptionalIntEnv("SEASIDE_ADMIN_QUEUE_WEIGHT", 1)
+	priorityDSCP := utils.GetOptionalIntEnv("SEASIDE_PRIORITY_DSCP", 0)
+	if priorityDSCP < 0 || priorityDSCP > DSCP_MAX {
+		logrus.Fatalf("Priority DSCP class should be between 0 and %d: %d", DSCP_MAX, priorityDSCP)
+	}
+
+	// Create packet loop detector if loop threshold is positive
+	var loops *loopDetector
+	loopThreshold := utils.GetOptionalIntEnv("SEASIDE_LOOP_THRESHOLD", 8)
+	if loopThreshold > math.MaxUint16 {
+		loopThreshold = math.MaxUint16
+	}
+	if loopThreshold > 0 {
+		loops = newLoopDetector(uint16(loopThreshold))
+	}
+
+	// Create bad source tracker if bad source threshold is positive
+	var sources *badSources
+	badSourceThreshold := utils.GetOptionalIntEnv("SEASIDE_BAD_SOURCE_THRESHOLD", 0)
+	if badSourceThreshold > 0 {
+		badSourceCooldown := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_BAD_SOURCE_COOLDOWN", 60))
+		sources = newBadSources(badSourceThreshold, badSourceCooldown)
+	}
+
+	// Parse forwarded ICMP types
+	icmpTypes, err := parseICMPFilter(utils.GetOptionalEnv("SEASIDE_ICMP_TYPES", DEFAULT_ICMP_TYPES))
+	if err != nil {
+		logrus.Fatalf("Error parsing forwarded ICMP types: %v", err)
+	}
+
+	// Parse viridian ID reservations
+	reservations, err := parseReservations(utils.GetOptionalEnv("SEASIDE_RESERVED_IDS", ""))
+	if err != nil {
+		logrus.Fatalf("Error parsing viridian ID reservations: %v", err)
+	}
+	reserved := make(map[uint16]string, len(reservations))
+	for uid, userID := range reservations {
+		reserved[userID] = uid
+	}
+
 	// Retrieve tunnel configurations from context
 	tunnelConfig, ok := tunnel.FromContext(ctx)
 	if !ok {
 		logrus.Fatalf("tunnel config not found in context: %v", ctx)
 	}
 
-	// Create viridian dictionary object and start sending packets to them
+	// Create traffic mirror if mirror target is configured
+	var mirror *Mirror
+	if mirrorTarget := utils.GetOptionalEnv("SEASIDE_MIRROR_TARGET", ""); mirrorTarget != "" {
+		mirror, err = NewMirror(ctx, mirrorTarget)
+		if err != nil {
+			logrus.Fatalf("Error initializing traffic mirror: %v", err)
+		}
+		logrus.Infof("Mirroring viridian packets to %s", mirrorTarget)
+	}
+
+	// Create flow exporter if flow collector is configured
+	var flows *FlowExporter
+	if flowCollector := utils.GetOptionalEnv("SEASIDE_NETFLOW_COLLECTOR", ""); flowCollector != "" {
+		flowInterval := time.Second * time.Duration(utils.GetOptionalIntEnv("SEASIDE_NETFLOW_INTERVAL", 60))
+		flows, err = NewFlowExporter(ctx, flowCollector, flowInterval)
+		if err != nil {
+			logrus.Fatalf("Error initializing flow exporter: %v", err)
+		}
+		logrus.Infof("Exporting flows to %s every %v", flowCollector, flowInterval)
+	}
+
+	// Create flow sampler if sample rate is positive
+	var sampler *flowSampler
+	if sampleRate := utils.GetOptionalIntEnv("SEASIDE_FLOW_SAMPLE_RATE", 0); sampleRate > 0 {
+		sampleLimit := utils.GetOptionalIntEnv("SEASIDE_FLOW_SAMPLE_LIMIT", 10)
+		sampler, err = newFlowSampler(uint64(sampleRate), sampleLimit)
+		if err != nil {
+			logrus.Fatalf("Error initializing flow sampler: %v", err)
+		}
+		logrus.Infof("Sampling one of %d forwarded packets (at most %d per second)", sampleRate, sampleLimit)
+	}
+
+	// Create viridian dictionary object, start writing packets to tunnel and sending packets to viridians
 	dict := ViridianDict{
 		viridianWaitingOvertime: viridianWaitingOvertime,
 		firstHealthcheckDelay:   firstHealthcheckDelay,
-		maxViridians:            uint(maxViridians),
-		maxOverhead:             uint(maxAdmins),
-		entries:                 make(map[uint16]*Viridian, maxTotal),
+		maxViridians:            maxViridians,
+		maxOverhead:             maxAdmins,
+		dataHealthcheck:         dataHealthcheck,
+		maxLifetime:             maxLifetime,
+		lifetimeExemptAdmins:    lifetimeExemptAdmins,
+		clockSkew:               clockSkew,
+		maxPacketPadding:        maxPacketPadding,
+		listenRetries:           listenRetries,
+		readBatchSize:           readBatchSize,
+		wireAccounting:          accountingMode == ACCOUNTING_WIRE,
+		tunnelIP:                tunnelConfig.IP,
+		externalMTU:             tunnelConfig.ExternalMTU,
+		scheduler:               newFairScheduler(tunnelQueueDepth, adminQueueWeight),
+		priorityDSCP:            uint8(priorityDSCP),
+		mirror:                  mirror,
+		flows:                   flows,
+		sampler:                 sampler,
+		loops:                   loops,
+		badSources:              sources,
+		icmpTypes:               icmpTypes,
+		reservations:            reservations,
+		reserved:                reserved,
+		idleTimeout:             idleTimeout,
+		idleBufferSize:          idleBufferSize,
+		entries:                 make(map[uint16]*Viridian, maxViridians+maxAdmins),
+		uniques:                 make(map[string]uint16, maxViridians+maxAdmins),
+		sockets:                 make(map[uint16]*net.UDPConn, maxViridians+maxAdmins),
+	}
+	go dict.scheduler.run(ctx, tunnelConfig.Device)
+	go dict.SendPacketsToViridians(ctx, tunnelConfig.Device, tunnelConfig.Network)
+	go dict.audit(ctx)
+	if idleTimeout > 0 {
+		go dict.shrinkIdleBuffers(ctx)
 	}
-	go dict.SendPacketsToViridians(ctx, tunnelConfig.Tunnel, tunnelConfig.Network)
 
 	// Return dictionary pointer
 	return &dict
 }
 
+// Calculate number of bytes that should be added to traffic counters for a packet, according to accounting mode.
+// Should be applied for ViridianDict object.
+// Accept packet payload (inner IP packet) and encrypted packet, as sent over the wire.
+// Return payload length in payload accounting mode, encrypted packet and outer headers length in wire accounting mode.
+func (dict *ViridianDict) accounted(payload, encrypted []byte) int {
+	if dict.wireAccounting {
+		return len(encrypted) + WIRE_HEADERS_LENGTH
+	} else {
+		return len(payload)
+	}
+}
+
+// Check if one more viridian can be connected.
+// Non-privileged viridians can only occupy viridian slots, privileged viridians can also occupy admin slots.
+// Both limits are checked with "not less", so that even if the dictionary somehow exceeds a limit, no more viridians are admitted.
+// Should be applied for ViridianDict object, dictionary mutex should be held by caller.
+// Accept number of connected viridians and flag if the new viridian is privileged.
+// Return nil if there is a slot available, gRPC status error otherwise.
+func (dict *ViridianDict) checkCapacity(connected int, privileged bool) error {
+	if !privileged && connected >= int(dict.maxViridians) {
+		return status.Error(codes.ResourceExhausted, "can not connect any more viridians")
+	} else if connected >= int(dict.maxViridians+dict.maxOverhead) {
+		return status.Error(codes.ResourceExhausted, "can not connect any more admins")
+	}
+	return nil
+}
+
+// Count connected viridians, except for the one with the given unique identifier (it will be replaced by reconnection).
+// Should be applied for ViridianDict object, dictionary mutex should be locked.
+// Accept viridian unique identifier.
+// Return number of connected viridians.
+func (dict *ViridianDict) connectedExcept(uid string) int {
+	connected := len(dict.entries)
+	if _, ok := dict.uniques[uid]; ok {
+		connected--
+	}
+	return connected
+}
+
+// Check if there are slots available for a viridian that is being added.
+// Should be applied for ViridianDict object, dictionary mutex should not be locked.
+// Accept viridian token.
+// Return nil if viridian can be added, gRPC status error otherwise.
+func (dict *ViridianDict) checkAddCapacity(token *generated.UserToken) error {
+	dict.mutex.RLock()
+	defer dict.mutex.RUnlock()
+	return dict.checkCapacity(dict.connectedExcept(token.Uid), token.Privileged)
+}
+
 // Add a viridian to the dictionary.
 // Check if there are available slots in the dictionary, parse token and other parameters.
 // Create viridian, open VPN connection for it and add the viridian to the dictionary.
+// If a viridian with the same unique identifier is already connected, it is replaced (reconnection).
 // Should be applied for ViridianDict object.
 // Accept context, token, viridian address, gateway and port.
 // Return viridian number and nil if added successfully and nil and error otherwise.
 func (dict *ViridianDict) Add(ctx context.Context, token *generated.UserToken, address, gateway net.IP, port uint16) (*uint16, error) {
-	dict.mutex.Lock()
-	defer dict.mutex.Unlock()
-
-	// Check if there are slots available
-	if !token.Privileged && len(dict.entries) >= int(dict.maxViridians) {
-		return nil, status.Error(codes.ResourceExhausted, "can not connect any more viridians")
-	} else if len(dict.entries) == int(dict.maxViridians+dict.maxOverhead) {
-		return nil, status.Error(codes.ResourceExhausted, "can not connect any more admins")
-	}
-
-	// Create viridian session cipher
-	aead, err := crypto.ParseCipher(token.Session)
-	if err != nil {
+	// Replaced viridians are stopped after the dictionary mutex is unlocked
+	var stale []*Viridian
+	defer func() { stopViridians(stale, DISCONNECT_RECONNECTED) }()
+
+	// Create viridian session cipher of the cipher suite requested on authentication
+	aead, err := crypto.ParseSuiteCipher(token.GetCipher(), token.Session)
+	if errors.Is(err, crypto.ErrWeakKey) {
+		return nil, status.Error(codes.InvalidArgument, "user session key is degenerate")
+	} else if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "error parsing encryption algorithm for user: %v", err)
 	}
 
@@ -110,12 +400,25 @@ func (dict *ViridianDict) Add(ctx context.Context, token *generated.UserToken, a
 		return nil, status.Errorf(codes.Internal, "error resolving local address: %v", err)
 	}
 
-	// Create VPN connection
-	seaConn, err := net.ListenUDP("udp4", localAddress)
+	// Check if there are slots available (previous connection of the viridian is kept until the new one is inserted)
+	if err := dict.checkAddCapacity(token); err != nil {
+		return nil, err
+	}
+
+	// Create VPN connection, retrying transient failures (dictionary mutex is not locked, so that retries do not block packet forwarding)
+	seaConn, err := dict.listenViridianRetrying(localAddress.IP, token.Uid)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "error resolving connection (%s): %v", localAddress.String(), err)
 	}
 
+	// Close connection if viridian is not added, after the dictionary mutex is unlocked (viridian was never inserted, so it is not stopped)
+	added := false
+	defer func() {
+		if !added {
+			seaConn.Close()
+		}
+	}()
+
 	// Get connection port number
 	_, userID, err := utils.GetIPAndPortFromAddress(seaConn.LocalAddr())
 	if err != nil {
@@ -127,29 +430,49 @@ func (dict *ViridianDict) Add(ctx context.Context, token *generated.UserToken, a
 		return nil, status.Errorf(codes.Internal, "error opening UDP listener, port: %d", userID)
 	}
 
-	// Derive child context from context
-	seaCtx, cancel := context.WithCancel(ctx)
-
-	// If found, setup deletion timer and create viridian object
-	subscriptionTimeout := token.Subscription.AsTime()
-	deletionTimer := time.AfterFunc(time.Duration(dict.firstHealthcheckDelay), func() { dict.Delete(userID, true) })
+	// Read subscription timeout, if token has a subscription
+	var subscriptionTimeout *time.Time
+	if token.Subscription != nil {
+		timeout := token.Subscription.AsTime()
+		subscriptionTimeout = &timeout
+	}
 
 	// Create viridian object
 	viridian := &Viridian{
 		UID:           token.Uid,
 		AEAD:          aead,
-		reset:         deletionTimer,
+		connected:     time.Now(),
+		healthTimeout: dict.firstHealthcheckDelay,
 		admin:         token.Privileged,
-		timeout:       &subscriptionTimeout,
+		timeout:       subscriptionTimeout,
 		Address:       address,
 		Gateway:       gateway,
 		Port:          port,
-		CancelContext: cancel,
 		SeaConn:       seaConn,
 	}
 
+	// Remember original connection buffer sizes, if they should be shrunk for idle viridians
+	if dict.idleTimeout > 0 {
+		viridian.buffers, err = getSocketBuffers(seaConn)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error reading connection buffer sizes: %v", err)
+		}
+		viridian.touch()
+	}
+
+	// Limit viridian bandwidth if requested by token
+	if token.Bandwidth != nil && *token.Bandwidth > 0 {
+		viridian.limiter = newBandwidthLimiter(*token.Bandwidth)
+	}
+
+	// Limit viridian destinations if split tunnel routes were negotiated
+	viridian.routes, err = parseRouteFilter(token.Routes)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "error parsing user routes: %v", err)
+	}
+
 	// If viridian subscription is expired, throw error, otherwise insert the viridian and return its' ID
-	if viridian.isViridianOvertime() {
+	if viridian.isViridianOvertime(dict.clockSkew) {
 		return nil, status.Error(codes.DeadlineExceeded, "viridian subscription outdated")
 	}
 
@@ -159,23 +482,257 @@ func (dict *ViridianDict) Add(ctx context.Context, token *generated.UserToken, a
 		return nil, status.Error(codes.Internal, "tunnel config not found in context")
 	}
 
+	// Check if there are still slots available, other viridians could have connected while the connection was being created
+	dict.mutex.Lock()
+	defer dict.mutex.Unlock()
+	if err := dict.checkCapacity(dict.connectedExcept(token.Uid), token.Privileged); err != nil {
+		return nil, err
+	}
+
+	// Derive child context from context, setup viridian deletion timer and lifetime timer, if connection lifetime is limited
+	seaCtx, cancel := context.WithCancel(ctx)
+	viridian.CancelContext = cancel
+	viridian.reset = dict.deletionTimer(userID, viridian, dict.firstHealthcheckDelay)
+	if dict.maxLifetime > 0 && !(viridian.admin && dict.lifetimeExemptAdmins) {
+		viridian.lifetime = dict.lifetimeTimer(userID, viridian, dict.maxLifetime)
+	}
+
 	// Launch goroutine for the created viridian
-	dict.entries[userID] = viridian
-	go dict.ReceivePacketsFromViridian(seaCtx, userID, seaConn, tunnelConfig.Tunnel, tunnelConfig.Network)
+	added = true
+	dict.sockets[userID] = seaConn
+	stale = dict.insert(userID, viridian)
+	go dict.ReceivePacketsFromViridian(seaCtx, userID, seaConn, tunnelConfig.Network)
 
 	// Return viridian ID and no error
 	return &userID, nil
 }
 
+// Insert viridian into the dictionary.
+// Stale viridians are removed from the dictionary: the one with the same ID (e.g. kernel reused its port or the viridian reconnected on its reserved port)
+// and the one with the same unique identifier (reconnection).
+// Stale viridians are not stopped, so that it can be done after the dictionary mutex is unlocked.
+// Should be applied for ViridianDict object, dictionary mutex should be locked.
+// Accept viridian ID and viridian pointer.
+// Return removed stale viridians that should be stopped.
+func (dict *ViridianDict) insert(userID uint16, viridian *Viridian) []*Viridian {
+	stale := make([]*Viridian, 0, 2)
+
+	// Remove stale viridian with the same ID, if any
+	if collision, ok := dict.remove(userID, DISCONNECT_RECONNECTED); ok {
+		if collision.UID == viridian.UID {
+			logrus.Infof("User %s reconnected: previous connection %d terminated", viridian.UID, userID)
+		} else {
+			logrus.Warnf("User ID %d collision: stale user %s terminated", userID, collision.UID)
+		}
+		stale = append(stale, collision)
+	}
+
+	// Remove stale viridian with the same unique identifier, if any
+	if previousID, ok := dict.uniques[viridian.UID]; ok {
+		if previous, ok := dict.remove(previousID, DISCONNECT_RECONNECTED); ok {
+			logrus.Infof("User %s reconnected: previous connection %d terminated", viridian.UID, previousID)
+			stale = append(stale, previous)
+		}
+	}
+
+	// Insert new viridian
+	delete(dict.departures, userID)
+	dict.entries[userID] = viridian
+	dict.uniques[viridian.UID] = userID
+	return stale
+}
+
+// Remove viridian from the dictionary without stopping it.
+// Disconnect reason is remembered until the ID is reused, so that it can be reported to the viridian.
+// Should be applied for ViridianDict object, dictionary mutex should be locked.
+// Accept viridian ID and disconnect reason.
+// Return removed viridian pointer and True if it was found, nil and False otherwise.
+func (dict *ViridianDict) remove(userID uint16, reason DisconnectReason) (*Viridian, bool) {
+	viridian, ok := dict.entries[userID]
+	if !ok {
+		return nil, false
+	}
+
+	delete(dict.entries, userID)
+	if dict.departures == nil {
+		dict.departures = make(map[uint16]DisconnectReason)
+	}
+	dict.departures[userID] = reason
+	if uniqueID, ok := dict.uniques[viridian.UID]; ok && uniqueID == userID {
+		delete(dict.uniques, viridian.UID)
+	}
+	return viridian, true
+}
+
+// Check and repair consistency of the unique identifier map.
+// Every unique identifier should point to a connected viridian with the same identifier,
+// every connected viridian should be reachable by its unique identifier.
+// Orphaned identifiers are removed, missing identifiers are restored.
+// Should be applied for ViridianDict object, dictionary mutex should be locked.
+// Return number of repaired divergences.
+func (dict *ViridianDict) repairUniques() int {
+	repaired := 0
+
+	// Remove identifiers that don't point to a viridian with the same identifier
+	for uid, userID := range dict.uniques {
+		if viridian, ok := dict.entries[userID]; !ok || viridian.UID != uid {
+			logrus.Warnf("Unique identifier %s points to missing user %d, removed", uid, userID)
+			delete(dict.uniques, uid)
+			repaired++
+		}
+	}
+
+	// Restore identifiers of the viridians that can not be found by them
+	for userID, viridian := range dict.entries {
+		if _, ok := dict.uniques[viridian.UID]; !ok {
+			logrus.Warnf("User %d is missing unique identifier %s, restored", userID, viridian.UID)
+			dict.uniques[viridian.UID] = userID
+			repaired++
+		}
+	}
+
+	return repaired
+}
+
+// Close viridian connections that don't belong to any live viridian.
+// Connections of the removed viridians are forgotten, connections that were not closed on removal are closed and reported.
+// Should be applied for ViridianDict object, dictionary mutex should be locked.
+// Return number of orphaned connections closed.
+func (dict *ViridianDict) reconcileSockets() int {
+	closed := 0
+	for userID, socket := range dict.sockets {
+		if viridian, ok := dict.entries[userID]; ok && viridian.SeaConn == socket {
+			continue
+		}
+		if err := socket.Close(); err == nil {
+			logrus.Warnf("Orphaned connection of user %d (%v) closed", userID, socket.LocalAddr())
+			closed++
+		}
+		delete(dict.sockets, userID)
+	}
+	return closed
+}
+
+// Audit viridian dictionary periodically: repair unique identifier map divergences and close orphaned viridian connections.
+// Should be applied for ViridianDict object.
+// Accept context for graceful termination.
+// NB! this method is blocking, so it should be run as goroutine.
+func (dict *ViridianDict) audit(ctx context.Context) {
+	ticker := time.NewTicker(DICTIONARY_AUDIT_INTERVAL)
+	defer ticker.Stop()
+
+	logrus.Debug("Auditing viridian dictionary started")
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Debug("Auditing viridian dictionary stopped")
+			return
+		case <-ticker.C:
+			dict.mutex.Lock()
+			if repaired := dict.repairUniques(); repaired > 0 {
+				logrus.Errorf("Unique identifiers diverged from viridian dictionary, %d entries repaired", repaired)
+			}
+			if closed := dict.reconcileSockets(); closed > 0 {
+				logrus.Errorf("Viridian connections leaked, %d orphaned connections closed", closed)
+			}
+			dict.mutex.Unlock()
+		}
+	}
+}
+
+// Stop viridians, removed from the dictionary.
+// Should be called after the dictionary mutex is unlocked.
+// Accept viridian pointers list and disconnect reason.
+func stopViridians(viridians []*Viridian, reason DisconnectReason) {
+	for _, viridian := range viridians {
+		viridian.stop(reason)
+	}
+}
+
+// Shrink connection buffers of idle viridians periodically.
+// Should be applied for ViridianDict object.
+// Accept context for graceful termination.
+// NB! this method is blocking, so it should be run as goroutine.
+func (dict *ViridianDict) shrinkIdleBuffers(ctx context.Context) {
+	ticker := time.NewTicker(dict.idleTimeout / 2)
+	defer ticker.Stop()
+
+	logrus.Debug("Shrinking idle viridian buffers started")
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Debug("Shrinking idle viridian buffers stopped")
+			return
+		case <-ticker.C:
+			dict.mutex.RLock()
+			for userID, viridian := range dict.entries {
+				if viridian.shrinkIfIdle(dict.idleTimeout, dict.idleBufferSize) {
+					logrus.Debugf("Viridian %d idle, connection buffers shrunk", userID)
+				}
+			}
+			dict.mutex.RUnlock()
+		}
+	}
+}
+
 // Get viridian from the dictionary by ID.
 // Should be applied for ViridianDict object.
 // Accept viridian ID.
 // Return viridian pointer and True if successful, nil and False otherwise.
 func (dict *ViridianDict) Get(userID uint16) (*Viridian, bool) {
+	dict.mutex.RLock()
+	defer dict.mutex.RUnlock()
+
 	value, ok := dict.entries[userID]
 	return value, ok
 }
 
+// Get snapshot of the dictionary.
+// Only viridian pointers are copied under read lock, so that lookups are not blocked,
+// viridian statistics can be read from the snapshot later without locking (they are atomic).
+// Should be applied for ViridianDict object.
+// Return viridian pointers by viridian IDs.
+func (dict *ViridianDict) Snapshot() map[uint16]*Viridian {
+	dict.mutex.RLock()
+	defer dict.mutex.RUnlock()
+
+	snapshot := make(map[uint16]*Viridian, len(dict.entries))
+	for userID, viridian := range dict.entries {
+		snapshot[userID] = viridian
+	}
+	return snapshot
+}
+
+// Find viridian in the dictionary by unique user identifier.
+// Should be applied for ViridianDict object.
+// Accept unique user identifier string.
+// Return viridian ID, viridian pointer and True if successful, 0, nil and False otherwise.
+func (dict *ViridianDict) Find(uid string) (uint16, *Viridian, bool) {
+	dict.mutex.RLock()
+	defer dict.mutex.RUnlock()
+
+	userID, ok := dict.uniques[uid]
+	if !ok {
+		return 0, nil, false
+	}
+	return userID, dict.entries[userID], true
+}
+
+// Count currently tracked flows (connections) of viridian.
+// Flows are counted in kernel connection tracking table by viridian tunnel source address.
+// Should be applied for ViridianDict object.
+// Accept viridian ID.
+// Return number of flows and nil if connection tracking table was read, otherwise 0 and error.
+func (dict *ViridianDict) Flows(userID uint16) (uint64, error) {
+	if dict.tunnelIP.To4() == nil {
+		return 0, errors.New("tunnel IPv4 address unknown")
+	}
+
+	viridianID := []byte{0, 0}
+	binary.BigEndian.PutUint16(viridianID, userID)
+	return tunnel.CountFlows(viridianSourceIP(&net.IPNet{IP: dict.tunnelIP}, viridianID))
+}
+
 // Update viridian, replace its' deletion timer with NextIn number.
 // Should be called upon healthping control message receiving.
 // Should be applied for ViridianDict object.
@@ -183,48 +740,126 @@ func (dict *ViridianDict) Get(userID uint16) (*Viridian, bool) {
 // Return control response success status and nil if viridian is updated successfully, otherwise error status and error.
 func (dict *ViridianDict) Update(userID uint16, nextIn int32) error {
 	dict.mutex.Lock()
-	defer dict.mutex.Unlock()
 
 	// Retrieve viridian from the dictionary
 	viridian, ok := dict.entries[userID]
 	if !ok {
+		dict.mutex.Unlock()
 		return status.Errorf(codes.InvalidArgument, "requested viridian %d doesn't exist", userID)
 	}
 
-	// Update viridian if not overtime, throw error otherwise
-	if viridian.isViridianOvertime() {
-		dict.Delete(userID, false)
+	// Update viridian if not overtime, remove it and throw error otherwise
+	if viridian.isViridianOvertime(dict.clockSkew) {
+		dict.remove(userID, DISCONNECT_SUBSCRIPTION)
+		dict.mutex.Unlock()
+		viridian.stop(DISCONNECT_SUBSCRIPTION)
+		logrus.Infof("User %d deleted by subscription timeout", userID)
 		return status.Errorf(codes.DeadlineExceeded, "viridian %d subscription outdated", userID)
 	} else {
-		viridian.reset.Reset(time.Duration(nextIn*int32(dict.viridianWaitingOvertime)) * time.Second)
+		viridian.healthTimeout = time.Duration(nextIn*int32(dict.viridianWaitingOvertime)) * time.Second
+		viridian.reset.Reset(viridian.healthTimeout)
+		dict.mutex.Unlock()
 		return nil
 	}
 }
 
-// Remove viridian from viridian list.
-// Viridian pointer is replaced by nil.
+// Create viridian deletion timer.
+// The timer only expires the viridian it was created for, so if the timer fires after the viridian was deleted
+// (e.g. concurrently with stopping) and another viridian was added with the same ID, the other viridian is not affected.
+// Should be applied for ViridianDict object.
+// Accept viridian ID, viridian pointer and timer delay.
+// Return deletion timer.
+func (dict *ViridianDict) deletionTimer(userID uint16, viridian *Viridian, delay time.Duration) *time.Timer {
+	return time.AfterFunc(delay, func() { dict.expire(userID, viridian) })
+}
+
+// Create viridian lifetime timer.
+// Similarly to deletion timer, the timer only retires the viridian it was created for.
+// Should be applied for ViridianDict object.
+// Accept viridian ID, viridian pointer and maximum connection lifetime.
+// Return lifetime timer.
+func (dict *ViridianDict) lifetimeTimer(userID uint16, viridian *Viridian, lifetime time.Duration) *time.Timer {
+	return time.AfterFunc(lifetime, func() { dict.retire(userID, viridian) })
+}
+
+// Handle viridian maximum connection lifetime end.
+// Viridian is deleted, so it has to connect again with a fresh handshake (and token check).
+// Nothing is done if the viridian is not in the dictionary anymore (even if another viridian has the same ID).
 // Should be applied for ViridianDict object.
-// Accept viridian ID (unsigned 16-bit integer) and flag if viridian was deleted by timeout.
-func (dict *ViridianDict) Delete(userID uint16, timeout bool) {
+// Accept viridian ID (unsigned 16-bit integer) and pointer to the viridian the timer was created for.
+func (dict *ViridianDict) retire(userID uint16, retired *Viridian) {
 	dict.mutex.Lock()
-	defer dict.mutex.Unlock()
+	viridian, ok := dict.entries[userID]
+	if !ok || viridian != retired {
+		dict.mutex.Unlock()
+		return
+	}
+	dict.remove(userID, DISCONNECT_LIFETIME)
+	dict.mutex.Unlock()
 
-	// Retrieve viridian from the dictionary
+	// Stop viridian outside of the critical section
+	viridian.stop(DISCONNECT_LIFETIME)
+	logrus.Infof("User %d deleted after maximum connection lifetime, reauthentication required", userID)
+}
+
+// Handle viridian healthcheck timeout.
+// If valid packets received from viridian count as healthchecks and a packet was received within healthcheck timeout,
+// the timer is rescheduled, otherwise viridian is deleted.
+// Nothing is done if the viridian is not in the dictionary anymore (even if another viridian has the same ID).
+// Should be applied for ViridianDict object.
+// Accept viridian ID (unsigned 16-bit integer) and pointer to the viridian the timer was created for.
+func (dict *ViridianDict) expire(userID uint16, expired *Viridian) {
+	dict.mutex.Lock()
 	viridian, ok := dict.entries[userID]
-	if !ok {
+	if !ok || viridian != expired {
+		dict.mutex.Unlock()
+		logrus.Debugf("Timer of deleted user %d fired, ignored", userID)
 		return
 	}
+	if dict.dataHealthcheck {
+		silence := time.Since(time.Unix(0, atomic.LoadInt64(&viridian.lastReceived)))
+		if silence < viridian.healthTimeout {
+			viridian.reset.Reset(viridian.healthTimeout - silence)
+			dict.mutex.Unlock()
+			logrus.Debugf("User %d healthcheck missed, but data received %v ago", userID, silence)
+			return
+		}
+	}
+	dict.remove(userID, DISCONNECT_UNHEALTHY)
+	dict.mutex.Unlock()
 
-	// Stop viridian and remove it from the dictionary
-	viridian.stop()
-	delete(dict.entries, userID)
+	// Stop viridian outside of the critical section
+	viridian.stop(DISCONNECT_UNHEALTHY)
+	logrus.Infof("User %d deleted by unhealthy timeout", userID)
+}
 
-	// Log appropriate message if deleted by timeout
-	if timeout {
-		logrus.Infof("User %d deleted by unhealthy timeout", userID)
-	} else {
-		logrus.Infof("User %d deleted successfully", userID)
+// Remove viridian from viridian list.
+// Viridian pointer is replaced by nil.
+// Should be applied for ViridianDict object.
+// Accept viridian ID (unsigned 16-bit integer) and disconnect reason.
+func (dict *ViridianDict) Delete(userID uint16, reason DisconnectReason) {
+	// Remove viridian from the dictionary
+	dict.mutex.Lock()
+	viridian, ok := dict.remove(userID, reason)
+	dict.mutex.Unlock()
+	if !ok {
+		return
 	}
+
+	// Stop viridian outside of the critical section
+	viridian.stop(reason)
+	logrus.Infof("User %d deleted, reason: %s", userID, reason)
+}
+
+// Get disconnect reason of a removed viridian.
+// Should be applied for ViridianDict object.
+// Accept viridian ID (unsigned 16-bit integer).
+// Return disconnect reason and True if viridian with the ID was removed and the ID was not reused, empty reason and False otherwise.
+func (dict *ViridianDict) Departure(userID uint16) (DisconnectReason, bool) {
+	dict.mutex.RLock()
+	defer dict.mutex.RUnlock()
+	reason, ok := dict.departures[userID]
+	return reason, ok
 }
 
 // Clear viridan dictionary.
@@ -232,9 +867,11 @@ func (dict *ViridianDict) Delete(userID uint16, timeout bool) {
 // Should be applied for ViridianDict object.
 func (dict *ViridianDict) Clear() {
 	dict.mutex.Lock()
-	defer dict.mutex.Unlock()
-	for key, viridian := range dict.entries {
-		viridian.stop()
-		delete(dict.entries, key)
+	stale := make([]*Viridian, 0, len(dict.entries))
+	for key := range dict.entries {
+		viridian, _ := dict.remove(key, DISCONNECT_SHUTDOWN)
+		stale = append(stale, viridian)
 	}
+	dict.mutex.Unlock()
+	stopViridians(stale, DISCONNECT_SHUTDOWN)
 }
@@ -3,20 +3,51 @@ package users
 import (
 	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"main/crypto"
 	"main/generated"
 	"main/tunnel"
 	"main/utils"
+	"math"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"golang.org/x/crypto/chacha20poly1305"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
 	DIRECTORY_CYCLE_MTU          = "1500"
 	DIRECTORY_CYCLE_VIRIDIAN_UID = "test_user_uid"
+
+	DIRECTORY_COLLISION_USER_ID   = 12345
+	DIRECTORY_COLLISION_STALE_UID = "test_stale_uid"
+	DIRECTORY_COLLISION_FRESH_UID = "test_fresh_uid"
+
+	DIRECTORY_LIMITS_VIRIDIANS = 10
+	DIRECTORY_LIMITS_ADMINS    = 5
+	DIRECTORY_LIMITS_OVERFLOW  = 40000
+
+	DIRECTORY_RECONNECT_NUMBER = 64
+	DIRECTORY_CHURN_NUMBER     = 256
+	DIRECTORY_READD_NUMBER     = 64
+	DIRECTORY_HAMMER_NUMBER    = 32
+	DIRECTORY_HAMMER_ROUNDS    = 64
+
+	DIRECTORY_HEALTHCHECK_TIMEOUT = 100 * time.Millisecond
+	DIRECTORY_RECONNECT_TIMEOUT   = 5 * time.Second
+
+	DIRECTORY_ACCOUNTING_PACKET_SIZE   = 1000
+	DIRECTORY_ACCOUNTING_PACKET_NUMBER = 10
 )
 
 func TestDirectoryCycle(test *testing.T) {
@@ -86,7 +117,7 @@ func TestDirectoryCycle(test *testing.T) {
 		test.Fatalf("error updating viridian: %v", err)
 	}
 
-	dict.Delete(*viridianID, false)
+	dict.Delete(*viridianID, DISCONNECT_REQUESTED)
 
 	deletedViridian, ok := dict.Get(*viridianID)
 	if ok {
@@ -98,3 +129,574 @@ func TestDirectoryCycle(test *testing.T) {
 	cancel()
 	tunnelConfig.Close()
 }
+
+func createTestViridian(test *testing.T, uid string) *Viridian {
+	_, cancel := context.WithCancel(context.Background())
+
+	address, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("error resolving local address: %v", err)
+	}
+
+	connection, err := net.ListenUDP("udp4", address)
+	if err != nil {
+		test.Fatalf("error resolving connection (%s): %v", address.String(), err)
+	}
+
+	return &Viridian{
+		UID:           uid,
+		connected:     time.Now(),
+		reset:         time.AfterFunc(time.Hour, func() {}),
+		CancelContext: cancel,
+		SeaConn:       connection,
+	}
+}
+
+func TestInsertCollision(test *testing.T) {
+	dict := ViridianDict{
+		entries: make(map[uint16]*Viridian),
+		uniques: make(map[string]uint16),
+	}
+
+	userID := uint16(DIRECTORY_COLLISION_USER_ID)
+	stale := createTestViridian(test, DIRECTORY_COLLISION_STALE_UID)
+	fresh := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	defer fresh.stop(DISCONNECT_REQUESTED)
+
+	stopViridians(dict.insert(userID, stale), DISCONNECT_RECONNECTED)
+	stopViridians(dict.insert(userID, fresh), DISCONNECT_RECONNECTED)
+
+	viridian, ok := dict.Get(userID)
+	if !ok {
+		test.Fatalf("error getting inserted viridian: %d", userID)
+	}
+
+	if viridian.UID != DIRECTORY_COLLISION_FRESH_UID {
+		test.Fatalf("viridian was not replaced on collision: %s != %s", viridian.UID, DIRECTORY_COLLISION_FRESH_UID)
+	}
+
+	if len(dict.entries) != 1 {
+		test.Fatalf("unexpected number of viridians after collision: %d", len(dict.entries))
+	}
+
+	r, err := stale.SeaConn.Read(make([]byte, 64))
+	if err == nil && r != 0 {
+		test.Fatalf("reading from stale viridian connection succeeded")
+	}
+}
+
+func TestCheckViridianLimits(test *testing.T) {
+	maxViridians, maxAdmins, err := checkViridianLimits(DIRECTORY_LIMITS_VIRIDIANS, DIRECTORY_LIMITS_ADMINS)
+	if err != nil {
+		test.Fatalf("error checking consistent limits: %v", err)
+	}
+
+	if maxViridians != DIRECTORY_LIMITS_VIRIDIANS || maxAdmins != DIRECTORY_LIMITS_ADMINS {
+		test.Fatalf("limits don't match provided: %d, %d != %d, %d", maxViridians, maxAdmins, DIRECTORY_LIMITS_VIRIDIANS, DIRECTORY_LIMITS_ADMINS)
+	}
+
+	// Sum of these limits wraps to a small value in 16-bit arithmetic
+	_, _, err = checkViridianLimits(DIRECTORY_LIMITS_OVERFLOW, DIRECTORY_LIMITS_OVERFLOW)
+	if err == nil {
+		test.Fatalf("limits overflowing user ID space were accepted: %d + %d", DIRECTORY_LIMITS_OVERFLOW, DIRECTORY_LIMITS_OVERFLOW)
+	}
+
+	_, _, err = checkViridianLimits(math.MaxUint16, 0)
+	if err == nil {
+		test.Fatalf("limits including special IP addresses were accepted: %d", math.MaxUint16)
+	}
+
+	_, _, err = checkViridianLimits(-DIRECTORY_LIMITS_VIRIDIANS, DIRECTORY_LIMITS_ADMINS)
+	if err == nil {
+		test.Fatalf("negative viridian limit was accepted: %d", -DIRECTORY_LIMITS_VIRIDIANS)
+	}
+
+	_, _, err = checkViridianLimits(DIRECTORY_LIMITS_VIRIDIANS, -DIRECTORY_LIMITS_ADMINS)
+	if err == nil {
+		test.Fatalf("negative admin limit was accepted: %d", -DIRECTORY_LIMITS_ADMINS)
+	}
+}
+
+func TestCheckCapacity(test *testing.T) {
+	dict := ViridianDict{maxViridians: DIRECTORY_LIMITS_VIRIDIANS, maxOverhead: DIRECTORY_LIMITS_ADMINS}
+	total := DIRECTORY_LIMITS_VIRIDIANS + DIRECTORY_LIMITS_ADMINS
+
+	if err := dict.checkCapacity(DIRECTORY_LIMITS_VIRIDIANS-1, false); err != nil {
+		test.Fatalf("viridian rejected below viridian limit: %v", err)
+	}
+	for _, connected := range []int{DIRECTORY_LIMITS_VIRIDIANS, DIRECTORY_LIMITS_VIRIDIANS + 1} {
+		if err := dict.checkCapacity(connected, false); status.Code(err) != codes.ResourceExhausted {
+			test.Fatalf("viridian admitted with %d viridians connected: %v", connected, err)
+		}
+	}
+
+	if err := dict.checkCapacity(total-1, true); err != nil {
+		test.Fatalf("admin rejected below total limit: %v", err)
+	}
+	for _, connected := range []int{total, total + 1} {
+		if err := dict.checkCapacity(connected, true); status.Code(err) != codes.ResourceExhausted {
+			test.Fatalf("admin admitted with %d viridians connected: %v", connected, err)
+		}
+	}
+}
+
+func TestFind(test *testing.T) {
+	dict := ViridianDict{
+		entries: make(map[uint16]*Viridian),
+		uniques: make(map[string]uint16),
+	}
+
+	userID := uint16(DIRECTORY_COLLISION_USER_ID)
+	viridian := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	defer viridian.stop(DISCONNECT_REQUESTED)
+	stopViridians(dict.insert(userID, viridian), DISCONNECT_RECONNECTED)
+
+	foundID, found, ok := dict.Find(DIRECTORY_COLLISION_FRESH_UID)
+	if !ok {
+		test.Fatalf("error finding inserted viridian: %s", DIRECTORY_COLLISION_FRESH_UID)
+	}
+
+	if foundID != userID || found != viridian {
+		test.Fatalf("found viridian doesn't match inserted: %d != %d", foundID, userID)
+	}
+
+	_, _, ok = dict.Find(DIRECTORY_COLLISION_STALE_UID)
+	if ok {
+		test.Fatalf("not inserted viridian was found: %s", DIRECTORY_COLLISION_STALE_UID)
+	}
+}
+
+func TestAccounted(test *testing.T) {
+	payloadDict := ViridianDict{wireAccounting: false}
+	wireDict := ViridianDict{wireAccounting: true}
+
+	payloadViridian := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	defer payloadViridian.stop(DISCONNECT_REQUESTED)
+	wireViridian := createTestViridian(test, DIRECTORY_COLLISION_STALE_UID)
+	defer wireViridian.stop(DISCONNECT_REQUESTED)
+
+	aead, err := crypto.GenerateCipher()
+	if err != nil {
+		test.Fatalf("error generating cipher: %v", err)
+	}
+
+	packet := make([]byte, DIRECTORY_ACCOUNTING_PACKET_SIZE)
+	for i := 0; i < DIRECTORY_ACCOUNTING_PACKET_NUMBER; i++ {
+		encrypted, err := crypto.Encrypt(packet, aead)
+		if err != nil {
+			test.Fatalf("error encrypting packet: %v", err)
+		}
+		payloadViridian.countSent(payloadDict.accounted(packet, encrypted))
+		wireViridian.countSent(wireDict.accounted(packet, encrypted))
+	}
+
+	overhead := aead.NonceSize() + aead.Overhead() + WIRE_HEADERS_LENGTH
+	expectedPayload := uint64(DIRECTORY_ACCOUNTING_PACKET_NUMBER * DIRECTORY_ACCOUNTING_PACKET_SIZE)
+	expectedWire := uint64(DIRECTORY_ACCOUNTING_PACKET_NUMBER * (DIRECTORY_ACCOUNTING_PACKET_SIZE + overhead))
+
+	if payloadBytes := payloadViridian.Statistics().BytesOut; payloadBytes != expectedPayload {
+		test.Fatalf("payload accounting bytes don't match expected: %d != %d", payloadBytes, expectedPayload)
+	}
+	if wireBytes := wireViridian.Statistics().BytesOut; wireBytes != expectedWire {
+		test.Fatalf("wire accounting bytes don't match expected: %d != %d", wireBytes, expectedWire)
+	}
+}
+
+func TestRapidReconnect(test *testing.T) {
+	dict := ViridianDict{
+		entries: make(map[uint16]*Viridian),
+		uniques: make(map[string]uint16),
+	}
+
+	viridians := make([]*Viridian, DIRECTORY_RECONNECT_NUMBER)
+	for i := range viridians {
+		viridians[i] = createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		waiter := sync.WaitGroup{}
+		for i, viridian := range viridians {
+			waiter.Add(2)
+			userID := uint16(DIRECTORY_COLLISION_USER_ID + i)
+			go func(viridian *Viridian) {
+				defer waiter.Done()
+				dict.mutex.Lock()
+				stale := dict.insert(userID, viridian)
+				dict.mutex.Unlock()
+				stopViridians(stale, DISCONNECT_RECONNECTED)
+			}(viridian)
+			go func() {
+				defer waiter.Done()
+				dict.Update(userID, 1)
+				dict.Find(DIRECTORY_COLLISION_FRESH_UID)
+			}()
+		}
+		waiter.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(DIRECTORY_RECONNECT_TIMEOUT):
+		test.Fatalf("reconnecting viridians deadlocked")
+	}
+
+	if len(dict.entries) != 1 || len(dict.uniques) != 1 {
+		test.Fatalf("unexpected number of viridians after reconnects: %d (unique: %d)", len(dict.entries), len(dict.uniques))
+	}
+
+	userID, connected, ok := dict.Find(DIRECTORY_COLLISION_FRESH_UID)
+	if !ok {
+		test.Fatalf("error finding reconnected viridian: %s", DIRECTORY_COLLISION_FRESH_UID)
+	}
+	defer connected.stop(DISCONNECT_REQUESTED)
+
+	if entry, ok := dict.Get(userID); !ok || entry != connected {
+		test.Fatalf("reconnected viridian ID doesn't match dictionary entry: %d", userID)
+	}
+
+	for _, viridian := range viridians {
+		if viridian == connected {
+			continue
+		}
+		viridian.SeaConn.SetReadDeadline(time.Now().Add(DIRECTORY_RECONNECT_TIMEOUT))
+		if _, err := viridian.SeaConn.Read(make([]byte, 64)); err == nil || !errors.Is(err, net.ErrClosed) {
+			test.Fatalf("replaced viridian connection was not closed: %v", err)
+		}
+	}
+}
+
+func TestUniquesChurn(test *testing.T) {
+	dict := ViridianDict{
+		entries: make(map[uint16]*Viridian),
+		uniques: make(map[string]uint16),
+	}
+
+	viridians := make([]*Viridian, DIRECTORY_CHURN_NUMBER)
+	for i := range viridians {
+		viridians[i] = createTestViridian(test, fmt.Sprintf("%s_%d", DIRECTORY_COLLISION_FRESH_UID, i))
+	}
+
+	waiter := sync.WaitGroup{}
+	for i, viridian := range viridians {
+		waiter.Add(1)
+		go func(number int, viridian *Viridian) {
+			defer waiter.Done()
+			userID := uint16(DIRECTORY_COLLISION_USER_ID + number)
+
+			dict.mutex.Lock()
+			stale := dict.insert(userID, viridian)
+			dict.mutex.Unlock()
+			stopViridians(stale, DISCONNECT_RECONNECTED)
+
+			if number%2 == 0 {
+				dict.Delete(userID, DISCONNECT_REQUESTED)
+			}
+		}(i, viridian)
+	}
+	waiter.Wait()
+	defer dict.Clear()
+
+	dict.mutex.Lock()
+	repaired := dict.repairUniques()
+	dict.mutex.Unlock()
+	if repaired != 0 {
+		test.Fatalf("unique identifiers diverged after churn: %d entries repaired", repaired)
+	}
+	if len(dict.entries) != DIRECTORY_CHURN_NUMBER/2 || len(dict.uniques) != len(dict.entries) {
+		test.Fatalf("unexpected number of viridians after churn: %d (unique: %d)", len(dict.entries), len(dict.uniques))
+	}
+
+	dict.mutex.Lock()
+	dict.uniques[DIRECTORY_COLLISION_STALE_UID] = DIRECTORY_COLLISION_USER_ID
+	delete(dict.uniques, fmt.Sprintf("%s_%d", DIRECTORY_COLLISION_FRESH_UID, 1))
+	repaired = dict.repairUniques()
+	dict.mutex.Unlock()
+	if repaired != 2 || len(dict.uniques) != len(dict.entries) {
+		test.Fatalf("unique identifiers not repaired: %d entries repaired (unique: %d, entries: %d)", repaired, len(dict.uniques), len(dict.entries))
+	}
+
+	dict.Clear()
+	if len(dict.entries) != 0 || len(dict.uniques) != 0 {
+		test.Fatalf("viridians left after clearing: %d (unique: %d)", len(dict.entries), len(dict.uniques))
+	}
+}
+
+func TestReconcileSockets(test *testing.T) {
+	live := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	defer live.stop(DISCONNECT_REQUESTED)
+	orphan := createTestViridian(test, DIRECTORY_COLLISION_STALE_UID)
+	defer orphan.stop(DISCONNECT_REQUESTED)
+
+	dict := ViridianDict{
+		entries: map[uint16]*Viridian{DIRECTORY_COLLISION_USER_ID: live},
+		uniques: map[string]uint16{DIRECTORY_COLLISION_FRESH_UID: DIRECTORY_COLLISION_USER_ID},
+		sockets: map[uint16]*net.UDPConn{
+			DIRECTORY_COLLISION_USER_ID:     live.SeaConn,
+			DIRECTORY_COLLISION_USER_ID + 1: orphan.SeaConn,
+		},
+	}
+
+	if closed := dict.reconcileSockets(); closed != 1 {
+		test.Fatalf("unexpected number of orphaned connections closed: %d", closed)
+	}
+	if len(dict.sockets) != 1 || dict.sockets[DIRECTORY_COLLISION_USER_ID] != live.SeaConn {
+		test.Fatalf("live connection not kept after reconciliation: %v", dict.sockets)
+	}
+
+	orphan.SeaConn.SetReadDeadline(time.Now().Add(DIRECTORY_RECONNECT_TIMEOUT))
+	if _, err := orphan.SeaConn.Read(make([]byte, 64)); !errors.Is(err, net.ErrClosed) {
+		test.Fatalf("orphaned connection was not closed: %v", err)
+	}
+	live.SeaConn.SetReadDeadline(time.Now())
+	if _, err := live.SeaConn.Read(make([]byte, 64)); errors.Is(err, net.ErrClosed) {
+		test.Fatalf("live connection was closed: %v", err)
+	}
+
+	dict.mutex.Lock()
+	stale, _ := dict.remove(DIRECTORY_COLLISION_USER_ID, DISCONNECT_REQUESTED)
+	dict.mutex.Unlock()
+	stale.stop(DISCONNECT_REQUESTED)
+	if closed := dict.reconcileSockets(); closed != 0 || len(dict.sockets) != 0 {
+		test.Fatalf("stopped viridian connection reported as orphaned: %d (left: %d)", closed, len(dict.sockets))
+	}
+}
+
+func TestAddRejectedClosed(test *testing.T) {
+	test.Setenv("SEASIDE_ADDRESS", RESERVATION_LOCAL_ADDRESS.String())
+	dict := &ViridianDict{
+		maxViridians: DIRECTORY_LIMITS_VIRIDIANS,
+		entries:      make(map[uint16]*Viridian),
+		uniques:      make(map[string]uint16),
+	}
+
+	var connection *net.UDPConn
+	listenUDP = func(network string, address *net.UDPAddr) (*net.UDPConn, error) {
+		var err error
+		connection, err = net.ListenUDP(network, address)
+		return connection, err
+	}
+	defer func() { listenUDP = net.ListenUDP }()
+
+	session := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(session); err != nil {
+		test.Fatalf("symmetrical key reading error: %v", err)
+	}
+	token := &generated.UserToken{Uid: DIRECTORY_COLLISION_FRESH_UID, Session: session, Subscription: timestamppb.New(time.Now().Add(-time.Hour))}
+
+	// Viridian that was never inserted should only have its connection closed, without disconnect summary
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	if _, err := dict.Add(context.Background(), token, RESERVATION_LOCAL_ADDRESS, RESERVATION_LOCAL_ADDRESS, 0); status.Code(err) != codes.DeadlineExceeded {
+		test.Fatalf("outdated viridian not rejected: %v", err)
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["event"] == "disconnect" {
+			test.Fatalf("disconnect summary logged for rejected viridian: %v", entry.Data)
+		}
+	}
+	if _, err := connection.Read(make([]byte, 64)); !errors.Is(err, net.ErrClosed) {
+		test.Fatalf("rejected viridian connection not closed: %v", err)
+	}
+}
+
+func TestDeleteDisconnectReason(test *testing.T) {
+	dict := ViridianDict{
+		entries: make(map[uint16]*Viridian),
+		uniques: make(map[string]uint16),
+	}
+
+	viridian := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	dict.mutex.Lock()
+	dict.insert(DIRECTORY_COLLISION_USER_ID, viridian)
+	dict.mutex.Unlock()
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	dict.Delete(DIRECTORY_COLLISION_USER_ID, DISCONNECT_SUBSCRIPTION)
+
+	var summary *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["event"] == "disconnect" {
+			summary = entry
+		}
+	}
+	if summary == nil || summary.Data["reason"] != string(DISCONNECT_SUBSCRIPTION) {
+		test.Fatalf("disconnect reason not emitted in disconnect event: %v", summary)
+	}
+
+	if entry := hook.LastEntry(); entry == nil || !strings.Contains(entry.Message, string(DISCONNECT_SUBSCRIPTION)) {
+		test.Fatalf("disconnect reason not logged: %v", entry)
+	}
+
+	if reason, ok := dict.Departure(DIRECTORY_COLLISION_USER_ID); !ok || reason != DISCONNECT_SUBSCRIPTION {
+		test.Fatalf("disconnect reason not remembered: %s", reason)
+	}
+
+	fresh := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	defer fresh.stop(DISCONNECT_REQUESTED)
+	dict.mutex.Lock()
+	dict.insert(DIRECTORY_COLLISION_USER_ID, fresh)
+	dict.mutex.Unlock()
+
+	if reason, ok := dict.Departure(DIRECTORY_COLLISION_USER_ID); ok {
+		test.Fatalf("disconnect reason of reused ID remembered: %s", reason)
+	}
+}
+
+func TestDataHealthcheck(test *testing.T) {
+	dict := ViridianDict{
+		dataHealthcheck: true,
+		entries:         make(map[uint16]*Viridian),
+		uniques:         make(map[string]uint16),
+	}
+
+	viridian := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	viridian.healthTimeout = DIRECTORY_HEALTHCHECK_TIMEOUT
+	viridian.reset = dict.deletionTimer(DIRECTORY_COLLISION_USER_ID, viridian, DIRECTORY_HEALTHCHECK_TIMEOUT)
+	viridian.received()
+
+	dict.mutex.Lock()
+	dict.insert(DIRECTORY_COLLISION_USER_ID, viridian)
+	dict.mutex.Unlock()
+	defer dict.Clear()
+
+	for start := time.Now(); time.Since(start) < 4*DIRECTORY_HEALTHCHECK_TIMEOUT; {
+		time.Sleep(DIRECTORY_HEALTHCHECK_TIMEOUT / 4)
+		viridian.received()
+	}
+	if _, _, ok := dict.Find(DIRECTORY_COLLISION_FRESH_UID); !ok {
+		test.Fatal("viridian sending data was deleted without healthchecks")
+	}
+
+	time.Sleep(3 * DIRECTORY_HEALTHCHECK_TIMEOUT)
+	if _, _, ok := dict.Find(DIRECTORY_COLLISION_FRESH_UID); ok {
+		test.Fatal("silent viridian was not deleted")
+	}
+}
+
+func TestExpireReplaced(test *testing.T) {
+	dict := ViridianDict{
+		entries: make(map[uint16]*Viridian),
+		uniques: make(map[string]uint16),
+	}
+	defer dict.Clear()
+
+	for i := 0; i < DIRECTORY_READD_NUMBER; i++ {
+		stale := createTestViridian(test, DIRECTORY_COLLISION_STALE_UID)
+		stale.reset = dict.deletionTimer(DIRECTORY_COLLISION_USER_ID, stale, 0)
+		fresh := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+
+		dict.mutex.Lock()
+		dict.insert(DIRECTORY_COLLISION_USER_ID, stale)
+		dict.mutex.Unlock()
+		dict.Delete(DIRECTORY_COLLISION_USER_ID, DISCONNECT_REQUESTED)
+
+		dict.mutex.Lock()
+		dict.insert(DIRECTORY_COLLISION_USER_ID, fresh)
+		dict.mutex.Unlock()
+
+		dict.expire(DIRECTORY_COLLISION_USER_ID, stale)
+		if _, _, ok := dict.Find(DIRECTORY_COLLISION_FRESH_UID); !ok {
+			test.Fatalf("readded viridian deleted by stale timer on iteration %d", i)
+		}
+		dict.Delete(DIRECTORY_COLLISION_USER_ID, DISCONNECT_REQUESTED)
+	}
+}
+
+func TestMaxLifetime(test *testing.T) {
+	dict := ViridianDict{
+		entries: make(map[uint16]*Viridian),
+		uniques: make(map[string]uint16),
+	}
+	defer dict.Clear()
+
+	viridian := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	viridian.lifetime = dict.lifetimeTimer(DIRECTORY_COLLISION_USER_ID, viridian, DIRECTORY_HEALTHCHECK_TIMEOUT)
+	dict.mutex.Lock()
+	dict.insert(DIRECTORY_COLLISION_USER_ID, viridian)
+	dict.mutex.Unlock()
+
+	if _, _, ok := dict.Find(DIRECTORY_COLLISION_FRESH_UID); !ok {
+		test.Fatal("viridian deleted before maximum lifetime")
+	}
+	time.Sleep(3 * DIRECTORY_HEALTHCHECK_TIMEOUT)
+	if _, _, ok := dict.Find(DIRECTORY_COLLISION_FRESH_UID); ok {
+		test.Fatal("viridian not deleted after maximum lifetime")
+	}
+
+	reconnected := createTestViridian(test, DIRECTORY_COLLISION_FRESH_UID)
+	reconnected.lifetime = dict.lifetimeTimer(DIRECTORY_COLLISION_USER_ID, reconnected, time.Hour)
+	dict.mutex.Lock()
+	dict.insert(DIRECTORY_COLLISION_USER_ID, reconnected)
+	dict.mutex.Unlock()
+
+	dict.retire(DIRECTORY_COLLISION_USER_ID, viridian)
+	if _, found, ok := dict.Find(DIRECTORY_COLLISION_FRESH_UID); !ok || found != reconnected {
+		test.Fatal("reconnected viridian deleted by lifetime of previous connection")
+	}
+}
+
+func TestConcurrentGet(test *testing.T) {
+	dict := ViridianDict{
+		entries: make(map[uint16]*Viridian),
+		uniques: make(map[string]uint16),
+	}
+	defer dict.Clear()
+
+	viridians := make([]*Viridian, DIRECTORY_HAMMER_NUMBER)
+	for i := range viridians {
+		viridians[i] = createTestViridian(test, fmt.Sprintf("%s_%d", DIRECTORY_COLLISION_FRESH_UID, i))
+	}
+
+	done := make(chan struct{})
+	writer := sync.WaitGroup{}
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		for round := 0; round < DIRECTORY_HAMMER_ROUNDS; round++ {
+			for i, viridian := range viridians {
+				dict.mutex.Lock()
+				dict.insert(uint16(DIRECTORY_COLLISION_USER_ID+i), viridian)
+				dict.mutex.Unlock()
+			}
+			for i := range viridians {
+				dict.mutex.Lock()
+				dict.remove(uint16(DIRECTORY_COLLISION_USER_ID+i), DISCONNECT_REQUESTED)
+				dict.mutex.Unlock()
+			}
+		}
+		close(done)
+	}()
+
+	readers := sync.WaitGroup{}
+	for reader := 0; reader < runtime.NumCPU(); reader++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := range viridians {
+					if viridian, ok := dict.Get(uint16(DIRECTORY_COLLISION_USER_ID + i)); ok {
+						viridian.Statistics()
+					}
+				}
+				for _, viridian := range dict.Snapshot() {
+					viridian.Statistics()
+				}
+			}
+		}()
+	}
+
+	writer.Wait()
+	readers.Wait()
+	if snapshot := dict.Snapshot(); len(snapshot) != 0 {
+		test.Fatalf("unexpected number of viridians after hammering: %d", len(snapshot))
+	}
+	stopViridians(viridians, DISCONNECT_SHUTDOWN)
+}
@@ -0,0 +1,46 @@
+package users
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ICMP types forwarded by default: echo reply, destination unreachable (including "fragmentation needed" for path MTU discovery),
+// echo request, time exceeded and parameter problem; redirects and all the other types are dropped.
+const DEFAULT_ICMP_TYPES = "0,3,8,11,12"
+
+// ICMP type filter, contains flags for all the ICMP types, allowed types are set.
+type icmpFilter [256]bool
+
+// Parse ICMP type filter.
+// Types are separated by commas, every type is a number between 0 and 255.
+// Accept ICMP types string.
+// Return ICMP type filter pointer and nil if parsed successfully (nil and nil if types string is empty, so filtering is disabled), otherwise nil and error.
+func parseICMPFilter(value string) (*icmpFilter, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	filter := new(icmpFilter)
+	for _, entry := range strings.Split(value, ",") {
+		icmpType, err := strconv.ParseUint(strings.TrimSpace(entry), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ICMP type: %s", entry)
+		}
+		filter[icmpType] = true
+	}
+	return filter, nil
+}
+
+// Check if packet can be forwarded by ICMP type filter.
+// Should be applied for icmpFilter object.
+// Accept parsed packet.
+// Return true if packet is not an ICMP packet or its type is allowed, false otherwise.
+func (filter *icmpFilter) allows(packet gopacket.Packet) bool {
+	icmpLayer, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	return !ok || filter[icmpLayer.TypeCode.Type()]
+}
@@ -0,0 +1,50 @@
+package users
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func icmpTestPacket(test *testing.T, typeCode layers.ICMPv4TypeCode) gopacket.Packet {
+	_, packet := parseTestPacket(createTestPacket(test, testPacketSpec{protocol: layers.IPProtocolICMPv4, typeCode: typeCode, payload: make([]byte, 28)}))
+	return packet
+}
+
+func TestICMPFilter(test *testing.T) {
+	filter, err := parseICMPFilter(DEFAULT_ICMP_TYPES)
+	if err != nil {
+		test.Fatalf("error parsing default ICMP types: %v", err)
+	}
+
+	echo := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)
+	if !filter.allows(icmpTestPacket(test, echo)) {
+		test.Fatal("echo request dropped")
+	}
+	fragmentationNeeded := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded)
+	if !filter.allows(icmpTestPacket(test, fragmentationNeeded)) {
+		test.Fatal("fragmentation needed message dropped")
+	}
+	redirect := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeRedirect, layers.ICMPv4CodeHost)
+	if filter.allows(icmpTestPacket(test, redirect)) {
+		test.Fatal("redirect message forwarded")
+	}
+
+	_, udp := parseTestPacket(createTestPacket(test, testPacketSpec{}))
+	if !filter.allows(udp) {
+		test.Fatal("non-ICMP packet dropped")
+	}
+}
+
+func TestParseICMPFilter(test *testing.T) {
+	if filter, err := parseICMPFilter(""); filter != nil || err != nil {
+		test.Fatalf("empty ICMP types not parsed as disabled filter: %v", err)
+	}
+	if _, err := parseICMPFilter("0,256"); err == nil {
+		test.Fatal("out of range ICMP type parsed")
+	}
+	if _, err := parseICMPFilter("echo"); err == nil {
+		test.Fatal("non-numeric ICMP type parsed")
+	}
+}
@@ -0,0 +1,66 @@
+package users
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of seconds of traffic that can be sent at once (in a burst) by a bandwidth limited viridian.
+const BANDWIDTH_BURST_SECONDS = 1
+
+// Bandwidth limiter structure.
+// Implements token bucket algorithm: bucket is filled with bytes at limited rate, every packet takes its size from the bucket.
+type bandwidthLimiter struct {
+	// Bucket filling rate (bytes per second).
+	rate float64
+
+	// Bucket capacity (bytes).
+	burst float64
+
+	// Number of bytes currently available in the bucket.
+	available float64
+
+	// Last time the bucket was filled.
+	last time.Time
+
+	// Mutex for bucket operations.
+	mutex sync.Mutex
+}
+
+// Create bandwidth limiter.
+// Bucket is full initially.
+// Accept bandwidth limit (kbytes per second).
+// Return bandwidth limiter pointer.
+func newBandwidthLimiter(kbytes int32) *bandwidthLimiter {
+	rate := float64(kbytes) * 1024
+	return &bandwidthLimiter{
+		rate:      rate,
+		burst:     rate * BANDWIDTH_BURST_SECONDS,
+		available: rate * BANDWIDTH_BURST_SECONDS,
+		last:      time.Now(),
+	}
+}
+
+// Check if packet fits into bandwidth limit and take its size from the bucket if it does.
+// Should be applied for bandwidthLimiter object.
+// Accept packet size (bytes).
+// Return true if packet should be transferred, false if it should be dropped.
+func (limiter *bandwidthLimiter) allow(size int) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	// Fill the bucket with bytes for the time elapsed
+	now := time.Now()
+	limiter.available += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.available > limiter.burst {
+		limiter.available = limiter.burst
+	}
+	limiter.last = now
+
+	// Take packet size from the bucket, if available
+	if float64(size) > limiter.available {
+		return false
+	}
+	limiter.available -= float64(size)
+	return true
+}
@@ -0,0 +1,28 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	LIMITER_BANDWIDTH   = 64
+	LIMITER_PACKET_SIZE = 1024
+)
+
+func TestBandwidthLimiter(test *testing.T) {
+	limiter := newBandwidthLimiter(LIMITER_BANDWIDTH)
+
+	allowed := 0
+	for limiter.allow(LIMITER_PACKET_SIZE) {
+		allowed++
+	}
+	if allowed != LIMITER_BANDWIDTH*BANDWIDTH_BURST_SECONDS {
+		test.Fatalf("unexpected number of packets allowed in burst: %d != %d", allowed, LIMITER_BANDWIDTH*BANDWIDTH_BURST_SECONDS)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if !limiter.allow(LIMITER_PACKET_SIZE) {
+		test.Fatalf("packet not allowed after bucket was refilled")
+	}
+}
@@ -0,0 +1,87 @@
+package users
+
+import (
+	"hash/fnv"
+	"math"
+	"time"
+)
+
+// Time window loop detector counts packet repetitions in.
+const LOOP_DETECTION_WINDOW = time.Second
+
+// Maximum number of packets tracked in one loop detection window, packets above the limit are not tracked.
+const LOOP_DETECTION_MAX_ENTRIES = 65536
+
+// IPv4 header fields that change while packet loops (TTL and header checksum), excluded from packet identity.
+const (
+	IPV4_TTL_OFFSET      = 8
+	IPV4_CHECKSUM_OFFSET = 10
+)
+
+// Packet loop detector structure.
+// Tracks identities of the packets read from tunnel interface and detects packets that are seen too many times in a short window.
+// Two generations of identities are kept, they are rotated every window, so that the memory is bounded.
+// NB! detector is not thread safe, it should only be used by a single goroutine.
+type loopDetector struct {
+	// Number of times a packet should be seen in one window to be considered looping.
+	threshold uint16
+
+	// Start time of the current window.
+	windowStart time.Time
+
+	// Packet identities seen in the current window with repetition numbers.
+	current map[uint64]uint16
+
+	// Packet identities seen in the previous window with repetition numbers.
+	previous map[uint64]uint16
+}
+
+// Create loop detector.
+// Accept number of times a packet should be seen in one window to be considered looping.
+// Return loop detector pointer.
+func newLoopDetector(threshold uint16) *loopDetector {
+	return &loopDetector{
+		threshold:   threshold,
+		windowStart: time.Now(),
+		current:     make(map[uint64]uint16),
+		previous:    make(map[uint64]uint16),
+	}
+}
+
+// Calculate packet identity.
+// TTL and header checksum are skipped, so that the identity of the packet does not change as it loops.
+// Accept raw IPv4 packet bytes (header should be at least 20 bytes long).
+// Return packet identity hash.
+func packetIdentity(raw []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(raw[:IPV4_TTL_OFFSET])
+	hash.Write(raw[IPV4_TTL_OFFSET+1 : IPV4_CHECKSUM_OFFSET])
+	hash.Write(raw[IPV4_CHECKSUM_OFFSET+2:])
+	return hash.Sum64()
+}
+
+// Account packet and check if it is looping.
+// Should be applied for loopDetector object.
+// Accept raw IPv4 packet bytes and current time.
+// Return true if packet was seen too many times recently, false otherwise.
+func (detector *loopDetector) observe(raw []byte, now time.Time) bool {
+	// Rotate windows if the current one is over, forget everything if both are over
+	if elapsed := now.Sub(detector.windowStart); elapsed >= 2*LOOP_DETECTION_WINDOW {
+		detector.previous, detector.current = make(map[uint64]uint16), make(map[uint64]uint16)
+		detector.windowStart = now
+	} else if elapsed >= LOOP_DETECTION_WINDOW {
+		detector.previous, detector.current = detector.current, make(map[uint64]uint16)
+		detector.windowStart = detector.windowStart.Add(LOOP_DETECTION_WINDOW)
+	}
+
+	// Count packet in the current window, if there is space
+	identity := packetIdentity(raw)
+	count, ok := detector.current[identity]
+	if (ok && count < math.MaxUint16) || (!ok && len(detector.current) < LOOP_DETECTION_MAX_ENTRIES) {
+		count++
+		detector.current[identity] = count
+	}
+
+	// Check packet repetitions in both windows
+	return uint32(count)+uint32(detector.previous[identity]) > uint32(detector.threshold)
+}
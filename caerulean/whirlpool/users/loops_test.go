@@ -0,0 +1,36 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+const LOOP_DETECTION_THRESHOLD = 4
+
+func TestLoopDetection(test *testing.T) {
+	detector := newLoopDetector(LOOP_DETECTION_THRESHOLD)
+	raw := createTestPacket(test, testPacketSpec{})
+	now := time.Now()
+
+	for i := 0; i < LOOP_DETECTION_THRESHOLD; i++ {
+		raw[IPV4_TTL_OFFSET]--
+		if detector.observe(raw, now) {
+			test.Fatalf("packet dropped as looping before threshold: %d", i+1)
+		}
+	}
+
+	raw[IPV4_TTL_OFFSET]--
+	if !detector.observe(raw, now) {
+		test.Fatal("packet not dropped as looping after threshold")
+	}
+
+	other := createTestPacket(test, testPacketSpec{})
+	other[len(other)-1] ^= 0xFF
+	if detector.observe(other, now) {
+		test.Fatal("different packet dropped as looping")
+	}
+
+	if detector.observe(raw, now.Add(2*LOOP_DETECTION_WINDOW)) {
+		test.Fatal("packet dropped as looping after detection windows passed")
+	}
+}
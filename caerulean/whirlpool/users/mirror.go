@@ -0,0 +1,87 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum number of packets waiting to be sent to mirror target.
+// Packets that do not fit will be dropped.
+const MIRROR_QUEUE_SIZE = 256
+
+// Traffic mirror structure.
+// Sends copies of encrypted viridian packets to a standby node, used for failover testing.
+// Mirroring is best-effort: if the mirror target is slow, packets are dropped.
+type Mirror struct {
+	// Connection to mirror target node.
+	connection *net.UDPConn
+
+	// Queue of packets waiting to be mirrored.
+	queue chan []byte
+}
+
+// Create traffic mirror and start sending packets to mirror target.
+// Accept context for graceful termination and mirror target address ("host:port").
+// Return mirror pointer and nil if created successfully, otherwise nil and error.
+func NewMirror(ctx context.Context, target string) (*Mirror, error) {
+	// Resolve mirror target address
+	address, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving mirror target address (%s): %v", target, err)
+	}
+
+	// Connect to mirror target
+	connection, err := net.DialUDP("udp4", nil, address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to mirror target (%s): %v", target, err)
+	}
+
+	// Create mirror and start sending packets
+	mirror := &Mirror{
+		connection: connection,
+		queue:      make(chan []byte, MIRROR_QUEUE_SIZE),
+	}
+	go mirror.run(ctx)
+
+	// Return mirror pointer
+	return mirror, nil
+}
+
+// Schedule packet for mirroring.
+// Packet is copied, so the buffer can be reused after the call, the call never blocks.
+// Should be applied for Mirror object.
+// Accept packet bytes.
+// Return true if packet was scheduled, false if it was dropped.
+func (mirror *Mirror) Send(packet []byte) bool {
+	select {
+	case mirror.queue <- append([]byte(nil), packet...):
+		return true
+	default:
+		return false
+	}
+}
+
+// Send scheduled packets to mirror target.
+// Should be applied for Mirror object.
+// Accept context for graceful termination.
+// NB! this method is blocking, so it should be run as goroutine.
+func (mirror *Mirror) run(ctx context.Context) {
+	defer mirror.connection.Close()
+
+	logrus.Debugf("Mirroring packets to %v started", mirror.connection.RemoteAddr())
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Debugf("Mirroring packets to %v stopped", mirror.connection.RemoteAddr())
+			return
+		case packet := <-mirror.queue:
+			s, err := mirror.connection.Write(packet)
+			if err != nil || s == 0 {
+				logrus.Warnf("Error writing to mirror (%d bytes written): %v", s, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	MIRROR_PACKETS_NUMBER = 8
+	MIRROR_READ_TIMEOUT   = time.Second
+)
+
+func TestMirrorDelivery(test *testing.T) {
+	address, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("error resolving local address: %v", err)
+	}
+
+	standby, err := net.ListenUDP("udp4", address)
+	if err != nil {
+		test.Fatalf("error resolving connection (%s): %v", address.String(), err)
+	}
+	defer standby.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mirror, err := NewMirror(ctx, standby.LocalAddr().String())
+	if err != nil {
+		test.Fatalf("error creating mirror: %v", err)
+	}
+
+	packet := []byte{0}
+	for i := 0; i < MIRROR_PACKETS_NUMBER; i++ {
+		packet[0] = byte(i)
+		if !mirror.Send(packet) {
+			test.Fatalf("packet %d was not scheduled for mirroring", i)
+		}
+	}
+
+	buffer := make([]byte, 64)
+	standby.SetReadDeadline(time.Now().Add(MIRROR_READ_TIMEOUT))
+	for i := 0; i < MIRROR_PACKETS_NUMBER; i++ {
+		r, err := standby.Read(buffer)
+		if err != nil {
+			test.Fatalf("error reading mirrored packet %d: %v", i, err)
+		}
+		if !bytes.Equal(buffer[:r], []byte{byte(i)}) {
+			test.Fatalf("mirrored packet doesn't match sent: %v != %v", buffer[:r], []byte{byte(i)})
+		}
+	}
+}
+
+func TestMirrorDropsWhenSlow(test *testing.T) {
+	mirror := &Mirror{
+		queue: make(chan []byte, 1),
+	}
+
+	if !mirror.Send([]byte{0}) {
+		test.Fatalf("first packet was not scheduled for mirroring")
+	}
+
+	start := time.Now()
+	if mirror.Send([]byte{1}) {
+		test.Fatalf("packet was scheduled for mirroring while queue was full")
+	}
+
+	if elapsed := time.Since(start); elapsed > MIRROR_READ_TIMEOUT {
+		test.Fatalf("sending to full mirror blocked for %v", elapsed)
+	}
+}
@@ -0,0 +1,296 @@
+package users
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+)
+
+// NetFlow protocol version.
+const NETFLOW_VERSION = 9
+
+// NetFlow template ID used for whirlpool flow records.
+const NETFLOW_TEMPLATE_ID = 256
+
+// Maximum number of flow records in a single NetFlow packet (keeps packets below typical MTU).
+const NETFLOW_RECORDS_PER_PACKET = 30
+
+// Maximum number of flows tracked between exports, packets of new flows are not accounted if the limit is reached.
+const NETFLOW_MAX_FLOWS = 65536
+
+// NetFlow packet header length.
+const NETFLOW_HEADER_LENGTH = 20
+
+// NetFlow flow record template: pairs of field type and field length.
+// Viridian ID is exported as input interface index (INPUT_SNMP field).
+var NETFLOW_TEMPLATE = [][2]uint16{
+	{8, 4},  // IPV4_SRC_ADDR
+	{12, 4}, // IPV4_DST_ADDR
+	{7, 2},  // L4_SRC_PORT
+	{11, 2}, // L4_DST_PORT
+	{4, 1},  // PROTOCOL
+	{61, 1}, // DIRECTION
+	{10, 2}, // INPUT_SNMP
+	{2, 8},  // IN_PKTS
+	{1, 8},  // IN_BYTES
+	{22, 4}, // FIRST_SWITCHED
+	{21, 4}, // LAST_SWITCHED
+}
+
+// Flow identifier: packet 5-tuple and direction.
+type flowKey struct {
+	// Packet source IP address.
+	source [4]byte
+
+	// Packet destination IP address.
+	destination [4]byte
+
+	// Packet source port (0 for protocols without ports).
+	sourcePort uint16
+
+	// Packet destination port (0 for protocols without ports).
+	destinationPort uint16
+
+	// Packet transport protocol.
+	protocol uint8
+
+	// Flag, whether packets are sent to viridian (egress) or received from viridian (ingress).
+	egress bool
+}
+
+// Create flow identifier of a packet.
+// Accept flag if packet is sent to viridian, packet IP layer header and parsed packet.
+// Return flow identifier.
+func newFlowKey(egress bool, netLayer *layers.IPv4, packet gopacket.Packet) flowKey {
+	key := flowKey{protocol: uint8(netLayer.Protocol), egress: egress}
+	copy(key.source[:], netLayer.SrcIP.To4())
+	copy(key.destination[:], netLayer.DstIP.To4())
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		key.sourcePort, key.destinationPort = uint16(transport.SrcPort), uint16(transport.DstPort)
+	case *layers.UDP:
+		key.sourcePort, key.destinationPort = uint16(transport.SrcPort), uint16(transport.DstPort)
+	}
+	return key
+}
+
+// Flow record structure, accumulates statistics of a single flow.
+type flowRecord struct {
+	// Viridian the flow belongs to.
+	userID uint16
+
+	// Number of packets in flow.
+	packets uint64
+
+	// Number of bytes in flow (IP packet lengths).
+	bytes uint64
+
+	// Exporter uptime of the first flow packet.
+	first time.Duration
+
+	// Exporter uptime of the last flow packet.
+	last time.Duration
+}
+
+// Flow exporter structure.
+// Aggregates packet flows with viridian attribution and exports them to NetFlow v9 collector periodically.
+// All the flows are exported and forgotten every export interval, so the memory is bounded.
+type FlowExporter struct {
+	// Connection to NetFlow collector.
+	connection *net.UDPConn
+
+	// Exporter start time, NetFlow system uptime is calculated from it.
+	start time.Time
+
+	// Flows observed since the last export.
+	flows map[flowKey]*flowRecord
+
+	// Number of NetFlow packets exported.
+	sequence uint32
+
+	// Mutex for flow operations.
+	mutex sync.Mutex
+}
+
+// Create flow exporter and start exporting flows to NetFlow collector.
+// Accept context for graceful termination, collector address ("host:port") and export interval.
+// Return flow exporter pointer and nil if created successfully, otherwise nil and error.
+func NewFlowExporter(ctx context.Context, collector string, interval time.Duration) (*FlowExporter, error) {
+	// Check export interval
+	if interval <= 0 {
+		return nil, fmt.Errorf("flow export interval should be positive: %v", interval)
+	}
+
+	// Resolve collector address
+	address, err := net.ResolveUDPAddr("udp4", collector)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving flow collector address (%s): %v", collector, err)
+	}
+
+	// Connect to collector
+	connection, err := net.DialUDP("udp4", nil, address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to flow collector (%s): %v", collector, err)
+	}
+
+	// Create exporter and start exporting flows
+	exporter := &FlowExporter{
+		connection: connection,
+		start:      time.Now(),
+		flows:      make(map[flowKey]*flowRecord),
+	}
+	go exporter.run(ctx, interval)
+
+	// Return exporter pointer
+	return exporter, nil
+}
+
+// Account packet in its flow.
+// Should be applied for FlowExporter object.
+// Accept viridian ID, flag if packet is sent to viridian, packet IP layer header and parsed packet.
+func (exporter *FlowExporter) Observe(userID uint16, egress bool, netLayer *layers.IPv4, packet gopacket.Packet) {
+	key := newFlowKey(egress, netLayer, packet)
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	// Find flow record or create a new one, if there is space
+	uptime := time.Since(exporter.start)
+	record, ok := exporter.flows[key]
+	if !ok {
+		if len(exporter.flows) >= NETFLOW_MAX_FLOWS {
+			return
+		}
+		record = &flowRecord{userID: userID, first: uptime}
+		exporter.flows[key] = record
+	}
+
+	// Update flow record
+	record.packets++
+	record.bytes += uint64(netLayer.Length)
+	record.last = uptime
+}
+
+// Export all the observed flows to collector and forget them.
+// Should be applied for FlowExporter object.
+// Return nil if exported successfully, otherwise error.
+func (exporter *FlowExporter) export() error {
+	// Take observed flows and replace them with an empty map
+	exporter.mutex.Lock()
+	flows := exporter.flows
+	exporter.flows = make(map[flowKey]*flowRecord)
+	exporter.mutex.Unlock()
+
+	// Collect flow identifiers
+	keys := make([]flowKey, 0, len(flows))
+	for key := range flows {
+		keys = append(keys, key)
+	}
+
+	// Send NetFlow packets, limited number of records each
+	for begin := 0; begin < len(keys); begin += NETFLOW_RECORDS_PER_PACKET {
+		end := begin + NETFLOW_RECORDS_PER_PACKET
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		packet := exporter.encode(keys[begin:end], flows, time.Now())
+		s, err := exporter.connection.Write(packet)
+		if err != nil || s == 0 {
+			return fmt.Errorf("error writing to flow collector (%d bytes written): %v", s, err)
+		}
+	}
+
+	// Return no error
+	return nil
+}
+
+// Encode flow records into a NetFlow v9 packet.
+// Every packet contains template flowset followed by data flowset.
+// Should be applied for FlowExporter object.
+// Accept flow identifiers to encode, flow records and current time.
+// Return NetFlow packet bytes.
+func (exporter *FlowExporter) encode(keys []flowKey, flows map[flowKey]*flowRecord, now time.Time) []byte {
+	// Calculate record and flowset lengths, data flowset is padded to 4 bytes
+	recordLength := 0
+	for _, field := range NETFLOW_TEMPLATE {
+		recordLength += int(field[1])
+	}
+	templateLength := 8 + 4*len(NETFLOW_TEMPLATE)
+	dataLength := 4 + recordLength*len(keys)
+	dataLength += (4 - dataLength%4) % 4
+
+	// Write packet header
+	packet := make([]byte, NETFLOW_HEADER_LENGTH+templateLength+dataLength)
+	binary.BigEndian.PutUint16(packet[0:], NETFLOW_VERSION)
+	binary.BigEndian.PutUint16(packet[2:], uint16(1+len(keys)))
+	binary.BigEndian.PutUint32(packet[4:], uint32(now.Sub(exporter.start).Milliseconds()))
+	binary.BigEndian.PutUint32(packet[8:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(packet[12:], exporter.sequence)
+	exporter.sequence++
+
+	// Write template flowset
+	template := packet[NETFLOW_HEADER_LENGTH:]
+	binary.BigEndian.PutUint16(template[2:], uint16(templateLength))
+	binary.BigEndian.PutUint16(template[4:], NETFLOW_TEMPLATE_ID)
+	binary.BigEndian.PutUint16(template[6:], uint16(len(NETFLOW_TEMPLATE)))
+	for i, field := range NETFLOW_TEMPLATE {
+		binary.BigEndian.PutUint16(template[8+4*i:], field[0])
+		binary.BigEndian.PutUint16(template[10+4*i:], field[1])
+	}
+
+	// Write data flowset (padding is left zeroed)
+	data := packet[NETFLOW_HEADER_LENGTH+templateLength:]
+	binary.BigEndian.PutUint16(data[0:], NETFLOW_TEMPLATE_ID)
+	binary.BigEndian.PutUint16(data[2:], uint16(dataLength))
+	for i, key := range keys {
+		record := flows[key]
+		entry := data[4+recordLength*i:]
+		copy(entry[0:], key.source[:])
+		copy(entry[4:], key.destination[:])
+		binary.BigEndian.PutUint16(entry[8:], key.sourcePort)
+		binary.BigEndian.PutUint16(entry[10:], key.destinationPort)
+		entry[12] = key.protocol
+		if key.egress {
+			entry[13] = 1
+		}
+		binary.BigEndian.PutUint16(entry[14:], record.userID)
+		binary.BigEndian.PutUint64(entry[16:], record.packets)
+		binary.BigEndian.PutUint64(entry[24:], record.bytes)
+		binary.BigEndian.PutUint32(entry[32:], uint32(record.first.Milliseconds()))
+		binary.BigEndian.PutUint32(entry[36:], uint32(record.last.Milliseconds()))
+	}
+
+	// Return packet
+	return packet
+}
+
+// Export observed flows to collector periodically.
+// Should be applied for FlowExporter object.
+// Accept context for graceful termination and export interval.
+// NB! this method is blocking, so it should be run as goroutine.
+func (exporter *FlowExporter) run(ctx context.Context, interval time.Duration) {
+	defer exporter.connection.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logrus.Debugf("Exporting flows to %v started", exporter.connection.RemoteAddr())
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Debugf("Exporting flows to %v stopped", exporter.connection.RemoteAddr())
+			return
+		case <-ticker.C:
+			if err := exporter.export(); err != nil {
+				logrus.Warnf("Error exporting flows: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package users
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	NETFLOW_TEST_USER_ID     = 12345
+	NETFLOW_TEST_PAYLOAD     = 100
+	NETFLOW_TEST_INTERVAL    = 100 * time.Millisecond
+	NETFLOW_TEST_READ_TIME   = 2 * time.Second
+	NETFLOW_TEST_FIRST_PORT  = 10000
+	NETFLOW_TEST_SECOND_PORT = 20000
+)
+
+var NETFLOW_TEST_SOURCE = net.IPv4(172, 16, 48, 57)
+
+func TestFlowExporter(test *testing.T) {
+	address, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("error resolving local address: %v", err)
+	}
+
+	collector, err := net.ListenUDP("udp4", address)
+	if err != nil {
+		test.Fatalf("error resolving connection (%s): %v", address.String(), err)
+	}
+	defer collector.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exporter, err := NewFlowExporter(ctx, collector.LocalAddr().String(), NETFLOW_TEST_INTERVAL)
+	if err != nil {
+		test.Fatalf("error creating flow exporter: %v", err)
+	}
+
+	expected := map[uint16]uint64{NETFLOW_TEST_FIRST_PORT: 3, NETFLOW_TEST_SECOND_PORT: 2}
+	for port, number := range expected {
+		for i := uint64(0); i < number; i++ {
+			netLayer, packet := parseTestPacket(createTestPacket(test, testPacketSpec{source: NETFLOW_TEST_SOURCE, sourcePort: port, payload: make([]byte, NETFLOW_TEST_PAYLOAD)}))
+			exporter.Observe(NETFLOW_TEST_USER_ID, false, netLayer, packet)
+		}
+	}
+
+	buffer := make([]byte, 1500)
+	collector.SetReadDeadline(time.Now().Add(NETFLOW_TEST_READ_TIME))
+	r, err := collector.Read(buffer)
+	if err != nil {
+		test.Fatalf("error reading flow export packet: %v", err)
+	}
+	packet := buffer[:r]
+
+	if version := binary.BigEndian.Uint16(packet[0:]); version != NETFLOW_VERSION {
+		test.Fatalf("unexpected NetFlow version: %d != %d", version, NETFLOW_VERSION)
+	}
+	if count := binary.BigEndian.Uint16(packet[2:]); int(count) != 1+len(expected) {
+		test.Fatalf("unexpected NetFlow record count: %d != %d", count, 1+len(expected))
+	}
+
+	template := packet[NETFLOW_HEADER_LENGTH:]
+	templateLength := int(binary.BigEndian.Uint16(template[2:]))
+	if flowsetID, templateID := binary.BigEndian.Uint16(template[0:]), binary.BigEndian.Uint16(template[4:]); flowsetID != 0 || templateID != NETFLOW_TEMPLATE_ID {
+		test.Fatalf("unexpected NetFlow template flowset: %d, %d", flowsetID, templateID)
+	}
+
+	data := template[templateLength:]
+	if flowsetID := binary.BigEndian.Uint16(data[0:]); flowsetID != NETFLOW_TEMPLATE_ID {
+		test.Fatalf("unexpected NetFlow data flowset: %d != %d", flowsetID, NETFLOW_TEMPLATE_ID)
+	}
+	if dataLength := int(binary.BigEndian.Uint16(data[2:])); dataLength != len(data) || dataLength%4 != 0 {
+		test.Fatalf("unexpected NetFlow data flowset length: %d (packet remainder %d)", dataLength, len(data))
+	}
+
+	records := len(expected)
+	recordLength := (len(data) - 4) / records
+	for i := 0; i < records; i++ {
+		record := data[4+recordLength*i:]
+		port := binary.BigEndian.Uint16(record[8:])
+		userID := binary.BigEndian.Uint16(record[14:])
+		packets := binary.BigEndian.Uint64(record[16:])
+		bytes := binary.BigEndian.Uint64(record[24:])
+
+		if !net.IP(record[0:4]).Equal(NETFLOW_TEST_SOURCE) || record[12] != uint8(layers.IPProtocolUDP) || record[13] != 0 {
+			test.Fatalf("unexpected flow record identifier: %v", record[:14])
+		}
+		if userID != NETFLOW_TEST_USER_ID {
+			test.Fatalf("flow record viridian doesn't match expected: %d != %d", userID, NETFLOW_TEST_USER_ID)
+		}
+		if packets != expected[port] {
+			test.Fatalf("flow record packets from port %d don't match expected: %d != %d", port, packets, expected[port])
+		}
+		if packetLength := uint64(20 + 8 + NETFLOW_TEST_PAYLOAD); bytes != packets*packetLength {
+			test.Fatalf("flow record bytes from port %d don't match expected: %d != %d", port, bytes, packets*packetLength)
+		}
+		delete(expected, port)
+	}
+
+	if len(expected) != 0 {
+		test.Fatalf("flows were not exported: %v", expected)
+	}
+}
@@ -0,0 +1,91 @@
+package users
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	TEST_PACKET_SOURCE_PORT      = 12345
+	TEST_PACKET_DESTINATION_PORT = 53
+	TEST_PACKET_PAYLOAD_LENGTH   = 1000
+)
+
+// Test packet specification, unset fields are replaced with defaults:
+// UDP packet from 192.168.0.2:12345 to 8.8.8.8:53 with 1000 zero bytes of payload.
+type testPacketSpec struct {
+	// Transport protocol, either UDP or ICMPv4.
+	protocol layers.IPProtocol
+
+	// Source IP address.
+	source net.IP
+
+	// UDP source port.
+	sourcePort uint16
+
+	// IP identification field.
+	id uint16
+
+	// IP flags.
+	flags layers.IPv4Flag
+
+	// ICMP type and code (ICMPv4 packets only).
+	typeCode layers.ICMPv4TypeCode
+
+	// Packet payload.
+	payload []byte
+}
+
+// Serialize IPv4 test packet with valid checksums and lengths.
+// Return packet bytes.
+func createTestPacket(test testing.TB, spec testPacketSpec) []byte {
+	if spec.protocol == 0 {
+		spec.protocol = layers.IPProtocolUDP
+	}
+	if spec.source == nil {
+		spec.source = net.IPv4(192, 168, 0, 2)
+	}
+	if spec.sourcePort == 0 {
+		spec.sourcePort = TEST_PACKET_SOURCE_PORT
+	}
+	if spec.payload == nil {
+		spec.payload = make([]byte, TEST_PACKET_PAYLOAD_LENGTH)
+	}
+
+	netLayer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Id:       spec.id,
+		Flags:    spec.flags,
+		Protocol: spec.protocol,
+		SrcIP:    spec.source.To4(),
+		DstIP:    net.IPv4(8, 8, 8, 8).To4(),
+	}
+
+	var transportLayer gopacket.SerializableLayer
+	if spec.protocol == layers.IPProtocolICMPv4 {
+		transportLayer = &layers.ICMPv4{TypeCode: spec.typeCode}
+	} else {
+		udpLayer := &layers.UDP{SrcPort: layers.UDPPort(spec.sourcePort), DstPort: TEST_PACKET_DESTINATION_PORT}
+		udpLayer.SetNetworkLayerForChecksum(netLayer)
+		transportLayer = udpLayer
+	}
+
+	serialBuffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(serialBuffer, options, netLayer, transportLayer, gopacket.Payload(spec.payload)); err != nil {
+		test.Fatalf("error serializing test packet: %v", err)
+	}
+	return serialBuffer.Bytes()
+}
+
+// Parse IPv4 test packet.
+// Return packet IP layer header and parsed packet.
+func parseTestPacket(raw []byte) (*layers.IPv4, gopacket.Packet) {
+	packet := gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.Default)
+	return packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4), packet
+}
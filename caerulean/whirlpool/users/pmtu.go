@@ -0,0 +1,62 @@
+package users
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Number of original packet data bytes (following IP header) included into ICMP error message.
+const ICMP_ORIGINAL_DATA_LENGTH = 8
+
+// Default TTL value for the ICMP packets generated by whirlpool.
+const ICMP_DEFAULT_TTL = 64
+
+// Check if packet can not be forwarded to external interface without fragmentation.
+// That is true if the packet is larger than the external interface MTU and its "don't fragment" flag is set.
+// Accept packet IP layer header, packet length and external interface MTU (check is disabled if MTU is not positive).
+// Return true if packet exceeds path MTU, false otherwise.
+func exceedsPathMTU(header *layers.IPv4, length, mtu int) bool {
+	return mtu > 0 && length > mtu && header.Flags&layers.IPv4DontFragment != 0
+}
+
+// Create ICMP "destination unreachable: fragmentation needed" packet (RFC 792, RFC 1191).
+// The packet is addressed to the original packet source and contains next-hop MTU and the beginning of the original packet.
+// Accept original packet bytes, original packet IP layer header, ICMP packet source address and next-hop MTU.
+// Return serialized ICMP packet and nil if created successfully, otherwise nil and error.
+func createFragmentationNeeded(original []byte, header *layers.IPv4, source net.IP, mtu int) ([]byte, error) {
+	// Include original IP header and first data bytes into ICMP payload
+	payloadLength := int(header.IHL)*4 + ICMP_ORIGINAL_DATA_LENGTH
+	if payloadLength > len(original) {
+		payloadLength = len(original)
+	}
+
+	// Create IP layer header, addressed back to the original packet source
+	netLayer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      ICMP_DEFAULT_TTL,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    source,
+		DstIP:    header.SrcIP,
+	}
+
+	// Create ICMP layer header, next-hop MTU is stored in the lower 16 bits of the unused field
+	icmpLayer := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+		Seq:      uint16(mtu),
+	}
+
+	// Serialize the packet
+	serialBuffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	err := gopacket.SerializeLayers(serialBuffer, options, netLayer, icmpLayer, gopacket.Payload(original[:payloadLength]))
+	if err != nil {
+		return nil, fmt.Errorf("error serializing ICMP packet: %v", err)
+	}
+
+	// Return packet bytes
+	return serialBuffer.Bytes(), nil
+}
@@ -0,0 +1,97 @@
+package users
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	PMTU_EXTERNAL_MTU  = 1500
+	PMTU_PACKET_LENGTH = 2000
+	PMTU_GATEWAY_IP    = "172.16.0.1"
+	PMTU_SOURCE_IP     = "192.168.0.2"
+	PMTU_DESTINATION   = "8.8.8.8"
+)
+
+func createPMTUTestPacket(test *testing.T, flags layers.IPv4Flag) ([]byte, *layers.IPv4) {
+	raw := createTestPacket(test, testPacketSpec{source: net.ParseIP(PMTU_SOURCE_IP), flags: flags, payload: make([]byte, PMTU_PACKET_LENGTH-28)})
+	header, _ := parseTestPacket(raw)
+	return raw, header
+}
+
+func TestExceedsPathMTU(test *testing.T) {
+	raw, header := createPMTUTestPacket(test, layers.IPv4DontFragment)
+	if !exceedsPathMTU(header, len(raw), PMTU_EXTERNAL_MTU) {
+		test.Fatalf("oversized packet with DF flag not detected: %d > %d", len(raw), PMTU_EXTERNAL_MTU)
+	}
+	if exceedsPathMTU(header, len(raw), 0) {
+		test.Fatalf("oversized packet detected while check is disabled")
+	}
+	if exceedsPathMTU(header, PMTU_EXTERNAL_MTU, PMTU_EXTERNAL_MTU) {
+		test.Fatalf("packet fitting MTU detected as oversized: %d", PMTU_EXTERNAL_MTU)
+	}
+
+	raw, header = createPMTUTestPacket(test, 0)
+	if exceedsPathMTU(header, len(raw), PMTU_EXTERNAL_MTU) {
+		test.Fatalf("oversized packet without DF flag detected")
+	}
+}
+
+func TestCreateFragmentationNeeded(test *testing.T) {
+	raw, header := createPMTUTestPacket(test, layers.IPv4DontFragment)
+	gateway := net.ParseIP(PMTU_GATEWAY_IP).To4()
+
+	icmp, err := createFragmentationNeeded(raw, header, gateway, PMTU_EXTERNAL_MTU)
+	if err != nil {
+		test.Fatalf("error creating ICMP packet: %v", err)
+	}
+
+	packet := gopacket.NewPacket(icmp, layers.LayerTypeIPv4, gopacket.Default)
+	if err := packet.ErrorLayer(); err != nil {
+		test.Fatalf("error decoding ICMP packet: %v", err)
+	}
+
+	netLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		test.Fatalf("IP layer not found in ICMP packet")
+	}
+	if !netLayer.SrcIP.Equal(gateway) || !netLayer.DstIP.Equal(header.SrcIP) {
+		test.Fatalf("ICMP packet addresses don't match expected: %v -> %v != %v -> %v", netLayer.SrcIP, netLayer.DstIP, gateway, header.SrcIP)
+	}
+	if int(netLayer.Length) != len(icmp) {
+		test.Fatalf("ICMP packet length doesn't match expected: %d != %d", netLayer.Length, len(icmp))
+	}
+
+	icmpLayer, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok {
+		test.Fatalf("ICMP layer not found in ICMP packet")
+	}
+	expectedTypeCode := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded)
+	if icmpLayer.TypeCode != expectedTypeCode {
+		test.Fatalf("ICMP type code doesn't match expected: %v != %v", icmpLayer.TypeCode, expectedTypeCode)
+	}
+	if icmpLayer.Seq != PMTU_EXTERNAL_MTU {
+		test.Fatalf("ICMP next-hop MTU doesn't match expected: %d != %d", icmpLayer.Seq, PMTU_EXTERNAL_MTU)
+	}
+
+	expectedPayload := raw[:int(header.IHL)*4+ICMP_ORIGINAL_DATA_LENGTH]
+	if !bytes.Equal(icmpLayer.Payload, expectedPayload) {
+		test.Fatalf("ICMP payload doesn't match original packet beginning: %v != %v", icmpLayer.Payload, expectedPayload)
+	}
+
+	checksum := uint32(0)
+	data := append(append([]byte{}, icmpLayer.Contents...), icmpLayer.Payload...)
+	for i := 0; i+1 < len(data); i += 2 {
+		checksum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	for checksum > 0xffff {
+		checksum = (checksum >> 16) + (checksum & 0xffff)
+	}
+	if checksum != 0xffff {
+		test.Fatalf("ICMP checksum is invalid: %x", icmpLayer.Checksum)
+	}
+}
@@ -0,0 +1,153 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"main/utils"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum number of attempts to get a viridian connection port that is not reserved.
+const RESERVATION_LISTEN_ATTEMPTS = 16
+
+// Delay before the first viridian connection retry, doubled after every retry.
+const LISTEN_RETRY_BACKOFF = 10 * time.Millisecond
+
+// Socket option allowing several sockets to listen on the same port (not defined in "syscall" package).
+const SO_REUSEPORT = 0xf
+
+// UDP listening function, can be replaced in tests.
+var listenUDP = net.ListenUDP
+
+// Parse viridian ID reservations.
+// Reservations are separated by commas, every reservation has format "uid:id",
+// where uid is viridian unique identifier and id is its reserved viridian ID (connection port number).
+// Accept reservations string.
+// Return reserved IDs by unique identifiers and nil if parsed successfully, otherwise nil and error.
+func parseReservations(value string) (map[string]uint16, error) {
+	reservations := make(map[string]uint16)
+	if value == "" {
+		return reservations, nil
+	}
+
+	reserved := make(map[uint16]string)
+	for _, entry := range strings.Split(value, ",") {
+		// Split reservation into unique identifier and ID, the identifier itself can contain colons
+		separator := strings.LastIndex(entry, ":")
+		if separator <= 0 {
+			return nil, fmt.Errorf("invalid reservation format: %s", entry)
+		}
+		uid := entry[:separator]
+
+		// Parse and validate reserved ID
+		userID, err := strconv.ParseUint(entry[separator+1:], 10, 16)
+		if err != nil || userID == 0 {
+			return nil, fmt.Errorf("invalid reserved ID: %s", entry)
+		} else if utils.IsSpecialIPAddress(uint16(userID)) {
+			return nil, fmt.Errorf("reserved ID %d makes special IP address", userID)
+		}
+
+		// Check reservation collisions
+		if _, ok := reservations[uid]; ok {
+			return nil, fmt.Errorf("ID reserved twice for identifier %s", uid)
+		} else if owner, ok := reserved[uint16(userID)]; ok {
+			return nil, fmt.Errorf("ID %d reserved for both %s and %s", userID, owner, uid)
+		}
+
+		reservations[uid] = uint16(userID)
+		reserved[uint16(userID)] = uid
+	}
+	return reservations, nil
+}
+
+// Listen on UDP port that can be shared with another socket (SO_REUSEPORT).
+// Reserved ports are shared, so that the new connection of a reconnecting viridian is created while the previous one still exists.
+// Accept network name and local address.
+// Return UDP connection and nil if created successfully, otherwise nil and error.
+func listenSharedUDP(network string, address *net.UDPAddr) (*net.UDPConn, error) {
+	config := net.ListenConfig{Control: func(_, _ string, raw syscall.RawConn) error {
+		var optionErr error
+		err := raw.Control(func(fd uintptr) {
+			optionErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return optionErr
+	}}
+
+	connection, err := config.ListenPacket(context.Background(), network, address.String())
+	if err != nil {
+		return nil, err
+	}
+	return connection.(*net.UDPConn), nil
+}
+
+// Check if viridian ID is reserved for another viridian.
+// Should be applied for ViridianDict object.
+// Accept viridian ID.
+// Return true if the ID is reserved, false otherwise.
+func (dict *ViridianDict) isReserved(userID uint16) bool {
+	_, ok := dict.reserved[userID]
+	return ok
+}
+
+// Create viridian connection.
+// Viridians with reserved IDs listen on their reserved port (shared with their previous connection until it is stopped),
+// the other viridians listen on a port chosen by kernel,
+// ports reserved for other viridians are never used (if kernel chooses such a port, it is kept busy until another port is chosen).
+// Should be applied for ViridianDict object.
+// Accept internal IP address and viridian unique identifier.
+// Return viridian connection and nil if created successfully, otherwise nil and error.
+func (dict *ViridianDict) listenViridian(internalAddress net.IP, uid string) (*net.UDPConn, error) {
+	// Listen on reserved port, if viridian has one
+	if userID, ok := dict.reservations[uid]; ok {
+		return listenSharedUDP("udp4", &net.UDPAddr{IP: internalAddress, Port: int(userID)})
+	}
+
+	// Keep reserved ports busy until a free port is chosen
+	busy := make([]*net.UDPConn, 0)
+	defer func() {
+		for _, connection := range busy {
+			connection.Close()
+		}
+	}()
+
+	// Listen on port chosen by kernel until it is not reserved
+	for attempt := 0; attempt < RESERVATION_LISTEN_ATTEMPTS; attempt++ {
+		connection, err := listenUDP("udp4", &net.UDPAddr{IP: internalAddress, Port: 0})
+		if err != nil {
+			return nil, err
+		}
+		if !dict.isReserved(uint16(connection.LocalAddr().(*net.UDPAddr).Port)) {
+			return connection, nil
+		}
+		busy = append(busy, connection)
+	}
+	return nil, fmt.Errorf("no free port found in %d attempts", RESERVATION_LISTEN_ATTEMPTS)
+}
+
+// Create viridian connection, retrying failures with exponential backoff.
+// Listening may fail transiently under resource pressure (e.g. file descriptor or buffer exhaustion), so that otherwise valid viridians are not rejected.
+// Should be applied for ViridianDict object, dictionary mutex should NOT be locked, as retries sleep.
+// Accept internal IP address and viridian unique identifier.
+// Return viridian connection and nil if created successfully, otherwise nil and the last error.
+func (dict *ViridianDict) listenViridianRetrying(internalAddress net.IP, uid string) (*net.UDPConn, error) {
+	backoff := LISTEN_RETRY_BACKOFF
+	for retry := 0; ; retry++ {
+		connection, err := dict.listenViridian(internalAddress, uid)
+		if err == nil || retry >= dict.listenRetries {
+			return connection, err
+		}
+
+		logrus.Warnf("Error creating viridian %s connection (retry %d of %d in %v): %v", uid, retry+1, dict.listenRetries, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,205 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"main/generated"
+	"main/tunnel"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	RESERVATION_STATIC_UID  = "test_static_uid"
+	RESERVATION_DYNAMIC_UID = "test_dynamic_uid"
+
+	RESERVATION_TRANSIENT_FAILURES = 2
+)
+
+var RESERVATION_LOCAL_ADDRESS = net.IPv4(127, 0, 0, 1)
+
+func TestParseReservations(test *testing.T) {
+	reservations, err := parseReservations("first:1000,second:host:2000")
+	if err != nil {
+		test.Fatalf("error parsing reservations: %v", err)
+	}
+	if len(reservations) != 2 || reservations["first"] != 1000 || reservations["second:host"] != 2000 {
+		test.Fatalf("unexpected reservations parsed: %v", reservations)
+	}
+
+	for _, invalid := range []string{"first", ":1000", "first:0", "first:65536", "first:1", "first:65535", "first:1000,first:2000", "first:1000,second:1000"} {
+		if _, err := parseReservations(invalid); err == nil {
+			test.Fatalf("invalid reservations parsed: %s", invalid)
+		}
+	}
+}
+
+func TestReservedReconnect(test *testing.T) {
+	free, err := net.ListenUDP("udp4", &net.UDPAddr{IP: RESERVATION_LOCAL_ADDRESS, Port: 0})
+	if err != nil {
+		test.Fatalf("error finding free port: %v", err)
+	}
+	reservedID := uint16(free.LocalAddr().(*net.UDPAddr).Port)
+	free.Close()
+
+	dict := ViridianDict{
+		reservations: map[string]uint16{RESERVATION_STATIC_UID: reservedID},
+		reserved:     map[uint16]string{reservedID: RESERVATION_STATIC_UID},
+	}
+
+	for i := 0; i < 2; i++ {
+		connection, err := dict.listenViridian(RESERVATION_LOCAL_ADDRESS, RESERVATION_STATIC_UID)
+		if err != nil {
+			test.Fatalf("error listening on reserved port (connection %d): %v", i, err)
+		}
+		if port := connection.LocalAddr().(*net.UDPAddr).Port; port != int(reservedID) {
+			test.Fatalf("reserved viridian got unexpected ID (connection %d): %d != %d", i, port, reservedID)
+		}
+		connection.Close()
+	}
+
+	connection, err := dict.listenViridian(RESERVATION_LOCAL_ADDRESS, RESERVATION_DYNAMIC_UID)
+	if err != nil {
+		test.Fatalf("error listening on dynamic port: %v", err)
+	}
+	defer connection.Close()
+	if dict.isReserved(uint16(connection.LocalAddr().(*net.UDPAddr).Port)) {
+		test.Fatalf("dynamic viridian got reserved ID: %d", reservedID)
+	}
+}
+
+func TestReservedReconnectValidated(test *testing.T) {
+	test.Setenv("SEASIDE_ADDRESS", RESERVATION_LOCAL_ADDRESS.String())
+
+	free, err := net.ListenUDP("udp4", &net.UDPAddr{IP: RESERVATION_LOCAL_ADDRESS, Port: 0})
+	if err != nil {
+		test.Fatalf("error finding free port: %v", err)
+	}
+	reservedID := uint16(free.LocalAddr().(*net.UDPAddr).Port)
+	free.Close()
+
+	dict := createTransferTestDict()
+	dict.maxViridians = DIRECTORY_LIMITS_VIRIDIANS
+	dict.reservations = map[string]uint16{RESERVATION_STATIC_UID: reservedID}
+	dict.reserved = map[uint16]string{reservedID: RESERVATION_STATIC_UID}
+	dict.sockets = make(map[uint16]*net.UDPConn)
+	defer dict.Clear()
+
+	connection, err := dict.listenViridian(RESERVATION_LOCAL_ADDRESS, RESERVATION_STATIC_UID)
+	if err != nil {
+		test.Fatalf("error listening on reserved port: %v", err)
+	}
+	_, cancel := context.WithCancel(context.Background())
+	previous := &Viridian{
+		UID:           RESERVATION_STATIC_UID,
+		connected:     time.Now(),
+		reset:         time.AfterFunc(time.Hour, func() {}),
+		CancelContext: cancel,
+		SeaConn:       connection,
+	}
+	dict.insert(reservedID, previous)
+
+	session := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(session); err != nil {
+		test.Fatalf("symmetrical key reading error: %v", err)
+	}
+	token := &generated.UserToken{Uid: RESERVATION_STATIC_UID, Session: session, Subscription: timestamppb.New(time.Now().Add(-time.Hour))}
+
+	// Reconnection that fails validation should not evict the previous connection
+	if _, err := dict.Add(context.Background(), token, RESERVATION_LOCAL_ADDRESS, RESERVATION_LOCAL_ADDRESS, 0); status.Code(err) != codes.DeadlineExceeded {
+		test.Fatalf("outdated reconnection not rejected: %v", err)
+	}
+	if viridian, ok := dict.Get(reservedID); !ok || viridian != previous {
+		test.Fatal("previous connection evicted by rejected reconnection")
+	}
+
+	// Valid reconnection should replace the previous connection on the reserved port
+	_, network, err := net.ParseCIDR(TRANSFER_TUNNEL_NETWORK)
+	if err != nil {
+		test.Fatalf("error parsing tunnel network: %v", err)
+	}
+	token.Subscription = nil
+	userID, err := dict.Add(tunnel.NewContext(context.Background(), &tunnel.TunnelConfig{Network: network}), token, RESERVATION_LOCAL_ADDRESS, RESERVATION_LOCAL_ADDRESS, 0)
+	if err != nil {
+		test.Fatalf("error reconnecting viridian with reserved ID: %v", err)
+	} else if *userID != reservedID {
+		test.Fatalf("reconnected viridian got unexpected ID: %d != %d", *userID, reservedID)
+	}
+	if viridian, ok := dict.Get(reservedID); !ok || viridian == previous || len(dict.entries) != 1 {
+		test.Fatal("previous connection not replaced by reconnection")
+	}
+	if _, err := previous.SeaConn.Read(make([]byte, 64)); err == nil {
+		test.Fatal("previous connection not closed after reconnection")
+	}
+}
+
+func TestListenViridianRetrying(test *testing.T) {
+	failures := 0
+	listenUDP = func(network string, address *net.UDPAddr) (*net.UDPConn, error) {
+		if failures < RESERVATION_TRANSIENT_FAILURES {
+			failures++
+			return nil, syscall.EMFILE
+		}
+		return net.ListenUDP(network, address)
+	}
+	defer func() { listenUDP = net.ListenUDP }()
+
+	dict := &ViridianDict{listenRetries: RESERVATION_TRANSIENT_FAILURES}
+	connection, err := dict.listenViridianRetrying(RESERVATION_LOCAL_ADDRESS, RESERVATION_DYNAMIC_UID)
+	if err != nil {
+		test.Fatalf("viridian connection not created after transient failures: %v", err)
+	}
+	connection.Close()
+
+	failures = 0
+	dict.listenRetries = RESERVATION_TRANSIENT_FAILURES - 1
+	if _, err := dict.listenViridianRetrying(RESERVATION_LOCAL_ADDRESS, RESERVATION_DYNAMIC_UID); !errors.Is(err, syscall.EMFILE) {
+		test.Fatalf("viridian connection created with insufficient retries: %v", err)
+	}
+}
+
+func TestAddRetriesUnlocked(test *testing.T) {
+	test.Setenv("SEASIDE_ADDRESS", RESERVATION_LOCAL_ADDRESS.String())
+
+	dict := &ViridianDict{
+		maxViridians:  DIRECTORY_LIMITS_VIRIDIANS,
+		listenRetries: RESERVATION_TRANSIENT_FAILURES,
+		entries:       make(map[uint16]*Viridian),
+		uniques:       make(map[string]uint16),
+		sockets:       make(map[uint16]*net.UDPConn),
+	}
+
+	// Dictionary should stay available for packet forwarding while connection creation is retried
+	failures, locked := 0, false
+	listenUDP = func(network string, address *net.UDPAddr) (*net.UDPConn, error) {
+		if dict.mutex.TryRLock() {
+			dict.mutex.RUnlock()
+		} else {
+			locked = true
+		}
+		if failures < RESERVATION_TRANSIENT_FAILURES {
+			failures++
+			return nil, syscall.EMFILE
+		}
+		return net.ListenUDP(network, address)
+	}
+	defer func() { listenUDP = net.ListenUDP }()
+
+	session := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(session); err != nil {
+		test.Fatalf("symmetrical key reading error: %v", err)
+	}
+	dict.Add(context.Background(), &generated.UserToken{Uid: RESERVATION_DYNAMIC_UID, Session: session}, RESERVATION_LOCAL_ADDRESS, RESERVATION_LOCAL_ADDRESS, 0)
+
+	if failures != RESERVATION_TRANSIENT_FAILURES || locked {
+		test.Fatalf("viridian connection retried with dictionary locked (failures: %d)", failures)
+	}
+}
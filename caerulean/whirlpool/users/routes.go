@@ -0,0 +1,114 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Maximum number of destination prefixes a viridian can request to route through the node.
+const MAX_VIRIDIAN_ROUTES = 64
+
+// Error returned for routes that are not within the routes allowed by node.
+var ErrRouteNotAllowed = errors.New("route is not allowed")
+
+// Viridian route filter, contains IPv4 destination prefixes viridian is allowed to route through the node (split tunnel).
+type routeFilter []*net.IPNet
+
+// Parse viridian route filter.
+// Every route is an IPv4 prefix in CIDR notation.
+// Accept route strings.
+// Return route filter and nil if parsed successfully (nil and nil if there are no routes, so all destinations are allowed), otherwise nil and error.
+func parseRouteFilter(routes []string) (routeFilter, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	} else if len(routes) > MAX_VIRIDIAN_ROUTES {
+		return nil, fmt.Errorf("too many routes requested: %d (maximum: %d)", len(routes), MAX_VIRIDIAN_ROUTES)
+	}
+
+	filter := make(routeFilter, 0, len(routes))
+	for _, route := range routes {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(route))
+		if err != nil || network.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 route: %s", route)
+		}
+		filter = append(filter, network)
+	}
+	return filter, nil
+}
+
+// Parse routes viridians are allowed to request.
+// Routes are separated by commas, every route is an IPv4 prefix in CIDR notation.
+// Accept routes string.
+// Return allowed routes and nil if parsed successfully (nil and nil if there are no routes, so any routes are allowed), otherwise nil and error.
+func ParseAllowedRoutes(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	routes := strings.Split(value, ",")
+	if _, err := parseRouteFilter(routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// Restrict viridian routes to the routes allowed by node.
+// If no routes are allowed explicitly, any valid routes are accepted.
+// If viridian requests no routes (full tunnel), it gets all the allowed routes.
+// Otherwise every requested route should be within one of the allowed routes.
+// Accept requested route strings and allowed route strings.
+// Return routes viridian is allowed to use and nil if the routes are valid and allowed, otherwise nil and error (wrapping ErrRouteNotAllowed if a route is not allowed).
+func RestrictRoutes(routes, allowed []string) ([]string, error) {
+	requested, err := parseRouteFilter(routes)
+	if err != nil {
+		return nil, err
+	} else if len(allowed) == 0 {
+		return routes, nil
+	} else if len(routes) == 0 {
+		return allowed, nil
+	}
+
+	// Check every requested route is within an allowed route
+	filter, err := parseRouteFilter(allowed)
+	if err != nil {
+		return nil, err
+	}
+	for index, network := range requested {
+		if !filter.covers(network) {
+			return nil, fmt.Errorf("%w: %s", ErrRouteNotAllowed, routes[index])
+		}
+	}
+	return routes, nil
+}
+
+// Check if network is entirely within one of the route filter routes.
+// Should be applied for routeFilter object.
+// Accept network.
+// Return true if the network is within one of the routes, false otherwise.
+func (filter routeFilter) covers(network *net.IPNet) bool {
+	requestedOnes, _ := network.Mask.Size()
+	for _, route := range filter {
+		if allowedOnes, _ := route.Mask.Size(); allowedOnes <= requestedOnes && route.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if packet can be forwarded by route filter.
+// Should be applied for routeFilter object.
+// Accept packet destination address.
+// Return true if filter is empty or destination belongs to one of the routes, false otherwise.
+func (filter routeFilter) allows(destination net.IP) bool {
+	if filter == nil {
+		return true
+	}
+	for _, network := range filter {
+		if network.Contains(destination) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package users
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+const (
+	ROUTES_ALLOWED_NETWORK = "10.10.0.0/16"
+	ROUTES_ALLOWED_HOST    = "8.8.8.8/32"
+	ROUTES_ALLOWED_SUBNET  = "10.10.1.0/24"
+)
+
+func TestParseRouteFilter(test *testing.T) {
+	filter, err := parseRouteFilter(nil)
+	if err != nil || filter != nil {
+		test.Fatalf("empty routes not parsed as disabled filter: %v (%v)", filter, err)
+	}
+
+	for _, routes := range [][]string{{"10.10.0.0"}, {"not_a_route"}, {"fd00::/8"}, make([]string, MAX_VIRIDIAN_ROUTES+1)} {
+		if _, err := parseRouteFilter(routes); err == nil {
+			test.Fatalf("invalid routes accepted: %v", routes)
+		}
+	}
+}
+
+func TestRouteFilterSplitTunnel(test *testing.T) {
+	filter, err := parseRouteFilter([]string{ROUTES_ALLOWED_NETWORK, ROUTES_ALLOWED_HOST})
+	if err != nil {
+		test.Fatalf("error parsing routes: %v", err)
+	}
+	viridian := &Viridian{routes: filter}
+
+	for _, destination := range []net.IP{net.IPv4(10, 10, 0, 1), net.IPv4(10, 10, 255, 254), net.IPv4(8, 8, 8, 8)} {
+		if !viridian.routes.allows(destination) {
+			test.Fatalf("packet to allowed destination dropped: %v", destination)
+		}
+	}
+
+	for _, destination := range []net.IP{net.IPv4(10, 11, 0, 1), net.IPv4(8, 8, 4, 4), net.IPv4(1, 1, 1, 1)} {
+		if viridian.routes.allows(destination) {
+			test.Fatalf("packet to disallowed destination forwarded: %v", destination)
+		}
+	}
+
+	fullTunnel := &Viridian{}
+	if !fullTunnel.routes.allows(net.IPv4(1, 1, 1, 1)) {
+		test.Fatalf("packet of full tunnel viridian dropped")
+	}
+}
+
+func TestRestrictRoutes(test *testing.T) {
+	allowed, err := ParseAllowedRoutes(ROUTES_ALLOWED_NETWORK + "," + ROUTES_ALLOWED_HOST)
+	if err != nil {
+		test.Fatalf("error parsing allowed routes: %v", err)
+	}
+
+	routes, err := RestrictRoutes([]string{ROUTES_ALLOWED_SUBNET, ROUTES_ALLOWED_HOST}, allowed)
+	if err != nil || len(routes) != 2 {
+		test.Fatalf("allowed routes rejected: %v (%v)", routes, err)
+	}
+
+	routes, err = RestrictRoutes(nil, allowed)
+	if err != nil || len(routes) != len(allowed) {
+		test.Fatalf("full tunnel not restricted to allowed routes: %v (%v)", routes, err)
+	}
+
+	for _, requested := range [][]string{{"0.0.0.0/0"}, {"10.0.0.0/8"}, {"8.8.0.0/16"}, {ROUTES_ALLOWED_SUBNET, "10.11.0.0/24"}} {
+		if _, err := RestrictRoutes(requested, allowed); !errors.Is(err, ErrRouteNotAllowed) {
+			test.Fatalf("routes outside allowed routes accepted: %v (%v)", requested, err)
+		}
+	}
+
+	if routes, err := RestrictRoutes([]string{"0.0.0.0/0"}, nil); err != nil || len(routes) != 1 {
+		test.Fatalf("routes rejected without allowed routes: %v (%v)", routes, err)
+	}
+	if _, err := ParseAllowedRoutes("10.10.0.0/16,not_a_route"); err == nil {
+		test.Fatal("invalid allowed routes parsed successfully")
+	}
+}
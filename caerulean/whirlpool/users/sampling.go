@@ -0,0 +1,129 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+)
+
+// Time window flow sample limit is applied in.
+const FLOW_SAMPLE_WINDOW = time.Second
+
+// Number of viridian unique identifier hash bytes included into flow samples.
+const FLOW_SAMPLE_HASH_LENGTH = 8
+
+// Length of flow sampler secret (bytes).
+const FLOW_SAMPLE_SECRET_LENGTH = 32
+
+// Flow sampler structure.
+// Logs headers (5-tuple and size) of every N-th forwarded packet, payloads are never logged.
+// Viridian unique identifiers are replaced with their truncated keyed hashes (HMAC with random per-process secret),
+// so that guessable identifiers can not be recovered by hashing candidate identifiers.
+// Number of samples logged per window is limited, so that sampling is safe to leave enabled.
+type flowSampler struct {
+	// Number of packets forwarded (accessed atomically, kept first for alignment).
+	counter uint64
+
+	// Every N-th packet is sampled.
+	rate uint64
+
+	// Maximum number of samples logged in one window.
+	limit int
+
+	// Start time of the current window.
+	windowStart time.Time
+
+	// Number of samples logged in the current window.
+	sampled int
+
+	// Mutex for window operations, only locked for the packets selected for sampling.
+	mutex sync.Mutex
+
+	// Random sampler secret, viridian unique identifier hashes can not be calculated without it.
+	secret []byte
+}
+
+// Create flow sampler with random secret.
+// Accept sampling rate (every N-th packet is sampled) and maximum number of samples per window.
+// Return flow sampler pointer and nil if created successfully, otherwise nil and error.
+func newFlowSampler(rate uint64, limit int) (*flowSampler, error) {
+	secret := make([]byte, FLOW_SAMPLE_SECRET_LENGTH)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("error generating flow sampler secret: %v", err)
+	}
+	return &flowSampler{rate: rate, limit: limit, windowStart: time.Now(), secret: secret}, nil
+}
+
+// Anonymize viridian unique identifier.
+// Should be applied for flowSampler object.
+// Accept viridian unique identifier.
+// Return hex-encoded truncated identifier HMAC.
+func (sampler *flowSampler) anonymize(uid string) string {
+	mac := hmac.New(sha256.New, sampler.secret)
+	mac.Write([]byte(uid))
+	return hex.EncodeToString(mac.Sum(nil)[:FLOW_SAMPLE_HASH_LENGTH])
+}
+
+// Count packet and check if it should be sampled.
+// Should be applied for flowSampler object.
+// Accept current time.
+// Return true if packet is selected by sampling rate and window limit is not reached, false otherwise.
+func (sampler *flowSampler) admit(now time.Time) bool {
+	// Select every N-th packet
+	if atomic.AddUint64(&sampler.counter, 1)%sampler.rate != 0 {
+		return false
+	}
+
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+
+	// Start new window if the current one is over
+	if now.Sub(sampler.windowStart) >= FLOW_SAMPLE_WINDOW {
+		sampler.windowStart = now
+		sampler.sampled = 0
+	}
+
+	// Check window limit
+	if sampler.sampled >= sampler.limit {
+		return false
+	}
+	sampler.sampled++
+	return true
+}
+
+// Account packet and log its headers if it is sampled.
+// Should be applied for flowSampler object.
+// Accept viridian unique identifier, flag if packet is sent to viridian, packet IP layer header and parsed packet.
+func (sampler *flowSampler) observe(uid string, egress bool, netLayer *layers.IPv4, packet gopacket.Packet) {
+	if !sampler.admit(time.Now()) {
+		return
+	}
+
+	direction := "ingress"
+	if egress {
+		direction = "egress"
+	}
+
+	key := newFlowKey(egress, netLayer, packet)
+	logrus.WithFields(logrus.Fields{
+		"event":            "sample",
+		"client":           sampler.anonymize(uid),
+		"direction":        direction,
+		"protocol":         netLayer.Protocol.String(),
+		"source":           net.IP(key.source[:]).String(),
+		"source_port":      key.sourcePort,
+		"destination":      net.IP(key.destination[:]).String(),
+		"destination_port": key.destinationPort,
+		"size":             netLayer.Length,
+	}).Info("Flow sample")
+}
@@ -0,0 +1,113 @@
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+const (
+	SAMPLING_TEST_UID     = "test_sampled_uid"
+	SAMPLING_TEST_RATE    = 4
+	SAMPLING_TEST_LIMIT   = 3
+	SAMPLING_TEST_PACKETS = 100
+	SAMPLING_TEST_MARKER  = "test_secret_payload"
+)
+
+func createSamplingTestSampler(test *testing.T, rate uint64, limit int) *flowSampler {
+	sampler, err := newFlowSampler(rate, limit)
+	if err != nil {
+		test.Fatalf("error creating flow sampler: %v", err)
+	}
+	return sampler
+}
+
+func TestFlowSamplerRate(test *testing.T) {
+	sampler := createSamplingTestSampler(test, SAMPLING_TEST_RATE, SAMPLING_TEST_PACKETS)
+	now := time.Now()
+
+	sampled := 0
+	for i := 0; i < SAMPLING_TEST_PACKETS; i++ {
+		if sampler.admit(now) {
+			sampled++
+		}
+	}
+	if sampled != SAMPLING_TEST_PACKETS/SAMPLING_TEST_RATE {
+		test.Fatalf("unexpected number of packets sampled: %d != %d", sampled, SAMPLING_TEST_PACKETS/SAMPLING_TEST_RATE)
+	}
+}
+
+func TestFlowSamplerLimit(test *testing.T) {
+	sampler := createSamplingTestSampler(test, 1, SAMPLING_TEST_LIMIT)
+	now := time.Now()
+
+	sampled := 0
+	for i := 0; i < SAMPLING_TEST_PACKETS; i++ {
+		if sampler.admit(now) {
+			sampled++
+		}
+	}
+	if sampled != SAMPLING_TEST_LIMIT {
+		test.Fatalf("sample limit not honored: %d != %d", sampled, SAMPLING_TEST_LIMIT)
+	}
+
+	if !sampler.admit(now.Add(FLOW_SAMPLE_WINDOW)) {
+		test.Fatalf("packet not sampled in the next window")
+	}
+}
+
+func TestFlowSamplerAnonymized(test *testing.T) {
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(level)
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	sampler := createSamplingTestSampler(test, SAMPLING_TEST_RATE, SAMPLING_TEST_PACKETS)
+	netLayer, packet := parseTestPacket(createTestPacket(test, testPacketSpec{payload: []byte(SAMPLING_TEST_MARKER)}))
+	for i := 0; i < SAMPLING_TEST_PACKETS; i++ {
+		sampler.observe(SAMPLING_TEST_UID, false, netLayer, packet)
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) != SAMPLING_TEST_PACKETS/SAMPLING_TEST_RATE {
+		test.Fatalf("unexpected number of samples logged: %d != %d", len(entries), SAMPLING_TEST_PACKETS/SAMPLING_TEST_RATE)
+	}
+
+	for _, entry := range entries {
+		if entry.Data["client"] != sampler.anonymize(SAMPLING_TEST_UID) || entry.Data["destination_port"] != uint16(53) || entry.Data["size"] != netLayer.Length {
+			test.Fatalf("sample doesn't match packet headers: %v", entry.Data)
+		}
+
+		line, err := entry.String()
+		if err != nil {
+			test.Fatalf("error formatting sample: %v", err)
+		}
+		if strings.Contains(line, SAMPLING_TEST_UID) || strings.Contains(line, SAMPLING_TEST_MARKER) {
+			test.Fatalf("sample contains viridian identifier or payload: %s", line)
+		}
+	}
+}
+
+func TestFlowSamplerKeyed(test *testing.T) {
+	first := createSamplingTestSampler(test, SAMPLING_TEST_RATE, SAMPLING_TEST_LIMIT)
+	second := createSamplingTestSampler(test, SAMPLING_TEST_RATE, SAMPLING_TEST_LIMIT)
+
+	if first.anonymize(SAMPLING_TEST_UID) != first.anonymize(SAMPLING_TEST_UID) {
+		test.Fatalf("viridian identifier anonymized inconsistently")
+	}
+	if first.anonymize(SAMPLING_TEST_UID) == second.anonymize(SAMPLING_TEST_UID) {
+		test.Fatalf("viridian identifier anonymized equally with different secrets")
+	}
+
+	unkeyed := sha256.Sum256([]byte(SAMPLING_TEST_UID))
+	if first.anonymize(SAMPLING_TEST_UID) == hex.EncodeToString(unkeyed[:FLOW_SAMPLE_HASH_LENGTH]) {
+		test.Fatalf("viridian identifier anonymized with unkeyed hash")
+	}
+}
@@ -0,0 +1,223 @@
+package users
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Number of bytes every viridian queue is allowed to send to tunnel per scheduling round (multiplied by queue weight).
+const SCHEDULER_QUANTUM = 1500
+
+// DSCP class of expedited forwarding (used for VoIP and other latency-sensitive traffic).
+const DSCP_EXPEDITED_FORWARDING = 46
+
+// Maximum DSCP class value (6 bits).
+const DSCP_MAX = 63
+
+// Tunnel packet queue of a single viridian.
+// Priority packets of the viridian are written to tunnel before its regular packets.
+type fairQueue struct {
+	// Priority packets waiting to be written to tunnel, oldest first.
+	priority [][]byte
+
+	// Regular packets waiting to be written to tunnel, oldest first.
+	packets [][]byte
+
+	// Number of bytes the queue is still allowed to send in current scheduling round.
+	deficit int
+
+	// Queue weight, number of quantums the queue receives per scheduling round.
+	weight int
+}
+
+// Get the lane next packet of the queue should be taken from.
+// Should be applied for fairQueue object.
+// Return pointer to priority packets if there are any, pointer to regular packets otherwise.
+func (queue *fairQueue) head() *[][]byte {
+	if len(queue.priority) > 0 {
+		return &queue.priority
+	}
+	return &queue.packets
+}
+
+// Fair tunnel write scheduler structure.
+// Shares tunnel egress between viridians using deficit round robin algorithm across per-viridian queues.
+// Every queue has bounded depth, if a queue is full, the oldest packet in it is dropped (regular packets are dropped first).
+// Packets of every viridian are written in the order they were scheduled (within every lane), since every viridian is read by one goroutine
+// and tunnel is written by one goroutine, so flows are never reordered inside the node (reordering would trigger spurious TCP retransmits).
+// Only packets of different DSCP classes (usually different flows) can overtake each other if prioritization is enabled.
+type fairScheduler struct {
+	// Mutex for queue operations.
+	mutex sync.Mutex
+
+	// Non-empty viridian queues.
+	queues map[uint16]*fairQueue
+
+	// Viridian IDs of the queues in scheduling order.
+	active []uint16
+
+	// Maximum number of packets in every queue.
+	depth int
+
+	// Weight of privileged viridian queues (non-privileged queues have weight 1).
+	privilegedWeight int
+
+	// Flag, whether writer has stopped, packets scheduled after it are dropped instead of being queued.
+	stopped bool
+
+	// Channel, notifies writer about new packets.
+	ready chan struct{}
+}
+
+// Create fair tunnel write scheduler.
+// Accept maximum queue depth and privileged viridian queue weight (both are at least 1).
+// Return scheduler pointer.
+func newFairScheduler(depth, privilegedWeight int) *fairScheduler {
+	if depth < 1 {
+		depth = 1
+	}
+	if privilegedWeight < 1 {
+		privilegedWeight = 1
+	}
+
+	return &fairScheduler{
+		queues:           make(map[uint16]*fairQueue),
+		depth:            depth,
+		privilegedWeight: privilegedWeight,
+		ready:            make(chan struct{}, 1),
+	}
+}
+
+// Schedule packet for writing to tunnel.
+// Packet is copied, so the buffer can be reused after the call, the call never blocks (even if writer has already stopped).
+// Should be applied for fairScheduler object.
+// Accept viridian ID, flag if viridian is privileged, flag if packet has priority and packet bytes.
+// Return true if packet was scheduled without dropping, false if the oldest packet of the viridian (or the packet itself, if writer has stopped) was dropped.
+func (scheduler *fairScheduler) enqueue(userID uint16, privileged, priority bool, packet []byte) bool {
+	scheduler.mutex.Lock()
+
+	// Drop packet if writer has stopped, nobody will write it
+	if scheduler.stopped {
+		scheduler.mutex.Unlock()
+		return false
+	}
+
+	// Create viridian queue if it doesn't exist and add it to the end of scheduling order
+	queue, ok := scheduler.queues[userID]
+	if !ok {
+		weight := 1
+		if privileged {
+			weight = scheduler.privilegedWeight
+		}
+		queue = &fairQueue{weight: weight}
+		scheduler.queues[userID] = queue
+		scheduler.active = append(scheduler.active, userID)
+	}
+
+	// Drop the oldest packet if queue is full, regular packets are dropped first
+	dropped := len(queue.priority)+len(queue.packets) >= scheduler.depth
+	if dropped {
+		lane := &queue.packets
+		if len(queue.packets) == 0 {
+			lane = &queue.priority
+		}
+		(*lane)[0] = nil
+		*lane = (*lane)[1:]
+	}
+
+	// Add packet copy to the queue
+	if priority {
+		queue.priority = append(queue.priority, append([]byte(nil), packet...))
+	} else {
+		queue.packets = append(queue.packets, append([]byte(nil), packet...))
+	}
+	scheduler.mutex.Unlock()
+
+	// Notify writer, if not notified yet
+	select {
+	case scheduler.ready <- struct{}{}:
+	default: // do nothing
+	}
+
+	// Return drop status
+	return !dropped
+}
+
+// Retrieve next packet that should be written to tunnel.
+// Queues are visited in round robin order, every visit a queue either sends its head packet (if its deficit allows)
+// or receives its quantum and is moved to the end of scheduling order, empty queues are removed.
+// Should be applied for fairScheduler object.
+// Return packet and true if there is a packet, nil and false otherwise.
+func (scheduler *fairScheduler) dequeue() ([]byte, bool) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	for len(scheduler.active) > 0 {
+		userID := scheduler.active[0]
+		queue := scheduler.queues[userID]
+
+		// Remove empty queue
+		if len(queue.priority)+len(queue.packets) == 0 {
+			delete(scheduler.queues, userID)
+			scheduler.active = scheduler.active[1:]
+			continue
+		}
+
+		// Send head packet (priority packets first) if queue deficit allows
+		lane := queue.head()
+		packet := (*lane)[0]
+		if len(packet) <= queue.deficit {
+			queue.deficit -= len(packet)
+			(*lane)[0] = nil
+			*lane = (*lane)[1:]
+			return packet, true
+		}
+
+		// Add quantum to queue deficit and move it to the end of scheduling order
+		queue.deficit += SCHEDULER_QUANTUM * queue.weight
+		scheduler.active = append(scheduler.active[1:], userID)
+	}
+
+	return nil, false
+}
+
+// Stop accepting packets and forget all the scheduled ones.
+// Packet producers (viridian readers) might still be running, they are never blocked and their packets are dropped.
+// Should be applied for fairScheduler object.
+func (scheduler *fairScheduler) stop() {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.stopped = true
+	scheduler.queues = make(map[uint16]*fairQueue)
+	scheduler.active = nil
+}
+
+// Start writing scheduled packets to tunnel.
+// Should be applied for fairScheduler object.
+// Accept Context for graceful termination and tunnel writer.
+// NB! this method is blocking, so it should be run as goroutine.
+func (scheduler *fairScheduler) run(ctx context.Context, tunnel io.Writer) {
+	logrus.Debug("Writing packets to tunnel started")
+	for {
+		// Wait for new packets or graceful termination
+		select {
+		case <-ctx.Done():
+			scheduler.stop()
+			logrus.Debug("Writing packets to tunnel stopped")
+			return
+		case <-scheduler.ready:
+		}
+
+		// Write all the scheduled packets to tunnel
+		for packet, ok := scheduler.dequeue(); ok; packet, ok = scheduler.dequeue() {
+			s, err := tunnel.Write(packet)
+			if err != nil || s == 0 {
+				logrus.Errorf("Error writing to tunnel (%d bytes written): %v", s, err)
+			}
+		}
+	}
+}
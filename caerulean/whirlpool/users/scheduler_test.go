@@ -0,0 +1,246 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	SCHEDULER_QUEUE_DEPTH       = 64
+	SCHEDULER_PACKET_SIZE       = 1400
+	SCHEDULER_FLOODING_USER     = 1
+	SCHEDULER_REGULAR_USER      = 2
+	SCHEDULER_MAX_DELAY         = 2
+	SCHEDULER_WRITE_TIMEOUT     = time.Second
+	SCHEDULER_PRIVILEGED_WEIGHT = 2
+
+	SCHEDULER_ORDERING_USERS   = 8
+	SCHEDULER_ORDERING_PACKETS = 512
+
+	SCHEDULER_SHUTDOWN_USERS   = 16
+	SCHEDULER_SHUTDOWN_PACKETS = 4096
+)
+
+func createSchedulerPacket(userID uint16, number int) []byte {
+	packet := make([]byte, SCHEDULER_PACKET_SIZE)
+	packet[0] = byte(userID)
+	packet[1] = byte(number)
+	return packet
+}
+
+func TestFairSchedulerFlood(test *testing.T) {
+	scheduler := newFairScheduler(SCHEDULER_QUEUE_DEPTH, 1)
+
+	for i := 0; i < SCHEDULER_QUEUE_DEPTH; i++ {
+		scheduler.enqueue(SCHEDULER_FLOODING_USER, false, false, createSchedulerPacket(SCHEDULER_FLOODING_USER, i))
+	}
+	scheduler.enqueue(SCHEDULER_REGULAR_USER, false, false, createSchedulerPacket(SCHEDULER_REGULAR_USER, 0))
+
+	for position := 0; ; position++ {
+		packet, ok := scheduler.dequeue()
+		if !ok {
+			test.Fatalf("regular user packet was never scheduled")
+		}
+		if packet[0] == SCHEDULER_REGULAR_USER {
+			if position > SCHEDULER_MAX_DELAY {
+				test.Fatalf("regular user packet delayed by flooding user: %d packets written before", position)
+			}
+			test.Logf("regular user packet written after %d packets", position)
+			return
+		}
+	}
+}
+
+func TestFairSchedulerDropsOldest(test *testing.T) {
+	scheduler := newFairScheduler(SCHEDULER_QUEUE_DEPTH, 1)
+
+	for i := 0; i < SCHEDULER_QUEUE_DEPTH; i++ {
+		if !scheduler.enqueue(SCHEDULER_FLOODING_USER, false, false, createSchedulerPacket(SCHEDULER_FLOODING_USER, i)) {
+			test.Fatalf("packet %d dropped while queue was not full", i)
+		}
+	}
+	if scheduler.enqueue(SCHEDULER_FLOODING_USER, false, false, createSchedulerPacket(SCHEDULER_FLOODING_USER, SCHEDULER_QUEUE_DEPTH)) {
+		test.Fatalf("packet scheduled without dropping while queue was full")
+	}
+
+	for i := 1; i <= SCHEDULER_QUEUE_DEPTH; i++ {
+		packet, ok := scheduler.dequeue()
+		if !ok {
+			test.Fatalf("packet %d was not scheduled", i)
+		}
+		if int(packet[1]) != i {
+			test.Fatalf("unexpected packet scheduled: %d != %d", packet[1], i)
+		}
+	}
+
+	if _, ok := scheduler.dequeue(); ok {
+		test.Fatalf("packet scheduled from empty scheduler")
+	}
+}
+
+func TestFairSchedulerWeights(test *testing.T) {
+	scheduler := newFairScheduler(SCHEDULER_QUEUE_DEPTH, SCHEDULER_PRIVILEGED_WEIGHT)
+
+	for i := 0; i < SCHEDULER_QUEUE_DEPTH; i++ {
+		scheduler.enqueue(SCHEDULER_FLOODING_USER, true, false, createSchedulerPacket(SCHEDULER_FLOODING_USER, i))
+		scheduler.enqueue(SCHEDULER_REGULAR_USER, false, false, createSchedulerPacket(SCHEDULER_REGULAR_USER, i))
+	}
+
+	written := map[byte]int{}
+	for i := 0; i < SCHEDULER_QUEUE_DEPTH; i++ {
+		packet, _ := scheduler.dequeue()
+		written[packet[0]]++
+	}
+
+	ratio := float64(written[SCHEDULER_FLOODING_USER]) / float64(written[SCHEDULER_REGULAR_USER])
+	if ratio < SCHEDULER_PRIVILEGED_WEIGHT-0.5 || ratio > SCHEDULER_PRIVILEGED_WEIGHT+0.5 {
+		test.Fatalf("privileged user share doesn't match weight: %d / %d", written[SCHEDULER_FLOODING_USER], written[SCHEDULER_REGULAR_USER])
+	}
+}
+
+type schedulerTestWriter chan []byte
+
+func (writer schedulerTestWriter) Write(packet []byte) (int, error) {
+	writer <- append([]byte(nil), packet...)
+	return len(packet), nil
+}
+
+func TestFairSchedulerRun(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer := make(schedulerTestWriter)
+	scheduler := newFairScheduler(SCHEDULER_QUEUE_DEPTH, 1)
+	go scheduler.run(ctx, writer)
+
+	expected := createSchedulerPacket(SCHEDULER_REGULAR_USER, 0)
+	scheduler.enqueue(SCHEDULER_REGULAR_USER, false, false, expected)
+
+	select {
+	case packet := <-writer:
+		if !bytes.Equal(packet, expected) {
+			test.Fatalf("written packet doesn't match scheduled: %v != %v", packet[:2], expected[:2])
+		}
+	case <-time.After(SCHEDULER_WRITE_TIMEOUT):
+		test.Fatalf("scheduled packet was not written in %v", SCHEDULER_WRITE_TIMEOUT)
+	}
+}
+
+func TestFairSchedulerOrdering(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer := make(schedulerTestWriter, SCHEDULER_QUEUE_DEPTH)
+	scheduler := newFairScheduler(SCHEDULER_ORDERING_PACKETS, 1)
+	go scheduler.run(ctx, writer)
+
+	for user := 1; user <= SCHEDULER_ORDERING_USERS; user++ {
+		go func(userID uint16) {
+			for number := 0; number < SCHEDULER_ORDERING_PACKETS; number++ {
+				packet := createSchedulerPacket(userID, 0)
+				binary.BigEndian.PutUint16(packet[1:3], uint16(number))
+				scheduler.enqueue(userID, false, false, packet)
+			}
+		}(uint16(user))
+	}
+
+	next := make(map[byte]uint16, SCHEDULER_ORDERING_USERS)
+	for i := 0; i < SCHEDULER_ORDERING_USERS*SCHEDULER_ORDERING_PACKETS; i++ {
+		select {
+		case packet := <-writer:
+			number := binary.BigEndian.Uint16(packet[1:3])
+			if number != next[packet[0]] {
+				test.Fatalf("packet of user %d written out of order: %d != %d", packet[0], number, next[packet[0]])
+			}
+			next[packet[0]]++
+		case <-time.After(SCHEDULER_WRITE_TIMEOUT):
+			test.Fatalf("only %d scheduled packets were written in %v", i, SCHEDULER_WRITE_TIMEOUT)
+		}
+	}
+}
+
+func TestFairSchedulerShutdown(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := make(schedulerTestWriter, SCHEDULER_QUEUE_DEPTH)
+	scheduler := newFairScheduler(SCHEDULER_QUEUE_DEPTH, 1)
+
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.run(ctx, writer)
+		close(stopped)
+	}()
+	go func() {
+		for range writer {
+		}
+	}()
+
+	var producers sync.WaitGroup
+	for user := 1; user <= SCHEDULER_SHUTDOWN_USERS; user++ {
+		producers.Add(1)
+		go func(userID uint16) {
+			defer producers.Done()
+			for number := 0; number < SCHEDULER_SHUTDOWN_PACKETS; number++ {
+				scheduler.enqueue(userID, false, number%2 == 0, createSchedulerPacket(userID, number))
+				if number == SCHEDULER_SHUTDOWN_PACKETS/2 {
+					cancel()
+				}
+			}
+		}(uint16(user))
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		producers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(SCHEDULER_WRITE_TIMEOUT):
+		test.Fatalf("packet producers blocked after tunnel writing stopped")
+	}
+
+	select {
+	case <-stopped:
+		close(writer)
+	case <-time.After(SCHEDULER_WRITE_TIMEOUT):
+		test.Fatalf("tunnel writing not stopped")
+	}
+
+	if scheduler.enqueue(SCHEDULER_REGULAR_USER, false, false, createSchedulerPacket(SCHEDULER_REGULAR_USER, 0)) {
+		test.Fatalf("packet scheduled after tunnel writing stopped")
+	}
+	if packet, ok := scheduler.dequeue(); ok {
+		test.Fatalf("packet kept after tunnel writing stopped: %v", packet[:2])
+	}
+}
+
+func TestFairSchedulerPriority(test *testing.T) {
+	scheduler := newFairScheduler(SCHEDULER_QUEUE_DEPTH, 1)
+
+	for i := 0; i < SCHEDULER_QUEUE_DEPTH/2; i++ {
+		scheduler.enqueue(SCHEDULER_REGULAR_USER, false, false, createSchedulerPacket(SCHEDULER_REGULAR_USER, i))
+	}
+	expected := createSchedulerPacket(SCHEDULER_REGULAR_USER, SCHEDULER_QUEUE_DEPTH)
+	scheduler.enqueue(SCHEDULER_REGULAR_USER, false, true, expected)
+
+	packet, ok := scheduler.dequeue()
+	if !ok || !bytes.Equal(packet, expected) {
+		test.Fatalf("priority packet not written before regular packets: %v", packet[:2])
+	}
+
+	dict := &ViridianDict{priorityDSCP: DSCP_EXPEDITED_FORWARDING}
+	if !dict.prioritized(&layers.IPv4{TOS: DSCP_EXPEDITED_FORWARDING << 2}) {
+		test.Fatal("expedited forwarding packet not prioritized")
+	}
+	if dict.prioritized(&layers.IPv4{TOS: 0}) {
+		test.Fatal("best effort packet prioritized")
+	}
+}
@@ -0,0 +1,128 @@
+package users
+
+import (
+	"container/list"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum number of source addresses tracked, least recently failed addresses are forgotten first.
+const BAD_SOURCE_CAPACITY = 4096
+
+// Bad source address key: IP address (16-byte form) followed by port number (big endian).
+type badSourceKey [net.IPv6len + 2]byte
+
+// Bad source address entry.
+type badSource struct {
+	// Source address key.
+	address badSourceKey
+
+	// Number of failed packets received from the address since the first failure in the current window.
+	failures int
+
+	// Time of the first failed packet in the current window.
+	firstFailure time.Time
+
+	// Time until which packets from the address are dropped (zero if address is not blocked).
+	blockedUntil time.Time
+}
+
+// Bad source address tracker structure.
+// Tracks source addresses (IP address and port) of the packets that fail decryption (authentication), bounded LRU is used, so the memory is bounded.
+// Packets that were decrypted successfully are never counted, even if they are malformed, since they could only be sent by the viridian itself.
+// Addresses that send too many failed packets within cooldown period are blocked for cooldown period:
+// their packets are dropped before decryption, so that scanners don't waste CPU.
+// NB! source IP address and port are equally easy to spoof and blocks are checked before decryption,
+// so an attacker knowing viridian address and port can still get the viridian blocked, tracking by port only avoids blocking other viridians behind the same address.
+// Blocks always expire, so that viridians behind a shared NAT are not penalized permanently.
+type badSources struct {
+	// Number of failed packets within cooldown period after which address is blocked.
+	threshold int
+
+	// Failure counting window and block duration.
+	cooldown time.Duration
+
+	// Tracked addresses, most recently failed first.
+	order *list.List
+
+	// Tracked address list elements by address.
+	entries map[badSourceKey]*list.Element
+
+	// Mutex for tracker operations.
+	mutex sync.Mutex
+}
+
+// Create bad source address tracker.
+// Accept number of failed packets after which address is blocked and cooldown period.
+// Return tracker pointer.
+func newBadSources(threshold int, cooldown time.Duration) *badSources {
+	return &badSources{
+		threshold: threshold,
+		cooldown:  cooldown,
+		order:     list.New(),
+		entries:   make(map[badSourceKey]*list.Element),
+	}
+}
+
+// Convert source address to tracker key.
+// Accept UDP source address.
+// Return address key.
+func newBadSourceKey(address *net.UDPAddr) badSourceKey {
+	var key badSourceKey
+	copy(key[:], address.IP.To16())
+	binary.BigEndian.PutUint16(key[net.IPv6len:], uint16(address.Port))
+	return key
+}
+
+// Check if packets from address should be dropped.
+// Should be applied for badSources object.
+// Accept UDP source address and current time.
+// Return true if address is blocked, false otherwise.
+func (sources *badSources) blocked(address *net.UDPAddr, now time.Time) bool {
+	sources.mutex.Lock()
+	defer sources.mutex.Unlock()
+
+	element, ok := sources.entries[newBadSourceKey(address)]
+	return ok && now.Before(element.Value.(*badSource).blockedUntil)
+}
+
+// Account failed packet from address, block the address if it failed too many times.
+// Should be applied for badSources object.
+// Accept UDP source address and current time.
+func (sources *badSources) fail(address *net.UDPAddr, now time.Time) {
+	sources.mutex.Lock()
+	defer sources.mutex.Unlock()
+
+	// Find address entry or create a new one, forgetting the least recently failed address if there is no space
+	key := newBadSourceKey(address)
+	element, ok := sources.entries[key]
+	if ok {
+		sources.order.MoveToFront(element)
+	} else {
+		if sources.order.Len() >= BAD_SOURCE_CAPACITY {
+			oldest := sources.order.Back()
+			delete(sources.entries, oldest.Value.(*badSource).address)
+			sources.order.Remove(oldest)
+		}
+		element = sources.order.PushFront(&badSource{address: key})
+		sources.entries[key] = element
+	}
+	entry := element.Value.(*badSource)
+
+	// Restart counting if the previous window is over
+	if now.Sub(entry.firstFailure) >= sources.cooldown {
+		entry.failures = 0
+		entry.firstFailure = now
+	}
+
+	// Count failure and block address if threshold is reached
+	entry.failures++
+	if entry.failures == sources.threshold {
+		entry.blockedUntil = now.Add(sources.cooldown)
+		logrus.Warnf("Source %v sent %d invalid packets, blocked for %v", address, entry.failures, sources.cooldown)
+	}
+}
@@ -0,0 +1,86 @@
+package users
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	BAD_SOURCE_THRESHOLD = 8
+	BAD_SOURCE_COOLDOWN  = time.Second
+	BAD_SOURCE_PORT      = 12345
+)
+
+func TestBadSourcesFlood(test *testing.T) {
+	sources := newBadSources(BAD_SOURCE_THRESHOLD, BAD_SOURCE_COOLDOWN)
+	flooder := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: BAD_SOURCE_PORT}
+	bystander := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 2), Port: BAD_SOURCE_PORT}
+	now := time.Now()
+
+	for i := 0; i < BAD_SOURCE_THRESHOLD-1; i++ {
+		sources.fail(flooder, now)
+		if sources.blocked(flooder, now) {
+			test.Fatalf("source blocked before threshold: %d", i+1)
+		}
+	}
+	sources.fail(bystander, now)
+
+	sources.fail(flooder, now)
+	if !sources.blocked(flooder, now) {
+		test.Fatal("flooding source not blocked after threshold")
+	}
+	if sources.blocked(bystander, now) {
+		test.Fatal("other source blocked by flood")
+	}
+
+	// Spoofing source IP address only does not block the other ports of the address
+	if sources.blocked(&net.UDPAddr{IP: flooder.IP, Port: BAD_SOURCE_PORT + 1}, now) {
+		test.Fatal("other port of flooding address blocked by flood")
+	}
+
+	if sources.blocked(flooder, now.Add(BAD_SOURCE_COOLDOWN)) {
+		test.Fatal("flooding source still blocked after cooldown")
+	}
+}
+
+func TestBadSourcesWindow(test *testing.T) {
+	sources := newBadSources(BAD_SOURCE_THRESHOLD, BAD_SOURCE_COOLDOWN)
+	source := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: BAD_SOURCE_PORT}
+	now := time.Now()
+
+	for i := 0; i < BAD_SOURCE_THRESHOLD; i++ {
+		now = now.Add(BAD_SOURCE_COOLDOWN / (BAD_SOURCE_THRESHOLD * 2))
+		sources.fail(source, now)
+	}
+	if !sources.blocked(source, now) {
+		test.Fatal("source not blocked after threshold within window")
+	}
+
+	slow := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 2), Port: BAD_SOURCE_PORT}
+	for i := 0; i < BAD_SOURCE_THRESHOLD*2; i++ {
+		now = now.Add(BAD_SOURCE_COOLDOWN)
+		sources.fail(slow, now)
+	}
+	if sources.blocked(slow, now) {
+		test.Fatal("source blocked for failures spread over several windows")
+	}
+}
+
+func TestBadSourcesCapacity(test *testing.T) {
+	sources := newBadSources(BAD_SOURCE_THRESHOLD, BAD_SOURCE_COOLDOWN)
+	first := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 0), Port: BAD_SOURCE_PORT}
+	now := time.Now()
+
+	sources.fail(first, now)
+	for i := 0; i < BAD_SOURCE_CAPACITY; i++ {
+		sources.fail(&net.UDPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: BAD_SOURCE_PORT}, now)
+	}
+
+	if len(sources.entries) != BAD_SOURCE_CAPACITY || sources.order.Len() != BAD_SOURCE_CAPACITY {
+		test.Fatalf("tracked source number exceeds capacity: %d", len(sources.entries))
+	}
+	if _, ok := sources.entries[newBadSourceKey(first)]; ok {
+		test.Fatal("least recently failed source not evicted")
+	}
+}
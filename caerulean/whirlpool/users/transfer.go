@@ -4,104 +4,304 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"main/crypto"
+	"main/utils"
 	"math"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/sirupsen/logrus"
-	"github.com/songgao/water"
 )
 
+// IPv4 header total length field offset.
+const IPV4_LENGTH_OFFSET = 2
+
 // Special type for checking IP packet layers - if they should use IP header in checksum calculation.
 type netSettableLayerType interface {
 	SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
 }
 
+// Decode IP packet read from tunnel interface.
+// IP version is detected first: only IPv4 packets are forwarded, other packets (IPv6, etc.) are quietly dropped and counted.
+// IPv4 packets that can not be parsed are dropped and counted as malformed, packets seen too many times recently are dropped as looping.
+// Should be applied for ViridianDict object.
+// Accept raw packet bytes.
+// Return parsed packet, packet IP layer header and true if packet should be forwarded, otherwise nil, nil and false.
+func (dict *ViridianDict) decodeTunnelPacket(raw []byte) (gopacket.Packet, *layers.IPv4, bool) {
+	// Check packet IP version
+	if len(raw) == 0 || raw[0]>>4 != 4 {
+		count := atomic.AddUint64(&dict.unsupportedPackets, 1)
+		logrus.Debugf("Unsupported tunnel packet dropped (%d bytes, %d dropped in total)", len(raw), count)
+		return nil, nil, false
+	}
+
+	// Check packet IP header
+	header := layers.IPv4{}
+	if err := header.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil {
+		count := atomic.AddUint64(&dict.malformedPackets, 1)
+		logrus.Warnf("Malformed tunnel packet dropped (%d bytes, %d dropped in total): %v", len(raw), count, err)
+		return nil, nil, false
+	}
+
+	// Check packet is not looping
+	if dict.loops != nil && dict.loops.observe(raw, time.Now()) {
+		count := atomic.AddUint64(&dict.loopingPackets, 1)
+		logrus.Warnf("Looping tunnel packet dropped (src: %v, dst: %v, %d dropped in total), check forwarding configuration", header.SrcIP, header.DstIP, count)
+		return nil, nil, false
+	}
+
+	// Parse all packet headers
+	packet := gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.NoCopy)
+	if err := packet.ErrorLayer(); err != nil {
+		logrus.Errorf("Error decoding some part of the packet: %v", err)
+	}
+
+	// Get packet IP layer header
+	netLayer, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+
+	// Return packet and IP layer header
+	return packet, netLayer, true
+}
+
+// Rewrite packet IP addresses and recompute checksums.
+// If addresses don't change (and packet has no trailing bytes), raw packet is returned as is, without serialization.
+// Accept cleared serialization buffer, parsed packet, its IP layer header, raw packet bytes and new source and destination addresses (nil to keep).
+// Return rewritten packet bytes (raw packet or serialization buffer contents) and nil if successful, otherwise nil and error.
+func rewritePacket(serialBuffer gopacket.SerializeBuffer, packet gopacket.Packet, netLayer *layers.IPv4, raw []byte, source, destination net.IP) ([]byte, error) {
+	// Return raw packet if nothing changes
+	sourceChanged := source != nil && !source.Equal(netLayer.SrcIP)
+	destinationChanged := destination != nil && !destination.Equal(netLayer.DstIP)
+	if !sourceChanged && !destinationChanged && len(raw) == int(netLayer.Length) {
+		return raw, nil
+	}
+
+	// Change addresses
+	if source != nil {
+		netLayer.SrcIP = source
+	}
+	if destination != nil {
+		netLayer.DstIP = destination
+	}
+
+	// Set the network layer to all the layers that require a network layer
+	for _, layer := range packet.Layers() {
+		netSettableLayer, ok := layer.(netSettableLayerType)
+		if ok {
+			netSettableLayer.SetNetworkLayerForChecksum(netLayer)
+		}
+	}
+
+	// Serialize the packet
+	if err := gopacket.SerializePacket(serialBuffer, gopacket.SerializeOptions{ComputeChecksums: true}, packet); err != nil {
+		return nil, err
+	}
+	return serialBuffer.Bytes(), nil
+}
+
+// Check decrypted viridian packet length against its IP total length.
+// Packets shorter than total length (truncated) or with more trailing bytes than tolerated (padded) are counted as mismatched.
+// Should be applied for ViridianDict object.
+// Accept raw packet bytes and viridian ID.
+// Return true if packet length matches or length check is disabled, false otherwise.
+func (dict *ViridianDict) checkPacketLength(raw []byte, userID uint16) bool {
+	if dict.maxPacketPadding < 0 {
+		return true
+	}
+
+	// Compare IP total length with packet length, packets without total length field are mismatched too
+	padding := -1
+	if len(raw) >= IPV4_LENGTH_OFFSET+2 {
+		padding = len(raw) - int(binary.BigEndian.Uint16(raw[IPV4_LENGTH_OFFSET:]))
+	}
+	if padding >= 0 && padding <= dict.maxPacketPadding {
+		return true
+	}
+
+	count := atomic.AddUint64(&dict.mismatchedPackets, 1)
+	logrus.Debugf("Packet from viridian %d with mismatched length dropped (%d bytes, %d dropped in total)", userID, len(raw), count)
+	return false
+}
+
+// Check if packet should be written to tunnel before the other packets of the same viridian.
+// Packets are prioritized by their DSCP class (first 6 bits of TOS IP header field).
+// Should be applied for ViridianDict object.
+// Accept packet IP layer header.
+// Return true if packet DSCP class is not less than priority DSCP class, false otherwise or if prioritization is disabled.
+func (dict *ViridianDict) prioritized(netLayer *layers.IPv4) bool {
+	return dict.priorityDSCP > 0 && netLayer.TOS>>2 >= dict.priorityDSCP
+}
+
+// Account packet that failed decryption (authentication) received from source address, if bad source blocking is enabled.
+// Should be applied for ViridianDict object.
+// Accept packet source address.
+func (dict *ViridianDict) rejectSource(address *net.UDPAddr) {
+	if dict.badSources != nil {
+		dict.badSources.fail(address, time.Now())
+	}
+}
+
+// Calculate viridian source IP address in tunnel network.
+// First 2 bytes of the address are taken from tunnel network, last 2 bytes are viridian ID.
+// Accept tunnel IP network address pointer and viridian ID as byte array.
+// Return viridian source IP address (4 bytes long).
+func viridianSourceIP(tunnetwork *net.IPNet, viridianID []byte) net.IP {
+	tunnelIP := tunnetwork.IP.To4()
+	return net.IP{tunnelIP[0], tunnelIP[1], viridianID[0], viridianID[1]}
+}
+
 // Start receiving UDP VPN packets from viridians (internal interface, seaside port) and sending them to the internet.
+// Packets are scheduled for writing to tunnel using dictionary fair scheduler.
 // Should be applied for ViridianDict object.
-// Accept Context for graceful termination, tunnel interface pointer and tunnel IP network address pointer.
+// Accept Context for graceful termination, viridian ID, viridian connection and tunnel IP network address pointer.
 // NB! this method is blocking, so it should be run as goroutine.
-func (dict *ViridianDict) ReceivePacketsFromViridian(ctx context.Context, userID uint16, connection *net.UDPConn, tunnel *water.Interface, tunnetwork *net.IPNet) {
-	buffer := make([]byte, math.MaxUint16)
+func (dict *ViridianDict) ReceivePacketsFromViridian(ctx context.Context, userID uint16, connection *net.UDPConn, tunnetwork *net.IPNet) {
+	reader := newPacketReader(connection, dict.readBatchSize)
 
 	// Convert viridian ID into byte array
 	viridianID := []byte{0, 0}
 	binary.BigEndian.PutUint16(viridianID, userID)
 
+	// Calculate viridian tunnel source IP (constant for the viridian connection)
+	sourceIP := viridianSourceIP(tunnetwork, viridianID)
+
 	// Create buffer for packet decoding
 	serialBuffer := gopacket.NewSerializeBuffer()
 
-	logrus.Debug("Receiving packets from viridian started")
-	for {
-		// Handle graceful termination
-		select {
-		case <-ctx.Done():
-			logrus.Debug("Receiving packets from viridian stopped")
-			return
-		default: // do nothing
-		}
-
+	// Process single packet received from viridian
+	handler := func(buffer []byte, address *net.UDPAddr) {
 		// Clear the serialization buffer
 		serialBuffer.Clear()
 
-		// Read packet from UDP connection
-		r, address, err := connection.ReadFromUDP(buffer)
-		if err != nil || r == 0 {
-			logrus.Errorf("Error reading from viridian (%d bytes read): %v", r, err)
-			continue
+		// Drop the packet if its source has recently sent too many invalid packets
+		if dict.badSources != nil && dict.badSources.blocked(address, time.Now()) {
+			logrus.Debugf("Packet from blocked source %v to viridian %d dropped", address, userID)
+			return
 		}
 
 		// Get the viridian the packet belongs to
 		viridian, ok := dict.Get(userID)
 		if !ok {
 			logrus.Errorf("Error: user %d not registered", userID)
-			continue
+			return
 		}
 
+		// Mark viridian as active
+		viridian.touch()
+
 		// Update viridian gateway port and address
 		viridian.Port = uint16(address.Port)
 		viridian.Gateway = address.IP
 
+		// Mirror the encrypted packet, if enabled
+		if dict.mirror != nil && !dict.mirror.Send(buffer) {
+			logrus.Debugf("Mirror queue full, packet from viridian %d not mirrored", userID)
+		}
+
 		// Decode the packet
-		raw, err := crypto.Decrypt(buffer[:r], viridian.AEAD)
+		raw, err := crypto.Decrypt(buffer, viridian.AEAD)
 		if err != nil {
 			logrus.Errorf("Error decrypting packet: %v", err)
-			continue
+			dict.rejectSource(address)
+			return
+		}
+
+		// Drop the packet if its length doesn't match IP total length, mark it as received otherwise
+		if !dict.checkPacketLength(raw, userID) {
+			viridian.countDropped()
+			return
+		}
+		viridian.received()
+
+		// Check viridian bandwidth limit, only authenticated packets are charged, so that forged packets can not drain it
+		// Decrypted packet length is charged, the same as for packets sent to viridian, so that the limit is equal in both directions
+		if !viridian.allow(len(raw)) {
+			logrus.Debugf("Bandwidth limit exceeded, packet from viridian %d dropped", userID)
+			viridian.countDropped()
+			return
 		}
 
 		// Parse all packet headers
 		packet := gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.NoCopy)
 		if err := packet.ErrorLayer(); err != nil {
 			logrus.Errorf("Error decoding some part of the packet: %v", err)
-			continue
+			viridian.countDropped()
+			return
 		}
 
-		// Get IP layer header and change source IP
+		// Drop ICMP packets of types that should not be forwarded
+		if dict.icmpTypes != nil && !dict.icmpTypes.allows(packet) {
+			logrus.Debugf("ICMP packet from viridian %d dropped by type filter", userID)
+			viridian.countDropped()
+			return
+		}
+
+		// Get IP layer header
 		netLayer, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 		logrus.Infof("Received %d bytes from viridian %d (src: %v, dst: %v)", netLayer.Length, userID, netLayer.SrcIP, netLayer.DstIP)
-		netLayer.SrcIP = net.IPv4(tunnetwork.IP[0], tunnetwork.IP[1], viridianID[0], viridianID[1])
 
-		// Set the network layer to all the layers that require a network layer
-		for _, layer := range packet.Layers() {
-			netSettableLayer, ok := layer.(netSettableLayerType)
-			if ok {
-				netSettableLayer.SetNetworkLayerForChecksum(netLayer)
-			}
+		// Drop packets to destinations viridian is not allowed to route
+		if !viridian.routes.allows(netLayer.DstIP) {
+			logrus.Debugf("Packet from viridian %d to disallowed destination %v dropped", userID, netLayer.DstIP)
+			viridian.countDropped()
+			return
 		}
 
-		// Serialize the packet
-		err = gopacket.SerializePacket(serialBuffer, gopacket.SerializeOptions{ComputeChecksums: true}, packet)
+		// Reply with ICMP "fragmentation needed" if packet can not be forwarded without fragmentation
+		if exceedsPathMTU(netLayer, len(raw), dict.externalMTU) {
+			viridian.countDropped()
+			dict.sendFragmentationNeeded(viridian, raw, netLayer, address)
+			return
+		}
+
+		// Change source IP
+		rewritten, err := rewritePacket(serialBuffer, packet, netLayer, raw, sourceIP, nil)
 		if err != nil {
 			logrus.Errorf("Error serializing packet: %v", err)
-			continue
+			viridian.countDropped()
+			return
 		}
 
-		// Write packet to tunnel
-		s, err := tunnel.Write(serialBuffer.Bytes())
-		if err != nil || s == 0 {
-			logrus.Errorf("Error writing to tunnel (%d bytes written): %v", s, err)
+		// Account packet in flow export, if enabled
+		if dict.flows != nil {
+			dict.flows.Observe(userID, false, netLayer, packet)
+		}
+
+		// Sample packet headers, if enabled
+		if dict.sampler != nil {
+			dict.sampler.observe(viridian.UID, false, netLayer, packet)
+		}
+
+		// Schedule packet for writing to tunnel, packets with high DSCP class are prioritized
+		// If a packet is dropped, it is counted as dropped instead of received
+		if !dict.scheduler.enqueue(userID, viridian.admin, dict.prioritized(netLayer), rewritten) {
+			logrus.Debugf("Tunnel queue of viridian %d full (or tunnel writing stopped), packet dropped", userID)
+			viridian.countDropped()
+			return
+		}
+
+		// Update viridian traffic counters
+		viridian.countReceived(dict.accounted(raw, buffer))
+		viridian.countGoodput(len(raw), len(buffer))
+	}
+
+	logrus.Debug("Receiving packets from viridian started")
+	for {
+		// Handle graceful termination
+		select {
+		case <-ctx.Done():
+			logrus.Debug("Receiving packets from viridian stopped")
+			return
+		default: // do nothing
+		}
+
+		// Read packets from UDP connection and process them
+		r, err := reader.read(handler)
+		if err != nil {
+			logrus.Errorf("Error reading from viridian (%d packets read): %v", r, err)
 			continue
 		}
 	}
@@ -109,9 +309,9 @@ func (dict *ViridianDict) ReceivePacketsFromViridian(ctx context.Context, userID
 
 // Start receiving packets from the internet (external interface) and sending them to viridians.
 // Should be applied for ViridianDict object.
-// Accept Context for graceful termination, tunnel interface pointer and tunnel IP network address pointer.
+// Accept Context for graceful termination, tunnel device reader and tunnel IP network address pointer.
 // NB! this method is blocking, so it should be run as goroutine.
-func (dict *ViridianDict) SendPacketsToViridians(ctx context.Context, tunnel *water.Interface, tunnetwork *net.IPNet) {
+func (dict *ViridianDict) SendPacketsToViridians(ctx context.Context, tunnel io.Reader, tunnetwork *net.IPNet) {
 	buffer := make([]byte, math.MaxUint16)
 
 	// Create buffer for packet decoding
@@ -137,23 +337,40 @@ func (dict *ViridianDict) SendPacketsToViridians(ctx context.Context, tunnel *wa
 			continue
 		}
 
-		// Parse all packet headers
-		packet := gopacket.NewPacket(buffer[:r], layers.LayerTypeIPv4, gopacket.NoCopy)
-		if err := packet.ErrorLayer(); err != nil {
-			logrus.Errorf("Error decoding some part of the packet: %v", err)
+		// Parse all packet headers, drop packets that can not be forwarded
+		packet, netLayer, ok := dict.decodeTunnelPacket(buffer[:r])
+		if !ok {
+			continue
 		}
 
-		// Get packet IP layer header
-		netLayer, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		// Drop ICMP packets of types that should not be forwarded
+		if dict.icmpTypes != nil && !dict.icmpTypes.allows(packet) {
+			logrus.Debugf("ICMP packet to %v dropped by type filter", netLayer.DstIP)
+			continue
+		}
 
-		// Get the viridian the packet was received from
+		// Get the viridian the packet was received from, special addresses never belong to viridians
 		viridianID := binary.BigEndian.Uint16([]byte{netLayer.DstIP[2], netLayer.DstIP[3]})
+		if utils.IsSpecialIPAddress(viridianID) {
+			logrus.Debugf("Packet to special address %v dropped", netLayer.DstIP)
+			continue
+		}
 		viridian, ok := dict.Get(viridianID)
 		if !ok {
 			logrus.Errorf("Error: user %d not registered", viridianID)
 			continue
 		}
 
+		// Mark viridian as active
+		viridian.touch()
+
+		// Check viridian bandwidth limit
+		if !viridian.allow(r) {
+			logrus.Debugf("Bandwidth limit exceeded, packet to viridian %d dropped", viridianID)
+			viridian.countDropped()
+			continue
+		}
+
 		// Resolve the viridian destination address
 		gateway, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", viridian.Gateway.String(), viridian.Port))
 		if err != nil {
@@ -161,27 +378,26 @@ func (dict *ViridianDict) SendPacketsToViridians(ctx context.Context, tunnel *wa
 			continue
 		}
 
-		// Change packet IP layer destination address
-		netLayer.DstIP = viridian.Address
-		logrus.Infof("Sending %d bytes to viridian %d (src: %v, dst: %v)", netLayer.Length, viridianID, netLayer.SrcIP, netLayer.DstIP)
+		// Account packet in flow export, if enabled
+		if dict.flows != nil {
+			dict.flows.Observe(viridianID, true, netLayer, packet)
+		}
 
-		// Set the network layer to all the layers that require a network layer
-		for _, layer := range packet.Layers() {
-			netSettableLayer, ok := layer.(netSettableLayerType)
-			if ok {
-				netSettableLayer.SetNetworkLayerForChecksum(netLayer)
-			}
+		// Sample packet headers, if enabled
+		if dict.sampler != nil {
+			dict.sampler.observe(viridian.UID, true, netLayer, packet)
 		}
 
-		// Serialize the packet
-		err = gopacket.SerializePacket(serialBuffer, gopacket.SerializeOptions{ComputeChecksums: true}, packet)
+		// Change packet IP layer destination address
+		rewritten, err := rewritePacket(serialBuffer, packet, netLayer, buffer[:r], nil, viridian.Address)
 		if err != nil {
 			logrus.Errorf("Error serializing packet: %v", err)
 			continue
 		}
+		logrus.Infof("Sending %d bytes to viridian %d (src: %v, dst: %v)", netLayer.Length, viridianID, netLayer.SrcIP, netLayer.DstIP)
 
 		// Encrypt packet
-		encrypted, err := crypto.Encrypt(serialBuffer.Bytes(), viridian.AEAD)
+		encrypted, err := crypto.Encrypt(rewritten, viridian.AEAD)
 		if err != nil {
 			logrus.Errorf("Error encrypting packet: %v", err)
 			continue
@@ -191,7 +407,44 @@ func (dict *ViridianDict) SendPacketsToViridians(ctx context.Context, tunnel *wa
 		s, err := viridian.SeaConn.WriteToUDP(encrypted, gateway)
 		if err != nil || s == 0 {
 			logrus.Errorf("Error writing to viridian (%d bytes written): %v", s, err)
+			viridian.countDropped()
 			continue
 		}
+
+		// Update viridian traffic counters
+		viridian.countSent(dict.accounted(rewritten, encrypted))
+		viridian.countGoodput(len(rewritten), len(encrypted))
+	}
+}
+
+// Send ICMP "fragmentation needed" packet to viridian in response to an oversized packet, so that path MTU discovery works.
+// Should be applied for ViridianDict object.
+// Accept viridian the packet was received from, original packet bytes, original packet IP layer header and viridian address.
+func (dict *ViridianDict) sendFragmentationNeeded(viridian *Viridian, raw []byte, netLayer *layers.IPv4, address *net.UDPAddr) {
+	logrus.Infof("Packet of %d bytes exceeds external MTU %d (src: %v, dst: %v)", len(raw), dict.externalMTU, netLayer.SrcIP, netLayer.DstIP)
+
+	// Create ICMP packet
+	icmp, err := createFragmentationNeeded(raw, netLayer, dict.tunnelIP, dict.externalMTU)
+	if err != nil {
+		logrus.Errorf("Error creating ICMP packet: %v", err)
+		return
+	}
+
+	// Encrypt packet
+	encrypted, err := crypto.Encrypt(icmp, viridian.AEAD)
+	if err != nil {
+		logrus.Errorf("Error encrypting packet: %v", err)
+		return
+	}
+
+	// Send packet to viridian
+	s, err := viridian.SeaConn.WriteToUDP(encrypted, address)
+	if err != nil || s == 0 {
+		logrus.Errorf("Error writing to viridian (%d bytes written): %v", s, err)
+		return
 	}
+
+	// Update viridian traffic counters
+	viridian.countSent(dict.accounted(icmp, encrypted))
+	viridian.countGoodput(len(icmp), len(encrypted))
 }
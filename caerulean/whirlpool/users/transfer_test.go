@@ -0,0 +1,456 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"main/crypto"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	TRANSFER_TUNNEL_NETWORK = "172.16.0.1/12"
+	TRANSFER_USER_ID        = 12345
+	TRANSFER_PACKET_PADDING = 4
+
+	TRANSFER_EXTERNAL_MTU      = 1500
+	TRANSFER_RECEIVE_TIMEOUT   = time.Second
+	TRANSFER_BANDWIDTH         = 4
+	TRANSFER_FORGED_PACKETS    = 16
+	TRANSFER_FORGED_SIZE       = 1024
+	TRANSFER_MALFORMED_SIZE    = 10
+	TRANSFER_QUEUE_DEPTH       = 64
+	TRANSFER_PRIVILEGED_WEIGHT = 1
+
+	TRANSFER_ORDERING_VIRIDIANS = 4
+	TRANSFER_ORDERING_PACKETS   = 256
+)
+
+func createTransferTestDict() *ViridianDict {
+	return &ViridianDict{
+		scheduler:        newFairScheduler(TRANSFER_QUEUE_DEPTH, TRANSFER_PRIVILEGED_WEIGHT),
+		maxPacketPadding: -1,
+		externalMTU:      TRANSFER_EXTERNAL_MTU,
+		readBatchSize:    1,
+		entries:          make(map[uint16]*Viridian),
+		uniques:          make(map[string]uint16),
+	}
+}
+
+// Register viridian in dictionary and start receiving its packets.
+// Return connection that sends packets to the node on behalf of viridian.
+func startTransferTestViridian(test *testing.T, ctx context.Context, dict *ViridianDict, viridian *Viridian) *net.UDPConn {
+	seaConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		test.Fatalf("error listening viridian connection: %v", err)
+	}
+	test.Cleanup(func() { seaConn.Close() })
+
+	userID := uint16(seaConn.LocalAddr().(*net.UDPAddr).Port)
+	viridian.SeaConn = seaConn
+	dict.mutex.Lock()
+	dict.entries[userID] = viridian
+	dict.uniques[viridian.UID] = userID
+	dict.mutex.Unlock()
+
+	_, tunnetwork, err := net.ParseCIDR(TRANSFER_TUNNEL_NETWORK)
+	if err != nil {
+		test.Fatalf("error parsing tunnel network: %v", err)
+	}
+	go dict.ReceivePacketsFromViridian(ctx, userID, seaConn, tunnetwork)
+
+	client, err := net.DialUDP("udp4", nil, seaConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		test.Fatalf("error dialing viridian connection: %v", err)
+	}
+	test.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Wait until viridian statistics satisfy condition.
+// Return true if condition was satisfied before timeout.
+func waitTransferTestStatistics(viridian *Viridian, condition func(ViridianStatistics) bool) bool {
+	deadline := time.Now().Add(TRANSFER_RECEIVE_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if condition(viridian.Statistics()) {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func benchmarkSourceRewrite(benchmark *testing.B, source func() net.IP) {
+	raw := createTestPacket(benchmark, testPacketSpec{})
+	serialBuffer := gopacket.NewSerializeBuffer()
+
+	benchmark.ReportAllocs()
+	benchmark.ResetTimer()
+	for i := 0; i < benchmark.N; i++ {
+		serialBuffer.Clear()
+		packet := gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.NoCopy)
+		netLayer, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		netLayer.SrcIP = source()
+		for _, layer := range packet.Layers() {
+			if netSettableLayer, ok := layer.(netSettableLayerType); ok {
+				netSettableLayer.SetNetworkLayerForChecksum(netLayer)
+			}
+		}
+		if err := gopacket.SerializePacket(serialBuffer, gopacket.SerializeOptions{ComputeChecksums: true}, packet); err != nil {
+			benchmark.Fatalf("error serializing packet: %v", err)
+		}
+	}
+}
+
+func BenchmarkSourceRewritePerPacket(benchmark *testing.B) {
+	_, tunnetwork, _ := net.ParseCIDR(TRANSFER_TUNNEL_NETWORK)
+	viridianID := []byte{0, 0}
+	binary.BigEndian.PutUint16(viridianID, TRANSFER_USER_ID)
+
+	benchmarkSourceRewrite(benchmark, func() net.IP {
+		return net.IPv4(tunnetwork.IP[0], tunnetwork.IP[1], viridianID[0], viridianID[1])
+	})
+}
+
+func BenchmarkSourceRewritePrecomputed(benchmark *testing.B) {
+	_, tunnetwork, _ := net.ParseCIDR(TRANSFER_TUNNEL_NETWORK)
+	viridianID := []byte{0, 0}
+	binary.BigEndian.PutUint16(viridianID, TRANSFER_USER_ID)
+
+	sourceIP := viridianSourceIP(tunnetwork, viridianID)
+	benchmarkSourceRewrite(benchmark, func() net.IP {
+		return sourceIP
+	})
+}
+
+func TestViridianSourceIP(test *testing.T) {
+	_, tunnetwork, _ := net.ParseCIDR(TRANSFER_TUNNEL_NETWORK)
+	viridianID := []byte{0, 0}
+	binary.BigEndian.PutUint16(viridianID, TRANSFER_USER_ID)
+
+	expected := net.IPv4(tunnetwork.IP[0], tunnetwork.IP[1], viridianID[0], viridianID[1])
+	if sourceIP := viridianSourceIP(tunnetwork, viridianID); !sourceIP.Equal(expected) {
+		test.Fatalf("viridian source IP doesn't match expected: %v != %v", sourceIP, expected)
+	}
+}
+
+func TestDecodeTunnelPacket(test *testing.T) {
+	dict := &ViridianDict{}
+
+	ipv6Layer := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolNoNextHeader,
+		SrcIP:      net.ParseIP("fd00::2"),
+		DstIP:      net.ParseIP("2001:4860:4860::8888"),
+	}
+	serialBuffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(serialBuffer, gopacket.SerializeOptions{FixLengths: true}, ipv6Layer); err != nil {
+		test.Fatalf("error serializing IPv6 packet: %v", err)
+	}
+	if _, _, ok := dict.decodeTunnelPacket(serialBuffer.Bytes()); ok {
+		test.Fatal("IPv6 packet not dropped")
+	}
+	if dict.unsupportedPackets != 1 || dict.malformedPackets != 0 {
+		test.Fatalf("IPv6 packet counted incorrectly: %d unsupported, %d malformed", dict.unsupportedPackets, dict.malformedPackets)
+	}
+
+	malformed := []byte{0x45, 0x00, 0x00, 0x54, 0x00}
+	if _, _, ok := dict.decodeTunnelPacket(malformed); ok {
+		test.Fatal("malformed packet not dropped")
+	}
+	if dict.unsupportedPackets != 1 || dict.malformedPackets != 1 {
+		test.Fatalf("malformed packet counted incorrectly: %d unsupported, %d malformed", dict.unsupportedPackets, dict.malformedPackets)
+	}
+
+	raw := createTestPacket(test, testPacketSpec{})
+	_, netLayer, ok := dict.decodeTunnelPacket(raw)
+	if !ok || !netLayer.DstIP.Equal(net.IPv4(8, 8, 8, 8)) {
+		test.Fatalf("IPv4 packet not decoded: %v", netLayer)
+	}
+	if dict.unsupportedPackets != 1 || dict.malformedPackets != 1 {
+		test.Fatalf("IPv4 packet counted as dropped: %d unsupported, %d malformed", dict.unsupportedPackets, dict.malformedPackets)
+	}
+}
+
+func TestCheckPacketLength(test *testing.T) {
+	dict := &ViridianDict{maxPacketPadding: TRANSFER_PACKET_PADDING}
+	raw := createTestPacket(test, testPacketSpec{})
+
+	if !dict.checkPacketLength(raw, TRANSFER_USER_ID) {
+		test.Fatal("packet with matching length dropped")
+	}
+
+	padded := append(append([]byte{}, raw...), make([]byte, TRANSFER_PACKET_PADDING)...)
+	if !dict.checkPacketLength(padded, TRANSFER_USER_ID) {
+		test.Fatal("packet with tolerated padding dropped")
+	}
+	if dict.mismatchedPackets != 0 {
+		test.Fatalf("valid packets counted as mismatched: %d", dict.mismatchedPackets)
+	}
+
+	if dict.checkPacketLength(append(padded, 0), TRANSFER_USER_ID) {
+		test.Fatal("packet with excessive padding not dropped")
+	}
+	if dict.checkPacketLength(raw[:len(raw)-1], TRANSFER_USER_ID) {
+		test.Fatal("truncated packet not dropped")
+	}
+	if dict.checkPacketLength(raw[:IPV4_LENGTH_OFFSET], TRANSFER_USER_ID) {
+		test.Fatal("packet without total length not dropped")
+	}
+	if dict.mismatchedPackets != 3 {
+		test.Fatalf("mismatched packets counted incorrectly: %d != 3", dict.mismatchedPackets)
+	}
+
+	disabled := &ViridianDict{maxPacketPadding: -1}
+	if !disabled.checkPacketLength(raw[:len(raw)-1], TRANSFER_USER_ID) {
+		test.Fatal("truncated packet dropped while length check is disabled")
+	}
+}
+
+func TestRewritePacket(test *testing.T) {
+	raw := createTestPacket(test, testPacketSpec{})
+	original := append([]byte{}, raw...)
+	serialBuffer := gopacket.NewSerializeBuffer()
+
+	packet := gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.NoCopy)
+	netLayer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	rewritten, err := rewritePacket(serialBuffer, packet, netLayer, raw, netLayer.SrcIP, nil)
+	if err != nil || !bytes.Equal(rewritten, original) || len(serialBuffer.Bytes()) != 0 {
+		test.Fatalf("no-op rewrite changed packet or serialized it: %v", err)
+	}
+
+	source := net.IPv4(172, 16, 48, 57).To4()
+	packet = gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.NoCopy)
+	netLayer = packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	rewritten, err = rewritePacket(serialBuffer, packet, netLayer, raw, source, nil)
+	if err != nil {
+		test.Fatalf("error rewriting packet: %v", err)
+	}
+
+	parsed := gopacket.NewPacket(rewritten, layers.LayerTypeIPv4, gopacket.Default)
+	parsedLayer := parsed.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !parsedLayer.SrcIP.Equal(source) || bytes.Equal(rewritten[IPV4_CHECKSUM_OFFSET:IPV4_CHECKSUM_OFFSET+2], original[IPV4_CHECKSUM_OFFSET:IPV4_CHECKSUM_OFFSET+2]) {
+		test.Fatalf("rewritten packet source or checksum not updated: %v", parsedLayer)
+	}
+}
+
+func TestForgedPacketsBandwidth(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aead, err := crypto.GenerateCipher()
+	if err != nil {
+		test.Fatalf("error generating cipher: %v", err)
+	}
+	dict := createTransferTestDict()
+	viridian := &Viridian{UID: DIRECTORY_CYCLE_VIRIDIAN_UID, AEAD: aead, limiter: newBandwidthLimiter(TRANSFER_BANDWIDTH)}
+	client := startTransferTestViridian(test, ctx, dict, viridian)
+
+	// Packets that can not be decrypted should not take anything from the bandwidth bucket
+	for i := 0; i < TRANSFER_FORGED_PACKETS; i++ {
+		if _, err := client.Write(make([]byte, TRANSFER_FORGED_SIZE)); err != nil {
+			test.Fatalf("error sending forged packet: %v", err)
+		}
+	}
+
+	encrypted, err := crypto.Encrypt(createTestPacket(test, testPacketSpec{}), aead)
+	if err != nil {
+		test.Fatalf("error encrypting packet: %v", err)
+	}
+	if _, err := client.Write(encrypted); err != nil {
+		test.Fatalf("error sending packet: %v", err)
+	}
+
+	if !waitTransferTestStatistics(viridian, func(stats ViridianStatistics) bool { return stats.PacketsIn+stats.Dropped > 0 }) {
+		test.Fatalf("valid packet was not processed in %v", TRANSFER_RECEIVE_TIMEOUT)
+	}
+	if stats := viridian.Statistics(); stats.PacketsIn != 1 || stats.Dropped != 0 {
+		test.Fatalf("valid packet dropped after forged packets: %d received, %d dropped", stats.PacketsIn, stats.Dropped)
+	}
+}
+
+func TestIngressBandwidthCharge(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aead, err := crypto.GenerateCipher()
+	if err != nil {
+		test.Fatalf("error generating cipher: %v", err)
+	}
+	raw := createTestPacket(test, testPacketSpec{})
+	encrypted, err := crypto.Encrypt(raw, aead)
+	if err != nil {
+		test.Fatalf("error encrypting packet: %v", err)
+	}
+
+	// Bucket only fits the decrypted packet, encryption overhead should not be charged
+	dict := createTransferTestDict()
+	limiter := &bandwidthLimiter{burst: float64(len(raw)), available: float64(len(raw)), last: time.Now()}
+	viridian := &Viridian{UID: DIRECTORY_CYCLE_VIRIDIAN_UID, AEAD: aead, limiter: limiter}
+	client := startTransferTestViridian(test, ctx, dict, viridian)
+	if _, err := client.Write(encrypted); err != nil {
+		test.Fatalf("error sending packet: %v", err)
+	}
+
+	if !waitTransferTestStatistics(viridian, func(stats ViridianStatistics) bool { return stats.PacketsIn+stats.Dropped > 0 }) {
+		test.Fatalf("packet was not processed in %v", TRANSFER_RECEIVE_TIMEOUT)
+	}
+	if stats := viridian.Statistics(); stats.PacketsIn != 1 || stats.Dropped != 0 {
+		test.Fatalf("packet fitting bandwidth limit dropped (%d bytes available, %d bytes encrypted): %d received, %d dropped", len(raw), len(encrypted), stats.PacketsIn, stats.Dropped)
+	}
+}
+
+func TestMismatchedPacketNotReceived(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aead, err := crypto.GenerateCipher()
+	if err != nil {
+		test.Fatalf("error generating cipher: %v", err)
+	}
+	dict := createTransferTestDict()
+	dict.maxPacketPadding = 0
+	viridian := &Viridian{UID: DIRECTORY_CYCLE_VIRIDIAN_UID, AEAD: aead}
+	client := startTransferTestViridian(test, ctx, dict, viridian)
+
+	// Packet with mismatched length should not count as data healthcheck
+	packet := append(createTestPacket(test, testPacketSpec{}), make([]byte, TRANSFER_PACKET_PADDING)...)
+	encrypted, err := crypto.Encrypt(packet, aead)
+	if err != nil {
+		test.Fatalf("error encrypting packet: %v", err)
+	}
+	if _, err := client.Write(encrypted); err != nil {
+		test.Fatalf("error sending packet: %v", err)
+	}
+
+	if !waitTransferTestStatistics(viridian, func(stats ViridianStatistics) bool { return stats.Dropped > 0 }) {
+		test.Fatalf("mismatched packet was not dropped in %v", TRANSFER_RECEIVE_TIMEOUT)
+	}
+	if received := atomic.LoadInt64(&viridian.lastReceived); received != 0 {
+		test.Fatalf("mismatched packet marked as received: %d", received)
+	}
+}
+
+func TestQueueDroppedPacketNotReceived(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aead, err := crypto.GenerateCipher()
+	if err != nil {
+		test.Fatalf("error generating cipher: %v", err)
+	}
+	dict := createTransferTestDict()
+	dict.scheduler.stop()
+	viridian := &Viridian{UID: DIRECTORY_CYCLE_VIRIDIAN_UID, AEAD: aead}
+	client := startTransferTestViridian(test, ctx, dict, viridian)
+
+	// Packet that can not be scheduled for writing to tunnel should be counted as dropped only
+	encrypted, err := crypto.Encrypt(createTestPacket(test, testPacketSpec{}), aead)
+	if err != nil {
+		test.Fatalf("error encrypting packet: %v", err)
+	}
+	if _, err := client.Write(encrypted); err != nil {
+		test.Fatalf("error sending packet: %v", err)
+	}
+
+	if !waitTransferTestStatistics(viridian, func(stats ViridianStatistics) bool { return stats.Dropped > 0 }) {
+		test.Fatalf("unscheduled packet was not dropped in %v", TRANSFER_RECEIVE_TIMEOUT)
+	}
+	if stats := viridian.Statistics(); stats.PacketsIn != 0 || stats.BytesIn != 0 || stats.PayloadBytes != 0 {
+		test.Fatalf("dropped packet counted as received: %d packets, %d bytes, %d payload bytes", stats.PacketsIn, stats.BytesIn, stats.PayloadBytes)
+	}
+}
+
+func TestMalformedPacketSourceNotBlocked(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aead, err := crypto.GenerateCipher()
+	if err != nil {
+		test.Fatalf("error generating cipher: %v", err)
+	}
+	dict := createTransferTestDict()
+	dict.badSources = newBadSources(1, time.Minute)
+	viridian := &Viridian{UID: DIRECTORY_CYCLE_VIRIDIAN_UID, AEAD: aead}
+	client := startTransferTestViridian(test, ctx, dict, viridian)
+
+	// Malformed packet that was decrypted successfully should not get its source blocked
+	malformed, err := crypto.Encrypt(createTestPacket(test, testPacketSpec{})[:TRANSFER_MALFORMED_SIZE], aead)
+	if err != nil {
+		test.Fatalf("error encrypting malformed packet: %v", err)
+	}
+	if _, err := client.Write(malformed); err != nil {
+		test.Fatalf("error sending malformed packet: %v", err)
+	}
+	if !waitTransferTestStatistics(viridian, func(stats ViridianStatistics) bool { return stats.Dropped > 0 }) {
+		test.Fatalf("malformed packet was not dropped in %v", TRANSFER_RECEIVE_TIMEOUT)
+	}
+
+	encrypted, err := crypto.Encrypt(createTestPacket(test, testPacketSpec{}), aead)
+	if err != nil {
+		test.Fatalf("error encrypting packet: %v", err)
+	}
+	if _, err := client.Write(encrypted); err != nil {
+		test.Fatalf("error sending packet: %v", err)
+	}
+	if !waitTransferTestStatistics(viridian, func(stats ViridianStatistics) bool { return stats.PacketsIn > 0 }) {
+		test.Fatalf("valid packet after malformed one was not received in %v", TRANSFER_RECEIVE_TIMEOUT)
+	}
+}
+
+func TestViridianPacketOrdering(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dict := createTransferTestDict()
+	dict.scheduler = newFairScheduler(TRANSFER_ORDERING_PACKETS, TRANSFER_PRIVILEGED_WEIGHT)
+	writer := make(schedulerTestWriter, TRANSFER_ORDERING_PACKETS)
+	go dict.scheduler.run(ctx, writer)
+
+	// Every viridian sends numbered packets (number is IP identification field) concurrently with the others
+	for i := 0; i < TRANSFER_ORDERING_VIRIDIANS; i++ {
+		aead, err := crypto.GenerateCipher()
+		if err != nil {
+			test.Fatalf("error generating cipher: %v", err)
+		}
+		viridian := &Viridian{UID: fmt.Sprintf("%s_%d", DIRECTORY_CYCLE_VIRIDIAN_UID, i), AEAD: aead}
+		client := startTransferTestViridian(test, ctx, dict, viridian)
+
+		packets := make([][]byte, TRANSFER_ORDERING_PACKETS)
+		for number := range packets {
+			raw := createTestPacket(test, testPacketSpec{id: uint16(number), payload: make([]byte, 16)})
+			if packets[number], err = crypto.Encrypt(raw, aead); err != nil {
+				test.Fatalf("error encrypting packet %d: %v", number, err)
+			}
+		}
+
+		go func() {
+			for _, packet := range packets {
+				client.Write(packet)
+			}
+		}()
+	}
+
+	// Packets of every viridian (identified by tunnel source address) should be written to tunnel in the order they were sent
+	next := make(map[uint16]uint16, TRANSFER_ORDERING_VIRIDIANS)
+	for i := 0; i < TRANSFER_ORDERING_VIRIDIANS*TRANSFER_ORDERING_PACKETS; i++ {
+		select {
+		case packet := <-writer:
+			source, number := binary.BigEndian.Uint16(packet[14:16]), binary.BigEndian.Uint16(packet[4:6])
+			if number != next[source] {
+				test.Fatalf("packet of viridian %d written to tunnel out of order: %d != %d", source, number, next[source])
+			}
+			next[source]++
+		case <-time.After(TRANSFER_RECEIVE_TIMEOUT):
+			test.Fatalf("only %d sent packets were written to tunnel in %v", i, TRANSFER_RECEIVE_TIMEOUT)
+		}
+	}
+}
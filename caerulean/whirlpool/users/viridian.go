@@ -3,13 +3,152 @@ package users
 import (
 	"context"
 	"crypto/cipher"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
+// Traffic accounting mode that counts inner IP packet bytes only.
+const ACCOUNTING_PAYLOAD = "payload"
+
+// Traffic accounting mode that counts bytes sent over the wire (encrypted packet, nonce, MAC and outer UDP and IP headers).
+const ACCOUNTING_WIRE = "wire"
+
+// Length of outer IPv4 and UDP headers of VPN packets, counted in wire accounting mode.
+const WIRE_HEADERS_LENGTH = 28
+
+// Viridian disconnect reason, reported in disconnect summary and to the disconnected viridian.
+type DisconnectReason string
+
+// Viridian disconnect reasons.
+const (
+	// Viridian requested disconnection or was deleted by node owner.
+	DISCONNECT_REQUESTED DisconnectReason = "requested"
+
+	// Viridian missed healthcheck.
+	DISCONNECT_UNHEALTHY DisconnectReason = "healthcheck_timeout"
+
+	// Viridian subscription expired.
+	DISCONNECT_SUBSCRIPTION DisconnectReason = "subscription_expired"
+
+	// Viridian maximum connection lifetime ended.
+	DISCONNECT_LIFETIME DisconnectReason = "lifetime_exceeded"
+
+	// Viridian with the same unique identifier connected again.
+	DISCONNECT_RECONNECTED DisconnectReason = "reconnected"
+
+	// Viridian reported a protocol error.
+	DISCONNECT_ERROR DisconnectReason = "protocol_error"
+
+	// Node is shutting down.
+	DISCONNECT_SHUTDOWN DisconnectReason = "shutdown"
+)
+
+// Viridian statistics structure.
+// Contains a snapshot of viridian traffic counters and connection properties.
+type ViridianStatistics struct {
+	// Number of packets received from viridian.
+	PacketsIn uint64
+
+	// Number of bytes received from viridian.
+	BytesIn uint64
+
+	// Number of packets sent to viridian.
+	PacketsOut uint64
+
+	// Number of bytes sent to viridian.
+	BytesOut uint64
+
+	// Number of inner IP packet bytes transferred in both directions, regardless of accounting mode.
+	PayloadBytes uint64
+
+	// Number of bytes transferred over the wire in both directions (with encryption overhead and outer headers), regardless of accounting mode.
+	WireBytes uint64
+
+	// Number of viridian packets dropped (because of limits, filters or errors) in both directions.
+	Dropped uint64
+
+	// Time elapsed since viridian connection.
+	Uptime time.Duration
+
+	// Flag, whether user is privileged.
+	Privileged bool
+
+	// User subscription expiration timeout, nil if there is no subscription.
+	Subscription *time.Time
+}
+
+// Calculate goodput: share of wire bytes that is useful payload.
+// Should be applied for ViridianStatistics object.
+// Return ratio of payload bytes to wire bytes, zero if nothing was transferred.
+func (stats ViridianStatistics) Goodput() float64 {
+	if stats.WireBytes == 0 {
+		return 0
+	}
+	return float64(stats.PayloadBytes) / float64(stats.WireBytes)
+}
+
+// Calculate average throughput of both directions.
+// Should be applied for ViridianStatistics object.
+// Return number of bytes (according to accounting mode) transferred per second of uptime, zero if uptime is zero.
+func (stats ViridianStatistics) Throughput() float64 {
+	if stats.Uptime <= 0 {
+		return 0
+	}
+	return float64(stats.BytesIn+stats.BytesOut) / stats.Uptime.Seconds()
+}
+
+// Create viridian disconnect summary log entry.
+// Should be applied for ViridianStatistics object.
+// Accept viridian unique identifier and disconnect reason.
+// Return log entry with summary fields.
+func (stats ViridianStatistics) summary(uid string, reason DisconnectReason) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"event":       "disconnect",
+		"uid":         uid,
+		"reason":      string(reason),
+		"duration":    stats.Uptime.Round(time.Millisecond).String(),
+		"packets_in":  stats.PacketsIn,
+		"bytes_in":    stats.BytesIn,
+		"packets_out": stats.PacketsOut,
+		"bytes_out":   stats.BytesOut,
+		"dropped":     stats.Dropped,
+		"throughput":  fmt.Sprintf("%.1f", stats.Throughput()),
+		"goodput":     fmt.Sprintf("%.3f", stats.Goodput()),
+	})
+}
+
 // Viridian structure.
 // Contains all the required information about connected viridian.
 type Viridian struct {
+	// Traffic counters, should only be accessed atomically (placed first for 64-bit alignment).
+	packetsIn, bytesIn, packetsOut, bytesOut uint64
+
+	// Payload, wire byte and dropped packet counters of both directions, should only be accessed atomically.
+	payloadBytes, wireBytes, dropped uint64
+
+	// Time of the last viridian traffic (unix nanoseconds), should only be accessed atomically.
+	lastActive int64
+
+	// Time of the last valid packet received from viridian (unix nanoseconds), should only be accessed atomically.
+	lastReceived int64
+
+	// Flag, whether viridian connection buffers are shrunk because of inactivity, should only be accessed atomically.
+	idle int32
+
+	// Original viridian connection buffer sizes, restored when traffic resumes.
+	buffers socketBuffers
+
+	// Mutex for viridian connection buffer size changes.
+	buffersMutex sync.Mutex
+
+	// Viridian connection time.
+	connected time.Time
+
 	// Unique user identifier as a string.
 	UID string
 
@@ -19,12 +158,24 @@ type Viridian struct {
 	// Resetting timer, updated on every healthcheck, removes user after timeout.
 	reset *time.Timer
 
+	// Current healthcheck timeout, the time reset timer was set to during the last healthcheck.
+	healthTimeout time.Duration
+
+	// Lifetime timer, removes user after maximum connection lifetime (nil if lifetime is not limited).
+	lifetime *time.Timer
+
 	// Flag, whether user is privileged.
 	admin bool
 
 	// User subscription expiration timeout, non-privileged user is deleted after the timeout.
 	timeout *time.Time
 
+	// User bandwidth limiter, nil if bandwidth is not limited.
+	limiter *bandwidthLimiter
+
+	// User allowed destination prefixes, nil if all destinations are allowed.
+	routes routeFilter
+
 	// User internal IP address: encrypted packet "dst" address will be set to this IP.
 	Address net.IP
 
@@ -42,17 +193,126 @@ type Viridian struct {
 }
 
 // Determine whether viridian should be removed.
-// Viridian is removed if it is NOT privileged AND if viridian subscription has expired.
+// Viridian is removed if it is NOT privileged AND if viridian subscription has expired more than clock skew ago.
 // Should be applied for Viridian object.
-// Accept viridian pointer, return flag if the viridian should be deleted.
-func (viridian *Viridian) isViridianOvertime() bool {
-	return !viridian.admin && viridian.timeout != nil && viridian.timeout.Before(time.Now().UTC())
+// Accept clock skew tolerance, return flag if the viridian should be deleted.
+func (viridian *Viridian) isViridianOvertime(skew time.Duration) bool {
+	return !viridian.admin && viridian.timeout != nil && viridian.timeout.Add(skew).Before(time.Now().UTC())
 }
 
-// Stop viridian connection and remove deletion timer.
+// Check if packet fits into viridian bandwidth limit.
 // Should be applied for Viridian object.
-func (viridian *Viridian) stop() {
+// Accept packet size in bytes.
+// Return true if packet should be transferred (or bandwidth is not limited), false if it should be dropped.
+func (viridian *Viridian) allow(size int) bool {
+	return viridian.limiter == nil || viridian.limiter.allow(size)
+}
+
+// Mark valid packet as received from viridian.
+// Should be applied for Viridian object.
+func (viridian *Viridian) received() {
+	atomic.StoreInt64(&viridian.lastReceived, time.Now().UnixNano())
+}
+
+// Mark viridian as active.
+// If viridian connection buffers were shrunk because of inactivity, restore them.
+// Should be applied for Viridian object.
+func (viridian *Viridian) touch() {
+	atomic.StoreInt64(&viridian.lastActive, time.Now().UnixNano())
+	if atomic.LoadInt32(&viridian.idle) == 0 {
+		return
+	}
+
+	viridian.buffersMutex.Lock()
+	defer viridian.buffersMutex.Unlock()
+	if atomic.LoadInt32(&viridian.idle) == 1 {
+		if err := setSocketBuffers(viridian.SeaConn, viridian.buffers); err != nil {
+			logrus.Warnf("Error restoring viridian %s buffers: %v", viridian.UID, err)
+		}
+		atomic.StoreInt32(&viridian.idle, 0)
+	}
+}
+
+// Shrink viridian connection buffers if viridian was inactive for long enough.
+// Should be applied for Viridian object.
+// Accept inactivity timeout and shrunk buffer size.
+// Return true if buffers were shrunk, false otherwise.
+func (viridian *Viridian) shrinkIfIdle(timeout time.Duration, size int) bool {
+	viridian.buffersMutex.Lock()
+	defer viridian.buffersMutex.Unlock()
+
+	lastActive := time.Unix(0, atomic.LoadInt64(&viridian.lastActive))
+	if atomic.LoadInt32(&viridian.idle) == 1 || time.Since(lastActive) < timeout {
+		return false
+	}
+
+	if err := setSocketBuffers(viridian.SeaConn, socketBuffers{read: size, write: size}); err != nil {
+		logrus.Warnf("Error shrinking viridian %s buffers: %v", viridian.UID, err)
+		return false
+	}
+	atomic.StoreInt32(&viridian.idle, 1)
+	return true
+}
+
+// Count packet received from viridian.
+// Should be applied for Viridian object.
+// Accept packet size in bytes.
+func (viridian *Viridian) countReceived(size int) {
+	atomic.AddUint64(&viridian.packetsIn, 1)
+	atomic.AddUint64(&viridian.bytesIn, uint64(size))
+}
+
+// Count packet sent to viridian.
+// Should be applied for Viridian object.
+// Accept packet size in bytes.
+func (viridian *Viridian) countSent(size int) {
+	atomic.AddUint64(&viridian.packetsOut, 1)
+	atomic.AddUint64(&viridian.bytesOut, uint64(size))
+}
+
+// Count payload and wire bytes of a packet transferred in any direction.
+// Should be applied for Viridian object.
+// Accept inner IP packet size and encrypted packet size in bytes.
+func (viridian *Viridian) countGoodput(payload, encrypted int) {
+	atomic.AddUint64(&viridian.payloadBytes, uint64(payload))
+	atomic.AddUint64(&viridian.wireBytes, uint64(encrypted+WIRE_HEADERS_LENGTH))
+}
+
+// Count packet of viridian dropped in any direction.
+// Should be applied for Viridian object.
+func (viridian *Viridian) countDropped() {
+	atomic.AddUint64(&viridian.dropped, 1)
+}
+
+// Get viridian statistics snapshot.
+// Should be applied for Viridian object.
+// Return viridian statistics structure.
+func (viridian *Viridian) Statistics() ViridianStatistics {
+	return ViridianStatistics{
+		PacketsIn:    atomic.LoadUint64(&viridian.packetsIn),
+		BytesIn:      atomic.LoadUint64(&viridian.bytesIn),
+		PacketsOut:   atomic.LoadUint64(&viridian.packetsOut),
+		BytesOut:     atomic.LoadUint64(&viridian.bytesOut),
+		PayloadBytes: atomic.LoadUint64(&viridian.payloadBytes),
+		WireBytes:    atomic.LoadUint64(&viridian.wireBytes),
+		Dropped:      atomic.LoadUint64(&viridian.dropped),
+		Uptime:       time.Since(viridian.connected),
+		Privileged:   viridian.admin,
+		Subscription: viridian.timeout,
+	}
+}
+
+// Stop viridian connection and remove deletion and lifetime timers.
+// Log viridian connection summary: traffic totals, duration, average throughput, goodput and dropped packets.
+// Should be applied for Viridian object.
+// Accept disconnect reason.
+func (viridian *Viridian) stop(reason DisconnectReason) {
 	viridian.reset.Stop()
+	if viridian.lifetime != nil {
+		viridian.lifetime.Stop()
+	}
 	viridian.CancelContext()
 	viridian.SeaConn.Close()
+
+	viridian.Statistics().summary(viridian.UID, reason).Info("Viridian disconnected")
 }
@@ -3,8 +3,21 @@ package users
 import (
 	"context"
 	"net"
+	"strconv"
 	"testing"
 	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+const (
+	VIRIDIAN_CLOCK_SKEW       = time.Minute
+	VIRIDIAN_GOODPUT_PACKETS  = 10
+	VIRIDIAN_GOODPUT_PAYLOAD  = 1000
+	VIRIDIAN_GOODPUT_OVERHEAD = 40
+	VIRIDIAN_SUMMARY_UID      = "test_summary_uid"
+	VIRIDIAN_SUMMARY_PACKETS  = 10
+	VIRIDIAN_SUMMARY_UPTIME   = 10 * time.Second
 )
 
 func TestViridianOvertime(test *testing.T) {
@@ -14,7 +27,7 @@ func TestViridianOvertime(test *testing.T) {
 		admin:   false,
 		timeout: &hourAgo,
 	}
-	if !viridian.isViridianOvertime() {
+	if !viridian.isViridianOvertime(0) {
 		test.Fatalf("viridian with timeout %v is not overtime at %v", viridian.timeout, time.Now())
 	}
 
@@ -22,11 +35,56 @@ func TestViridianOvertime(test *testing.T) {
 		admin:   true,
 		timeout: &hourAgo,
 	}
-	if admin.isViridianOvertime() {
+	if admin.isViridianOvertime(0) {
 		test.Fatalf("admin with timeout %v is overtime at %v", viridian.timeout, time.Now())
 	}
 }
 
+func TestViridianOvertimeClockSkew(test *testing.T) {
+	skew := VIRIDIAN_CLOCK_SKEW
+
+	withinSkew := time.Now().UTC().Add(-skew + time.Second)
+	tolerated := &Viridian{timeout: &withinSkew}
+	if tolerated.isViridianOvertime(skew) {
+		test.Fatalf("viridian with timeout %v within skew %v is overtime at %v", withinSkew, skew, time.Now())
+	}
+	if !tolerated.isViridianOvertime(0) {
+		test.Fatalf("viridian with timeout %v is not overtime without skew at %v", withinSkew, time.Now())
+	}
+
+	beyondSkew := time.Now().UTC().Add(-skew - time.Second)
+	expired := &Viridian{timeout: &beyondSkew}
+	if !expired.isViridianOvertime(skew) {
+		test.Fatalf("viridian with timeout %v beyond skew %v is not overtime at %v", beyondSkew, skew, time.Now())
+	}
+
+	unlimited := &Viridian{}
+	if unlimited.isViridianOvertime(0) {
+		test.Fatalf("viridian without subscription is overtime")
+	}
+}
+
+func TestViridianGoodput(test *testing.T) {
+	viridian := &Viridian{}
+	if goodput := viridian.Statistics().Goodput(); goodput != 0 {
+		test.Fatalf("goodput without traffic is not zero: %f", goodput)
+	}
+
+	for i := 0; i < VIRIDIAN_GOODPUT_PACKETS; i++ {
+		viridian.countGoodput(VIRIDIAN_GOODPUT_PAYLOAD, VIRIDIAN_GOODPUT_PAYLOAD+VIRIDIAN_GOODPUT_OVERHEAD)
+	}
+
+	stats := viridian.Statistics()
+	expectedPayload := uint64(VIRIDIAN_GOODPUT_PACKETS * VIRIDIAN_GOODPUT_PAYLOAD)
+	expectedWire := uint64(VIRIDIAN_GOODPUT_PACKETS * (VIRIDIAN_GOODPUT_PAYLOAD + VIRIDIAN_GOODPUT_OVERHEAD + WIRE_HEADERS_LENGTH))
+	if stats.PayloadBytes != expectedPayload || stats.WireBytes != expectedWire {
+		test.Fatalf("goodput counters don't match expected: %d != %d or %d != %d", stats.PayloadBytes, expectedPayload, stats.WireBytes, expectedWire)
+	}
+	if goodput := stats.Goodput(); goodput != float64(expectedPayload)/float64(expectedWire) {
+		test.Fatalf("goodput doesn't match expected: %f != %f", goodput, float64(expectedPayload)/float64(expectedWire))
+	}
+}
+
 func TestViridianStop(test *testing.T) {
 	_, cancel := context.WithCancel(context.Background())
 
@@ -47,10 +105,54 @@ func TestViridianStop(test *testing.T) {
 		SeaConn:       connection,
 	}
 
-	viridian.stop()
+	viridian.stop(DISCONNECT_REQUESTED)
 
 	r, err := viridian.SeaConn.Read(make([]byte, 64))
 	if err == nil && r != 0 {
 		test.Fatalf("reading from closed connection succeeded")
 	}
 }
+
+func TestViridianDisconnectSummary(test *testing.T) {
+	_, cancel := context.WithCancel(context.Background())
+	connection, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		test.Fatalf("error creating connection: %v", err)
+	}
+
+	viridian := &Viridian{
+		UID:           VIRIDIAN_SUMMARY_UID,
+		connected:     time.Now().Add(-VIRIDIAN_SUMMARY_UPTIME),
+		reset:         time.AfterFunc(time.Hour, func() {}),
+		CancelContext: cancel,
+		SeaConn:       connection,
+	}
+	for i := 0; i < VIRIDIAN_SUMMARY_PACKETS; i++ {
+		viridian.countReceived(VIRIDIAN_GOODPUT_PAYLOAD)
+		viridian.countSent(VIRIDIAN_GOODPUT_PAYLOAD)
+	}
+	viridian.countDropped()
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	viridian.stop(DISCONNECT_LIFETIME)
+
+	entry := hook.LastEntry()
+	if entry == nil || entry.Data["event"] != "disconnect" {
+		test.Fatalf("disconnect summary not logged: %v", entry)
+	}
+
+	expectedBytes := uint64(VIRIDIAN_SUMMARY_PACKETS * VIRIDIAN_GOODPUT_PAYLOAD)
+	if entry.Data["uid"] != VIRIDIAN_SUMMARY_UID || entry.Data["reason"] != string(DISCONNECT_LIFETIME) || entry.Data["dropped"] != uint64(1) {
+		test.Fatalf("disconnect summary identity doesn't match expected: %v", entry.Data)
+	}
+	if entry.Data["packets_in"] != uint64(VIRIDIAN_SUMMARY_PACKETS) || entry.Data["bytes_in"] != expectedBytes || entry.Data["bytes_out"] != expectedBytes {
+		test.Fatalf("disconnect summary totals don't match expected: %v", entry.Data)
+	}
+
+	throughput, err := strconv.ParseFloat(entry.Data["throughput"].(string), 64)
+	expectedThroughput := float64(2*expectedBytes) / VIRIDIAN_SUMMARY_UPTIME.Seconds()
+	if err != nil || throughput > expectedThroughput || throughput < expectedThroughput*0.9 {
+		test.Fatalf("disconnect summary throughput doesn't match expected: %v != %f", entry.Data["throughput"], expectedThroughput)
+	}
+}
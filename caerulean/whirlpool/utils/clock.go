@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default NTP server port.
+const NTP_PORT = "123"
+
+// Size of NTP packet without extensions (in bytes).
+const NTP_PACKET_SIZE = 48
+
+// Time to wait for NTP server response.
+const NTP_TIMEOUT = 5 * time.Second
+
+// Minimal clock offset that is reported, offsets below it are considered normal.
+const MIN_CLOCK_OFFSET_WARNING = time.Second
+
+// Seconds between NTP epoch (1900) and Unix epoch (1970).
+const NTP_EPOCH_OFFSET = 2208988800
+
+// Convert NTP timestamp to time.
+// Accept 8-byte NTP timestamp (32-bit seconds since 1900 and 32-bit fraction).
+// Return time object.
+func parseNTPTime(timestamp []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(timestamp[:4])) - NTP_EPOCH_OFFSET
+	fraction := int64(binary.BigEndian.Uint32(timestamp[4:]))
+	return time.Unix(seconds, (fraction*int64(time.Second))>>32)
+}
+
+// Query local clock offset from NTP server (SNTP).
+// Accept NTP server address ("host" or "host:port") and response timeout.
+// Return offset that should be added to local clock and nil if successful, zero and error otherwise.
+func QueryClockOffset(server string, timeout time.Duration) (time.Duration, error) {
+	// Add default port if server port is not specified
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, NTP_PORT)
+	}
+
+	// Connect to NTP server
+	connection, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, fmt.Errorf("error connecting to NTP server: %v", err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(timeout))
+
+	// Send client request (no leap indicator, version 4, client mode)
+	request := make([]byte, NTP_PACKET_SIZE)
+	request[0] = 0x23
+	originTime := time.Now()
+	if _, err := connection.Write(request); err != nil {
+		return 0, fmt.Errorf("error sending NTP request: %v", err)
+	}
+
+	// Receive server response
+	response := make([]byte, NTP_PACKET_SIZE)
+	r, err := connection.Read(response)
+	destinationTime := time.Now()
+	if err != nil {
+		return 0, fmt.Errorf("error receiving NTP response: %v", err)
+	} else if r < NTP_PACKET_SIZE {
+		return 0, fmt.Errorf("NTP response too short: %d bytes", r)
+	}
+
+	// Check response is a valid server response, not a "kiss-of-death" packet
+	if response[0]&0x7 != 4 {
+		return 0, fmt.Errorf("unexpected NTP response mode: %d", response[0]&0x7)
+	} else if response[1] == 0 {
+		return 0, errors.New("NTP server refused request")
+	}
+
+	// Calculate offset as average of request and response clock differences
+	receiveTime := parseNTPTime(response[32:40])
+	transmitTime := parseNTPTime(response[40:48])
+	return (receiveTime.Sub(originTime) + transmitTime.Sub(destinationTime)) / 2, nil
+}
+
+// Check local clock against NTP server and log warning if it differs significantly.
+// Accept NTP server address and clock offset tolerance (offsets below MIN_CLOCK_OFFSET_WARNING are never reported).
+// NB! this method is blocking, so it should be run as goroutine.
+func CheckClockOffset(server string, tolerance time.Duration) {
+	offset, err := QueryClockOffset(server, NTP_TIMEOUT)
+	if err != nil {
+		logrus.Warnf("Error checking clock with NTP server %s: %v", server, err)
+		return
+	}
+
+	if tolerance < MIN_CLOCK_OFFSET_WARNING {
+		tolerance = MIN_CLOCK_OFFSET_WARNING
+	}
+	if offset > tolerance || offset < -tolerance {
+		logrus.Warnf("Local clock differs from NTP server %s by %v, subscriptions may be checked incorrectly", server, offset)
+	} else {
+		logrus.Debugf("Local clock differs from NTP server %s by %v", server, offset)
+	}
+}
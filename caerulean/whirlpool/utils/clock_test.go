@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	CLOCK_SERVER_OFFSET = time.Hour
+	CLOCK_PRECISION     = time.Second
+)
+
+func createNTPTime(moment time.Time) []byte {
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint32(timestamp[:4], uint32(moment.Unix()+NTP_EPOCH_OFFSET))
+	binary.BigEndian.PutUint32(timestamp[4:], uint32((int64(moment.Nanosecond())<<32)/int64(time.Second)))
+	return timestamp
+}
+
+func createTestNTPServer(test *testing.T, offset time.Duration, stratum byte) *net.UDPConn {
+	connection, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		test.Fatalf("error creating NTP server: %v", err)
+	}
+
+	go func() {
+		request := make([]byte, NTP_PACKET_SIZE)
+		_, address, err := connection.ReadFromUDP(request)
+		if err != nil {
+			return
+		}
+
+		response := make([]byte, NTP_PACKET_SIZE)
+		response[0], response[1] = 0x24, stratum
+		now := time.Now().Add(offset)
+		copy(response[32:40], createNTPTime(now))
+		copy(response[40:48], createNTPTime(now))
+		connection.WriteToUDP(response, address)
+	}()
+	return connection
+}
+
+func TestQueryClockOffset(test *testing.T) {
+	server := createTestNTPServer(test, CLOCK_SERVER_OFFSET, 1)
+	defer server.Close()
+
+	offset, err := QueryClockOffset(server.LocalAddr().String(), NTP_TIMEOUT)
+	if err != nil {
+		test.Fatalf("error querying clock offset: %v", err)
+	}
+	if difference := offset - CLOCK_SERVER_OFFSET; difference > CLOCK_PRECISION || difference < -CLOCK_PRECISION {
+		test.Fatalf("clock offset doesn't match server offset: %v != %v", offset, CLOCK_SERVER_OFFSET)
+	}
+}
+
+func TestQueryClockOffsetRefused(test *testing.T) {
+	server := createTestNTPServer(test, 0, 0)
+	defer server.Close()
+
+	if _, err := QueryClockOffset(server.LocalAddr().String(), NTP_TIMEOUT); err == nil {
+		test.Fatalf("kiss-of-death NTP response accepted")
+	}
+}
@@ -1,12 +1,100 @@
 package utils
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Prefix of environment variable values that reference secret files.
+const SECRET_REFERENCE_PREFIX = "secret://"
+
+// Environment variable, directory with secret files named after the environment variables they replace.
+const SECRET_SOURCE_VARIABLE = "SEASIDE_SECRET_SOURCE"
+
+// Read secret from file.
+// Secret files should not be accessible by group or other users, trailing newlines are trimmed.
+// Accept secret file path.
+// Return secret value and nil if read successfully, otherwise empty string and error.
+func readSecret(path string) (string, error) {
+	// Check secret file permissions
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file: %v", err)
+	} else if info.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("secret file %s is accessible by other users (permissions: %v)", path, info.Mode().Perm())
+	}
+
+	// Read secret file
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file: %v", err)
+	}
+
+	// Return secret value
+	return strings.TrimRight(string(value), "\r\n"), nil
+}
+
+// Find secret value.
+// Secret is read from environment variable, if its value is a secret reference ("secret://path"), it is read from the referenced file.
+// If environment variable is not set, secret is read from file named after it in secret source directory (if it exists).
+// Accept environment variable (string).
+// Return secret value, true if secret was found and nil if it was read successfully, otherwise error.
+func lookupSecret(key string) (string, bool, error) {
+	// Read secret from environment variable or secret reference
+	if value, ok := os.LookupEnv(key); ok {
+		if !strings.HasPrefix(value, SECRET_REFERENCE_PREFIX) {
+			return value, true, nil
+		}
+		secret, err := readSecret(strings.TrimPrefix(value, SECRET_REFERENCE_PREFIX))
+		return secret, true, err
+	}
+
+	// Read secret from secret source directory
+	if source, ok := os.LookupEnv(SECRET_SOURCE_VARIABLE); ok {
+		path := filepath.Join(source, key)
+		if _, err := os.Stat(path); err == nil {
+			secret, err := readSecret(path)
+			return secret, true, err
+		}
+	}
+
+	// Return secret not found
+	return "", false, nil
+}
+
+// Get secret value from environment variable, secret reference or secret source directory.
+// Secret values are never logged.
+// Accept environment variable (string).
+// Return secret value or terminate program with an error.
+func GetSecretEnv(key string) string {
+	value, ok, err := lookupSecret(key)
+	if err != nil {
+		logrus.Fatalf("Error reading secret %s: %v", key, err)
+	} else if !ok {
+		logrus.Fatalf("Error reading env var: %s", key)
+	}
+	return value
+}
+
+// Get optional secret value from environment variable, secret reference or secret source directory.
+// Secret values are never logged.
+// Accept environment variable (string) and default value (string).
+// Return secret value, default value if it is not set or terminate program with an error.
+func GetOptionalSecretEnv(key, fallback string) string {
+	value, ok, err := lookupSecret(key)
+	if err != nil {
+		logrus.Fatalf("Error reading secret %s: %v", key, err)
+	} else if !ok {
+		return fallback
+	}
+	return value
+}
+
 // Get value from environment variable.
 // Accept environment variable (string).
 // Return environment variable value or empty string.
@@ -19,6 +107,17 @@ func GetEnv(key string) string {
 	}
 }
 
+// Get optional value from environment variable.
+// Accept environment variable (string) and default value (string).
+// Return environment variable value or default value if it is not set.
+func GetOptionalEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	} else {
+		return fallback
+	}
+}
+
 // Get integer value from environment variable.
 // Accept environment variable (string).
 // Return environment variable value (converted to integer) or terminate program with an error.
@@ -36,3 +135,14 @@ func GetIntEnv(key string) int {
 		return -1
 	}
 }
+
+// Get optional integer value from environment variable.
+// Accept environment variable (string) and default value (integer).
+// Return environment variable value (converted to integer), default value if it is not set or terminate program with an error.
+func GetOptionalIntEnv(key string, fallback int) int {
+	if _, ok := os.LookupEnv(key); ok {
+		return GetIntEnv(key)
+	} else {
+		return fallback
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	SECRET_KEY   = "SEASIDE_TEST_SECRET"
+	SECRET_VALUE = "test_secret_value"
+)
+
+func TestLookupSecretReference(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(SECRET_VALUE+"\n"), 0o600); err != nil {
+		test.Fatalf("error writing secret file: %v", err)
+	}
+	test.Setenv(SECRET_KEY, SECRET_REFERENCE_PREFIX+path)
+
+	value, ok, err := lookupSecret(SECRET_KEY)
+	if err != nil || !ok || value != SECRET_VALUE {
+		test.Fatalf("secret not read from reference: %s != %s (%v)", value, SECRET_VALUE, err)
+	}
+
+	if err := os.Chmod(path, 0o644); err != nil {
+		test.Fatalf("error changing secret file permissions: %v", err)
+	}
+	if _, _, err := lookupSecret(SECRET_KEY); err == nil {
+		test.Fatal("secret file accessible by other users read successfully")
+	}
+}
+
+func TestLookupSecretSource(test *testing.T) {
+	source := test.TempDir()
+	if err := os.WriteFile(filepath.Join(source, SECRET_KEY), []byte(SECRET_VALUE), 0o600); err != nil {
+		test.Fatalf("error writing secret file: %v", err)
+	}
+	test.Setenv(SECRET_SOURCE_VARIABLE, source)
+
+	// Secret variable should not be set at all, its original value is restored after the test by test.Setenv
+	test.Setenv(SECRET_KEY, "")
+	os.Unsetenv(SECRET_KEY)
+
+	value, ok, err := lookupSecret(SECRET_KEY)
+	if err != nil || !ok || value != SECRET_VALUE {
+		test.Fatalf("secret not read from source directory: %s != %s (%v)", value, SECRET_VALUE, err)
+	}
+
+	if _, ok, err := lookupSecret(SECRET_KEY + "_MISSING"); ok || err != nil {
+		test.Fatalf("missing secret found in source directory: %v", err)
+	}
+}
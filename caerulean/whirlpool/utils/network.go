@@ -4,11 +4,18 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 // None (invalid) port number
 const NONE_PORT = 0
 
+// Maximum number of alternate control ports.
+const MAX_ALTERNATE_PORTS = 64
+
 // List of special IP addresses.
 // These addresses are not valid in any network with 16 prefix length.
 // Includes following IP addresses:
@@ -43,3 +50,75 @@ func IsSpecialIPAddress(address uint16) bool {
 	}
 	return false
 }
+
+// Parse port number.
+// Accept port number string.
+// Return port number and nil if it is a valid port number (between 1 and 65535), otherwise NONE_PORT and error.
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port <= NONE_PORT || port > 65535 {
+		return NONE_PORT, fmt.Errorf("invalid port number: %s", value)
+	}
+	return port, nil
+}
+
+// Parse port list.
+// Ports are separated by commas, every entry is either a port number or an inclusive port range ("first-last").
+// Accept port list string (can be empty) and maximum number of ports.
+// Return list of unique port numbers (in order of appearance) and nil if parsed successfully, otherwise nil and error.
+func ParsePortList(value string, limit int) ([]int, error) {
+	ports := make([]int, 0)
+	if value == "" {
+		return ports, nil
+	}
+
+	seen := make(map[int]bool)
+	for _, entry := range strings.Split(value, ",") {
+		// Parse port range bounds (both are equal for single port)
+		bounds := strings.SplitN(entry, "-", 2)
+		first, err := parsePort(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parsePort(bounds[1]); err != nil {
+				return nil, err
+			} else if last < first {
+				return nil, fmt.Errorf("invalid port range: %s", entry)
+			}
+		}
+
+		// Add all the ports of the range, skipping duplicates
+		for port := first; port <= last; port++ {
+			if seen[port] {
+				continue
+			}
+			if len(ports) >= limit {
+				return nil, fmt.Errorf("too many ports in list (more than %d): %s", limit, value)
+			}
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// Get node control ports from environment variables.
+// The main control port (SEASIDE_CTRLPORT) goes first, followed by alternate control ports (SEASIDE_CTRLPORT_ALTERNATES), duplicates are skipped.
+// Return control port numbers list or terminate program with an error.
+func GetControlPorts() []int {
+	ctrlPort := GetIntEnv("SEASIDE_CTRLPORT")
+	alternates, err := ParsePortList(GetOptionalEnv("SEASIDE_CTRLPORT_ALTERNATES", ""), MAX_ALTERNATE_PORTS)
+	if err != nil {
+		logrus.Fatalf("Error parsing alternate control ports: %v", err)
+	}
+
+	ports := []int{ctrlPort}
+	for _, port := range alternates {
+		if port != ctrlPort {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+const NETWORK_PORT_LIMIT = 8
+
+func TestParsePortList(test *testing.T) {
+	ports, err := ParsePortList("8587, 8600-8602,8587,8601", NETWORK_PORT_LIMIT)
+	if err != nil {
+		test.Fatalf("error parsing port list: %v", err)
+	}
+	if expected := []int{8587, 8600, 8601, 8602}; !reflect.DeepEqual(ports, expected) {
+		test.Fatalf("unexpected ports parsed: %v != %v", ports, expected)
+	}
+
+	if ports, err = ParsePortList("", NETWORK_PORT_LIMIT); err != nil || len(ports) != 0 {
+		test.Fatalf("empty port list not parsed as empty: %v, %v", ports, err)
+	}
+
+	for _, invalid := range []string{"0", "65536", "port", "8602-8600", "8600-", "8600,,8601", "8000-8100"} {
+		if _, err := ParsePortList(invalid, NETWORK_PORT_LIMIT); err == nil {
+			test.Fatalf("invalid port list parsed: %s", invalid)
+		}
+	}
+}
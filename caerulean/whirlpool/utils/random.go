@@ -13,15 +13,26 @@ var NO_TAIL_LENGTH = big.NewInt(1)
 // Maximal tail length (in bytes).
 var MAX_TAIL_LENGTH = big.NewInt(64)
 
+// Flag, whether tails are disabled (SEASIDE_DISABLE_TAIL environment variable is set to non-zero value).
+// Useful for benchmarking and trusted links, where traffic shaping overhead is not needed.
+var TAIL_DISABLED = GetOptionalIntEnv("SEASIDE_DISABLE_TAIL", 0) != 0
+
 // Generate tail of random bytes.
-// Tail length will be between 1 and MAX_TAIL_LENGTH, return empty size tail if an error occurs.
+// Tail length will be between 1 and MAX_TAIL_LENGTH, return empty size tail if an error occurs or if tails are disabled.
 // Return byte array - tail.
 func GenerateReliableTail() []byte {
-	// Read random tail length
+	// Return empty tail if tails are disabled
+	if TAIL_DISABLED {
+		return []byte{}
+	}
+
+	// Read random tail length, between 1 and MAX_TAIL_LENGTH
 	tailLength, err := rand.Int(rand.Reader, MAX_TAIL_LENGTH)
 	if err != nil {
 		logrus.Errorf("Error reading tail length: %v, sending message without tail!", err)
 		tailLength = NO_TAIL_LENGTH
+	} else {
+		tailLength.Add(tailLength, NO_TAIL_LENGTH)
 	}
 
 	// Read and return random byte array
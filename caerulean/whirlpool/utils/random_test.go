@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"testing"
+)
+
+const RANDOM_TAIL_ATTEMPTS = 16
+
+func TestGenerateReliableTail(test *testing.T) {
+	tail := GenerateReliableTail()
+	if len(tail) == 0 {
+		test.Fatalf("tail is empty while enabled")
+	}
+	if int64(len(tail)) > MAX_TAIL_LENGTH.Int64() {
+		test.Fatalf("tail is longer than maximum: %d > %d", len(tail), MAX_TAIL_LENGTH.Int64())
+	}
+}
+
+func TestGenerateReliableTailDisabled(test *testing.T) {
+	TAIL_DISABLED = true
+	defer func() { TAIL_DISABLED = false }()
+
+	for i := 0; i < RANDOM_TAIL_ATTEMPTS; i++ {
+		if tail := GenerateReliableTail(); tail == nil || len(tail) != 0 {
+			test.Fatalf("tail is not empty while disabled: %v", tail)
+		}
+	}
+
+	TAIL_DISABLED = false
+	if tail := GenerateReliableTail(); len(tail) == 0 {
+		test.Fatal("tail is empty after it was enabled again")
+	}
+}